@@ -3,12 +3,21 @@ package main
 import (
 	"fmt"
 	"strconv"
+	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/util"
+	pb "github.com/hyperledger/fabric/protos/peer"
 
 	"errors"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/EnzoX/learn-chaincode/money"
 )
 
 //==============================================================================================================================
@@ -20,6 +29,337 @@ import (
 type SimpleChaincode struct {
 }		
 
+//==============================================================================================================================
+//	RelayStub - The stub a transaction is routed with. It collects the calls the proxy forwards so that Invoke can relay
+//				them in a single event, as Fabric keeps only the last event a transaction sets.
+//==============================================================================================================================
+type RelayStub struct{
+	shim.ChaincodeStubInterface
+	calls []ProxyCall
+}
+
+//==============================================================================================================================
+//	ProxyEvent - The payload of the proxyEventName event. The correlation id is the "correlationId" transient field
+//				 when the client sets one, otherwise the transaction id, which the target chaincodes see as well.
+//	ProxyCall - One call forwarded in the transaction, in order: OK or FAILED with the status the target returned, or
+//				DENIED when the allowlist did not permit it
+//==============================================================================================================================
+type ProxyEvent struct{
+	CorrelationId string `json:"correlationId"`
+	TransactionId string `json:"transactionId"`
+	Calls []ProxyCall `json:"calls"`
+}
+
+type ProxyCall struct{
+	Index int `json:"index"`
+	ChaincodeName string `json:"chaincodeName"`
+	Channel string `json:"channel"`
+	Function string `json:"function"`
+	Status string `json:"status"`
+	RemoteStatus int32 `json:"remoteStatus,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+//==============================================================================================================================
+//	ProxyMetric - The counts of the calls the proxy made to a function of a chaincode, and the last error one returned.
+//				  They are kept in metricShards shards, picked by transaction id, so that concurrent transactions
+//				  seldom update the same key; get_metrics adds the shards up. Only committed transactions count.
+//==============================================================================================================================
+type ProxyMetric struct{
+	ChaincodeName string `json:"chaincodeName"`
+	Function string `json:"function"`
+	Success int64 `json:"success"`
+	Failure int64 `json:"failure"`
+	Denied int64 `json:"denied"`
+	LastError string `json:"lastError,omitempty"`
+	LastErrorAt string `json:"lastErrorAt,omitempty"`
+}
+
+//==============================================================================================================================
+//	Target - The chaincode the proxy calls when the caller names none, and the channel it is deployed to. Overrides
+//			 send single functions, keyed by function name, to another chaincode.
+//==============================================================================================================================
+type Target struct{
+	ChaincodeName string `json:"chaincodeName"`
+	Channel string `json:"channel"`
+	Overrides map[string]Target `json:"overrides,omitempty"`
+}
+
+//==============================================================================================================================
+//	CacheConfig - The read-through cache of target accounts, on while set. Cached accounts older than the maximum age
+//				  are reported stale.
+//	CachedAccount - The copy of an account a successful query read from a target chaincode. Only queries submitted as
+//					transactions are committed, so only those refresh the cache.
+//	CachedAccountResponse - A cached account with its age when it is read
+//==============================================================================================================================
+type CacheConfig struct{
+	MaxAgeSeconds int64 `json:"maxAgeSeconds"`
+	UpdatedBy string `json:"updatedBy"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+type CachedAccount struct{
+	ChaincodeName string `json:"chaincodeName"`
+	Channel string `json:"channel"`
+	AccountNo string `json:"accountNo"`
+	Account json.RawMessage `json:"account"`
+	TransactionId string `json:"transactionId"`
+	CachedAt string `json:"cachedAt"`
+}
+
+type CachedAccountResponse struct{
+	CachedAccount
+	AgeSeconds int64 `json:"ageSeconds"`
+	Stale bool `json:"stale"`
+}
+
+//==============================================================================================================================
+//	AccountRoute - The chaincode, and the channel it is deployed to, holding the accounts whose number starts with the
+//				   prefix. The longest matching prefix routes an account.
+//==============================================================================================================================
+type AccountRoute struct{
+	Prefix string `json:"prefix"`
+	ChaincodeName string `json:"chaincodeName"`
+	Channel string `json:"channel"`
+	UpdatedBy string `json:"updatedBy"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+//==============================================================================================================================
+//	AllowlistEntry - The functions of a chaincode the proxy may call. Nothing is callable until an admin allows it.
+//	ProxyDenied - A call the allowlist did not permit, logged instead of being made. Denied calls return a
+//				  ProxyResponse with the DENIED status rather than an error, so that the record is committed.
+//==============================================================================================================================
+type AllowlistEntry struct{
+	ChaincodeName string `json:"chaincodeName"`
+	Functions []string `json:"functions"`
+	UpdatedBy string `json:"updatedBy"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+type ProxyDenied struct{
+	DenialId string `json:"denialId"`
+	Caller string `json:"caller"`
+	ChaincodeName string `json:"chaincodeName"`
+	Channel string `json:"channel"`
+	Function string `json:"function"`
+	Reason string `json:"reason"`
+	DeniedAt string `json:"deniedAt"`
+}
+
+type ProxyResponse struct{
+	Status string `json:"status"`
+	ProxyDenied *ProxyDenied `json:"proxyDenied,omitempty"`
+}
+
+//==============================================================================================================================
+//	Envelope - The standard response of a proxied call: the status code of the target chaincode, the data it returned
+//			   as JSON, and its error message. Failed calls return the envelope as the error message.
+//	ResponseAdapter - How the payload of a target chaincode is read into the envelope, see set_adapter
+//==============================================================================================================================
+type Envelope struct{
+	Code int32 `json:"code"`
+	Data json.RawMessage `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type ResponseAdapter struct{
+	ChaincodeName string `json:"chaincodeName"`
+	Adapter string `json:"adapter"`
+	UpdatedBy string `json:"updatedBy"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+type LegacyError struct{
+	Error string `json:"Error"`
+}
+
+//==============================================================================================================================
+//	ProxyTransaction - The journal entry of a call the proxy made to write on a target chaincode, with the SHA-256 hash
+//					   of the arguments it passed and the status the target returned. Index tells the calls of one
+//					   batch_transfer apart.
+//==============================================================================================================================
+type ProxyTransaction struct{
+	TransactionId string `json:"transactionId"`
+	Index int `json:"index"`
+	ChaincodeName string `json:"chaincodeName"`
+	Channel string `json:"channel"`
+	Function string `json:"function"`
+	ArgsHash string `json:"argsHash"`
+	Caller string `json:"caller"`
+	RemoteStatus int32 `json:"remoteStatus"`
+	RemoteMessage string `json:"remoteMessage,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+type ProxyTransactionPage struct{
+	Records []ProxyTransaction `json:"records"`
+	FetchedRecordsCount int32 `json:"fetchedRecordsCount"`
+	Bookmark string `json:"bookmark"`
+}
+
+//==============================================================================================================================
+//	PendingTransfer - A two-phase transfer. prepare_transfer places a hold for it on the target chaincode and
+//					  commit_transfer or cancel_transfer completes or releases the hold on the same chaincode. The
+//					  transfer id, which is also the hold id passed to the target, is the prepare transaction id.
+//==============================================================================================================================
+type PendingTransfer struct{
+	TransferId string `json:"transferId"`
+	ChaincodeName string `json:"chaincodeName"`
+	Channel string `json:"channel"`
+	AccountFrom string `json:"accountFrom"`
+	AccountTo string `json:"accountTo"`
+	Amount string `json:"amount"`
+	FxRate string `json:"fxRate,omitempty"`
+	Status string `json:"status"`
+	HoldResponse string `json:"holdResponse,omitempty"`
+	PreparedBy string `json:"preparedBy"`
+	PreparedAt string `json:"preparedAt"`
+	CompletedBy string `json:"completedBy,omitempty"`
+	CompletedAt string `json:"completedAt,omitempty"`
+}
+
+//==============================================================================================================================
+//	TargetAccount - The part of an account read from a target chaincode that transfers are checked against
+//==============================================================================================================================
+type TargetAccount struct{
+	Currency string `json:"currency"`
+}
+
+//==============================================================================================================================
+//	FanOutResult - The outcome of init_account_everywhere on one of the fan-out targets: OK with the envelope of its
+//				   response, FAILED with its error, or DENIED
+//==============================================================================================================================
+type FanOutResult struct{
+	ChaincodeName string `json:"chaincodeName"`
+	Channel string `json:"channel"`
+	Status string `json:"status"`
+	Response *Envelope `json:"response,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+//==============================================================================================================================
+//	ProbeResult - Whether a configured target answered the versionFunction ping, and the schema version it reported
+//	TargetVersion - The JSON answers of versionFunction that are understood. Other payloads are taken as the version.
+//==============================================================================================================================
+type ProbeResult struct{
+	ChaincodeName string `json:"chaincodeName"`
+	Channel string `json:"channel"`
+	Reachable bool `json:"reachable"`
+	Status string `json:"status"`
+	SchemaVersion string `json:"schemaVersion,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type TargetVersion struct{
+	SchemaVersion string `json:"schemaVersion"`
+	Version string `json:"version"`
+}
+
+//==============================================================================================================================
+//	ProcessedRequest - The result of a transfer, kept under the clientRequestId the caller gave it so that a retry of
+//					   the same request returns the original result instead of moving the amount again
+//==============================================================================================================================
+type ProcessedRequest struct{
+	ClientRequestId string `json:"clientRequestId"`
+	Function string `json:"function"`
+	TransactionId string `json:"transactionId"`
+	Response string `json:"response"`
+	ProcessedBy string `json:"processedBy"`
+	ProcessedAt string `json:"processedAt"`
+}
+
+//==============================================================================================================================
+//	Saga - A flow of writes on target chaincodes that run one step per transaction, such as a debit in one chaincode and
+//		   the credit in another. Each step names the call that reverses it, which compensate_saga makes for the
+//		   completed steps when a later step fails.
+//	SagaStep - One call of a saga and its compensating call, on the same chaincode
+//==============================================================================================================================
+type Saga struct{
+	SagaId string `json:"sagaId"`
+	Status string `json:"status"`
+	Steps []SagaStep `json:"steps"`
+	CreatedBy string `json:"createdBy"`
+	CreatedAt string `json:"createdAt"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+type SagaStep struct{
+	Index int `json:"index"`
+	ChaincodeName string `json:"chaincodeName"`
+	Channel string `json:"channel"`
+	Function string `json:"function"`
+	Args []string `json:"args"`
+	CompensationFunction string `json:"compensationFunction"`
+	CompensationArgs []string `json:"compensationArgs"`
+	Status string `json:"status"`
+	Response string `json:"response,omitempty"`
+	Error string `json:"error,omitempty"`
+	TransactionId string `json:"transactionId,omitempty"`
+	CompensationTransactionId string `json:"compensationTransactionId,omitempty"`
+}
+
+//==============================================================================================================================
+//	TransferInstruction - One transfer of a batch_transfer payment run. The FX rate is needed between accounts in
+//						  different currencies.
+//	BatchResult - The outcome of one instruction, in the order given: OK with the target's response, FAILED with its
+//				  error, or DENIED
+//==============================================================================================================================
+type TransferInstruction struct{
+	From string `json:"from"`
+	To string `json:"to"`
+	Amount string `json:"amount"`
+	FxRate string `json:"fxRate,omitempty"`
+}
+
+type BatchResult struct{
+	Index int `json:"index"`
+	From string `json:"from"`
+	To string `json:"to"`
+	Amount string `json:"amount"`
+	Status string `json:"status"`
+	Response string `json:"response,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+const targetStr = "_target"				// Key the target configuration is stored under
+const fanOutStr = "_fanout"				// Key the targets of init_account_everywhere are stored under
+const accountRoutePrefix = "accountroute"	// Object type of the composite key account routes are stored under, by prefix
+const cacheStr = "_cache"				// Key the cache configuration is stored under
+const cachedAccountPrefix = "cachedaccount"	// Object type of the composite key cached accounts are stored under, by chaincode name, channel and account
+const versionFunction = "version"		// Target chaincode function probe_targets pings, which reports the schema version
+const readFunction = "read"				// Target chaincode function that returns an account, with its currency
+const accountCurrencyPrefix = "accountcurrency"	// Object type of the composite key account currencies are cached under, by chaincode name and account
+const adminAttribute = "admin"			// Certificate attribute that must be "true" for admin-only functions
+const treasuryAttribute = "treasury"	// Certificate attribute that must be "true" to move balances through the proxy
+const allowlistPrefix = "allowlist"		// Object type of the composite key allowlist entries are stored under, by chaincode name
+const proxyDeniedPrefix = "proxydenied"	// Object type of the composite key denied calls are stored under, by denial id
+const DENIED = "DENIED"					// ProxyResponse status of a call the allowlist did not permit
+const OK = "OK"							// BatchResult, FanOutResult, ProbeResult and ProxyCall statuses, besides DENIED
+const FAILED = "FAILED"
+const batchLimit = 100					// Most instructions batch_transfer takes in one transaction
+const proxyTransactionPrefix = "proxytransaction"	// Object type of the composite key the journal is stored under, by timestamp, transaction id and index
+const pendingTransferPrefix = "pendingtransfer"	// Object type of the composite key two-phase transfers are stored under, by transfer id
+const holdFunction = "place_hold"		// Target chaincode functions of a two-phase transfer, each passed the transfer id
+const captureFunction = "capture_hold"
+const releaseFunction = "release_hold"
+const PENDING = "PENDING"				// PendingTransfer statuses
+const COMMITTED = "COMMITTED"
+const CANCELLED = "CANCELLED"
+const sagaPrefix = "saga"				// Object type of the composite key sagas are stored under, by saga id
+const RUNNING = "RUNNING"				// Saga statuses, besides FAILED
+const COMPLETED = "COMPLETED"			// Saga and SagaStep statuses, besides PENDING and FAILED
+const COMPENSATED = "COMPENSATED"
+const proxyEventName = "proxy_invocation"	// Event relaying the calls the proxy forwarded in a transaction
+const metricPrefix = "metric"			// Object type of the composite key metrics are stored under, by chaincode name, function and shard
+const metricShards = 16					// Number of shards each metric is kept in
+const correlationField = "correlationId"	// Transient field a client may set the correlation id of the event with
+const processedRequestPrefix = "processedrequest"	// Object type of the composite key transfer results are stored under, by clientRequestId
+const adapterPrefix = "adapter"			// Object type of the composite key response adapters are stored under, by chaincode name
+const adapterJSON = "json"				// Response adapters. The default, payloads that are not JSON are wrapped as a string
+const adapterRaw = "raw"				// Payloads are always wrapped as a string
+const adapterLegacyError = "legacy_error"	// Payloads of the form {"Error": "..."} are errors, even on a successful status
+
 // ============================================================================================================================
 //  Main - main - Starts up the chaincode
 // ============================================================================================================================
@@ -33,187 +373,2611 @@ func main() {
 // ============================================================================================================================
 // Init Function - Called when the user deploys the chaincode
 // ============================================================================================================================
-func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+
+	_, args := stub.GetFunctionAndParameters()
 
 	var Aval int
 	var err error
 
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 
 	// Initialize the chaincode
 	Aval, err = strconv.Atoi(args[0])
 	if err != nil {
-		return nil, errors.New("Expecting integer value for testing the blockchain network")
+		return shim.Error("Expecting integer value for testing the blockchain network")
 	}
 
 	// Write the state to the ledger, test the network
 	err = stub.PutState("test_key", []byte(strconv.Itoa(Aval)))	
 	if err != nil {
-		return nil, err
+		return shim.Error(err.Error())
 	}
 	
-	return nil, nil
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Invoke - Called on chaincode invoke and query. Routes the transaction, relays the calls it forwarded to target
+//			chaincodes in an event and counts them in the metrics.
+// ============================================================================================================================
+func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+
+	relay := &RelayStub{ChaincodeStubInterface: stub}
+
+	response := t.route(relay)
+	if response.Status != shim.OK || len(relay.calls) == 0 {
+		return response
+	}
+
+	err := t.emit_proxy_event(relay)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = t.update_metrics(relay)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return response
 }
 
 // ============================================================================================================================
-// Invoke - Called on chaincode invoke. Takes a function name passed and calls that function. Converts some
-//		    initial arguments passed to other things for use in the called function.
+// Route - Takes a function name passed and calls that function. Converts some initial arguments passed to other things
+//		   for use in the called function.
 // ============================================================================================================================
-func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (t *SimpleChaincode) route(stub shim.ChaincodeStubInterface) pb.Response {
+
+	function, args := stub.GetFunctionAndParameters()
 
 	if function == "init_account" {
 		return t.init_account(stub, args)
 	} else if function == "transfer_balance" {									
 		return t.transfer_balance(stub, args)										
+	} else if function == "batch_transfer" {
+		return t.batch_transfer(stub, args)
+	} else if function == "prepare_transfer" {
+		return t.prepare_transfer(stub, args)
+	} else if function == "commit_transfer" {
+		return t.complete_transfer(stub, args, captureFunction, COMMITTED)
+	} else if function == "cancel_transfer" {
+		return t.complete_transfer(stub, args, releaseFunction, CANCELLED)
+	} else if function == "init_account_everywhere" {
+		return t.init_account_everywhere(stub, args)
+	} else if function == "start_saga" {
+		return t.start_saga(stub, args)
+	} else if function == "run_saga_step" {
+		return t.run_saga_step(stub, args)
+	} else if function == "compensate_saga" {
+		return t.compensate_saga(stub, args)
+	} else if function == "get_saga" {
+		return t.get_saga(stub, args)
+	} else if function == "set_target" {
+		return t.set_target(stub, args)
+	} else if function == "set_fanout_targets" {
+		return t.set_fanout_targets(stub, args)
+	} else if function == "set_account_route" {
+		return t.set_account_route(stub, args)
+	} else if function == "get_account_routes" {
+		return t.get_account_routes(stub, args)
+	} else if function == "set_allowlist" {
+		return t.set_allowlist(stub, args)
+	} else if function == "get_allowlist" {
+		return t.get_allowlist(stub, args)
+	} else if function == "set_adapter" {
+		return t.set_adapter(stub, args)
+	} else if function == "get_adapters" {
+		return t.get_adapters(stub, args)
+	} else if function == "get_proxy_denials" {
+		return t.get_proxy_denials(stub, args)
+	} else if function == "get_proxy_history" {
+		return t.get_proxy_history(stub, args)
+	} else if function == "read" {												
+		return t.read(stub, args)
+	} else if function == "query" {
+		return t.query(stub, args)
+	} else if function == "proxy_query" {
+		return t.proxy_query(stub, args)
+	} else if function == "probe_targets" {
+		return t.probe_targets(stub, args)
+	} else if function == "set_cache" {
+		return t.set_cache(stub, args)
+	} else if function == "get_cached_account" {
+		return t.get_cached_account(stub, args)
+	} else if function == "get_metrics" {
+		return t.get_metrics(stub, args)
 	}
-	return nil, errors.New("Received unknown function invocation: " + function)
+	fmt.Println("invoke did not find func: " + function)						//error
+
+	return shim.Error("Received unknown function invocation: " + function)
 }
 
-func (t *SimpleChaincode) init_account(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+// ============================================================================================================================
+// Init Account - Admin only. Open an account on the target chaincode. The chaincode name may be left out, or empty,
+//				  to use the configured target, see set_target.
+// ============================================================================================================================
+func (t *SimpleChaincode) init_account(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	var err error
 
+	if len(args) == 4 {
+		args = append([]string{""}, args...)
+	}
 	if len(args) != 5 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+		return shim.Error("Incorrect number of arguments. Expecting 4 or 5")
 	}
 
-	//input sanitation
-	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
+	if !t.is_admin(stub) {
+		return shim.Error("Permission Denied. init_account requires the " + adminAttribute + " attribute")
 	}
+
+	//input sanitation
 	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
+		return shim.Error("2nd argument must be a non-empty string")
 	}
 	if len(args[2]) <= 0 {
-		return nil, errors.New("3rd argument must be a non-empty string")
+		return shim.Error("3rd argument must be a non-empty string")
 	}
 	if len(args[3]) <= 0 {
-		return nil, errors.New("4th argument must be a non-empty string")
+		return shim.Error("4th argument must be a non-empty string")
 	}
 	if len(args[4]) <= 0 {
-		return nil, errors.New("5th argument must be a non-empty string")
+		return shim.Error("5th argument must be a non-empty string")
 	}
 
-	chaincodeId := args[0]
-
 	accountNo := args[1]
 	legalEntity := strings.ToLower(args[2])
 	currency := args[3]
 	amount := args[4]
 
 	f := "init_account"
-	invokeArgs := util.ToChaincodeArgs(f, accountNo, legalEntity, currency, amount)
-	response, err := stub.InvokeChaincode(chaincodeId, invokeArgs)
+	chaincodeId, channel, err := t.resolve_target(stub, f, args[0], "")
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to invoke chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return shim.Error(err.Error())
 	}
-	fmt.Printf("Invoke chaincode successful. Got response %s", string(response))
-	err = stub.PutState(accountNo, []byte("success"))
+	err = t.check_writable(stub, channel)
 	if err != nil {
-		return nil, err
+		return shim.Error(err.Error())
+	}
+
+	response, denied, err := t.call_target(stub, chaincodeId, channel, f, accountNo, legalEntity, currency, amount)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if denied != nil {
+		return t.denied_response(denied)
+	}
+	envelope, err := t.adapt(stub, chaincodeId, response)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if envelope.Error != "" {
+		fmt.Printf("Failed to invoke chaincode. Got error: %s", envelope.Error)
+		return t.envelope_response(envelope)
+	}
+	fmt.Printf("Invoke chaincode successful. Got response %s", string(response.Payload))
+	err = t.record_proxy_transaction(stub, chaincodeId, channel, 0, response, f, accountNo, legalEntity, currency, amount)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	return nil, nil
+	return t.envelope_response(envelope)
 
 }
 
-func (t *SimpleChaincode) transfer_balance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+// ============================================================================================================================
+// Init Account Everywhere - Admin only. Open an account on every fan-out target, see set_fanout_targets, in one
+//							 transaction. If any target fails or denies the call nothing is committed and the
+//							 results of all the targets are returned as the error, so that the account is opened
+//							 everywhere or nowhere.
+// ============================================================================================================================
+func (t *SimpleChaincode) init_account_everywhere(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	var err error
+	//    0         1       2        3
+	// "1001"   "acme"   "EUR"   "0.00"
 
 	if len(args) != 4 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	if !t.is_admin(stub) {
+		return shim.Error("Permission Denied. init_account_everywhere requires the " + adminAttribute + " attribute")
 	}
 
 	//input sanitation
 	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
+		return shim.Error("1st argument must be a non-empty string")
 	}
 	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
+		return shim.Error("2nd argument must be a non-empty string")
 	}
 	if len(args[2]) <= 0 {
-		return nil, errors.New("3rd argument must be a non-empty string")
+		return shim.Error("3rd argument must be a non-empty string")
 	}
 	if len(args[3]) <= 0 {
-		return nil, errors.New("4th argument must be a non-empty string")
+		return shim.Error("4th argument must be a non-empty string")
 	}
 
-	chaincodeId := args[0]
-	accountFrom := args[1]
-	accountTo := args[2]
+	accountNo := args[0]
+	legalEntity := strings.ToLower(args[1])
+	currency := args[2]
 	amount := args[3]
 
-	f := "transfer_balance"
-	invokeArgs := util.ToChaincodeArgs(f, accountFrom, accountTo, amount)
-	response, err := stub.InvokeChaincode(chaincodeId, invokeArgs)
+	targets, err := t.get_fanout_targets(stub)
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to invoke chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return shim.Error(err.Error())
+	}
+	if len(targets) == 0 {
+		return shim.Error("No fan-out targets are set, see set_fanout_targets")
+	}
+
+	f := "init_account"
+	failed := false
+	results := []FanOutResult{}
+	for i, target := range targets {
+		result := FanOutResult{ChaincodeName: target.ChaincodeName, Channel: target.Channel}
+
+		response, denied, err := t.call_target(stub, target.ChaincodeName, target.Channel, f, accountNo, legalEntity, currency, amount)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if denied != nil {
+			failed = true
+			result.Status = DENIED
+			result.Error = denied.Reason
+			results = append(results, result)
+			continue
+		}
+
+		envelope, err := t.adapt(stub, target.ChaincodeName, response)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if envelope.Error != "" {
+			failed = true
+			result.Status = FAILED
+			result.Error = envelope.Error
+			results = append(results, result)
+			continue
+		}
+
+		result.Status = OK
+		result.Response = &envelope
+		results = append(results, result)
+
+		err = t.record_proxy_transaction(stub, target.ChaincodeName, target.Channel, i, response, f, accountNo, legalEntity, currency, amount)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
 	}
-	fmt.Printf("Invoke chaincode successful. Got response %s", string(response))
 
-	return nil, nil
+	jsonAsBytes, _ := json.Marshal(results)
+	if failed {
+		fmt.Printf("init_account_everywhere failed. Got results %s", string(jsonAsBytes))
+		return shim.Error(string(jsonAsBytes))
+	}
 
+	return shim.Success(jsonAsBytes)
 }
+
 // ============================================================================================================================
-//	Query - Called on chaincode query. Takes a function name passed and calls that function. Passes the
-//  		initial arguments passed are passed on to the called function.
+// Transfer Balance - Treasury only. Move an amount between two accounts on the target chaincode. The chaincode name
+//					  may be left out, or empty, to use the chaincode the accounts are routed to, see
+//					  set_account_route, or the configured target. Accounts in different currencies need an FX
+//					  rate, which is passed on to the target. A retry with the same clientRequestId returns the
+//					  result of the first transfer.
 // ============================================================================================================================
-func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (t *SimpleChaincode) transfer_balance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	if function == "read" {												
-		return t.read(stub, args)
-	} else if function == "query" {
-		return t.query(stub, args)
+	//        0              1         2       3        4        5 (optional)
+	// "clientRequestId" "accounts"  "1001"  "2001"  "250.00"  "1.0850"
+
+	if len(args) == 4 {
+		args = append([]string{args[0], ""}, args[1:]...)
+	}
+	if len(args) == 5 {
+		args = append(args, "")
+	}
+	if len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 to 6")
+	}
+
+	if !t.is_treasury(stub) {
+		return shim.Error("Permission Denied. transfer_balance requires the " + treasuryAttribute + " attribute")
+	}
+
+	//input sanitation
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		return shim.Error("3rd argument must be a non-empty string")
+	}
+	if len(args[3]) <= 0 {
+		return shim.Error("4th argument must be a non-empty string")
+	}
+	if len(args[4]) <= 0 {
+		return shim.Error("5th argument must be a non-empty string")
+	}
+
+	clientRequestId := args[0]
+	accountFrom := args[2]
+	accountTo := args[3]
+	amount := args[4]
+	fxRate := args[5]
+
+	err := t.check_transfer(accountFrom, accountTo, amount, fxRate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	f := "transfer_balance"
+	processed, err := t.get_processed_request(stub, clientRequestId, f)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if processed != nil {
+		return shim.Success([]byte(processed.Response))
+	}
+
+	chaincodeId, channel, err := t.resolve_account_target(stub, f, args[1], "", accountFrom, accountTo)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = t.check_writable(stub, channel)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = t.check_currencies(stub, chaincodeId, channel, accountFrom, accountTo, amount, fxRate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	transferArgs := []string{accountFrom, accountTo, amount}
+	if fxRate != "" {
+		transferArgs = append(transferArgs, fxRate)
+	}
+
+	response, denied, err := t.call_target(stub, chaincodeId, channel, f, transferArgs...)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if denied != nil {
+		return t.denied_response(denied)
+	}
+	envelope, err := t.adapt(stub, chaincodeId, response)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if envelope.Error != "" {
+		fmt.Printf("Failed to invoke chaincode. Got error: %s", envelope.Error)
+		return t.envelope_response(envelope)
+	}
+	fmt.Printf("Invoke chaincode successful. Got response %s", string(response.Payload))
+	err = t.record_proxy_transaction(stub, chaincodeId, channel, 0, response, f, transferArgs...)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result := t.envelope_response(envelope)
+	err = t.save_processed_request(stub, clientRequestId, f, result.Payload)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	fmt.Println("query did not find func: " + function)						//error
 
-	return nil, errors.New("Received unknown function query " + function)
+	return result
+
 }
 
 // ============================================================================================================================
-// Read - read a variable from chaincode world state
+// Batch Transfer - Treasury only. Run a payment run of transfers on the target chaincode in one transaction. Every
+//					instruction is attempted and reported on; one that fails does not stop the others. An account may
+//					appear in only one instruction. The chaincode name may be left out, or empty, to use the
+//					configured target for "transfer_balance". A retry with the same clientRequestId returns the
+//					results of the first run.
 // ============================================================================================================================
-func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var name, jsonResp string
-	var err error
+func (t *SimpleChaincode) batch_transfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the var to query")
+	//        0              1                  2
+	// "clientRequestId" "accounts"  "[{"from":"1001","to":"2001","amount":"250.00"}]"
+
+	if len(args) == 2 {
+		args = append([]string{args[0], ""}, args[1:]...)
+	}
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3")
 	}
 
-	name = args[0]
-	valAsbytes, err := stub.GetState(name)	
+	if !t.is_treasury(stub) {
+		return shim.Error("Permission Denied. batch_transfer requires the " + treasuryAttribute + " attribute")
+	}
+
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	clientRequestId := args[0]
+
+	var instructions []TransferInstruction
+	err := json.Unmarshal([]byte(args[2]), &instructions)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
-		return nil, errors.New(jsonResp)
+		return shim.Error("Instructions must be a JSON array of {from, to, amount}")
+	}
+	if len(instructions) == 0 || len(instructions) > batchLimit {
+		return shim.Error("Expecting 1 to " + strconv.Itoa(batchLimit) + " instructions")
+	}
+
+	// The target reads balances as they were before this transaction, so a second transfer on an account would
+	// overwrite the first one's update
+	instructionOf := map[string]int{}
+	for i, instruction := range instructions {
+		for _, accountNo := range []string{instruction.From, instruction.To} {
+			if j, ok := instructionOf[accountNo]; ok && j != i {
+				return shim.Error("Account " + accountNo + " appears in instructions " + strconv.Itoa(j) + " and " + strconv.Itoa(i) + ". An account can only be in one instruction of a batch")
+			}
+			instructionOf[accountNo] = i
+		}
+	}
+
+	processed, err := t.get_processed_request(stub, clientRequestId, "batch_transfer")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if processed != nil {
+		return shim.Success([]byte(processed.Response))
+	}
+
+	f := "transfer_balance"
+	chaincodeId, channel, err := t.resolve_target(stub, f, args[1], "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = t.check_writable(stub, channel)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	results := []BatchResult{}
+	for i, instruction := range instructions {
+		result := BatchResult{Index: i, From: instruction.From, To: instruction.To, Amount: instruction.Amount}
+
+		if len(instruction.From) <= 0 || len(instruction.To) <= 0 || len(instruction.Amount) <= 0 {
+			result.Status = FAILED
+			result.Error = "from, to and amount must be non-empty strings"
+			results = append(results, result)
+			continue
+		}
+
+		err = t.check_transfer(instruction.From, instruction.To, instruction.Amount, instruction.FxRate)
+		if err == nil {
+			err = t.check_currencies(stub, chaincodeId, channel, instruction.From, instruction.To, instruction.Amount, instruction.FxRate)
+		}
+		if err != nil {
+			result.Status = FAILED
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+
+		transferArgs := []string{instruction.From, instruction.To, instruction.Amount}
+		if instruction.FxRate != "" {
+			transferArgs = append(transferArgs, instruction.FxRate)
+		}
+
+		response, denied, err := t.call_target(stub, chaincodeId, channel, f, transferArgs...)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if denied != nil {
+			result.Status = DENIED
+			result.Error = denied.Reason
+			results = append(results, result)
+			continue
+		}
+
+		if response.Status != shim.OK {
+			result.Status = FAILED
+			result.Error = response.Message
+		} else {
+			result.Status = OK
+			result.Response = string(response.Payload)
+		}
+		results = append(results, result)
+
+		err = t.record_proxy_transaction(stub, chaincodeId, channel, i, response, f, transferArgs...)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	jsonAsBytes, _ := json.Marshal(results)
+	err = t.save_processed_request(stub, clientRequestId, "batch_transfer", jsonAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	return valAsbytes, nil												
+	return shim.Success(jsonAsBytes)
 }
 
-func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+// ============================================================================================================================
+// Prepare Transfer - Treasury only. Place a hold for a transfer on the target chaincode and keep it pending until
+//					  commit_transfer or cancel_transfer, so that an off-chain approval can happen in between. The
+//					  chaincode name may be left out, or empty, to use the configured target for "place_hold".
+//					  Accounts in different currencies need an FX rate, which is passed on with the hold. A retry
+//					  with the same clientRequestId returns the transfer the first one prepared.
+// ============================================================================================================================
+func (t *SimpleChaincode) prepare_transfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	var err error
+	//        0              1         2       3        4        5 (optional)
+	// "clientRequestId" "accounts"  "1001"  "2001"  "250.00"  "1.0850"
 
-	chaincodeId := args[0]
-	accountNo := args[1]
+	if len(args) == 4 {
+		args = append([]string{args[0], ""}, args[1:]...)
+	}
+	if len(args) == 5 {
+		args = append(args, "")
+	}
+	if len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 to 6")
+	}
 
-	f := "read"
-	queryArgs := util.ToChaincodeArgs(f, accountNo)
+	if !t.is_treasury(stub) {
+		return shim.Error("Permission Denied. prepare_transfer requires the " + treasuryAttribute + " attribute")
+	}
+
+	//input sanitation
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		return shim.Error("3rd argument must be a non-empty string")
+	}
+	if len(args[3]) <= 0 {
+		return shim.Error("4th argument must be a non-empty string")
+	}
+	if len(args[4]) <= 0 {
+		return shim.Error("5th argument must be a non-empty string")
+	}
 
-	response, err := stub.QueryChaincode(chaincodeId, queryArgs)
+	clientRequestId := args[0]
+	err := t.check_transfer(args[2], args[3], args[4], args[5])
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to query chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return shim.Error(err.Error())
 	}
 
-	return response, nil												
+	processed, err := t.get_processed_request(stub, clientRequestId, "prepare_transfer")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if processed != nil {
+		return shim.Success([]byte(processed.Response))
+	}
+
+	pending := PendingTransfer{TransferId: stub.GetTxID(), AccountFrom: args[2], AccountTo: args[3], Amount: args[4], FxRate: args[5], Status: PENDING}
+
+	pending.ChaincodeName, pending.Channel, err = t.resolve_target(stub, holdFunction, args[1], "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = t.check_writable(stub, pending.Channel)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = t.check_currencies(stub, pending.ChaincodeName, pending.Channel, pending.AccountFrom, pending.AccountTo, pending.Amount, pending.FxRate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	holdArgs := []string{pending.TransferId, pending.AccountFrom, pending.AccountTo, pending.Amount}
+	if pending.FxRate != "" {
+		holdArgs = append(holdArgs, pending.FxRate)
+	}
+
+	response, denied, err := t.call_target(stub, pending.ChaincodeName, pending.Channel, holdFunction, holdArgs...)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if denied != nil {
+		return t.denied_response(denied)
+	}
+	if response.Status != shim.OK {
+		errStr := fmt.Sprintf("Failed to place hold. Got error: %s", response.Message)
+		fmt.Printf(errStr)
+		return shim.Error(errStr)
+	}
+	err = t.record_proxy_transaction(stub, pending.ChaincodeName, pending.Channel, 0, response, holdFunction, holdArgs...)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	pending.HoldResponse = string(response.Payload)
+	pending.PreparedBy, err = t.get_caller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pending.PreparedAt, err = t.get_timestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.save_pending_transfer(stub, pending)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	jsonAsBytes, _ := json.Marshal(pending)
+	err = t.save_processed_request(stub, clientRequestId, "prepare_transfer", jsonAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Complete Transfer - commit_transfer and cancel_transfer, treasury only. Call the target function that captures or
+//					   releases the hold of a pending transfer, on the chaincode that holds it, and record the outcome.
+// ============================================================================================================================
+func (t *SimpleChaincode) complete_transfer(stub shim.ChaincodeStubInterface, args []string, function string, status string) pb.Response {
+
+	//      0
+	// "transferId"
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	if !t.is_treasury(stub) {
+		return shim.Error("Permission Denied. Completing a transfer requires the " + treasuryAttribute + " attribute")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	key, err := stub.CreateCompositeKey(pendingTransferPrefix, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pendingAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error("Failed to get transfer " + args[0])
+	}
+	if pendingAsBytes == nil {
+		return shim.Error("Transfer " + args[0] + " does not exist")
+	}
+
+	var pending PendingTransfer
+	err = json.Unmarshal(pendingAsBytes, &pending)
+	if err != nil {
+		return shim.Error("Corrupt transfer " + args[0])
+	}
+	if pending.Status != PENDING {
+		return shim.Error("Transfer " + args[0] + " is already " + pending.Status)
+	}
+
+	response, denied, err := t.call_target(stub, pending.ChaincodeName, pending.Channel, function, pending.TransferId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if denied != nil {
+		return t.denied_response(denied)
+	}
+	if response.Status != shim.OK {
+		errStr := fmt.Sprintf("Failed to invoke chaincode. Got error: %s", response.Message)
+		fmt.Printf(errStr)
+		return shim.Error(errStr)
+	}
+	err = t.record_proxy_transaction(stub, pending.ChaincodeName, pending.Channel, 0, response, function, pending.TransferId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	pending.Status = status
+	pending.CompletedBy, err = t.get_caller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pending.CompletedAt, err = t.get_timestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.save_pending_transfer(stub, pending)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	jsonAsBytes, _ := json.Marshal(pending)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Save Pending Transfer - Write a two-phase transfer into the world state
+// ============================================================================================================================
+func (t *SimpleChaincode) save_pending_transfer(stub shim.ChaincodeStubInterface, pending PendingTransfer) error {
+	key, err := stub.CreateCompositeKey(pendingTransferPrefix, []string{pending.TransferId})
+	if err != nil {
+		return err
+	}
+
+	jsonAsBytes, _ := json.Marshal(pending)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return fmt.Errorf("Error storing transfer %s", pending.TransferId)
+	}
+
+	return nil
+}
+
+// ============================================================================================================================
+// Start Saga - Treasury only. Store the steps of a saga for run_saga_step to make, each with its compensating call.
+//				Every step must write on this channel.
+// ============================================================================================================================
+func (t *SimpleChaincode) start_saga(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//    0          1
+	// "saga1"  "[{"chaincodeName":"gl","channel":"","function":"debit","args":["1001","250.00"],
+	//            "compensationFunction":"credit","compensationArgs":["1001","250.00"]}]"
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	if !t.is_treasury(stub) {
+		return shim.Error("Permission Denied. start_saga requires the " + treasuryAttribute + " attribute")
+	}
+
+	//input sanitation
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	existing, err := t.retrieve_saga(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil {
+		return shim.Error("Saga " + args[0] + " already exists")
+	}
+
+	var steps []SagaStep
+	err = json.Unmarshal([]byte(args[1]), &steps)
+	if err != nil {
+		return shim.Error("Steps must be a JSON array of {chaincodeName, channel, function, args, compensationFunction, compensationArgs}")
+	}
+	if len(steps) == 0 || len(steps) > batchLimit {
+		return shim.Error("Expecting 1 to " + strconv.Itoa(batchLimit) + " steps")
+	}
+
+	for i := range steps {
+		step := &steps[i]
+		if len(step.ChaincodeName) <= 0 || len(step.Function) <= 0 || len(step.CompensationFunction) <= 0 {
+			return shim.Error("Step " + strconv.Itoa(i) + " must name a chaincode, a function and a compensation function")
+		}
+		err = t.check_writable(stub, step.Channel)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		step.Index = i
+		step.Status = PENDING
+		step.Response, step.Error, step.TransactionId, step.CompensationTransactionId = "", "", "", ""
+	}
+
+	saga := Saga{SagaId: args[0], Status: RUNNING, Steps: steps}
+	saga.CreatedBy, err = t.get_caller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	saga.CreatedAt, err = t.get_timestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return t.save_saga(stub, saga)
+}
+
+// ============================================================================================================================
+// Run Saga Step - Treasury only. Make the next pending call of a running saga. A step the target fails, or the
+//				   allowlist denies, fails the saga; the saga is returned rather than an error so that this is
+//				   committed and compensate_saga can follow.
+// ============================================================================================================================
+func (t *SimpleChaincode) run_saga_step(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//    0
+	// "saga1"
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	if !t.is_treasury(stub) {
+		return shim.Error("Permission Denied. run_saga_step requires the " + treasuryAttribute + " attribute")
+	}
+
+	saga, err := t.retrieve_saga(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if saga == nil {
+		return shim.Error("Saga " + args[0] + " does not exist")
+	}
+	if saga.Status != RUNNING {
+		return shim.Error("Saga " + saga.SagaId + " is " + saga.Status)
+	}
+
+	for i := range saga.Steps {
+		step := &saga.Steps[i]
+		if step.Status != PENDING {
+			continue
+		}
+
+		step.TransactionId = stub.GetTxID()
+		response, denied, err := t.call_target(stub, step.ChaincodeName, step.Channel, step.Function, step.Args...)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if denied != nil {
+			step.Status = FAILED
+			step.Error = denied.Reason
+		} else {
+			err = t.record_proxy_transaction(stub, step.ChaincodeName, step.Channel, step.Index, response, step.Function, step.Args...)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+
+			if response.Status != shim.OK {
+				step.Status = FAILED
+				step.Error = response.Message
+			} else {
+				step.Status = COMPLETED
+				step.Response = string(response.Payload)
+			}
+		}
+
+		if step.Status == FAILED {
+			saga.Status = FAILED
+		} else if i == len(saga.Steps) - 1 {
+			saga.Status = COMPLETED
+		}
+		return t.save_saga(stub, *saga)
+	}
+
+	return shim.Error("Saga " + saga.SagaId + " has no pending step")
+}
+
+// ============================================================================================================================
+// Compensate Saga - Treasury only. Make the compensating calls of the completed steps of a failed saga, last step
+//					 first. A compensation the target fails leaves its step completed, with the error, for a retry;
+//					 the saga is compensated once every completed step is.
+// ============================================================================================================================
+func (t *SimpleChaincode) compensate_saga(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//    0
+	// "saga1"
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	if !t.is_treasury(stub) {
+		return shim.Error("Permission Denied. compensate_saga requires the " + treasuryAttribute + " attribute")
+	}
+
+	saga, err := t.retrieve_saga(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if saga == nil {
+		return shim.Error("Saga " + args[0] + " does not exist")
+	}
+	if saga.Status != FAILED {
+		return shim.Error("Only a failed saga can be compensated. Saga " + saga.SagaId + " is " + saga.Status)
+	}
+
+	compensated := true
+	for i := len(saga.Steps) - 1; i >= 0; i-- {
+		step := &saga.Steps[i]
+		if step.Status != COMPLETED {
+			continue
+		}
+
+		step.CompensationTransactionId = stub.GetTxID()
+		response, denied, err := t.call_target(stub, step.ChaincodeName, step.Channel, step.CompensationFunction, step.CompensationArgs...)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if denied != nil {
+			compensated = false
+			step.Error = denied.Reason
+			continue
+		}
+
+		err = t.record_proxy_transaction(stub, step.ChaincodeName, step.Channel, step.Index, response, step.CompensationFunction, step.CompensationArgs...)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if response.Status != shim.OK {
+			compensated = false
+			step.Error = response.Message
+			continue
+		}
+		step.Status = COMPENSATED
+		step.Error = ""
+	}
+
+	if compensated {
+		saga.Status = COMPENSATED
+	}
+	return t.save_saga(stub, *saga)
+}
+
+// ============================================================================================================================
+// Get Saga - Read a saga and the status of its steps
+// ============================================================================================================================
+func (t *SimpleChaincode) get_saga(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	saga, err := t.retrieve_saga(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if saga == nil {
+		return shim.Error("Saga " + args[0] + " does not exist")
+	}
+
+	jsonAsBytes, _ := json.Marshal(saga)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Retrieve Saga - The stored saga, nil when there is none
+// ============================================================================================================================
+func (t *SimpleChaincode) retrieve_saga(stub shim.ChaincodeStubInterface, sagaId string) (*Saga, error) {
+	key, err := stub.CreateCompositeKey(sagaPrefix, []string{sagaId})
+	if err != nil {
+		return nil, err
+	}
+
+	sagaAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get saga " + sagaId)
+	}
+	if sagaAsBytes == nil {
+		return nil, nil
+	}
+
+	var saga Saga
+	err = json.Unmarshal(sagaAsBytes, &saga)
+	if err != nil {
+		return nil, errors.New("Corrupt saga " + sagaId)
+	}
+	return &saga, nil
+}
+
+// ============================================================================================================================
+// Save Saga - Write a saga into the world state and return it
+// ============================================================================================================================
+func (t *SimpleChaincode) save_saga(stub shim.ChaincodeStubInterface, saga Saga) pb.Response {
+	var err error
+	saga.UpdatedAt, err = t.get_timestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := stub.CreateCompositeKey(sagaPrefix, []string{saga.SagaId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	jsonAsBytes, _ := json.Marshal(saga)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return shim.Error("Error storing saga " + saga.SagaId)
+	}
+
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Check Transfer - Check a transfer before anything is forwarded: the amount and any FX rate must be positive decimals
+//					and the accounts must differ
+// ============================================================================================================================
+func (t *SimpleChaincode) check_transfer(accountFrom string, accountTo string, amount string, fxRate string) error {
+
+	if !t.is_positive_decimal(amount) {
+		return errors.New("Amount " + amount + " must be a positive decimal")
+	}
+	if fxRate != "" && !t.is_positive_decimal(fxRate) {
+		return errors.New("FX rate " + fxRate + " must be a positive decimal")
+	}
+	if accountFrom == accountTo {
+		return errors.New("Cannot transfer from account " + accountFrom + " to itself")
+	}
+
+	return nil
+}
+
+// ============================================================================================================================
+// Is Positive Decimal - Whether a string is a decimal greater than zero, without exponent
+// ============================================================================================================================
+func (t *SimpleChaincode) is_positive_decimal(value string) bool {
+	decimal, err := money.ParseDecimal(value)
+	return err == nil && decimal.Sign() > 0
+}
+
+// ============================================================================================================================
+// Check Currencies - Accounts in different currencies need an FX rate. Between accounts in the same currency the amount
+//					  may not have more decimals than the currency.
+// ============================================================================================================================
+func (t *SimpleChaincode) check_currencies(stub shim.ChaincodeStubInterface, chaincodeId string, channel string, accountFrom string, accountTo string, amount string, fxRate string) error {
+
+	if fxRate != "" {
+		return nil
+	}
+
+	currencyFrom, err := t.get_account_currency(stub, chaincodeId, channel, accountFrom)
+	if err != nil {
+		return err
+	}
+	currencyTo, err := t.get_account_currency(stub, chaincodeId, channel, accountTo)
+	if err != nil {
+		return err
+	}
+
+	if currencyFrom != currencyTo {
+		return errors.New("Account " + accountFrom + " is in " + currencyFrom + " and account " + accountTo + " in " + currencyTo + ". An FX rate is required")
+	}
+
+	_, err = money.Parse(currencyFrom, amount)
+	return err
+}
+
+// ============================================================================================================================
+// Get Account Currency - The currency of an account on a target chaincode. It is read from the target once and cached,
+//						  as the currency of an account does not change.
+// ============================================================================================================================
+func (t *SimpleChaincode) get_account_currency(stub shim.ChaincodeStubInterface, chaincodeId string, channel string, accountNo string) (string, error) {
+
+	key, err := stub.CreateCompositeKey(accountCurrencyPrefix, []string{chaincodeId, accountNo})
+	if err != nil {
+		return "", err
+	}
+
+	currencyAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return "", errors.New("Failed to get the currency of account " + accountNo)
+	}
+	if currencyAsBytes != nil {
+		return string(currencyAsBytes), nil
+	}
+
+	response, denied, err := t.call_target(stub, chaincodeId, channel, readFunction, accountNo)
+	if err != nil {
+		return "", err
+	}
+	if denied != nil {
+		return "", errors.New("Cannot check the currency of account " + accountNo + ": " + denied.Reason)
+	}
+	if response.Status != shim.OK {
+		return "", errors.New("Failed to read account " + accountNo + ". Got error: " + response.Message)
+	}
+
+	var account TargetAccount
+	err = json.Unmarshal(response.Payload, &account)
+	if err != nil || account.Currency == "" {
+		return "", errors.New("Account " + accountNo + " on " + chaincodeId + " has no currency")
+	}
+
+	err = stub.PutState(key, []byte(account.Currency))
+	if err != nil {
+		return "", errors.New("Error caching the currency of account " + accountNo)
+	}
+
+	return account.Currency, nil
+}
+
+// ============================================================================================================================
+// Get Processed Request - The stored result of the request with the clientRequestId, nil when it has not been
+//						   processed. An id already used for another function is an error.
+// ============================================================================================================================
+func (t *SimpleChaincode) get_processed_request(stub shim.ChaincodeStubInterface, clientRequestId string, function string) (*ProcessedRequest, error) {
+	key, err := stub.CreateCompositeKey(processedRequestPrefix, []string{clientRequestId})
+	if err != nil {
+		return nil, err
+	}
+
+	processedAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get request " + clientRequestId)
+	}
+	if processedAsBytes == nil {
+		return nil, nil
+	}
+
+	var processed ProcessedRequest
+	err = json.Unmarshal(processedAsBytes, &processed)
+	if err != nil {
+		return nil, errors.New("Corrupt request " + clientRequestId)
+	}
+	if processed.Function != function {
+		return nil, errors.New("clientRequestId " + clientRequestId + " was already used for " + processed.Function)
+	}
+
+	fmt.Printf("Request %s was already processed in transaction %s", clientRequestId, processed.TransactionId)
+	return &processed, nil
+}
+
+// ============================================================================================================================
+// Save Processed Request - Store the result of a request under its clientRequestId
+// ============================================================================================================================
+func (t *SimpleChaincode) save_processed_request(stub shim.ChaincodeStubInterface, clientRequestId string, function string, response []byte) error {
+	processed := ProcessedRequest{ClientRequestId: clientRequestId, Function: function, TransactionId: stub.GetTxID(), Response: string(response)}
+
+	var err error
+	processed.ProcessedBy, err = t.get_caller(stub)
+	if err != nil {
+		return err
+	}
+	processed.ProcessedAt, err = t.get_timestamp(stub)
+	if err != nil {
+		return err
+	}
+
+	key, err := stub.CreateCompositeKey(processedRequestPrefix, []string{clientRequestId})
+	if err != nil {
+		return err
+	}
+
+	jsonAsBytes, _ := json.Marshal(processed)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return fmt.Errorf("Error storing request %s", clientRequestId)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Read - read a variable from chaincode world state
+// ============================================================================================================================
+func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var name, jsonResp string
+	var err error
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting name of the var to query")
+	}
+
+	name = args[0]
+	valAsbytes, err := stub.GetState(name)	
+	if err != nil {
+		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
+		return shim.Error(jsonResp)
+	}
+
+	return shim.Success(valAsbytes)												
+}
+
+// ============================================================================================================================
+// Query - read an account from the target chaincode. Reads go through InvokeChaincode too; called from a query the
+//		   invoked chaincode's writes are never committed. The chaincode name may be left out, or empty, to use the
+//		   chaincode the account is routed to or the configured target for "query". Being read-only, a query may
+//		   name another channel to read from. While the cache is on, see set_cache, the account read is cached.
+// ============================================================================================================================
+func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) == 1 {
+		args = append([]string{""}, args...)
+	}
+	if len(args) == 2 {
+		args = append(args, "")
+	}
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 to 3")
+	}
+
+	accountNo := args[1]
+
+	chaincodeId, channel, err := t.resolve_account_target(stub, "query", args[0], args[2], accountNo)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	f := "read"
+	response, denied, err := t.call_target(stub, chaincodeId, channel, f, accountNo)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if denied != nil {
+		return t.denied_response(denied)
+	}
+	envelope, err := t.adapt(stub, chaincodeId, response)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if envelope.Error != "" {
+		fmt.Printf("Failed to query chaincode. Got error: %s", envelope.Error)
+		return t.envelope_response(envelope)
+	}
+
+	err = t.cache_account(stub, chaincodeId, channel, accountNo, envelope.Data)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return t.envelope_response(envelope)
+}
+
+// ============================================================================================================================
+// Proxy Query - Forward any read function and its arguments to the target chaincode, so new target-side queries need no
+//				 proxy changes. Arguments that are not strings, such as a CouchDB selector, are passed as JSON. Only
+//				 functions on the allowlist are forwarded, so only reads should be allowed for the target. The chaincode
+//				 name may be left out, or empty, to use the configured target for "proxy_query"; a channel may be given.
+// ============================================================================================================================
+func (t *SimpleChaincode) proxy_query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0                1                              2                                    3
+	// "accounts"  "query_accounts"  "[{"selector":{"currency":"EUR"}},"20"]"     "otherchannel"
+
+	if len(args) == 2 {
+		args = append([]string{""}, args...)
+	}
+	if len(args) == 3 {
+		args = append(args, "")
+	}
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 to 4")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+
+	var values []interface{}
+	err := json.Unmarshal([]byte(args[2]), &values)
+	if err != nil {
+		return shim.Error("3rd argument must be a JSON array of arguments")
+	}
+
+	queryArgs := []string{}
+	for _, value := range values {
+		if str, ok := value.(string); ok {
+			queryArgs = append(queryArgs, str)
+		} else {
+			valueAsBytes, _ := json.Marshal(value)
+			queryArgs = append(queryArgs, string(valueAsBytes))
+		}
+	}
+
+	chaincodeId, channel, err := t.resolve_target(stub, "proxy_query", args[0], args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	response, denied, err := t.call_target(stub, chaincodeId, channel, args[1], queryArgs...)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if denied != nil {
+		return t.denied_response(denied)
+	}
+	envelope, err := t.adapt(stub, chaincodeId, response)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if envelope.Error != "" {
+		fmt.Printf("Failed to query chaincode. Got error: %s", envelope.Error)
+	}
+
+	return t.envelope_response(envelope)
+}
+
+// ============================================================================================================================
+// Probe Targets - Ping every configured chaincode, the target and its overrides, the fan-out targets and the account
+//				   routes, with versionFunction, and report which answered and the schema version they run, so that
+//				   the wiring can be checked after a deployment or an upgrade. versionFunction must be on the
+//				   allowlist of each chaincode to be probed.
+// ============================================================================================================================
+func (t *SimpleChaincode) probe_targets(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	target, err := t.get_target(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	targets := []Target{}
+	if target.ChaincodeName != "" {
+		targets = append(targets, target)
+	}
+	functions := []string{}
+	for function := range target.Overrides {
+		functions = append(functions, function)
+	}
+	sort.Strings(functions)
+	for _, function := range functions {
+		targets = append(targets, target.Overrides[function])
+	}
+
+	fanOut, err := t.get_fanout_targets(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	targets = append(targets, fanOut...)
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(accountRoutePrefix, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var route AccountRoute
+		err = json.Unmarshal(queryResponse.Value, &route)
+		if err != nil {
+			return shim.Error("Corrupt account route " + queryResponse.Key)
+		}
+		targets = append(targets, Target{ChaincodeName: route.ChaincodeName, Channel: route.Channel})
+	}
+
+	probed := map[string]bool{}
+	results := []ProbeResult{}
+	for _, target := range targets {
+		if probed[target.ChaincodeName + "/" + target.Channel] {
+			continue
+		}
+		probed[target.ChaincodeName + "/" + target.Channel] = true
+
+		result := ProbeResult{ChaincodeName: target.ChaincodeName, Channel: target.Channel}
+
+		response, denied, err := t.call_target(stub, target.ChaincodeName, target.Channel, versionFunction)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if denied != nil {
+			result.Status = DENIED
+			result.Error = denied.Reason
+		} else if response.Status != shim.OK {
+			result.Status = FAILED
+			result.Error = response.Message
+		} else {
+			result.Status = OK
+			result.Reachable = true
+
+			var version TargetVersion
+			if json.Unmarshal(response.Payload, &version) == nil {
+				result.SchemaVersion = version.SchemaVersion
+				if result.SchemaVersion == "" {
+					result.SchemaVersion = version.Version
+				}
+			} else {
+				result.SchemaVersion = strings.TrimSpace(string(response.Payload))
+			}
+		}
+		results = append(results, result)
+	}
+
+	jsonAsBytes, _ := json.Marshal(results)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Set Cache - Admin only. Turn the read-through cache of target accounts on, with the age in seconds after which a
+//			   cached account is stale, or off when the age is empty. Cached accounts are kept when it is turned off.
+// ============================================================================================================================
+func (t *SimpleChaincode) set_cache(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "300"
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	if !t.is_admin(stub) {
+		return shim.Error("Permission Denied. set_cache requires the " + adminAttribute + " attribute")
+	}
+
+	if args[0] == "" {
+		err := stub.DelState(cacheStr)
+		if err != nil {
+			return shim.Error("Error removing the cache configuration")
+		}
+		return shim.Success(nil)
+	}
+
+	maxAge, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || maxAge <= 0 {
+		return shim.Error("1st argument must be a positive number of seconds")
+	}
+
+	config := CacheConfig{MaxAgeSeconds: maxAge}
+	config.UpdatedBy, err = t.get_caller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	config.UpdatedAt, err = t.get_timestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	jsonAsBytes, _ := json.Marshal(config)
+	err = stub.PutState(cacheStr, jsonAsBytes)
+	if err != nil {
+		return shim.Error("Error storing the cache configuration")
+	}
+
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Get Cache Config - The cache configuration, nil while the cache is off
+// ============================================================================================================================
+func (t *SimpleChaincode) get_cache_config(stub shim.ChaincodeStubInterface) (*CacheConfig, error) {
+
+	configAsBytes, err := stub.GetState(cacheStr)
+	if err != nil {
+		return nil, errors.New("Failed to get the cache configuration")
+	}
+	if configAsBytes == nil {
+		return nil, nil
+	}
+
+	var config CacheConfig
+	err = json.Unmarshal(configAsBytes, &config)
+	if err != nil {
+		return nil, errors.New("Corrupt cache configuration")
+	}
+	return &config, nil
+}
+
+// ============================================================================================================================
+// Cache Account - Store the copy of an account read from a target chaincode, while the cache is on
+// ============================================================================================================================
+func (t *SimpleChaincode) cache_account(stub shim.ChaincodeStubInterface, chaincodeId string, channel string, accountNo string, account json.RawMessage) error {
+
+	config, err := t.get_cache_config(stub)
+	if err != nil {
+		return err
+	}
+	if config == nil || len(account) == 0 {
+		return nil
+	}
+
+	if channel == "" {
+		channel = stub.GetChannelID()
+	}
+	cached := CachedAccount{ChaincodeName: chaincodeId, Channel: channel, AccountNo: accountNo, Account: account, TransactionId: stub.GetTxID()}
+	cached.CachedAt, err = t.get_timestamp(stub)
+	if err != nil {
+		return err
+	}
+
+	key, err := t.cached_account_key(stub, chaincodeId, channel, accountNo)
+	if err != nil {
+		return err
+	}
+
+	jsonAsBytes, _ := json.Marshal(cached)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return errors.New("Error caching account " + accountNo)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Cached Account Key - The key an account of a target chaincode is cached under. The same chaincode name can be
+//						installed on several channels with different ledgers, so the channel is part of the key; an
+//						empty channel is this transaction's channel.
+// ============================================================================================================================
+func (t *SimpleChaincode) cached_account_key(stub shim.ChaincodeStubInterface, chaincodeId string, channel string, accountNo string) (string, error) {
+
+	if channel == "" {
+		channel = stub.GetChannelID()
+	}
+	return stub.CreateCompositeKey(cachedAccountPrefix, []string{chaincodeId, channel, accountNo})
+}
+
+// ============================================================================================================================
+// Get Cached Account - Read the cached copy of an account without calling the target chaincode, with its age and
+//						whether it is older than the maximum age of the cache. The chaincode name may be left out,
+//						or empty, to use the chaincode query would read the account from; the channel, like for
+//						query, defaults to the one the account is routed to or this channel. While the cache is off
+//						every cached account is stale.
+// ============================================================================================================================
+func (t *SimpleChaincode) get_cached_account(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0         1        2
+	// "accounts"  "1001"  "channel"
+
+	if len(args) == 1 {
+		args = append([]string{""}, args...)
+	}
+	if len(args) == 2 {
+		args = append(args, "")
+	}
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 to 3")
+	}
+
+	//input sanitation
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+
+	accountNo := args[1]
+	chaincodeId, channel, err := t.resolve_account_target(stub, "query", args[0], args[2], accountNo)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := t.cached_account_key(stub, chaincodeId, channel, accountNo)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	cachedAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error("Failed to get cached account " + accountNo)
+	}
+	if cachedAsBytes == nil {
+		return shim.Error("Account " + accountNo + " of " + chaincodeId + " is not cached")
+	}
+
+	var response CachedAccountResponse
+	err = json.Unmarshal(cachedAsBytes, &response.CachedAccount)
+	if err != nil {
+		return shim.Error("Corrupt cached account " + accountNo)
+	}
+
+	now, err := t.get_timestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	nowTime, _ := time.Parse(time.RFC3339, now)
+	cachedTime, err := time.Parse(time.RFC3339, response.CachedAt)
+	if err != nil {
+		return shim.Error("Corrupt cached account " + accountNo)
+	}
+	response.AgeSeconds = int64(nowTime.Sub(cachedTime).Seconds())
+
+	config, err := t.get_cache_config(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	response.Stale = config == nil || response.AgeSeconds > config.MaxAgeSeconds
+
+	jsonAsBytes, _ := json.Marshal(response)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Set Target - Admin only. Set the chaincode, and the channel it is deployed to, that init_account, transfer_balance
+//				and query call when the caller names none. Given a function name it sets an override for that function
+//				only. An empty chaincode name removes the target or the override.
+// ============================================================================================================================
+func (t *SimpleChaincode) set_target(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3")
+	}
+
+	if !t.is_admin(stub) {
+		return shim.Error("Permission Denied. set_target requires the " + adminAttribute + " attribute")
+	}
+
+	target, err := t.get_target(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	function := ""
+	if len(args) == 3 {
+		function = args[2]
+	}
+
+	if function == "" {
+		target.ChaincodeName = args[0]
+		target.Channel = args[1]
+	} else if args[0] == "" {
+		delete(target.Overrides, function)
+	} else {
+		if target.Overrides == nil {
+			target.Overrides = map[string]Target{}
+		}
+		target.Overrides[function] = Target{ChaincodeName: args[0], Channel: args[1]}
+	}
+
+	if target.ChaincodeName == "" && len(target.Overrides) == 0 {
+		err = stub.DelState(targetStr)
+		if err != nil {
+			return shim.Error("Error removing the target")
+		}
+		return shim.Success(nil)
+	}
+
+	jsonAsBytes, _ := json.Marshal(target)
+	err = stub.PutState(targetStr, jsonAsBytes)
+	if err != nil {
+		return shim.Error("Error storing the target")
+	}
+
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Get Target - The stored target configuration, empty when none is set
+// ============================================================================================================================
+func (t *SimpleChaincode) get_target(stub shim.ChaincodeStubInterface) (Target, error) {
+
+	var target Target
+
+	targetAsBytes, err := stub.GetState(targetStr)
+	if err != nil {
+		return target, errors.New("Failed to get the target")
+	}
+	if targetAsBytes == nil {
+		return target, nil
+	}
+
+	err = json.Unmarshal(targetAsBytes, &target)
+	if err != nil {
+		return target, errors.New("Corrupt target " + string(targetAsBytes))
+	}
+
+	return target, nil
+}
+
+// ============================================================================================================================
+// Set Fanout Targets - Admin only. Set the chaincodes, and the channels they are deployed to, that
+//						init_account_everywhere opens accounts on. An empty list removes them.
+// ============================================================================================================================
+func (t *SimpleChaincode) set_fanout_targets(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "[{"chaincodeName":"gl","channel":""},{"chaincodeName":"reporting","channel":""}]"
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	if !t.is_admin(stub) {
+		return shim.Error("Permission Denied. set_fanout_targets requires the " + adminAttribute + " attribute")
+	}
+
+	var targets []Target
+	err := json.Unmarshal([]byte(args[0]), &targets)
+	if err != nil {
+		return shim.Error("Targets must be a JSON array of {chaincodeName, channel}")
+	}
+
+	if len(targets) == 0 {
+		err = stub.DelState(fanOutStr)
+		if err != nil {
+			return shim.Error("Error removing the fan-out targets")
+		}
+		return shim.Success(nil)
+	}
+
+	for i := range targets {
+		if len(targets[i].ChaincodeName) <= 0 {
+			return shim.Error("Every target must name a chaincode")
+		}
+		targets[i].Overrides = nil
+
+		err = t.check_writable(stub, targets[i].Channel)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	jsonAsBytes, _ := json.Marshal(targets)
+	err = stub.PutState(fanOutStr, jsonAsBytes)
+	if err != nil {
+		return shim.Error("Error storing the fan-out targets")
+	}
+
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Get Fanout Targets - The stored targets of init_account_everywhere, empty when none are set
+// ============================================================================================================================
+func (t *SimpleChaincode) get_fanout_targets(stub shim.ChaincodeStubInterface) ([]Target, error) {
+
+	var targets []Target
+
+	targetsAsBytes, err := stub.GetState(fanOutStr)
+	if err != nil {
+		return targets, errors.New("Failed to get the fan-out targets")
+	}
+	if targetsAsBytes == nil {
+		return targets, nil
+	}
+
+	err = json.Unmarshal(targetsAsBytes, &targets)
+	if err != nil {
+		return targets, errors.New("Corrupt fan-out targets")
+	}
+	return targets, nil
+}
+
+// ============================================================================================================================
+// Resolve Target - The chaincode and channel to call for a function: the chaincode the caller named, or else the
+//					function's override or the configured target. A channel the caller named wins over the
+//					configured one; an empty channel is this one.
+// ============================================================================================================================
+func (t *SimpleChaincode) resolve_target(stub shim.ChaincodeStubInterface, function string, chaincodeId string, channel string) (string, string, error) {
+
+	if chaincodeId != "" {
+		return chaincodeId, channel, nil
+	}
+
+	target, err := t.get_target(stub)
+	if err != nil {
+		return "", "", err
+	}
+
+	if override, ok := target.Overrides[function]; ok {
+		target = override
+	}
+	if target.ChaincodeName == "" {
+		return "", "", errors.New("No chaincode given and no target set for " + function + ", see set_target")
+	}
+	if channel == "" {
+		channel = target.Channel
+	}
+
+	return target.ChaincodeName, channel, nil
+}
+
+// ============================================================================================================================
+// Resolve Account Target - The chaincode and channel to call for a function on accounts: the chaincode the caller
+//							named, or else the one the accounts are routed to. Accounts without a route use the
+//							target of resolve_target. Accounts routed to different chaincodes are an error.
+// ============================================================================================================================
+func (t *SimpleChaincode) resolve_account_target(stub shim.ChaincodeStubInterface, function string, chaincodeId string, channel string, accounts ...string) (string, string, error) {
+
+	if chaincodeId != "" || len(accounts) == 0 {
+		return t.resolve_target(stub, function, chaincodeId, channel)
+	}
+
+	resolvedId, resolvedChannel := "", ""
+	for i, accountNo := range accounts {
+		route, err := t.route_account(stub, accountNo)
+		if err != nil {
+			return "", "", err
+		}
+
+		routeId, routeChannel := "", channel
+		if route == nil {
+			routeId, routeChannel, err = t.resolve_target(stub, function, "", channel)
+			if err != nil {
+				return "", "", err
+			}
+		} else {
+			routeId = route.ChaincodeName
+			if routeChannel == "" {
+				routeChannel = route.Channel
+			}
+		}
+
+		if i > 0 && (routeId != resolvedId || routeChannel != resolvedChannel) {
+			return "", "", errors.New("Accounts " + strings.Join(accounts, " and ") + " are routed to different chaincodes")
+		}
+		resolvedId, resolvedChannel = routeId, routeChannel
+	}
+
+	return resolvedId, resolvedChannel, nil
+}
+
+// ============================================================================================================================
+// Route Account - The route with the longest prefix of the account number, nil when none matches
+// ============================================================================================================================
+func (t *SimpleChaincode) route_account(stub shim.ChaincodeStubInterface, accountNo string) (*AccountRoute, error) {
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(accountRoutePrefix, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var match *AccountRoute
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var route AccountRoute
+		err = json.Unmarshal(queryResponse.Value, &route)
+		if err != nil {
+			return nil, errors.New("Corrupt account route " + queryResponse.Key)
+		}
+		if strings.HasPrefix(accountNo, route.Prefix) && (match == nil || len(route.Prefix) > len(match.Prefix)) {
+			match = &route
+		}
+	}
+
+	return match, nil
+}
+
+// ============================================================================================================================
+// Set Account Route - Admin only. Route the accounts whose number starts with the prefix to a chaincode and the
+//					   channel it is deployed to. An empty chaincode name removes the route.
+// ============================================================================================================================
+func (t *SimpleChaincode) set_account_route(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1          2
+	// "40"   "accounts"   ""
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	//input sanitation
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	if !t.is_admin(stub) {
+		return shim.Error("Permission Denied. set_account_route requires the " + adminAttribute + " attribute")
+	}
+
+	key, err := stub.CreateCompositeKey(accountRoutePrefix, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if args[1] == "" {
+		err = stub.DelState(key)
+		if err != nil {
+			return shim.Error("Error removing account route " + args[0])
+		}
+		return shim.Success(nil)
+	}
+
+	route := AccountRoute{Prefix: args[0], ChaincodeName: args[1], Channel: args[2]}
+	route.UpdatedBy, err = t.get_caller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	route.UpdatedAt, err = t.get_timestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	jsonAsBytes, _ := json.Marshal(route)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return shim.Error("Error storing account route " + args[0])
+	}
+
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Get Account Routes - List the account routes
+// ============================================================================================================================
+func (t *SimpleChaincode) get_account_routes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(accountRoutePrefix, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	routes := []AccountRoute{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var route AccountRoute
+		err = json.Unmarshal(queryResponse.Value, &route)
+		if err != nil {
+			return shim.Error("Corrupt account route " + queryResponse.Key)
+		}
+		routes = append(routes, route)
+	}
+
+	jsonAsBytes, _ := json.Marshal(routes)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Check Writable - Fail unless the channel is this one. Fabric only commits the writes of a chaincode called on the
+//					same channel; one on another channel can be read but its writes are never committed, let alone
+//					atomically with this transaction.
+// ============================================================================================================================
+func (t *SimpleChaincode) check_writable(stub shim.ChaincodeStubInterface, channel string) error {
+
+	if channel == "" || channel == stub.GetChannelID() {
+		return nil
+	}
+
+	return errors.New("Cross-channel writes are not supported: the target is on channel " + channel + " but this transaction runs on " + stub.GetChannelID() + ". Fabric would not commit the writes there; only queries can cross channels")
+}
+
+// ============================================================================================================================
+// Is Admin - Check the admin attribute on the certificate of the identity submitting the transaction
+// ============================================================================================================================
+func (t *SimpleChaincode) is_admin(stub shim.ChaincodeStubInterface) bool {
+	value, found, err := cid.GetAttributeValue(stub, adminAttribute)
+	return err == nil && found && value == "true"
+}
+
+// ============================================================================================================================
+// Is Treasury - Check the treasury attribute on the certificate of the identity submitting the transaction
+// ============================================================================================================================
+func (t *SimpleChaincode) is_treasury(stub shim.ChaincodeStubInterface) bool {
+	value, found, err := cid.GetAttributeValue(stub, treasuryAttribute)
+	return err == nil && found && value == "true"
+}
+
+// ============================================================================================================================
+// Call Target - Invoke a function of a chaincode if the allowlist permits it. Otherwise the call is not made and is
+//				 logged as a ProxyDenied record, which is returned instead of a response.
+// ============================================================================================================================
+func (t *SimpleChaincode) call_target(stub shim.ChaincodeStubInterface, chaincodeId string, channel string, function string, args ...string) (pb.Response, *ProxyDenied, error) {
+
+	var response pb.Response
+
+	allowed, err := t.is_allowed(stub, chaincodeId, function)
+	if err != nil {
+		return response, nil, err
+	}
+	call := ProxyCall{ChaincodeName: chaincodeId, Channel: channel, Function: function}
+	if !allowed {
+		denied, err := t.log_denied(stub, chaincodeId, channel, function, "Function " + function + " of chaincode " + chaincodeId + " is not on the allowlist")
+		call.Status = DENIED
+		if denied != nil {
+			call.Error = denied.Reason
+		}
+		t.relay_call(stub, call)
+		return response, denied, err
+	}
+
+	invokeArgs := util.ToChaincodeArgs(append([]string{function}, args...)...)
+	response = stub.InvokeChaincode(chaincodeId, invokeArgs, channel)
+
+	call.Status = OK
+	if response.Status != shim.OK {
+		call.Status = FAILED
+		call.Error = response.Message
+	}
+	call.RemoteStatus = response.Status
+	t.relay_call(stub, call)
+
+	return response, nil, nil
+}
+
+// ============================================================================================================================
+// Relay Call - Add a forwarded call to the event of the transaction, when it is routed with a RelayStub
+// ============================================================================================================================
+func (t *SimpleChaincode) relay_call(stub shim.ChaincodeStubInterface, call ProxyCall) {
+	relay, ok := stub.(*RelayStub)
+	if !ok {
+		return
+	}
+	call.Index = len(relay.calls)
+	relay.calls = append(relay.calls, call)
+}
+
+// ============================================================================================================================
+// Emit Proxy Event - Set the event relaying the calls forwarded in the transaction
+// ============================================================================================================================
+func (t *SimpleChaincode) emit_proxy_event(relay *RelayStub) error {
+
+	event := ProxyEvent{TransactionId: relay.GetTxID(), Calls: relay.calls}
+
+	transient, err := relay.GetTransient()
+	if err != nil {
+		return fmt.Errorf("Couldn't retrieve the transient fields")
+	}
+	event.CorrelationId = string(transient[correlationField])
+	if event.CorrelationId == "" {
+		event.CorrelationId = event.TransactionId
+	}
+
+	jsonAsBytes, _ := json.Marshal(event)
+	err = relay.SetEvent(proxyEventName, jsonAsBytes)
+	if err != nil {
+		return fmt.Errorf("Error setting event %s", proxyEventName)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Update Metrics - Add the calls forwarded in the transaction to their metrics, in the shard of the transaction. The
+//					calls are added up first, as a transaction does not read its own writes.
+// ============================================================================================================================
+func (t *SimpleChaincode) update_metrics(relay *RelayStub) error {
+
+	now, err := t.get_timestamp(relay)
+	if err != nil {
+		return err
+	}
+	txHash := sha256.Sum256([]byte(relay.GetTxID()))
+	shard := fmt.Sprintf("%02d", int(txHash[0]) % metricShards)
+
+	deltas := []ProxyMetric{}
+	indexes := map[string]int{}
+	for _, call := range relay.calls {
+		name := call.ChaincodeName + "\x00" + call.Function
+		i, ok := indexes[name]
+		if !ok {
+			i = len(deltas)
+			indexes[name] = i
+			deltas = append(deltas, ProxyMetric{ChaincodeName: call.ChaincodeName, Function: call.Function})
+		}
+
+		if call.Status == OK {
+			deltas[i].Success++
+		} else if call.Status == DENIED {
+			deltas[i].Denied++
+		} else {
+			deltas[i].Failure++
+		}
+		if call.Status != OK {
+			deltas[i].LastError = call.Error
+			deltas[i].LastErrorAt = now
+		}
+	}
+
+	for _, delta := range deltas {
+		key, err := relay.CreateCompositeKey(metricPrefix, []string{delta.ChaincodeName, delta.Function, shard})
+		if err != nil {
+			return err
+		}
+
+		metric := ProxyMetric{ChaincodeName: delta.ChaincodeName, Function: delta.Function}
+		metricAsBytes, err := relay.GetState(key)
+		if err != nil {
+			return errors.New("Failed to get the metric of " + delta.ChaincodeName + " " + delta.Function)
+		}
+		if metricAsBytes != nil {
+			err = json.Unmarshal(metricAsBytes, &metric)
+			if err != nil {
+				return errors.New("Corrupt metric " + key)
+			}
+		}
+
+		metric.Success += delta.Success
+		metric.Failure += delta.Failure
+		metric.Denied += delta.Denied
+		if delta.LastErrorAt != "" {
+			metric.LastError = delta.LastError
+			metric.LastErrorAt = delta.LastErrorAt
+		}
+
+		metricAsBytes, _ = json.Marshal(metric)
+		err = relay.PutState(key, metricAsBytes)
+		if err != nil {
+			return errors.New("Error storing the metric of " + delta.ChaincodeName + " " + delta.Function)
+		}
+	}
+
+	return nil
+}
+
+// ============================================================================================================================
+// Get Metrics - The metrics of the calls the proxy made, optionally only those to one chaincode, with their shards
+//				 added up
+// ============================================================================================================================
+func (t *SimpleChaincode) get_metrics(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0 (optional)
+	// "accounts"
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+
+	keys := []string{}
+	if len(args) == 1 && args[0] != "" {
+		keys = append(keys, args[0])
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(metricPrefix, keys)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	metrics := []ProxyMetric{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var shard ProxyMetric
+		err = json.Unmarshal(queryResponse.Value, &shard)
+		if err != nil {
+			return shim.Error("Corrupt metric " + queryResponse.Key)
+		}
+
+		// The shards of a metric are next to each other, ordered by chaincode name and function
+		last := len(metrics) - 1
+		if last < 0 || metrics[last].ChaincodeName != shard.ChaincodeName || metrics[last].Function != shard.Function {
+			metrics = append(metrics, shard)
+			continue
+		}
+
+		metrics[last].Success += shard.Success
+		metrics[last].Failure += shard.Failure
+		metrics[last].Denied += shard.Denied
+		if shard.LastErrorAt > metrics[last].LastErrorAt {
+			metrics[last].LastError = shard.LastError
+			metrics[last].LastErrorAt = shard.LastErrorAt
+		}
+	}
+
+	jsonAsBytes, _ := json.Marshal(metrics)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Record Proxy Transaction - Journal a call made to write on a target chaincode and the status it returned
+// ============================================================================================================================
+func (t *SimpleChaincode) record_proxy_transaction(stub shim.ChaincodeStubInterface, chaincodeId string, channel string, index int, response pb.Response, function string, args ...string) error {
+
+	argsAsBytes, _ := json.Marshal(args)
+	hash := sha256.Sum256(argsAsBytes)
+
+	txn := ProxyTransaction{TransactionId: stub.GetTxID(), Index: index, ChaincodeName: chaincodeId, Channel: channel, Function: function, ArgsHash: hex.EncodeToString(hash[:]), RemoteStatus: response.Status, RemoteMessage: response.Message}
+
+	var err error
+	txn.Caller, err = t.get_caller(stub)
+	if err != nil {
+		return err
+	}
+	txn.Timestamp, err = t.get_timestamp(stub)
+	if err != nil {
+		return err
+	}
+
+	key, err := stub.CreateCompositeKey(proxyTransactionPrefix, []string{txn.Timestamp, txn.TransactionId, fmt.Sprintf("%04d", index)})
+	if err != nil {
+		return err
+	}
+
+	jsonAsBytes, _ := json.Marshal(txn)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return fmt.Errorf("Error storing proxy transaction %s", txn.TransactionId)
+	}
+
+	return nil
+}
+
+// ============================================================================================================================
+// Get Proxy History - Page through the journal of proxied writes, oldest first
+// ============================================================================================================================
+func (t *SimpleChaincode) get_proxy_history(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1
+	// "20",  "bookmark"
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+	pageSize, err := strconv.ParseInt(args[0], 10, 32)
+	if err != nil || pageSize <= 0 {
+		return shim.Error("1st argument must be a positive integer")
+	}
+	bookmark := ""
+	if len(args) == 2 {
+		bookmark = args[1]
+	}
+
+	resultsIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(proxyTransactionPrefix, []string{}, int32(pageSize), bookmark)
+	if err != nil {
+		return shim.Error("Failed to query the proxy history")
+	}
+	defer resultsIterator.Close()
+
+	page := ProxyTransactionPage{Records: []ProxyTransaction{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var txn ProxyTransaction
+		err = json.Unmarshal(queryResponse.Value, &txn)
+		if err != nil {
+			return shim.Error("Corrupt proxy transaction " + queryResponse.Key)
+		}
+		page.Records = append(page.Records, txn)
+	}
+	page.FetchedRecordsCount = int32(len(page.Records))
+	if metadata != nil {
+		page.Bookmark = metadata.Bookmark
+	}
+
+	jsonAsBytes, _ := json.Marshal(page)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Set Allowlist - Admin only. Set the functions of a chaincode the proxy may call, as a comma separated list. An empty
+//				   list removes the chaincode from the allowlist.
+// ============================================================================================================================
+func (t *SimpleChaincode) set_allowlist(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0                    1
+	// "accounts"  "init_account,transfer_balance,read"
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	if !t.is_admin(stub) {
+		return shim.Error("Permission Denied. set_allowlist requires the " + adminAttribute + " attribute")
+	}
+
+	key, err := stub.CreateCompositeKey(allowlistPrefix, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	functions := []string{}
+	for _, function := range strings.Split(args[1], ",") {
+		if function = strings.TrimSpace(function); function != "" {
+			functions = append(functions, function)
+		}
+	}
+
+	if len(functions) == 0 {
+		err = stub.DelState(key)
+		if err != nil {
+			return shim.Error("Error removing allowlist entry " + args[0])
+		}
+		return shim.Success(nil)
+	}
+
+	entry := AllowlistEntry{ChaincodeName: args[0], Functions: functions}
+	entry.UpdatedBy, err = t.get_caller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	entry.UpdatedAt, err = t.get_timestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	jsonAsBytes, _ := json.Marshal(entry)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return shim.Error("Error storing allowlist entry " + args[0])
+	}
+
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Get Allowlist - List the chaincodes the proxy may call and their functions
+// ============================================================================================================================
+func (t *SimpleChaincode) get_allowlist(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(allowlistPrefix, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	entries := []AllowlistEntry{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var entry AllowlistEntry
+		err = json.Unmarshal(queryResponse.Value, &entry)
+		if err != nil {
+			return shim.Error("Corrupt allowlist entry " + queryResponse.Key)
+		}
+		entries = append(entries, entry)
+	}
+
+	jsonAsBytes, _ := json.Marshal(entries)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Is Allowed - Whether the allowlist permits calling the function of the chaincode
+// ============================================================================================================================
+func (t *SimpleChaincode) is_allowed(stub shim.ChaincodeStubInterface, chaincodeId string, function string) (bool, error) {
+
+	key, err := stub.CreateCompositeKey(allowlistPrefix, []string{chaincodeId})
+	if err != nil {
+		return false, err
+	}
+
+	entryAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return false, errors.New("Failed to get allowlist entry " + chaincodeId)
+	}
+	if entryAsBytes == nil {
+		return false, nil
+	}
+
+	var entry AllowlistEntry
+	err = json.Unmarshal(entryAsBytes, &entry)
+	if err != nil {
+		return false, errors.New("Corrupt allowlist entry " + chaincodeId)
+	}
+
+	for _, allowed := range entry.Functions {
+		if allowed == function {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ============================================================================================================================
+// Log Denied - Store a ProxyDenied record of a call that was not made. The denial id is the transaction id.
+// ============================================================================================================================
+func (t *SimpleChaincode) log_denied(stub shim.ChaincodeStubInterface, chaincodeId string, channel string, function string, reason string) (*ProxyDenied, error) {
+
+	denied := ProxyDenied{DenialId: stub.GetTxID(), ChaincodeName: chaincodeId, Channel: channel, Function: function, Reason: reason}
+
+	var err error
+	denied.Caller, err = t.get_caller(stub)
+	if err != nil {
+		return nil, err
+	}
+	denied.DeniedAt, err = t.get_timestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Proxy call denied: %s", reason)
+
+	key, err := stub.CreateCompositeKey(proxyDeniedPrefix, []string{denied.DenialId})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ := json.Marshal(denied)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Error storing denial %s", denied.DenialId)
+	}
+
+	return &denied, nil
+}
+
+// ============================================================================================================================
+// Denied Response - The successful response of a denied call, so that its ProxyDenied record is committed
+// ============================================================================================================================
+func (t *SimpleChaincode) denied_response(denied *ProxyDenied) pb.Response {
+
+	jsonAsBytes, _ := json.Marshal(ProxyResponse{Status: DENIED, ProxyDenied: denied})
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Set Adapter - Admin only. Set how the responses of a chaincode are read into the standard envelope: json (the
+//				 default), raw or legacy_error. An empty adapter removes it.
+// ============================================================================================================================
+func (t *SimpleChaincode) set_adapter(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0            1
+	// "mycc", "legacy_error"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	//input sanitation
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if args[1] != "" && args[1] != adapterJSON && args[1] != adapterRaw && args[1] != adapterLegacyError {
+		return shim.Error("2nd argument must be " + adapterJSON + ", " + adapterRaw + " or " + adapterLegacyError)
+	}
+
+	if !t.is_admin(stub) {
+		return shim.Error("Permission Denied. set_adapter requires the " + adminAttribute + " attribute")
+	}
+
+	key, err := stub.CreateCompositeKey(adapterPrefix, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if args[1] == "" {
+		err = stub.DelState(key)
+		if err != nil {
+			return shim.Error("Error removing adapter " + args[0])
+		}
+		return shim.Success(nil)
+	}
+
+	adapter := ResponseAdapter{ChaincodeName: args[0], Adapter: args[1]}
+	adapter.UpdatedBy, err = t.get_caller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	adapter.UpdatedAt, err = t.get_timestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	jsonAsBytes, _ := json.Marshal(adapter)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return shim.Error("Error storing adapter " + args[0])
+	}
+
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Get Adapters - List the response adapters set for target chaincodes
+// ============================================================================================================================
+func (t *SimpleChaincode) get_adapters(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(adapterPrefix, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	adapters := []ResponseAdapter{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var adapter ResponseAdapter
+		err = json.Unmarshal(queryResponse.Value, &adapter)
+		if err != nil {
+			return shim.Error("Corrupt adapter " + queryResponse.Key)
+		}
+		adapters = append(adapters, adapter)
+	}
+
+	jsonAsBytes, _ := json.Marshal(adapters)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Adapt - Read the response of a chaincode into the standard envelope with the adapter set for it
+// ============================================================================================================================
+func (t *SimpleChaincode) adapt(stub shim.ChaincodeStubInterface, chaincodeId string, response pb.Response) (Envelope, error) {
+
+	adapter := adapterJSON
+
+	key, err := stub.CreateCompositeKey(adapterPrefix, []string{chaincodeId})
+	if err != nil {
+		return Envelope{}, err
+	}
+	adapterAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return Envelope{}, errors.New("Failed to get adapter " + chaincodeId)
+	}
+	if adapterAsBytes != nil {
+		var stored ResponseAdapter
+		err = json.Unmarshal(adapterAsBytes, &stored)
+		if err != nil {
+			return Envelope{}, errors.New("Corrupt adapter " + chaincodeId)
+		}
+		adapter = stored.Adapter
+	}
+
+	envelope := Envelope{Code: response.Status}
+	if response.Status != shim.OK {
+		envelope.Error = response.Message
+		if envelope.Error == "" {
+			envelope.Error = string(response.Payload)
+		}
+		return envelope, nil
+	}
+	if len(response.Payload) == 0 {
+		return envelope, nil
+	}
+
+	if adapter == adapterLegacyError {
+		var legacy LegacyError
+		if json.Unmarshal(response.Payload, &legacy) == nil && legacy.Error != "" {
+			envelope.Code = shim.ERROR
+			envelope.Error = legacy.Error
+			return envelope, nil
+		}
+	}
+
+	if adapter != adapterRaw && json.Valid(response.Payload) {
+		envelope.Data = json.RawMessage(response.Payload)
+	} else {
+		envelope.Data, _ = json.Marshal(string(response.Payload))
+	}
+	return envelope, nil
+}
+
+// ============================================================================================================================
+// Envelope Response - The envelope as a successful response, or as the message of an error
+// ============================================================================================================================
+func (t *SimpleChaincode) envelope_response(envelope Envelope) pb.Response {
+
+	jsonAsBytes, _ := json.Marshal(envelope)
+	if envelope.Error != "" {
+		return shim.Error(string(jsonAsBytes))
+	}
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Get Proxy Denials - Admin only. List the calls the allowlist denied
+// ============================================================================================================================
+func (t *SimpleChaincode) get_proxy_denials(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if !t.is_admin(stub) {
+		return shim.Error("Permission Denied. get_proxy_denials requires the " + adminAttribute + " attribute")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(proxyDeniedPrefix, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	denials := []ProxyDenied{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var denied ProxyDenied
+		err = json.Unmarshal(queryResponse.Value, &denied)
+		if err != nil {
+			return shim.Error("Corrupt denial " + queryResponse.Key)
+		}
+		denials = append(denials, denied)
+	}
+
+	jsonAsBytes, _ := json.Marshal(denials)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Get Caller - The common name of the identity submitting the transaction
+// ============================================================================================================================
+func (t *SimpleChaincode) get_caller(stub shim.ChaincodeStubInterface) (string, error) {
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil || cert == nil {
+		return "", fmt.Errorf("Couldn't retrieve the identity of the caller")
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// ============================================================================================================================
+// Get Timestamp - Return the transaction timestamp (identical on every endorsing peer) formatted as RFC 3339
+// ============================================================================================================================
+func (t *SimpleChaincode) get_timestamp(stub shim.ChaincodeStubInterface) (string, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return "", fmt.Errorf("Couldn't retrieve the transaction timestamp")
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Format(time.RFC3339), nil
 }
\ No newline at end of file
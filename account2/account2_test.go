@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/common/attrmgr"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// testStub invokes the proxy as a given identity. MockStub has no creator and keeps the arguments of MockInvoke to
+// itself, so both are set here and the chaincode is called with the testStub directly.
+type testStub struct {
+	*shim.MockStub
+	creator []byte
+	args    [][]byte
+	txs     int
+}
+
+func (stub *testStub) GetCreator() ([]byte, error) { return stub.creator, nil }
+func (stub *testStub) GetArgs() [][]byte          { return stub.args }
+
+func (stub *testStub) GetStringArgs() []string {
+	args := []string{}
+	for _, arg := range stub.args {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func (stub *testStub) GetFunctionAndParameters() (string, []string) {
+	args := stub.GetStringArgs()
+	return args[0], args[1:]
+}
+
+func (stub *testStub) invoke(caller []byte, function string, args ...string) pb.Response {
+	stub.txs++
+	txID := fmt.Sprintf("tx%d", stub.txs)
+	stub.creator = caller
+	stub.args = [][]byte{[]byte(function)}
+	for _, arg := range args {
+		stub.args = append(stub.args, []byte(arg))
+	}
+
+	stub.MockTransactionStart(txID)
+	defer stub.MockTransactionEnd(txID)
+	return new(SimpleChaincode).Invoke(stub)
+}
+
+// targetChaincode stands in for the accounts chaincode the proxy forwards to. It records the arguments of every call
+// and keeps accounts as their JSON under the account number.
+type targetChaincode struct {
+	calls [][]string
+}
+
+func (cc *targetChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (cc *targetChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	cc.calls = append(cc.calls, stub.GetStringArgs())
+	function, args := stub.GetFunctionAndParameters()
+
+	switch function {
+	case "init_account":
+		if existing, _ := stub.GetState(args[0]); existing != nil {
+			return shim.Error("Account " + args[0] + " already exists")
+		}
+		accountAsBytes, _ := json.Marshal(map[string]string{"accountNo": args[0], "legalEntity": args[1], "currency": args[2], "balance": args[3]})
+		stub.PutState(args[0], accountAsBytes)
+		return shim.Success(accountAsBytes)
+	case "read":
+		accountAsBytes, _ := stub.GetState(args[0])
+		if accountAsBytes == nil {
+			return shim.Error("Account " + args[0] + " not found")
+		}
+		return shim.Success(accountAsBytes)
+	case "transfer_balance":
+		return shim.Success([]byte(`{"transactionId":"` + stub.GetTxID() + `","from":"` + args[0] + `","to":"` + args[1] + `","amount":"` + args[2] + `"}`))
+	}
+	argsAsBytes, _ := json.Marshal(args)
+	return shim.Success(argsAsBytes)
+}
+
+// newTestStub is a proxy whose target is a targetChaincode named "accounts", which may be called for the functions
+// allowed
+func newTestStub(t *testing.T, admin []byte, allowed string) (*testStub, *targetChaincode) {
+	target := &targetChaincode{}
+	stub := &testStub{MockStub: shim.NewMockStub("account2", new(SimpleChaincode))}
+	stub.MockPeerChaincode("accounts", shim.NewMockStub("accounts", target))
+
+	succeed(t, stub.invoke(admin, "set_target", "accounts", ""), "set_target")
+	succeed(t, stub.invoke(admin, "set_allowlist", "accounts", allowed), "set_allowlist")
+	return stub, target
+}
+
+// identity is the serialized identity of a caller with a certificate for name carrying attrs, the way cid reads them
+func identity(t *testing.T, name string, attrs map[string]string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: name}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	err = attrmgr.New().AddAttributesToCert(&attrmgr.Attributes{Attrs: attrs}, template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.ExtraExtensions = template.Extensions	// x509 only writes the extensions of a template from ExtraExtensions
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: "Org1MSP", IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creator
+}
+
+func succeed(t *testing.T, res pb.Response, what string) []byte {
+	t.Helper()
+	if res.Status != shim.OK {
+		t.Fatalf("%s: %s", what, res.Message)
+	}
+	return res.Payload
+}
+
+func fail(t *testing.T, res pb.Response, what string, message string) {
+	t.Helper()
+	if res.Status == shim.OK {
+		t.Fatalf("%s succeeded, want an error containing %q", what, message)
+	}
+	if !strings.Contains(res.Message, message) {
+		t.Fatalf("%s: %q, want an error containing %q", what, res.Message, message)
+	}
+}
+
+func envelope(t *testing.T, payload []byte) Envelope {
+	t.Helper()
+	var envelope Envelope
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		t.Fatalf("Payload %s is not an Envelope: %v", payload, err)
+	}
+	return envelope
+}
+
+func denied(t *testing.T, payload []byte) bool {
+	t.Helper()
+	var response ProxyResponse
+	return json.Unmarshal(payload, &response) == nil && response.Status == DENIED && response.ProxyDenied != nil
+}
+
+// lastEvent is the event of the latest transaction, the others are dropped
+func lastEvent(t *testing.T, stub *testStub) ProxyEvent {
+	t.Helper()
+	var event *pb.ChaincodeEvent
+	for len(stub.ChaincodeEventsChannel) > 0 {
+		event = <-stub.ChaincodeEventsChannel
+	}
+	var proxyEvent ProxyEvent
+	if event == nil || event.EventName != proxyEventName || json.Unmarshal(event.Payload, &proxyEvent) != nil {
+		t.Fatalf("No %s event, got %v", proxyEventName, event)
+	}
+	return proxyEvent
+}
+
+func TestProxyForwarding(t *testing.T) {
+	admin := identity(t, "admin", map[string]string{adminAttribute: "true"})
+	treasurer := identity(t, "treasurer", map[string]string{treasuryAttribute: "true"})
+	stub, target := newTestStub(t, admin, "init_account,read")
+
+	fail(t, stub.invoke(treasurer, "init_account", "1001", "Acme", "EUR", "100.00"), "init_account by a treasurer", "Permission Denied")
+
+	// The target's payload and status come back in the envelope of the response
+	response := envelope(t, succeed(t, stub.invoke(admin, "init_account", "1001", "Acme", "EUR", "100.00"), "init_account"))
+	if response.Code != shim.OK || string(response.Data) != `{"accountNo":"1001","balance":"100.00","currency":"EUR","legalEntity":"acme"}` {
+		t.Fatalf("init_account = %+v (data %s); want the account the target created", response, response.Data)
+	}
+	if want := []string{"init_account", "1001", "acme", "EUR", "100.00"}; !reflect.DeepEqual(target.calls[len(target.calls)-1], want) {
+		t.Fatalf("The target was called with %v, want %v", target.calls[len(target.calls)-1], want)
+	}
+	if event := lastEvent(t, stub); event.TransactionId != fmt.Sprintf("tx%d", stub.txs) || len(event.Calls) != 1 || event.Calls[0].Function != "init_account" || event.Calls[0].Status != OK {
+		t.Fatalf("init_account event = %+v; want one OK init_account call", event)
+	}
+	succeed(t, stub.invoke(admin, "init_account", "1002", "Acme", "EUR", "0.00"), "init_account 1002")
+	succeed(t, stub.invoke(admin, "init_account", "2001", "Acme", "USD", "0.00"), "init_account 2001")
+
+	// An error of the target is an error of the proxy, carrying the target's message
+	res := stub.invoke(admin, "init_account", "1001", "Acme", "EUR", "100.00")
+	fail(t, res, "init_account of an existing account", "Account 1001 already exists")
+	if response := envelope(t, []byte(res.Message)); response.Code != shim.ERROR {
+		t.Fatalf("init_account of an existing account = %+v; want the target's error status", response)
+	}
+
+	// Calls off the allowlist are denied and logged rather than made
+	calls := len(target.calls)
+	if !denied(t, succeed(t, stub.invoke(treasurer, "transfer_balance", "req-1", "1001", "1002", "25.00"), "transfer_balance off the allowlist")) {
+		t.Fatal("transfer_balance off the allowlist was not denied")
+	}
+	for _, call := range target.calls[calls:] {
+		if call[0] == "transfer_balance" {
+			t.Fatalf("transfer_balance off the allowlist reached the target: %v", call)
+		}
+	}
+
+	succeed(t, stub.invoke(admin, "set_allowlist", "accounts", "init_account,read,transfer_balance"), "set_allowlist")
+	fail(t, stub.invoke(admin, "transfer_balance", "req-2", "1001", "1002", "25.00"), "transfer_balance by an admin", "Permission Denied")
+	fail(t, stub.invoke(treasurer, "transfer_balance", "req-2", "1001", "2001", "25.00"), "transfer_balance across currencies", "An FX rate is required")
+
+	payload := succeed(t, stub.invoke(treasurer, "transfer_balance", "req-3", "1001", "1002", "25.00"), "transfer_balance")
+	if response := envelope(t, payload); string(response.Data) != fmt.Sprintf(`{"transactionId":"tx%d","from":"1001","to":"1002","amount":"25.00"}`, stub.txs) {
+		t.Fatalf("transfer_balance = %s; want the target's transfer", response.Data)
+	}
+	if want := []string{"transfer_balance", "1001", "1002", "25.00"}; !reflect.DeepEqual(target.calls[len(target.calls)-1], want) {
+		t.Fatalf("The target was called with %v, want %v", target.calls[len(target.calls)-1], want)
+	}
+
+	// A retry returns the first result without moving the amount again
+	calls = len(target.calls)
+	if retry := succeed(t, stub.invoke(treasurer, "transfer_balance", "req-3", "1001", "1002", "25.00"), "transfer_balance retry"); string(retry) != string(payload) || len(target.calls) != calls {
+		t.Fatalf("transfer_balance retry = %s after %d more calls; want %s and no call", retry, len(target.calls)-calls, payload)
+	}
+}
+
+func TestProxyQuery(t *testing.T) {
+	admin := identity(t, "admin", map[string]string{adminAttribute: "true"})
+	reader := identity(t, "reader", nil)
+	stub, target := newTestStub(t, admin, "query_accounts")
+	other := &targetChaincode{}
+	stub.MockPeerChaincode("accounts/otherchannel", shim.NewMockStub("accounts", other))
+
+	// A selector is passed on as JSON, strings as they are
+	response := envelope(t, succeed(t, stub.invoke(reader, "proxy_query", "accounts", "query_accounts", `[{"selector":{"currency":"EUR"}},"20"]`), "proxy_query"))
+	if want := []string{"query_accounts", `{"selector":{"currency":"EUR"}}`, "20"}; !reflect.DeepEqual(target.calls[len(target.calls)-1], want) {
+		t.Fatalf("The target was called with %v, want %v", target.calls[len(target.calls)-1], want)
+	}
+	if response.Code != shim.OK || string(response.Data) != `["{\"selector\":{\"currency\":\"EUR\"}}","20"]` {
+		t.Fatalf("proxy_query = %+v (data %s); want the target's result", response, response.Data)
+	}
+
+	// Without a chaincode name the configured target answers, and a channel may be named
+	calls := len(target.calls)
+	succeed(t, stub.invoke(reader, "proxy_query", "query_accounts", `[]`), "proxy_query of the configured target")
+	if len(target.calls) != calls+1 {
+		t.Fatal("proxy_query without a chaincode name did not reach the configured target")
+	}
+	succeed(t, stub.invoke(reader, "proxy_query", "accounts", "query_accounts", `["x"]`, "otherchannel"), "proxy_query of another channel")
+	if len(other.calls) != 1 || len(target.calls) != calls+1 {
+		t.Fatalf("proxy_query of another channel made %d calls there and %d here; want 1 and none", len(other.calls), len(target.calls)-calls-1)
+	}
+
+	// Functions off the allowlist are denied, whatever they are
+	if !denied(t, succeed(t, stub.invoke(reader, "proxy_query", "accounts", "init_account", `["1001","acme","EUR","100.00"]`), "proxy_query of init_account")) {
+		t.Fatal("proxy_query of init_account was not denied")
+	}
+	if len(target.calls) != calls+1 {
+		t.Fatalf("proxy_query of init_account reached the target: %v", target.calls[len(target.calls)-1])
+	}
+
+	fail(t, stub.invoke(reader, "proxy_query", "accounts", "query_accounts", `{"selector":{}}`), "proxy_query without an array", "must be a JSON array")
+	fail(t, stub.invoke(reader, "proxy_query", "accounts", "", `[]`), "proxy_query without a function", "2nd argument")
+}
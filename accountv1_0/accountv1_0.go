@@ -9,6 +9,8 @@ import (
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 	"errors"
+
+	"github.com/EnzoX/learn-chaincode/index"
 )
 
 //==============================================================================================================================
@@ -31,7 +33,9 @@ type Account struct{
 	Balance string `json:"balance"`
 }
 
-var accountIndexStr = "_accountindex"	  // Define an index varibale to track all the accounts stored in the world state
+const accountIndexName = "account"	  // Index of every account stored in the world state
+
+var accountIndexStr = "_accountindex"	  // Key of the JSON array of accounts kept by earlier versions
 
 // ============================================================================================================================
 //  Main - main - Starts up the chaincode
@@ -69,9 +73,8 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 		return shim.Error(err.Error())
 	}
 	
-	var empty []string
-	jsonAsBytes, _ := json.Marshal(empty)								//marshal an emtpy array of strings to clear the account index
-	err = stub.PutState(accountIndexStr, jsonAsBytes)
+	// Move the account index of an upgraded version onto composite keys
+	err = t.migrate_account_index(stub)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -79,6 +82,29 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	return shim.Success(nil)
 }
 
+// ============================================================================================================================
+// Migrate Account Index - Add every account of the JSON array index to the composite key index and remove the array
+// ============================================================================================================================
+func (t *SimpleChaincode) migrate_account_index(stub shim.ChaincodeStubInterface) error {
+	accountsAsBytes, err := stub.GetState(accountIndexStr)
+	if err != nil {
+		return errors.New("Failed to get account index")
+	}
+	if accountsAsBytes == nil {
+		return nil
+	}
+	var accountIndex []string
+	json.Unmarshal(accountsAsBytes, &accountIndex)
+
+	for _, accountNo := range accountIndex {
+		err = index.CreateIndex(stub, accountIndexName, []string{accountNo})
+		if err != nil {
+			return err
+		}
+	}
+	return stub.DelState(accountIndexStr)
+}
+
 // ============================================================================================================================
 // Invoke - Called on chaincode invoke. Takes a function name passed and calls that function. Converts some
 //		    initial arguments passed to other things for use in the called function.
@@ -146,23 +172,11 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 		return shim.Error("Failed to delete state")
 	}
 
-	//get the account index
-	accountsAsBytes, err := stub.GetState(accountIndexStr)
-	if err != nil {
-		return shim.Error("Failed to get account index")
-	}
-	var accountIndex []string
-	json.Unmarshal(accountsAsBytes, &accountIndex)						
-	
 	//remove account from index
-	for i,val := range accountIndex{
-		if val == name{															//find the correct account
-			accountIndex = append(accountIndex[:i], accountIndex[i+1:]...)			//remove it
-			break
-		}
+	err = index.RemoveIndex(stub, accountIndexName, []string{name})
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	jsonAsBytes, _ := json.Marshal(accountIndex)									//save the new index
-	err = stub.PutState(accountIndexStr, jsonAsBytes)
 	return shim.Success(nil)
 }
 
@@ -243,19 +257,12 @@ func (t *SimpleChaincode) init_account(stub shim.ChaincodeStubInterface, args []
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-		
-	//get the account index
-	accountsAsBytes, err := stub.GetState(accountIndexStr)
+
+	//append the index
+	err = index.CreateIndex(stub, accountIndexName, []string{accountNo})
 	if err != nil {
-		return shim.Error("Failed to get account index")
+		return shim.Error(err.Error())
 	}
-	var accountIndex []string
-	json.Unmarshal(accountsAsBytes, &accountIndex)							
-	
-	//append the index 
-	accountIndex = append(accountIndex, accountNo)	
-	jsonAsBytes, _ := json.Marshal(accountIndex)
-	err = stub.PutState(accountIndexStr, jsonAsBytes)						
 
 	return shim.Success(nil)
 }
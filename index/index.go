@@ -0,0 +1,110 @@
+package index
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+//==============================================================================================================================
+//	Index - Secondary indexes kept as composite keys, one key per entry: indexName~attribute~...~id with an empty
+//			value. Unlike a JSON array of IDs under a single key, adding or removing an entry never reads or rewrites
+//			the other entries, so concurrent transactions touching different records do not conflict on the index.
+//			The indexed record is normally named by the last attribute, e.g. "owner~status~invoice".
+//==============================================================================================================================
+
+var emptyValue = []byte{0x00}			// Value of every index entry, the key holds all the information
+
+// ============================================================================================================================
+// CreateIndex - Add the entry of a record to an index. Adding an entry that already exists does nothing.
+// ============================================================================================================================
+func CreateIndex(stub shim.ChaincodeStubInterface, indexName string, attributes []string) error {
+	key, err := stub.CreateCompositeKey(indexName, attributes)
+	if err != nil {
+		return fmt.Errorf("Error building %s index key: %s", indexName, err)
+	}
+	err = stub.PutState(key, emptyValue)
+	if err != nil {
+		return fmt.Errorf("Error storing %s index", indexName)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// RemoveIndex - Remove the entry of a record from an index. Removing an entry that does not exist does nothing.
+// ============================================================================================================================
+func RemoveIndex(stub shim.ChaincodeStubInterface, indexName string, attributes []string) error {
+	key, err := stub.CreateCompositeKey(indexName, attributes)
+	if err != nil {
+		return fmt.Errorf("Error building %s index key: %s", indexName, err)
+	}
+	err = stub.DelState(key)
+	if err != nil {
+		return fmt.Errorf("Error removing %s index", indexName)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// QueryByPartialKey - The attributes of the entries of an index that start with the given attributes, in key order.
+//					   With a page size of 0 every entry is returned. A positive page size returns at most that many
+//					   entries from the bookmark on, together with the bookmark of the next page ("" once there are no
+//					   more). Fabric only allows paging in queries, not in transactions that write.
+// ============================================================================================================================
+func QueryByPartialKey(stub shim.ChaincodeStubInterface, indexName string, attributes []string, pageSize int32, bookmark string) ([][]string, string, error) {
+	var iter shim.StateQueryIteratorInterface
+	var metadata *pb.QueryResponseMetadata
+	var err error
+
+	if pageSize > 0 {
+		iter, metadata, err = stub.GetStateByPartialCompositeKeyWithPagination(indexName, attributes, pageSize, bookmark)
+	} else {
+		iter, err = stub.GetStateByPartialCompositeKey(indexName, attributes)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to query the %s index", indexName)
+	}
+	defer iter.Close()
+
+	entries := [][]string{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, "", fmt.Errorf("Unable to read the %s index", indexName)
+		}
+		_, keys, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(keys) == 0 {
+			return nil, "", fmt.Errorf("Corrupt %s index key", indexName)
+		}
+		entries = append(entries, keys)
+	}
+
+	next := ""
+	if metadata != nil && int32(len(entries)) == pageSize {
+		next = metadata.Bookmark
+	}
+	return entries, next, nil
+}
+
+// ============================================================================================================================
+// Last - The last attribute of each entry, normally the ID of the indexed record
+// ============================================================================================================================
+func Last(entries [][]string) []string {
+	ids := []string{}
+	for _, keys := range entries {
+		ids = append(ids, keys[len(keys)-1])
+	}
+	return ids
+}
+
+// ============================================================================================================================
+// IDs - The IDs of the records under the entries of an index that start with the given attributes, unpaged
+// ============================================================================================================================
+func IDs(stub shim.ChaincodeStubInterface, indexName string, attributes ...string) ([]string, error) {
+	entries, _, err := QueryByPartialKey(stub, indexName, attributes, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	return Last(entries), nil
+}
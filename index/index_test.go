@@ -0,0 +1,138 @@
+package index
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// pagingStub adds the paged partial key query MockStub leaves unimplemented. Like CouchDB it hands out a bookmark
+// with every page, the last page included, so the tests show QueryByPartialKey only passes it on for full pages.
+type pagingStub struct {
+	*shim.MockStub
+}
+
+type sliceIterator struct {
+	kvs []*queryresult.KV
+}
+
+func (it *sliceIterator) HasNext() bool { return len(it.kvs) > 0 }
+func (it *sliceIterator) Close() error  { return nil }
+func (it *sliceIterator) Next() (*queryresult.KV, error) {
+	kv := it.kvs[0]
+	it.kvs = it.kvs[1:]
+	return kv, nil
+}
+
+func (stub pagingStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer iter.Close()
+
+	page := &sliceIterator{}
+	next := bookmark
+	for iter.HasNext() && int32(len(page.kvs)) < pageSize {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if bookmark != "" && kv.Key <= bookmark {
+			continue
+		}
+		page.kvs = append(page.kvs, kv)
+		next = kv.Key
+	}
+	return page, &pb.QueryResponseMetadata{FetchedRecordsCount: int32(len(page.kvs)), Bookmark: next}, nil
+}
+
+func newStub(t *testing.T, entries ...[]string) pagingStub {
+	stub := pagingStub{shim.NewMockStub("index", nil)}
+	stub.MockTransactionStart("setup")
+	defer stub.MockTransactionEnd("setup")
+
+	for _, attributes := range entries {
+		if err := CreateIndex(stub, "owner~invoice", attributes); err != nil {
+			t.Fatalf("CreateIndex(%v): %v", attributes, err)
+		}
+	}
+	return stub
+}
+
+func TestCreateRemoveIndex(t *testing.T) {
+	stub := newStub(t, []string{"alice", "INV-2"}, []string{"alice", "INV-1"}, []string{"bob", "INV-3"})
+
+	ids, err := IDs(stub, "owner~invoice", "alice")
+	if err != nil || !reflect.DeepEqual(ids, []string{"INV-1", "INV-2"}) {
+		t.Fatalf("IDs(alice) = %v, %v; want [INV-1 INV-2]", ids, err)
+	}
+
+	stub.MockTransactionStart("tx1")
+	if err := CreateIndex(stub, "owner~invoice", []string{"alice", "INV-1"}); err != nil {
+		t.Fatalf("CreateIndex of an existing entry: %v", err)
+	}
+	if err := RemoveIndex(stub, "owner~invoice", []string{"alice", "INV-2"}); err != nil {
+		t.Fatalf("RemoveIndex: %v", err)
+	}
+	if err := RemoveIndex(stub, "owner~invoice", []string{"carol", "INV-9"}); err != nil {
+		t.Fatalf("RemoveIndex of a missing entry: %v", err)
+	}
+	stub.MockTransactionEnd("tx1")
+
+	ids, err = IDs(stub, "owner~invoice", "alice")
+	if err != nil || !reflect.DeepEqual(ids, []string{"INV-1"}) {
+		t.Fatalf("IDs(alice) after removal = %v, %v; want [INV-1]", ids, err)
+	}
+	ids, err = IDs(stub, "owner~invoice", "bob")
+	if err != nil || !reflect.DeepEqual(ids, []string{"INV-3"}) {
+		t.Fatalf("IDs(bob) = %v, %v; want [INV-3]", ids, err)
+	}
+	ids, err = IDs(stub, "owner~invoice", "carol")
+	if err != nil || len(ids) != 0 {
+		t.Fatalf("IDs(carol) = %v, %v; want none", ids, err)
+	}
+
+	entries, _, err := QueryByPartialKey(stub, "owner~invoice", []string{}, 0, "")
+	want := [][]string{{"alice", "INV-1"}, {"bob", "INV-3"}}
+	if err != nil || !reflect.DeepEqual(entries, want) {
+		t.Fatalf("QueryByPartialKey of every entry = %v, %v; want %v", entries, err, want)
+	}
+}
+
+func TestQueryByPartialKeyPaging(t *testing.T) {
+	stub := newStub(t, []string{"alice", "INV-1"}, []string{"alice", "INV-2"}, []string{"alice", "INV-3"}, []string{"alice", "INV-4"}, []string{"alice", "INV-5"}, []string{"bob", "INV-6"})
+
+	tests := []struct {
+		pageSize int32
+		pages    [][]string
+	}{
+		{2, [][]string{{"INV-1", "INV-2"}, {"INV-3", "INV-4"}, {"INV-5"}}},
+		{5, [][]string{{"INV-1", "INV-2", "INV-3", "INV-4", "INV-5"}, {}}},
+		{10, [][]string{{"INV-1", "INV-2", "INV-3", "INV-4", "INV-5"}}},
+	}
+	for _, test := range tests {
+		bookmark := ""
+		for i, want := range test.pages {
+			entries, next, err := QueryByPartialKey(stub, "owner~invoice", []string{"alice"}, test.pageSize, bookmark)
+			if err != nil {
+				t.Fatalf("page size %d, page %d: %v", test.pageSize, i, err)
+			}
+			if ids := Last(entries); !reflect.DeepEqual(ids, want) {
+				t.Errorf("page size %d, page %d = %v; want %v", test.pageSize, i, ids, want)
+			}
+
+			last := i == len(test.pages)-1
+			if last && next != "" {
+				t.Errorf("page size %d, page %d: bookmark %q on a page that is not full", test.pageSize, i, next)
+			}
+			if !last && next == "" {
+				t.Fatalf("page size %d, page %d: no bookmark on a full page", test.pageSize, i)
+			}
+			bookmark = next
+		}
+	}
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"encoding/json"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	pb "github.com/hyperledger/fabric/protos/peer"
+
+	"github.com/EnzoX/learn-chaincode/index"
+	"github.com/EnzoX/learn-chaincode/money"
 )
 
 //==============================================================================================================================
@@ -32,9 +41,420 @@ type Account struct{
 	Activity string `json:"activity"`
 	PeriodToDateBalance string `json:"periodToDateBalance"`
 	TransactionType string `json:"transactionType"`
+	AccountName string `json:"accountName,omitempty"`
+	Changes []AccountChange `json:"changes,omitempty"`
+	TransactionCount int `json:"transactionCount"`
+	Status string `json:"status,omitempty"`
+	AllowNegative *bool `json:"allowNegative,omitempty"`
+	CreditLimit string `json:"creditLimit,omitempty"`
+	Tags []string `json:"tags,omitempty"`
+	NoOverdraft bool `json:"noOverdraft,omitempty"`		// Written by version 4 and earlier, read as allowNegative false
+}
+
+//==============================================================================================================================
+//	AccountChange - One entry in the change history of an account, written by update_account each time a descriptive
+//					field is corrected.
+//==============================================================================================================================
+type AccountChange struct{
+	Field string `json:"field"`
+	OldValue string `json:"oldValue"`
+	NewValue string `json:"newValue"`
+	ChangedBy string `json:"changedBy"`
+	TxID string `json:"txId"`
+	Timestamp string `json:"timestamp"`
+}
+
+//==============================================================================================================================
+//	Transaction - A single posting against an account. Every change to an account's activity is recorded as one of these
+//				  so that it can be traced, reversed and replayed. Stored under the composite key
+//				  transaction~accountNo~sequence and addressed by clients through its TransactionId.
+//==============================================================================================================================
+type Transaction struct{
+	TransactionId string `json:"transactionId"`
+	AccountNo string `json:"accountNo"`
+	Period string `json:"period"`
+	Type string `json:"type"`
+	Amount string `json:"amount"`
+	BalanceAfter string `json:"balanceAfter"`
+	ReversalOf string `json:"reversalOf,omitempty"`
+	ReversedBy string `json:"reversedBy,omitempty"`
+	PostingId string `json:"postingId,omitempty"`		// The pending posting this transaction applies once approved
+	LinkedTransactionId string `json:"linkedTransactionId,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Memo string `json:"memo,omitempty"`
+	References []string `json:"references,omitempty"`
+	DocumentHashes []string `json:"documentHashes,omitempty"`
+	Tags []string `json:"tags,omitempty"`
+	PostedBy string `json:"postedBy"`
+	TxID string `json:"txId"`
+	Timestamp string `json:"timestamp"`
+}
+
+//	Transaction types
+const ACTIVITY = "activity"
+const REVERSAL = "reversal"
+const ADJUSTMENT = "adjustment"
+const REVALUATION = "revaluation"
+const NETTING = "netting"
+const RECURRING = "recurring"
+const CLOSING_TRANSFER = "closing-transfer"
+const TRANSFER = "transfer"
+
+//	Account statuses, an account without a status is open
+const CLOSED = "Closed"
+
+//	Netting proposal statuses
+const NETTING_PROPOSED = "proposed"
+const NETTING_EXECUTED = "executed"
+
+//	Reconciliation statuses
+const UNRECONCILED = "unreconciled"
+const RECONCILED = "reconciled"
+const REQUIRES_REVIEW = "requires-review"
+
+//	Posting response statuses, besides PENDING and PARKED
+const POSTED = "posted"
+
+//	Error queue entry statuses
+const PARKED = "parked"
+const REPOSTED = "reposted"
+
+//	Pending posting statuses
+const PENDING = "pending"
+const APPROVED = "approved"
+const REJECTED = "rejected"
+
+//	Recurring template frequencies
+const MONTHLY = "monthly"
+const QUARTERLY = "quarterly"
+const YEARLY = "yearly"
+
+//	Error codes prefixed to the message of postings rejected by the limit controls
+const NEGATIVE_BALANCE_NOT_ALLOWED = "NEGATIVE_BALANCE_NOT_ALLOWED"
+const CREDIT_LIMIT_EXCEEDED = "CREDIT_LIMIT_EXCEEDED"
+const APPROVAL_REQUIRED = "APPROVAL_REQUIRED"
+
+//	Returned, wrapped, by check_posting for postings above the approval threshold. Callers that can hold the posting as a
+//	PendingPosting instead look for it with errors.Is.
+var errApprovalRequired = errors.New(APPROVAL_REQUIRED)
+
+//	Transaction types posted without going through the approval threshold. Adjustments and revaluations are admin-only,
+//	adjustments carry a mandatory reason and revaluations are computed from the rates rather than entered, and nettings
+//	only execute once an identity of each entity has confirmed them. Postings of every other type above the threshold,
+//	including the reversal of a transaction that was not exempt, are held as a PendingPosting until approved.
+var approvalExemptTypes = map[string]bool{ADJUSTMENT: true, REVALUATION: true, NETTING: true}
+
+//==============================================================================================================================
+//	AdminAction - Audit record written every time the raw write or delete functions are used
+//==============================================================================================================================
+type AdminAction struct{
+	Action string `json:"action"`
+	Key string `json:"key"`
+	PreviousValue string `json:"previousValue"`
+	NewValue string `json:"newValue,omitempty"`
+	PerformedBy string `json:"performedBy"`
+	TxID string `json:"txId"`
+	Timestamp string `json:"timestamp"`
+}
+
+//==============================================================================================================================
+//	Config - Deployment configuration. RawAccessDisabled switches off the raw write and delete functions and is set by
+//			 passing "production" as the second argument when instantiating or upgrading. ApprovalThresholds holds the
+//			 approval threshold of each currency that has one, postings above it wait for an approver, see
+//			 set_approval_threshold.
+//==============================================================================================================================
+type Config struct{
+	RawAccessDisabled bool `json:"rawAccessDisabled"`
+	ApprovalThresholds map[string]string `json:"approvalThresholds,omitempty"`
+}
+
+//==============================================================================================================================
+//	Statement - The transactions of one account for one period, each with the running balance after it was posted.
+//				Returned by get_statement.
+//==============================================================================================================================
+type Statement struct{
+	AccountNo string `json:"accountNo"`
+	Currency string `json:"currency"`
+	Period string `json:"period"`
+	OpeningBalance string `json:"openingBalance"`
+	Lines []StatementLine `json:"lines"`
+	ClosingBalance string `json:"closingBalance"`
+}
+
+type StatementLine struct{
+	TransactionId string `json:"transactionId"`
+	Type string `json:"type"`
+	Timestamp string `json:"timestamp"`
+	Amount string `json:"amount"`
+	RunningBalance string `json:"runningBalance"`
+	ReversalOf string `json:"reversalOf,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+//==============================================================================================================================
+//	Revaluation - Period end revaluation of every account held in one foreign currency. Keeps the rates and the original
+//				  balances it was computed from; the unrealized difference is a single transaction on the revaluation
+//				  account which reverse_transaction undoes at the start of the next period. Period is the period of the
+//				  revaluation account, each currency is revalued at most once per period.
+//==============================================================================================================================
+type Revaluation struct{
+	RevaluationId string `json:"revaluationId"`
+	Currency string `json:"currency"`
+	Period string `json:"period"`
+	ClosingRate string `json:"closingRate"`
+	BookRate string `json:"bookRate"`
+	RevaluationAccountNo string `json:"revaluationAccountNo"`
+	Entries []RevaluationEntry `json:"entries"`
+	TotalDifference string `json:"totalDifference"`
+	TransactionId string `json:"transactionId"`
+	Timestamp string `json:"timestamp"`
+}
+
+type RevaluationEntry struct{
+	AccountNo string `json:"accountNo"`
+	OriginalBalance string `json:"originalBalance"`
+	BookValue string `json:"bookValue"`
+	RevaluedBalance string `json:"revaluedBalance"`
+	Difference string `json:"difference"`
+}
+
+//==============================================================================================================================
+//	NettingProposal - The net position between two entities in one currency across all their mutual accounts. Lines
+//					  record each account's balance when proposed and the offset that execute_netting will post; the
+//					  netting only executes once an identity of each entity has confirmed it.
+//==============================================================================================================================
+type NettingProposal struct{
+	ProposalId string `json:"proposalId"`
+	EntityA string `json:"entityA"`
+	EntityB string `json:"entityB"`
+	Currency string `json:"currency"`
+	Lines []NettingLine `json:"lines"`
+	TotalAToB string `json:"totalAToB"`
+	TotalBToA string `json:"totalBToA"`
+	NetAmount string `json:"netAmount"`
+	NetDebtor string `json:"netDebtor"`
+	Status string `json:"status"`
+	ProposedBy string `json:"proposedBy"`
+	ConfirmedByA string `json:"confirmedByA,omitempty"`
+	ConfirmedByB string `json:"confirmedByB,omitempty"`
+	TransactionIds []string `json:"transactionIds,omitempty"`
+}
+
+type NettingLine struct{
+	AccountNo string `json:"accountNo"`
+	DueFrom string `json:"dueFrom"`
+	DueTo string `json:"dueTo"`
+	Balance string `json:"balance"`
+	Offset string `json:"offset"`
+}
+
+//==============================================================================================================================
+//	Reconciliation - The reconciliation status of one account for one period. Set to reconciled by mark_reconciled and
+//					 flipped to requires-review when a later posting lands in the reconciled period.
+//==============================================================================================================================
+type Reconciliation struct{
+	AccountNo string `json:"accountNo"`
+	Period string `json:"period"`
+	Status string `json:"status"`
+	ReconciledBy string `json:"reconciledBy,omitempty"`
+	Reference string `json:"reference,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+	ReviewTransactionId string `json:"reviewTransactionId,omitempty"`
+}
+
+//==============================================================================================================================
+//	RecurringTemplate - A standing posting (e.g. a monthly management fee recharge) that run_recurring posts once in every
+//						period it is due. Quarterly and yearly templates need period labels of the form YYYY-MM.
+//==============================================================================================================================
+type RecurringTemplate struct{
+	TemplateId string `json:"templateId"`
+	AccountNo string `json:"accountNo"`
+	Amount string `json:"amount"`
+	Memo string `json:"memo"`
+	Frequency string `json:"frequency"`
+	CreatedBy string `json:"createdBy"`
+}
+
+//==============================================================================================================================
+//	AccountEvent - Payload of the events emitted by create_account, transaction_activity, next_period and delete so that
+//				   downstream systems can replicate balances. Before is absent on creation and After on deletion. Tags
+//				   are the account's subscriber tags, for event routers to fan the event out on.
+//==============================================================================================================================
+type AccountEvent struct{
+	AccountNo string `json:"accountNo"`
+	Tags []string `json:"tags,omitempty"`
+	TransactionId string `json:"transactionId,omitempty"`
+	Before *AccountBalances `json:"before,omitempty"`
+	After *AccountBalances `json:"after,omitempty"`
+}
+
+type AccountBalances struct{
+	Period string `json:"period"`
+	OpeningBalance string `json:"openingBalance"`
+	Activity string `json:"activity"`
+	PeriodToDateBalance string `json:"periodToDateBalance"`
+}
+
+//==============================================================================================================================
+//	BulkResult - Outcome of one account definition passed to bulk_create_accounts
+//==============================================================================================================================
+type BulkResult struct{
+	Index int `json:"index"`
+	AccountNo string `json:"accountNo"`
+	Created bool `json:"created"`
+	PostingId string `json:"postingId,omitempty"`		// The pending posting holding the activity when above the approval threshold
+	Error string `json:"error,omitempty"`
+}
+
+//==============================================================================================================================
+//	AccountPage - One page of accounts returned by the account queries. Bookmark is passed back to fetch the next page
+//				  and is empty once there are no more results.
+//==============================================================================================================================
+type AccountPage struct{
+	Records []Account `json:"records"`
+	FetchedRecordsCount int32 `json:"fetchedRecordsCount"`
+	Bookmark string `json:"bookmark"`
+}
+
+//==============================================================================================================================
+//	AccountVersion - One historical version of an account record as returned by get_account_history
+//==============================================================================================================================
+type AccountVersion struct{
+	TxID string `json:"txId"`
+	Timestamp string `json:"timestamp"`
+	IsDelete bool `json:"isDelete"`
+	Account *Account `json:"account,omitempty"`
+}
+
+//==============================================================================================================================
+//	BalanceAt - Balances of an account as of a point in time, reconstructed by get_balance_at
+//==============================================================================================================================
+type BalanceAt struct{
+	AccountNo string `json:"accountNo"`
+	AsOf string `json:"asOf"`
+	TxID string `json:"txId"`
+	Timestamp string `json:"timestamp"`
+	Balances *AccountBalances `json:"balances"`
+}
+
+//==============================================================================================================================
+//	PendingPosting - A posting above the approval threshold, held back until an identity with the approver attribute
+//					 approves it. Only then does the account balance change. Type is the type of the transaction to post
+//					 (activity when empty); transfers and closing transfers debit AccountNo and credit ToAccountNo.
+//					 RequestReason is the reason given with the request and Reason the reason of the decision.
+//==============================================================================================================================
+type PendingPosting struct{
+	PostingId string `json:"postingId"`
+	Type string `json:"type,omitempty"`
+	AccountNo string `json:"accountNo"`
+	ToAccountNo string `json:"toAccountNo,omitempty"`
+	Amount string `json:"amount"`
+	ReversalOf string `json:"reversalOf,omitempty"`
+	Memo string `json:"memo,omitempty"`
+	RequestReason string `json:"requestReason,omitempty"`
+	References []string `json:"references,omitempty"`
+	DocumentHashes []string `json:"documentHashes,omitempty"`
+	Status string `json:"status"`
+	RequestedBy string `json:"requestedBy"`
+	RequestedAt string `json:"requestedAt"`
+	DecidedBy string `json:"decidedBy,omitempty"`
+	DecidedAt string `json:"decidedAt,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	TransactionId string `json:"transactionId,omitempty"`
+}
+
+//==============================================================================================================================
+//	MigrationResult - Summary returned by migrate_accounts
+//==============================================================================================================================
+type MigrationResult struct{
+	FromVersion int `json:"fromVersion"`
+	ToVersion int `json:"toVersion"`
+	Migrated []string `json:"migrated"`
+}
+
+//==============================================================================================================================
+//	ErrorQueueEntry - A posting that could not be applied because its account does not exist. Kept with everything needed
+//					  to replay it, and linked to the transaction it became once reposted.
+//==============================================================================================================================
+type ErrorQueueEntry struct{
+	EntryId string `json:"entryId"`
+	AccountNo string `json:"accountNo"`
+	Amount string `json:"amount"`
+	References []string `json:"references,omitempty"`
+	DocumentHashes []string `json:"documentHashes,omitempty"`
+	Error string `json:"error"`
+	Status string `json:"status"`
+	ParkedBy string `json:"parkedBy"`
+	ParkedAt string `json:"parkedAt"`
+	RepostedBy string `json:"repostedBy,omitempty"`
+	RepostedAt string `json:"repostedAt,omitempty"`
+	RepostedToAccountNo string `json:"repostedToAccountNo,omitempty"`
+	TransactionId string `json:"transactionId,omitempty"`
+	PostingId string `json:"postingId,omitempty"`
+}
+
+//==============================================================================================================================
+//	LimitUtilization - An account's period-to-date balance as a percentage of its credit limit
+//==============================================================================================================================
+type LimitUtilization struct{
+	AccountNo string `json:"accountNo"`
+	Currency string `json:"currency"`
+	CreditLimit string `json:"creditLimit"`
+	PeriodToDateBalance string `json:"periodToDateBalance"`
+	Utilization string `json:"utilization"`
+}
+
+//==============================================================================================================================
+//	PostingResponse - Payload returned by transaction_activity and approve_posting, and by the other functions that post
+//					  when they hold a posting for approval. Status tells which of the other fields are set: posted
+//					  carries the account as updated by the posting and its transaction (the debit of a transfer),
+//					  pending the PendingPosting waiting for approval and parked the ErrorQueueEntry.
+//==============================================================================================================================
+type PostingResponse struct{
+	Status string `json:"status"`
+	Account *Account `json:"account,omitempty"`
+	Transaction *Transaction `json:"transaction,omitempty"`
+	PendingPosting *PendingPosting `json:"pendingPosting,omitempty"`
+	ErrorQueueEntry *ErrorQueueEntry `json:"errorQueueEntry,omitempty"`
+}
+
+//==============================================================================================================================
+//	ControlTotals - Totals over all accounts held in one currency, returned by get_control_totals. OutOfBalance
+//					lists the accounts whose opening balance plus activity does not equal their period-to-date balance.
+//==============================================================================================================================
+type ControlTotals struct{
+	Currency string `json:"currency"`
+	AccountCount int `json:"accountCount"`
+	OpeningBalance string `json:"openingBalance"`
+	Activity string `json:"activity"`
+	PeriodToDateBalance string `json:"periodToDateBalance"`
+	OutOfBalance []string `json:"outOfBalance"`
 }
 
-var accountIndexStr = "_accountindex"	  // Define an index varibale to track all the accounts stored in the world state
+const transactionPrefix = "transaction"	// Object type of the composite key transactions are stored under
+const adminActionPrefix = "adminaction"	// Object type of the composite key admin actions are stored under
+const revaluationPrefix = "revaluation"	// Object type of the composite key revaluations are stored under
+const revaluationRunPrefix = "revaluationrun"	// Object type of the composite key marking a currency as revalued for a period (period~currency)
+const nettingPrefix = "netting"			// Object type of the composite key netting proposals are stored under
+const reconciliationPrefix = "reconciliation"	// Object type of the composite key reconciliations are stored under (period~accountNo)
+const recurringPrefix = "recurring"		// Object type of the composite key recurring templates are stored under
+const recurringRunPrefix = "recurringrun"	// Object type of the composite key marking a template as run for a period
+const entityAttribute = "entity"		// Certificate attribute holding the entity code an identity acts for
+const entityAccountPrefix = "entity~account"	// Object type of the composite key indexing accounts by due to/due from entity
+const adminAttribute = "admin"			// Certificate attribute that must be "true" for admin-only functions
+const approverAttribute = "approver"	// Certificate attribute that must be "true" to approve or reject pending postings
+const pendingPostingPrefix = "pendingposting"	// Object type of the composite key pending postings are stored under
+const errorQueuePrefix = "errorqueue"	// Object type of the composite key error queue entries are stored under
+const referenceTransactionPrefix = "reference~transaction"	// Object type of the composite key indexing transactions by reference number
+const configStr = "_config"				// Key the deployment configuration is stored under
+const schemaVersionStr = "_schemaversion"	// Key the schema version of the stored accounts is kept under
+const accountSchemaVersion = 5			// Version 1 accounts were written with "accountno" instead of "accountNo",
+										// version 2 stored amounts in scientific notation ("4.5E+04"), version 3
+										// stored every currency with 2 decimals, version 4 could carry noOverdraft
+										// instead of allowNegative
+
+const accountIndexName = "account"		// Index of every account number stored in the world state
+const legacyAccountIndexStr = "_accountindex"	// Key of the JSON array of account numbers kept by earlier versions
 
 // ============================================================================================================================
 //  Main - main - Starts up the chaincode
@@ -56,8 +476,8 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	var Aval int
 	var err error
 
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting a single integer")
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting a single integer and optionally \"production\"")
 	}
 
 	// Initialize the chaincode
@@ -71,10 +491,27 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+
+	// Move the account index of an upgraded version onto composite keys
+	err = t.migrate_account_index(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	
-	var empty []string
-	jsonAsBytes, _ := json.Marshal(empty)								//marshal an emtpy array of strings to clear the account index
-	err = stub.PutState(accountIndexStr, jsonAsBytes)
+	// Raw write and delete stay available unless the deployment is marked as production
+	config, err := t.get_config(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	config.RawAccessDisabled = false
+	if len(args) == 2 {
+		if args[1] != "production" {
+			return shim.Error("Expecting \"production\" as the optional second argument to Init()")
+		}
+		config.RawAccessDisabled = true
+	}
+	jsonAsBytes, _ := json.Marshal(config)
+	err = stub.PutState(configStr, jsonAsBytes)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -91,6 +528,10 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
 	// Handle different functions
 	if function == "init" {					   //initialize the chaincode state, used as reset
+		err := t.check_raw_access(stub, "init")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
 		return t.Init(stub)
 	} else if function == "delete" {									
 		return t.delete(stub, args)	
@@ -104,6 +545,72 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.transaction_activity(stub, args)										
 	} else if function == "next_period" {									
 		return t.next_period(stub, args)										
+	} else if function == "update_account" {
+		return t.update_account(stub, args)
+	} else if function == "reverse_transaction" {
+		return t.reverse_transaction(stub, args)
+	} else if function == "adjust_balance" {
+		return t.adjust_balance(stub, args)
+	} else if function == "get_admin_actions" {
+		return t.get_admin_actions(stub, args)
+	} else if function == "get_statement" {
+		return t.get_statement(stub, args)
+	} else if function == "revalue" {
+		return t.revalue(stub, args)
+	} else if function == "get_revaluation" {
+		return t.get_revaluation(stub, args)
+	} else if function == "propose_netting" {
+		return t.propose_netting(stub, args)
+	} else if function == "execute_netting" {
+		return t.execute_netting(stub, args)
+	} else if function == "mark_reconciled" {
+		return t.mark_reconciled(stub, args)
+	} else if function == "get_unreconciled" {
+		return t.get_unreconciled(stub, args)
+	} else if function == "create_recurring_template" {
+		return t.create_recurring_template(stub, args)
+	} else if function == "get_recurring_templates" {
+		return t.get_recurring_templates(stub, args)
+	} else if function == "run_recurring" {
+		return t.run_recurring(stub, args)
+	} else if function == "close_account" {
+		return t.close_account(stub, args)
+	} else if function == "bulk_create_accounts" {
+		return t.bulk_create_accounts(stub, args)
+	} else if function == "get_accounts_by_entity" {
+		return t.get_accounts_by_entity(stub, args)
+	} else if function == "query_accounts_by_type" {
+		return t.query_accounts(stub, "transactionType", args)
+	} else if function == "query_accounts_by_currency" {
+		return t.query_accounts(stub, "currency", args)
+	} else if function == "get_account_history" {
+		return t.get_account_history(stub, args)
+	} else if function == "get_balance_at" {
+		return t.get_balance_at(stub, args)
+	} else if function == "transfer_between_accounts" {
+		return t.transfer_between_accounts(stub, args)
+	} else if function == "set_approval_threshold" {
+		return t.set_approval_threshold(stub, args)
+	} else if function == "approve_posting" {
+		return t.approve_posting(stub, args)
+	} else if function == "reject_posting" {
+		return t.reject_posting(stub, args)
+	} else if function == "get_pending_postings" {
+		return t.get_pending_postings(stub, args)
+	} else if function == "get_transactions_by_reference" {
+		return t.get_transactions_by_reference(stub, args)
+	} else if function == "migrate_accounts" {
+		return t.migrate_accounts(stub, args)
+	} else if function == "list_error_queue" {
+		return t.list_error_queue(stub, args)
+	} else if function == "repost_from_queue" {
+		return t.repost_from_queue(stub, args)
+	} else if function == "get_accounts_near_limit" {
+		return t.get_accounts_near_limit(stub, args)
+	} else if function == "tag_account" {
+		return t.tag_account(stub, args)
+	} else if function == "get_control_totals" {
+		return t.get_control_totals(stub, args)
 	}
 
 	return shim.Error("Received unknown invoke function name - '" + function + "'")
@@ -138,7 +645,8 @@ func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string)
 }
 
 // ============================================================================================================================
-// Delete - remove a key/value pair from the world state
+// Delete - remove a key/value pair from the world state. Admin-only, logged as an AdminAction and unavailable in
+//			production deployments.
 // ============================================================================================================================
 func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
@@ -146,33 +654,51 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 	}
 	
 	name := args[0]
-	err := stub.DelState(name)													//remove the key from chaincode state
+	err := t.check_raw_access(stub, "delete")
 	if err != nil {
-		return shim.Error("Failed to delete state")
+		return shim.Error(err.Error())
+	}
+	err = t.log_admin_action(stub, "delete", name, "")
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	//get the account index
-	accountsAsBytes, err := stub.GetState(accountIndexStr)
+	// Deleting an account is announced with its last balances, other keys have none
+	event := AccountEvent{AccountNo: name}
+	accountAsBytes, err := stub.GetState(name)
 	if err != nil {
-		return shim.Error("Failed to get account index")
+		return shim.Error("Failed to get state for " + name)
 	}
-	var accountIndex []string
-	json.Unmarshal(accountsAsBytes, &accountIndex)						
-	
-	//remove account from index
-	for i,val := range accountIndex{
-		if val == name{															//find the correct account
-			accountIndex = append(accountIndex[:i], accountIndex[i+1:]...)			//remove it
-			break
+	res := Account{}
+	if json.Unmarshal(accountAsBytes, &res) == nil && res.AccountNo == name {
+		event.Tags = res.Tags
+		event.Before = t.balances_of(res)
+		err = t.unindex_account(stub, res)
+		if err != nil {
+			return shim.Error(err.Error())
 		}
 	}
-	jsonAsBytes, _ := json.Marshal(accountIndex)									//save the new index
-	err = stub.PutState(accountIndexStr, jsonAsBytes)
+
+	err = stub.DelState(name)													//remove the key from chaincode state
+	if err != nil {
+		return shim.Error("Failed to delete state")
+	}
+
+	err = index.RemoveIndex(stub, accountIndexName, []string{name})					//remove account from index
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emit_event(stub, "delete", event)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	return shim.Success(nil)
 }
 
 // ============================================================================================================================
-// Write - directly write a variable into chaincode world state
+// Write - directly write a variable into chaincode world state. Admin-only, logged as an AdminAction and unavailable
+//		   in production deployments.
 // ============================================================================================================================
 func (t *SimpleChaincode) write(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var name, value string 
@@ -184,6 +710,15 @@ func (t *SimpleChaincode) write(stub shim.ChaincodeStubInterface, args []string)
 
 	name = args[0]														
 	value = args[1]
+	err = t.check_raw_access(stub, "write")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = t.log_admin_action(stub, "write", name, value)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	err = stub.PutState(name, []byte(value))					
 	if err != nil {
 		return shim.Error(err.Error())
@@ -192,7 +727,8 @@ func (t *SimpleChaincode) write(stub shim.ChaincodeStubInterface, args []string)
 }
 
 // ============================================================================================================================
-// Init account - create a new account, store into chaincode world state, and then append the account index
+// Init account - create a new account, store into chaincode world state, and then append the account index. An initial
+//				  activity above the approval threshold is held as a PendingPosting and returned in a PostingResponse.
 // ============================================================================================================================
 func (t *SimpleChaincode) create_account(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
@@ -243,144 +779,3298 @@ func (t *SimpleChaincode) create_account(stub shim.ChaincodeStubInterface, args
 
 	transactionType := args[7]
 
-	openingBalance, err := strconv.ParseFloat(args[5],64)
+	openingBalance, err := t.parse_amount(currency, args[5])
 	if err != nil {
-		return shim.Error("5th argument must be a numeric string")
+		return shim.Error("6th argument must be a decimal string with at most " + strconv.Itoa(money.Decimals(currency)) + " decimals")
 	}
 
-	activity, err := strconv.ParseFloat(args[6],64)
+	activity, err := t.parse_amount(currency, args[6])
 	if err != nil {
-		return shim.Error("6th argument must be a numeric string")
+		return shim.Error("7th argument must be a decimal string with at most " + strconv.Itoa(money.Decimals(currency)) + " decimals")
 	}
 
-	periodToDateBalance := openingBalance + activity
-
 	//check if account already exists
 	accountAsBytes, err := stub.GetState(accountNo)
 	if err != nil {
 		return shim.Error("Failed to get account number")
 	}
-	res := Account{}
-	json.Unmarshal(accountAsBytes, &res)
-	if res.AccountNo == accountNo{
+	if accountAsBytes != nil {
 		return shim.Error("This account arleady exists")			
 	}
-	openingBalanceStr := strconv.FormatFloat(openingBalance, 'E', -1, 64)
-	activityStr := strconv.FormatFloat(activity, 'E', -1, 64)
-	periodToDateBalanceStr := strconv.FormatFloat(periodToDateBalance, 'E', -1, 64)
 
-	//build the account json string 
-	str := `{"accountno": "` + accountNo + `", "dueTo": "` + dueTo + `", "dueFrom": "` + dueFrom + `", "currency": "` + currency + `", "period": "` + period + `", "openingBalance": "` + openingBalanceStr + `", "activity": "` + activityStr + `", "periodToDateBalance": "` + periodToDateBalanceStr + `", "transactionType": "` + transactionType + `"}`
-	err = stub.PutState(accountNo, []byte(str))							
+	//build the account, the initial activity is posted below so that it shows up on the statement. The posting works on
+	//this copy: GetState does not see the account written by this transaction, so it cannot be read back
+	res := Account{AccountNo: accountNo, DueTo: dueTo, DueFrom: dueFrom, Currency: currency, Period: period, TransactionType: transactionType}
+	res.OpeningBalance = t.format_amount(currency, openingBalance)
+	res.Activity = t.format_amount(currency, 0)
+	res.PeriodToDateBalance = res.OpeningBalance
+	err = t.save_account(stub, res)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	event := AccountEvent{AccountNo: accountNo}
+	var pending *PendingPosting
+	if activity != 0 {
+		txn, err := t.post_transaction(stub, &res, activity, Transaction{Type: ACTIVITY})
+		if errors.Is(err, errApprovalRequired) {
+			// The account is created without it and the initial activity waits for approval
+			posting, err := t.hold_posting(stub, PendingPosting{AccountNo: res.AccountNo, Amount: t.format_amount(currency, activity)})
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			pending = &posting
+		} else if err != nil {
+			return shim.Error(err.Error())
+		} else {
+			event.TransactionId = txn.TransactionId
+		}
+	}
+	event.After = t.balances_of(res)
+
+	err = t.index_account(stub, res)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-		
-	//get the account index
-	accountsAsBytes, err := stub.GetState(accountIndexStr)
+
+	//append the index
+	err = index.CreateIndex(stub, accountIndexName, []string{accountNo})
 	if err != nil {
-		return shim.Error("Failed to get account index")
+		return shim.Error(err.Error())
+	}
+
+	err = t.emit_event(stub, "create_account", event)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	var accountIndex []string
-	json.Unmarshal(accountsAsBytes, &accountIndex)							
-	
-	//append the index 
-	accountIndex = append(accountIndex, accountNo)	
-	jsonAsBytes, _ := json.Marshal(accountIndex)
-	err = stub.PutState(accountIndexStr, jsonAsBytes)						
 
+	if pending != nil {
+		jsonAsBytes, _ := json.Marshal(PostingResponse{Status: PENDING, Account: &res, PendingPosting: pending})
+		return shim.Success(jsonAsBytes)
+	}
 	return shim.Success(nil)
 }
 
 // ============================================================================================================================
-// Transaction Activity - Create a transaction and change the activity balance and period-to-date balance
+// Transaction Activity - Create a transaction and change the activity balance and period-to-date balance. Optional JSON
+//						  arrays of reference numbers (invoice no, contract id) and document hashes are kept on the
+//						  transaction. Amounts above the approval threshold are held as a PendingPosting and postings to
+//						  a missing account are parked as an ErrorQueueEntry. The payload is a PostingResponse.
 // ============================================================================================================================
 func (t *SimpleChaincode) transaction_activity(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	
-	//      0           1  
-	// "accountNo", "100.00"
+	//      0           1                2                        3
+	// "accountNo", "100.00", "[\"INV-1001\",\"CTR-77\"]", "[\"9f86d081884c7d65...\"]"
 
 	var err error
-	var newActivity, newPeriodToDateBalance float64
 
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	if len(args) < 2 || len(args) > 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 to 4")
 	}
 	if len(args[0]) <= 0 {
 		return shim.Error("1st argument must be a non-empty string")
 	}
-	amount,err := strconv.ParseFloat(args[1], 64)
+	_, err = money.ParseDecimal(args[1])
 	if err != nil {
-		return shim.Error("2nd argument must be a numeric string")
+		return shim.Error("2nd argument must be a decimal string")
+	}
+	var references, documentHashes []string
+	if len(args) > 2 && len(args[2]) > 0 {
+		err = json.Unmarshal([]byte(args[2]), &references)
+		if err != nil {
+			return shim.Error("3rd argument must be a JSON array of reference numbers")
+		}
+	}
+	if len(args) > 3 && len(args[3]) > 0 {
+		err = json.Unmarshal([]byte(args[3]), &documentHashes)
+		if err != nil {
+			return shim.Error("4th argument must be a JSON array of document hashes")
+		}
 	}
 
-	account, err := stub.GetState(args[0])
+	// Postings to an account that does not exist are parked in the error queue to be fixed and reposted
+	accountAsBytes, err := stub.GetState(args[0])
 	if err != nil {
-		return shim.Error("Failed to get the first account")
+		return shim.Error("Failed to get account " + args[0])
 	}
-	res := Account{}
-	json.Unmarshal(account, &res)																		
-	
-	Activity,err := strconv.ParseFloat(res.Activity, 64)
+	if accountAsBytes == nil {
+		entry, err := t.park_posting(stub, args[0], strings.TrimSpace(args[1]), references, documentHashes, "Account " + args[0] + " does not exist")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		jsonAsBytes, _ := json.Marshal(PostingResponse{Status: PARKED, ErrorQueueEntry: &entry})
+		return shim.Success(jsonAsBytes)
+	}
+
+	res, err := t.get_account(stub, args[0])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	PeriodToDateBalance,err := strconv.ParseFloat(res.PeriodToDateBalance, 64)
+	amount, err := t.parse_amount(res.Currency, args[1])
 	if err != nil {
-		return shim.Error(err.Error())
+		return shim.Error("2nd argument must be a decimal string with at most " + strconv.Itoa(money.Decimals(res.Currency)) + " decimals")
 	}
 
-	newActivity = Activity + amount
-	newPeriodToDateBalance = PeriodToDateBalance + amount
-
-	newActivityStr := strconv.FormatFloat(newActivity, 'E', -1, 64)
-	newPeriodToDateBalanceStr := strconv.FormatFloat(newPeriodToDateBalance, 'E', -1, 64)
-
-	res.Activity = newActivityStr
-	res.PeriodToDateBalance = newPeriodToDateBalanceStr
+	before := t.balances_of(res)
+	txn, err := t.post_transaction(stub, &res, amount, Transaction{Type: ACTIVITY, References: references, DocumentHashes: documentHashes})
+	if errors.Is(err, errApprovalRequired) {
+		// Postings above the approval threshold only change the balance once approved
+		return t.hold_for_approval(stub, PendingPosting{AccountNo: res.AccountNo, Amount: t.format_amount(res.Currency, amount), References: references, DocumentHashes: documentHashes})
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	jsonAsBytes, _ := json.Marshal(res)
-	err = stub.PutState(args[0], jsonAsBytes)								
+	err = t.emit_event(stub, "transaction_activity", AccountEvent{AccountNo: res.AccountNo, Tags: res.Tags, TransactionId: txn.TransactionId, Before: before, After: t.balances_of(res)})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	
-	return shim.Success(nil)
+	jsonAsBytes, _ := json.Marshal(PostingResponse{Status: POSTED, Account: &res, Transaction: &txn})
+	return shim.Success(jsonAsBytes)
 }
 
 // ============================================================================================================================
-// Next Period - Set account to be in next period (move periodToDateBalance to openingBalance & set activity = 0)
+// Next Period - Set account to be in next period (move periodToDateBalance to openingBalance & set activity = 0). The
+//				 second argument names the new period, transactions are recorded against the period label. It may be
+//				 left out for an account whose period is labelled YYYY-MM, which then moves on to the following month.
 // ============================================================================================================================
 func (t *SimpleChaincode) next_period(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	
-	//      0      
-	// "accountNo"
+	//      0            1
+	// "accountNo", "2017-07"
 
 	var err error
 
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
 	}
 	if len(args[0]) <= 0 {
 		return shim.Error("1st argument must be a non-empty string")
 	}
 
-	account, err := stub.GetState(args[0])
+	res, err := t.get_account(stub, args[0])
 	if err != nil {
-		return shim.Error("Failed to get the first account")
+		return shim.Error(err.Error())
 	}
-	res := Account{}
-	json.Unmarshal(account, &res)																		
+	before := t.balances_of(res)
 	
-	res.OpeningBalance = res.PeriodToDateBalance
-	activity, err := strconv.ParseFloat("0",64)
-	res.Activity = strconv.FormatFloat(activity, 'E', -1, 64)
+	periodToDateBalance, err := t.parse_amount(res.Currency, res.PeriodToDateBalance)
+	if err != nil {
+		return shim.Error("Corrupt period-to-date balance on account " + res.AccountNo)
+	}
+	res.OpeningBalance = t.format_amount(res.Currency, periodToDateBalance)
+	res.PeriodToDateBalance = res.OpeningBalance
+	res.Activity = t.format_amount(res.Currency, 0)
+	if len(args) == 2 {
+		if len(args[1]) <= 0 {
+			return shim.Error("2nd argument must be a non-empty string")
+		}
+		if args[1] == res.Period {
+			return shim.Error("Account " + res.AccountNo + " is already in period " + res.Period)
+		}
+		res.Period = args[1]
+	} else {
+		// Statements, reconciliations and recurring runs are keyed by the period label, so it must change
+		date, err := time.Parse("2006-01", res.Period)
+		if err != nil {
+			return shim.Error("Account " + res.AccountNo + " is in period " + res.Period + ", which is not of the form YYYY-MM. The 2nd argument must name the new period")
+		}
+		res.Period = date.AddDate(0, 1, 0).Format("2006-01")
+	}
+
+	err = t.save_account(stub, res)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	jsonAsBytes, _ := json.Marshal(res)
-	err = stub.PutState(args[0], jsonAsBytes)								
+	err = t.emit_event(stub, "next_period", AccountEvent{AccountNo: res.AccountNo, Tags: res.Tags, Before: before, After: t.balances_of(res)})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	
 	return shim.Success(nil)
-}
\ No newline at end of file
+}
+
+// ============================================================================================================================
+// Update Account - Correct a descriptive field of an account (account name, due to, due from, transaction type or
+//				    currency) or its limit controls (allowNegative, creditLimit). The currency is locked once the
+//				    account carries activity or a balance. Every change is appended to the account's change history.
+// ============================================================================================================================
+func (t *SimpleChaincode) update_account(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0              1                    2
+	// "accountNo", "transactionType", "Cash Transactions"
+
+	var err error
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		return shim.Error("3rd argument must be a non-empty string")
+	}
+
+	res, err := t.get_account(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	field := args[1]
+	value := args[2]
+	var oldValue string
+
+	switch field {
+	case "accountName":
+		oldValue = res.AccountName
+		res.AccountName = value
+	case "dueTo":
+		oldValue = res.DueTo
+		res.DueTo = value
+	case "dueFrom":
+		oldValue = res.DueFrom
+		res.DueFrom = value
+	case "transactionType":
+		oldValue = res.TransactionType
+		res.TransactionType = value
+	case "allowNegative":
+		if value != "true" && value != "false" {
+			return shim.Error("allowNegative must be true or false")
+		}
+		oldValue = strconv.FormatBool(t.allows_negative(res))
+		allowNegative := value == "true"
+		res.AllowNegative = &allowNegative
+	case "creditLimit":
+		if value != "none" {
+			limit, err := t.parse_amount(res.Currency, value)
+			if err != nil || limit <= 0 {
+				return shim.Error("creditLimit must be a positive decimal string with at most " + strconv.Itoa(money.Decimals(res.Currency)) + " decimals or none")
+			}
+			value = t.format_amount(res.Currency, limit)
+		}
+		oldValue = res.CreditLimit
+		if oldValue == "" {
+			oldValue = "none"
+		}
+		res.CreditLimit = value
+		if value == "none" {
+			res.CreditLimit = ""
+		}
+	case "currency":
+		if t.has_activity(res) {
+			return shim.Error("The currency of account " + res.AccountNo + " cannot be changed once it carries activity or a balance")
+		}
+		oldValue = res.Currency
+		res.Currency = value
+	default:
+		return shim.Error("Field '" + field + "' cannot be updated")
+	}
+
+	if oldValue == value {
+		return shim.Success(nil)
+	}
+
+	changedBy, err := t.get_caller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	timestamp, err := t.get_timestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Moving an account to another entity moves its entity~account index entries with it
+	if field == "dueTo" || field == "dueFrom" {
+		previous := res
+		if field == "dueTo" {
+			previous.DueTo = oldValue
+		} else {
+			previous.DueFrom = oldValue
+		}
+		err = t.unindex_account(stub, previous)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = t.index_account(stub, res)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	res.Changes = append(res.Changes, AccountChange{Field: field, OldValue: oldValue, NewValue: value, ChangedBy: changedBy, TxID: stub.GetTxID(), Timestamp: timestamp})
+
+	err = t.save_account(stub, res)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Has Activity - Check whether an account has any non-zero opening balance, activity or period-to-date balance
+// ============================================================================================================================
+func (t *SimpleChaincode) has_activity(res Account) bool {
+	for _, balance := range []string{res.OpeningBalance, res.Activity, res.PeriodToDateBalance} {
+		value, err := t.parse_amount(res.Currency, balance)
+		if err != nil || value != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// Get Account - Retrieve an account from the world state, failing if it does not exist
+// ============================================================================================================================
+func (t *SimpleChaincode) get_account(stub shim.ChaincodeStubInterface, accountNo string) (Account, error) {
+	res := Account{}
+
+	accountAsBytes, err := stub.GetState(accountNo)
+	if err != nil {
+		return res, fmt.Errorf("Failed to get account %s", accountNo)
+	}
+	if accountAsBytes == nil {
+		return res, fmt.Errorf("Account %s does not exist", accountNo)
+	}
+
+	err = json.Unmarshal(accountAsBytes, &res)
+	if err != nil {
+		return res, fmt.Errorf("Corrupt account record %s", accountNo)
+	}
+	t.normalize_overdraft(&res)
+
+	return res, nil
+}
+
+// ============================================================================================================================
+// Normalize Overdraft - Carry the noOverdraft flag of accounts written by version 4 and earlier over to allowNegative.
+//						 An allowNegative set since takes precedence. Returns whether the account carried the flag.
+// ============================================================================================================================
+func (t *SimpleChaincode) normalize_overdraft(res *Account) bool {
+	if !res.NoOverdraft {
+		return false
+	}
+	if res.AllowNegative == nil {
+		allowNegative := false
+		res.AllowNegative = &allowNegative
+	}
+	res.NoOverdraft = false
+	return true
+}
+
+// ============================================================================================================================
+// Save Account - Write an account back into the world state under its account number
+// ============================================================================================================================
+func (t *SimpleChaincode) save_account(stub shim.ChaincodeStubInterface, res Account) error {
+	jsonAsBytes, err := json.Marshal(res)
+	if err != nil {
+		return fmt.Errorf("Error converting account record %s", res.AccountNo)
+	}
+
+	err = stub.PutState(res.AccountNo, jsonAsBytes)
+	if err != nil {
+		return fmt.Errorf("Error storing account record %s", res.AccountNo)
+	}
+
+	return nil
+}
+
+// ============================================================================================================================
+// Get Caller - Return the common name from the certificate of the identity submitting the transaction
+// ============================================================================================================================
+func (t *SimpleChaincode) get_caller(stub shim.ChaincodeStubInterface) (string, error) {
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil || cert == nil {
+		return "", fmt.Errorf("Couldn't retrieve the identity of the caller")
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// ============================================================================================================================
+// Get Timestamp - Return the transaction timestamp (identical on every endorsing peer) formatted as RFC 3339
+// ============================================================================================================================
+func (t *SimpleChaincode) get_timestamp(stub shim.ChaincodeStubInterface) (string, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return "", fmt.Errorf("Couldn't retrieve the transaction timestamp")
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Format(time.RFC3339), nil
+}
+
+
+// ============================================================================================================================
+// Reverse Transaction - Post the opposite amount of an earlier transaction into the account's current period, linking
+//						 the reversal and the original to each other. Reversing an adjustment or a revaluation takes the
+//						 admin attribute like posting one did, and netting transactions are only undone by a new netting.
+//						 A reversal above the approval threshold is held as a PendingPosting, unless the type of the
+//						 original is exempt from approval, and the payload is then a PostingResponse.
+// ============================================================================================================================
+func (t *SimpleChaincode) reverse_transaction(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//        0                  1
+	// "transactionId", "Posted to the wrong period"
+
+	var err error
+
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	reason := ""
+	if len(args) == 2 {
+		reason = args[1]
+	}
+
+	original, err := t.get_transaction(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if original.Type == NETTING {
+		return shim.Error("Transaction " + original.TransactionId + " is part of a netting, propose a new netting to undo it")
+	}
+	if (original.Type == ADJUSTMENT || original.Type == REVALUATION) && !t.is_admin(stub) {
+		return shim.Error("Permission Denied. Reversing a " + original.Type + " requires the " + adminAttribute + " attribute")
+	}
+
+	res, err := t.get_account(stub, original.AccountNo)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amount, err := t.parse_amount(res.Currency, original.Amount)
+	if err != nil {
+		return shim.Error("Corrupt amount on transaction " + original.TransactionId)
+	}
+
+	reversal, err := t.post_reversal(stub, &res, original, Transaction{Reason: reason})
+	if errors.Is(err, errApprovalRequired) {
+		return t.hold_for_approval(stub, PendingPosting{Type: REVERSAL, AccountNo: res.AccountNo, Amount: t.format_amount(res.Currency, -amount), ReversalOf: original.TransactionId, RequestReason: reason, References: original.References})
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emit_event(stub, "reverse_transaction", reversal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Post Reversal - Post the opposite amount of a transaction to its account and mark the original as reversed. The caller
+//				   fills in the reason and, for an approved reversal, the posting id of txn.
+// ============================================================================================================================
+func (t *SimpleChaincode) post_reversal(stub shim.ChaincodeStubInterface, res *Account, original Transaction, txn Transaction) (Transaction, error) {
+	if original.ReversedBy != "" {
+		return txn, fmt.Errorf("Transaction %s has already been reversed by %s", original.TransactionId, original.ReversedBy)
+	}
+	if original.Type == REVERSAL {
+		return txn, fmt.Errorf("Transaction %s is itself a reversal", original.TransactionId)
+	}
+
+	amount, err := t.parse_amount(res.Currency, original.Amount)
+	if err != nil {
+		return txn, fmt.Errorf("Corrupt amount on transaction %s", original.TransactionId)
+	}
+
+	txn.Type = REVERSAL
+	txn.ReversalOf = original.TransactionId
+	txn.References = original.References
+	reversal, err := t.post_transaction(stub, res, -amount, txn)
+	if err != nil {
+		return reversal, err
+	}
+
+	original.ReversedBy = reversal.TransactionId
+	err = t.save_transaction(stub, original)
+	if err != nil {
+		return reversal, err
+	}
+
+	return reversal, nil
+}
+
+// ============================================================================================================================
+// Adjust Balance - Admin-only controlled correction of an account's balance. A reason is mandatory and is kept on the
+//					resulting adjustment transaction.
+// ============================================================================================================================
+func (t *SimpleChaincode) adjust_balance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0           1                  2
+	// "accountNo", "-25.00", "Bank charge booked twice"
+
+	var err error
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		return shim.Error("3rd argument must be a non-empty string, a reason is required for every adjustment")
+	}
+	_, err = money.ParseDecimal(args[1])
+	if err != nil {
+		return shim.Error("2nd argument must be a decimal string")
+	}
+
+	if !t.is_admin(stub) {
+		return shim.Error("Permission Denied. adjust_balance requires the " + adminAttribute + " attribute")
+	}
+
+	res, err := t.get_account(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amount, err := t.parse_amount(res.Currency, args[1])
+	if err != nil {
+		return shim.Error("2nd argument must be a decimal string with at most " + strconv.Itoa(money.Decimals(res.Currency)) + " decimals")
+	}
+
+	adjustment, err := t.post_transaction(stub, &res, amount, Transaction{Type: ADJUSTMENT, Reason: args[2]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emit_event(stub, "adjust_balance", adjustment)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Check Posting - Fail unless post_transaction can apply the amount to the account: the account must be open and the
+//				   new balances must fit. Postings that break the account's limit controls are rejected, as are postings
+//				   above the approval threshold unless they apply an approved pending posting or their type is in
+//				   approvalExemptTypes. A reversal is exempt when the transaction it reverses is.
+// ============================================================================================================================
+func (t *SimpleChaincode) check_posting(stub shim.ChaincodeStubInterface, res Account, amount int64, txn Transaction) error {
+
+	if res.Status == CLOSED {
+		return fmt.Errorf("Account %s is closed", res.AccountNo)
+	}
+
+	activity, err := t.parse_amount(res.Currency, res.Activity)
+	if err != nil {
+		return fmt.Errorf("Corrupt activity on account %s", res.AccountNo)
+	}
+	periodToDateBalance, err := t.parse_amount(res.Currency, res.PeriodToDateBalance)
+	if err != nil {
+		return fmt.Errorf("Corrupt period-to-date balance on account %s", res.AccountNo)
+	}
+
+	_, err = money.AddUnits(activity, amount)
+	if err != nil {
+		return err
+	}
+	_, err = money.AddUnits(periodToDateBalance, amount)
+	if err != nil {
+		return err
+	}
+
+	err = t.check_limits(res, periodToDateBalance, amount)
+	if err != nil {
+		return err
+	}
+
+	if txn.PostingId != "" {
+		return nil
+	}
+	txnType := txn.Type
+	if txn.Type == REVERSAL {
+		original, err := t.get_transaction(stub, txn.ReversalOf)
+		if err != nil {
+			return err
+		}
+		txnType = original.Type
+	}
+	if !approvalExemptTypes[txnType] {
+		requiresApproval, err := t.requires_approval(stub, res.Currency, amount)
+		if err != nil {
+			return err
+		}
+		if requiresApproval {
+			return fmt.Errorf("%w: posting of %s to account %s is above the approval threshold", errApprovalRequired, t.format_amount(res.Currency, amount), res.AccountNo)
+		}
+	}
+
+	return nil
+}
+
+// ============================================================================================================================
+// Post Transaction - Apply an amount to an account's activity and period-to-date balance, record it as a Transaction
+//					  and save both. The caller fills in the type specific fields of txn; the rest are set here.
+//					  Postings check_posting rejects fail before anything is written.
+// ============================================================================================================================
+func (t *SimpleChaincode) post_transaction(stub shim.ChaincodeStubInterface, res *Account, amount int64, txn Transaction) (Transaction, error) {
+
+	err := t.check_posting(stub, *res, amount, txn)
+	if err != nil {
+		return txn, err
+	}
+
+	activity, err := t.parse_amount(res.Currency, res.Activity)
+	if err != nil {
+		return txn, fmt.Errorf("Corrupt activity on account %s", res.AccountNo)
+	}
+	periodToDateBalance, err := t.parse_amount(res.Currency, res.PeriodToDateBalance)
+	if err != nil {
+		return txn, fmt.Errorf("Corrupt period-to-date balance on account %s", res.AccountNo)
+	}
+
+	newActivity, err := money.AddUnits(activity, amount)
+	if err != nil {
+		return txn, err
+	}
+	newBalance, err := money.AddUnits(periodToDateBalance, amount)
+	if err != nil {
+		return txn, err
+	}
+
+	res.Activity = t.format_amount(res.Currency, newActivity)
+	res.PeriodToDateBalance = t.format_amount(res.Currency, newBalance)
+
+	txn.PostedBy, err = t.get_caller(stub)
+	if err != nil {
+		return txn, err
+	}
+	txn.Timestamp, err = t.get_timestamp(stub)
+	if err != nil {
+		return txn, err
+	}
+	txn.TransactionId = t.next_transaction_id(*res)
+	txn.AccountNo = res.AccountNo
+	txn.Period = res.Period
+	txn.Amount = t.format_amount(res.Currency, amount)
+	txn.BalanceAfter = res.PeriodToDateBalance
+	txn.Tags = res.Tags
+	txn.TxID = stub.GetTxID()
+	res.TransactionCount++
+
+	err = t.save_transaction(stub, txn)
+	if err != nil {
+		return txn, err
+	}
+
+	for _, reference := range txn.References {
+		err = index.CreateIndex(stub, referenceTransactionPrefix, []string{reference, txn.TransactionId})
+		if err != nil {
+			return txn, fmt.Errorf("Error indexing transaction %s by reference %s", txn.TransactionId, reference)
+		}
+	}
+
+	err = t.save_account(stub, *res)
+	if err != nil {
+		return txn, err
+	}
+
+	err = t.flag_for_review(stub, txn)
+	if err != nil {
+		return txn, err
+	}
+
+	return txn, nil
+}
+
+// ============================================================================================================================
+// Next Transaction Id - The id the next transaction posted to an account will get
+// ============================================================================================================================
+func (t *SimpleChaincode) next_transaction_id(res Account) string {
+	return fmt.Sprintf("%s:%08d", res.AccountNo, res.TransactionCount + 1)
+}
+
+// ============================================================================================================================
+// Transaction Key - Split a transaction id of the form accountNo:sequence into the composite key it is stored under
+// ============================================================================================================================
+func (t *SimpleChaincode) transaction_key(stub shim.ChaincodeStubInterface, transactionId string) (string, error) {
+	i := strings.LastIndex(transactionId, ":")
+	if i <= 0 || i == len(transactionId)-1 {
+		return "", fmt.Errorf("Invalid transaction id %s", transactionId)
+	}
+	return stub.CreateCompositeKey(transactionPrefix, []string{transactionId[:i], transactionId[i+1:]})
+}
+
+// ============================================================================================================================
+// Get Transaction - Retrieve a transaction record by its transaction id
+// ============================================================================================================================
+func (t *SimpleChaincode) get_transaction(stub shim.ChaincodeStubInterface, transactionId string) (Transaction, error) {
+	txn := Transaction{}
+
+	key, err := t.transaction_key(stub, transactionId)
+	if err != nil {
+		return txn, err
+	}
+
+	txnAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return txn, fmt.Errorf("Failed to get transaction %s", transactionId)
+	}
+	if txnAsBytes == nil {
+		return txn, fmt.Errorf("Transaction %s does not exist", transactionId)
+	}
+
+	err = json.Unmarshal(txnAsBytes, &txn)
+	if err != nil {
+		return txn, fmt.Errorf("Corrupt transaction record %s", transactionId)
+	}
+
+	return txn, nil
+}
+
+// ============================================================================================================================
+// Save Transaction - Write a transaction record into the world state
+// ============================================================================================================================
+func (t *SimpleChaincode) save_transaction(stub shim.ChaincodeStubInterface, txn Transaction) error {
+	key, err := t.transaction_key(stub, txn.TransactionId)
+	if err != nil {
+		return err
+	}
+
+	jsonAsBytes, err := json.Marshal(txn)
+	if err != nil {
+		return fmt.Errorf("Error converting transaction record %s", txn.TransactionId)
+	}
+
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return fmt.Errorf("Error storing transaction record %s", txn.TransactionId)
+	}
+
+	return nil
+}
+
+// ============================================================================================================================
+// Is Admin - Check the admin attribute on the certificate of the identity submitting the transaction
+// ============================================================================================================================
+func (t *SimpleChaincode) is_admin(stub shim.ChaincodeStubInterface) bool {
+	value, found, err := cid.GetAttributeValue(stub, adminAttribute)
+	return err == nil && found && value == "true"
+}
+
+// ============================================================================================================================
+// Balances Of - Snapshot the balances of an account for an AccountEvent
+// ============================================================================================================================
+func (t *SimpleChaincode) balances_of(res Account) *AccountBalances {
+	return &AccountBalances{Period: res.Period, OpeningBalance: res.OpeningBalance, Activity: res.Activity, PeriodToDateBalance: res.PeriodToDateBalance}
+}
+
+// ============================================================================================================================
+// Emit Event - Set the chaincode event for this transaction with a JSON payload. Fabric keeps only one event per
+//				transaction, so each invoke emits at most once.
+// ============================================================================================================================
+func (t *SimpleChaincode) emit_event(stub shim.ChaincodeStubInterface, name string, payload interface{}) error {
+	payloadAsBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("Error converting %s event payload", name)
+	}
+
+	err = stub.SetEvent(name, payloadAsBytes)
+	if err != nil {
+		return fmt.Errorf("Error setting %s event", name)
+	}
+
+	return nil
+}
+
+
+// ============================================================================================================================
+// Get Admin Actions - List every AdminAction recorded by the raw write and delete functions, oldest first
+// ============================================================================================================================
+func (t *SimpleChaincode) get_admin_actions(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(adminActionPrefix, []string{})
+	if err != nil {
+		return shim.Error("Failed to get admin actions")
+	}
+	defer resultsIterator.Close()
+
+	actions := []AdminAction{}
+	for resultsIterator.HasNext() {
+		result, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		action := AdminAction{}
+		err = json.Unmarshal(result.Value, &action)
+		if err != nil {
+			return shim.Error("Corrupt admin action record " + result.Key)
+		}
+		actions = append(actions, action)
+	}
+
+	jsonAsBytes, _ := json.Marshal(actions)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Check Raw Access - Refuse the raw write, delete and reset functions to non-admins and in production deployments
+// ============================================================================================================================
+func (t *SimpleChaincode) check_raw_access(stub shim.ChaincodeStubInterface, action string) error {
+	config, err := t.get_config(stub)
+	if err != nil {
+		return err
+	}
+	if config.RawAccessDisabled {
+		return fmt.Errorf("%s is disabled in this deployment", action)
+	}
+	if !t.is_admin(stub) {
+		return fmt.Errorf("Permission Denied. %s requires the %s attribute", action, adminAttribute)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Log Admin Action - Record a use of the raw write or delete functions together with the value it replaces
+// ============================================================================================================================
+func (t *SimpleChaincode) log_admin_action(stub shim.ChaincodeStubInterface, action string, key string, newValue string) error {
+	previousValue, err := stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to get state for %s", key)
+	}
+
+	performedBy, err := t.get_caller(stub)
+	if err != nil {
+		return err
+	}
+	timestamp, err := t.get_timestamp(stub)
+	if err != nil {
+		return err
+	}
+
+	record := AdminAction{Action: action, Key: key, PreviousValue: string(previousValue), NewValue: newValue, PerformedBy: performedBy, TxID: stub.GetTxID(), Timestamp: timestamp}
+	jsonAsBytes, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("Error converting admin action record")
+	}
+
+	actionKey, err := stub.CreateCompositeKey(adminActionPrefix, []string{timestamp, stub.GetTxID()})
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(actionKey, jsonAsBytes)
+	if err != nil {
+		return fmt.Errorf("Error storing admin action record")
+	}
+
+	return nil
+}
+
+// ============================================================================================================================
+// Get Config - Read the deployment configuration. Chaincode instantiated before the configuration existed gets the
+//				defaults.
+// ============================================================================================================================
+func (t *SimpleChaincode) get_config(stub shim.ChaincodeStubInterface) (Config, error) {
+	config := Config{}
+
+	configAsBytes, err := stub.GetState(configStr)
+	if err != nil {
+		return config, fmt.Errorf("Failed to get the configuration")
+	}
+	if configAsBytes == nil {
+		return config, nil
+	}
+
+	err = json.Unmarshal(configAsBytes, &config)
+	if err != nil {
+		return config, fmt.Errorf("Corrupt configuration record")
+	}
+
+	return config, nil
+}
+
+
+// ============================================================================================================================
+// Get Statement - Build the statement of an account for a period: the opening balance, every transaction posted in the
+//				   period in order with a running balance, and the closing balance
+// ============================================================================================================================
+func (t *SimpleChaincode) get_statement(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0           1
+	// "accountNo", "2017-06"
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+
+	res, err := t.get_account(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	period := args[1]
+
+	transactions, err := t.get_account_transactions(stub, res.AccountNo)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var lines []Transaction
+	for _, txn := range transactions {
+		if txn.Period == period {
+			lines = append(lines, txn)
+		}
+	}
+
+	// The opening balance is the balance before the first transaction of the period. A period without transactions
+	// can only be reported while it is the account's current period.
+	var openingBalance int64
+	if len(lines) > 0 {
+		balanceAfter, err := t.parse_amount(res.Currency, lines[0].BalanceAfter)
+		if err != nil {
+			return shim.Error("Corrupt balance on transaction " + lines[0].TransactionId)
+		}
+		amount, err := t.parse_amount(res.Currency, lines[0].Amount)
+		if err != nil {
+			return shim.Error("Corrupt amount on transaction " + lines[0].TransactionId)
+		}
+		openingBalance = balanceAfter - amount
+	} else if period == res.Period {
+		openingBalance, err = t.parse_amount(res.Currency, res.OpeningBalance)
+		if err != nil {
+			return shim.Error("Corrupt opening balance on account " + res.AccountNo)
+		}
+	} else {
+		return shim.Error("No transactions recorded for account " + res.AccountNo + " in period " + period)
+	}
+
+	statement := Statement{AccountNo: res.AccountNo, Currency: res.Currency, Period: period, OpeningBalance: t.format_amount(res.Currency, openingBalance), Lines: []StatementLine{}}
+	runningBalance := openingBalance
+	for _, txn := range lines {
+		amount, err := t.parse_amount(res.Currency, txn.Amount)
+		if err != nil {
+			return shim.Error("Corrupt amount on transaction " + txn.TransactionId)
+		}
+		runningBalance += amount
+		statement.Lines = append(statement.Lines, StatementLine{TransactionId: txn.TransactionId, Type: txn.Type, Timestamp: txn.Timestamp, Amount: t.format_amount(res.Currency, amount), RunningBalance: t.format_amount(res.Currency, runningBalance), ReversalOf: txn.ReversalOf, Reason: txn.Reason})
+	}
+	statement.ClosingBalance = t.format_amount(res.Currency, runningBalance)
+
+	jsonAsBytes, _ := json.Marshal(statement)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Get Account Transactions - Return every transaction recorded against an account in the order they were posted
+// ============================================================================================================================
+func (t *SimpleChaincode) get_account_transactions(stub shim.ChaincodeStubInterface, accountNo string) ([]Transaction, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(transactionPrefix, []string{accountNo})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get transactions for account %s", accountNo)
+	}
+	defer resultsIterator.Close()
+
+	var transactions []Transaction
+	for resultsIterator.HasNext() {
+		result, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		txn := Transaction{}
+		err = json.Unmarshal(result.Value, &txn)
+		if err != nil {
+			return nil, fmt.Errorf("Corrupt transaction record %s", result.Key)
+		}
+		transactions = append(transactions, txn)
+	}
+
+	return transactions, nil
+}
+
+
+// ============================================================================================================================
+// Revalue - Revalue the period-to-date balances of all accounts in a foreign currency at the closing rate. The difference
+//			 to their value at the book rate is posted as one unrealized gain or loss to the revaluation account, and the
+//			 rates and original balances are stored as a Revaluation so the entry can be reversed next period. The rates
+//			 are quoted in the currency of the revaluation account per unit of the foreign currency. Admin-only, and a
+//			 currency can only be revalued once in each period of the revaluation account.
+// ============================================================================================================================
+func (t *SimpleChaincode) revalue(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//     0        1         2              3
+	// "EUR",  "1.1825", "1.1500", "revaluationAccountNo"
+
+	var err error
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[3]) <= 0 {
+		return shim.Error("4th argument must be a non-empty string")
+	}
+	closingRate, err := money.ParseDecimal(args[1])
+	if err != nil || closingRate.Sign() <= 0 {
+		return shim.Error("2nd argument must be a positive numeric string")
+	}
+	bookRate, err := money.ParseDecimal(args[2])
+	if err != nil || bookRate.Sign() <= 0 {
+		return shim.Error("3rd argument must be a positive numeric string")
+	}
+	currency := args[0]
+
+	if !t.is_admin(stub) {
+		return shim.Error("Permission Denied. revalue requires the " + adminAttribute + " attribute")
+	}
+
+	revaluationAccount, err := t.get_account(stub, args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if revaluationAccount.Currency == currency {
+		return shim.Error("The revaluation account must not be held in the currency being revalued")
+	}
+
+	runKey, err := stub.CreateCompositeKey(revaluationRunPrefix, []string{revaluationAccount.Period, currency})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	runAsBytes, err := stub.GetState(runKey)
+	if err != nil {
+		return shim.Error("Failed to get the revaluations of period " + revaluationAccount.Period)
+	}
+	if runAsBytes != nil {
+		return shim.Error(currency + " has already been revalued in period " + revaluationAccount.Period + " by revaluation " + string(runAsBytes))
+	}
+
+	accountIndex, err := t.get_account_index(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	revaluation := Revaluation{RevaluationId: stub.GetTxID(), Currency: currency, Period: revaluationAccount.Period, ClosingRate: args[1], BookRate: args[2], RevaluationAccountNo: revaluationAccount.AccountNo, Entries: []RevaluationEntry{}}
+	var totalDifference int64
+	for _, accountNo := range accountIndex {
+		res, err := t.get_account(stub, accountNo)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if res.Currency != currency {
+			continue
+		}
+
+		balance, err := t.parse_amount(res.Currency, res.PeriodToDateBalance)
+		if err != nil {
+			return shim.Error("Corrupt period-to-date balance on account " + res.AccountNo)
+		}
+		bookValue, err := money.New(currency, balance).Convert(revaluationAccount.Currency, bookRate)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		revaluedBalance, err := money.New(currency, balance).Convert(revaluationAccount.Currency, closingRate)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		difference, err := revaluedBalance.Sub(bookValue)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		totalDifference, err = money.AddUnits(totalDifference, difference.Units)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		revaluation.Entries = append(revaluation.Entries, RevaluationEntry{AccountNo: res.AccountNo, OriginalBalance: t.format_amount(currency, balance), BookValue: bookValue.String(), RevaluedBalance: revaluedBalance.String(), Difference: difference.String()})
+	}
+	if len(revaluation.Entries) == 0 {
+		return shim.Error("There are no accounts held in " + currency)
+	}
+	revaluation.TotalDifference = t.format_amount(revaluationAccount.Currency, totalDifference)
+
+	txn, err := t.post_transaction(stub, &revaluationAccount, totalDifference, Transaction{Type: REVALUATION, Reason: "Unrealized revaluation of " + currency + " at " + args[1]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	revaluation.TransactionId = txn.TransactionId
+	revaluation.Timestamp = txn.Timestamp
+
+	key, err := stub.CreateCompositeKey(revaluationPrefix, []string{revaluation.RevaluationId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	jsonAsBytes, _ := json.Marshal(revaluation)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = stub.PutState(runKey, []byte(revaluation.RevaluationId))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Get Revaluation - Read a revaluation record by its id (the transaction id of the revalue invoke)
+// ============================================================================================================================
+func (t *SimpleChaincode) get_revaluation(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	key, err := stub.CreateCompositeKey(revaluationPrefix, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	revaluationAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error("Failed to get revaluation " + args[0])
+	}
+	if revaluationAsBytes == nil {
+		return shim.Error("Revaluation " + args[0] + " does not exist")
+	}
+
+	return shim.Success(revaluationAsBytes)
+}
+
+// ============================================================================================================================
+// Get Account Index - Read the list of account numbers stored in the world state
+// ============================================================================================================================
+func (t *SimpleChaincode) get_account_index(stub shim.ChaincodeStubInterface) ([]string, error) {
+	return index.IDs(stub, accountIndexName)
+}
+
+// ============================================================================================================================
+// Migrate Account Index - Add every account of the JSON array index of an earlier version to the account index and
+//						   remove the array
+// ============================================================================================================================
+func (t *SimpleChaincode) migrate_account_index(stub shim.ChaincodeStubInterface) error {
+	accountsAsBytes, err := stub.GetState(legacyAccountIndexStr)
+	if err != nil {
+		return fmt.Errorf("Failed to get account index")
+	}
+	if accountsAsBytes == nil {
+		return nil
+	}
+	var legacyIndex []string
+	err = json.Unmarshal(accountsAsBytes, &legacyIndex)
+	if err != nil {
+		return fmt.Errorf("Corrupt account index")
+	}
+
+	for _, accountNo := range legacyIndex {
+		err = index.CreateIndex(stub, accountIndexName, []string{accountNo})
+		if err != nil {
+			return err
+		}
+	}
+	err = stub.DelState(legacyAccountIndexStr)
+	if err != nil {
+		return fmt.Errorf("Failed to remove the legacy account index")
+	}
+	return nil
+}
+
+
+// ============================================================================================================================
+// Propose Netting - Compute the net position between two entities in one currency across all accounts where one is due
+//					 from the other, and store it as a NettingProposal. The smaller gross side is cleared completely and
+//					 the larger side is reduced by the same amount, leaving only the net position.
+// ============================================================================================================================
+func (t *SimpleChaincode) propose_netting(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//     0         1        2
+	// "ENT001", "ENT002", "USD"
+
+	var err error
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		return shim.Error("3rd argument must be a non-empty string")
+	}
+	if args[0] == args[1] {
+		return shim.Error("An entity cannot be netted against itself")
+	}
+
+	proposal := NettingProposal{ProposalId: stub.GetTxID(), EntityA: args[0], EntityB: args[1], Currency: args[2], Status: NETTING_PROPOSED}
+	proposal.ProposedBy, err = t.get_caller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	accountIndex, err := t.get_account_index(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Collect the mutual accounts with a positive balance on each side
+	var aToB, bToA []NettingLine
+	var totalAToB, totalBToA int64
+	for _, accountNo := range accountIndex {
+		res, err := t.get_account(stub, accountNo)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if res.Currency != proposal.Currency {
+			continue
+		}
+		balance, err := t.parse_amount(res.Currency, res.PeriodToDateBalance)
+		if err != nil {
+			return shim.Error("Corrupt period-to-date balance on account " + res.AccountNo)
+		}
+		if balance <= 0 {
+			continue
+		}
+
+		line := NettingLine{AccountNo: res.AccountNo, DueFrom: res.DueFrom, DueTo: res.DueTo, Balance: t.format_amount(res.Currency, balance)}
+		if res.DueFrom == proposal.EntityA && res.DueTo == proposal.EntityB {
+			aToB = append(aToB, line)
+			totalAToB += balance
+		} else if res.DueFrom == proposal.EntityB && res.DueTo == proposal.EntityA {
+			bToA = append(bToA, line)
+			totalBToA += balance
+		}
+	}
+	if totalAToB == 0 || totalBToA == 0 {
+		return shim.Error("There is nothing to net between " + proposal.EntityA + " and " + proposal.EntityB + " in " + proposal.Currency)
+	}
+
+	smaller, larger := bToA, aToB
+	offset := totalBToA
+	proposal.NetDebtor = proposal.EntityA
+	if totalAToB < totalBToA {
+		smaller, larger = aToB, bToA
+		offset = totalAToB
+		proposal.NetDebtor = proposal.EntityB
+	}
+
+	for i := range smaller {
+		balance, _ := t.parse_amount(proposal.Currency, smaller[i].Balance)
+		smaller[i].Offset = t.format_amount(proposal.Currency, -balance)
+	}
+	remaining := offset
+	for i := range larger {
+		balance, _ := t.parse_amount(proposal.Currency, larger[i].Balance)
+		amount := balance
+		if amount > remaining {
+			amount = remaining
+		}
+		remaining -= amount
+		larger[i].Offset = t.format_amount(proposal.Currency, -amount)
+	}
+
+	proposal.Lines = append(aToB, bToA...)
+	proposal.TotalAToB = t.format_amount(proposal.Currency, totalAToB)
+	proposal.TotalBToA = t.format_amount(proposal.Currency, totalBToA)
+	if totalAToB > totalBToA {
+		proposal.NetAmount = t.format_amount(proposal.Currency, totalAToB - totalBToA)
+	} else {
+		proposal.NetAmount = t.format_amount(proposal.Currency, totalBToA - totalAToB)
+	}
+
+	err = t.save_netting_proposal(stub, proposal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emit_event(stub, "propose_netting", proposal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	jsonAsBytes, _ := json.Marshal(proposal)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Execute Netting - Confirm a netting proposal on behalf of the caller's entity (taken from the entity attribute of the
+//					 caller's certificate). Once both entities have confirmed, the offsetting entries are posted provided
+//					 none of the balances changed since the proposal was made.
+// ============================================================================================================================
+func (t *SimpleChaincode) execute_netting(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "proposalId"
+
+	var err error
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	proposal, err := t.get_netting_proposal(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if proposal.Status != NETTING_PROPOSED {
+		return shim.Error("Netting proposal " + proposal.ProposalId + " is " + proposal.Status)
+	}
+
+	entity, found, err := cid.GetAttributeValue(stub, entityAttribute)
+	if err != nil || !found {
+		return shim.Error("Permission Denied. execute_netting requires the " + entityAttribute + " attribute")
+	}
+	caller, err := t.get_caller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if entity == proposal.EntityA && proposal.ConfirmedByA == "" {
+		proposal.ConfirmedByA = caller
+	} else if entity == proposal.EntityB && proposal.ConfirmedByB == "" {
+		proposal.ConfirmedByB = caller
+	} else if entity == proposal.EntityA || entity == proposal.EntityB {
+		return shim.Error("Netting proposal " + proposal.ProposalId + " has already been confirmed by " + entity)
+	} else {
+		return shim.Error("Permission Denied. " + entity + " is not a party to netting proposal " + proposal.ProposalId)
+	}
+
+	if proposal.ConfirmedByA == "" || proposal.ConfirmedByB == "" {
+		err = t.save_netting_proposal(stub, proposal)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = t.emit_event(stub, "confirm_netting", proposal)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(nil)
+	}
+
+	for _, line := range proposal.Lines {
+		res, err := t.get_account(stub, line.AccountNo)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		balance, err := t.parse_amount(res.Currency, res.PeriodToDateBalance)
+		if err != nil {
+			return shim.Error("Corrupt period-to-date balance on account " + res.AccountNo)
+		}
+		if t.format_amount(res.Currency, balance) != line.Balance {
+			return shim.Error("The balance of account " + line.AccountNo + " changed since netting proposal " + proposal.ProposalId + " was made, propose the netting again")
+		}
+		offset, err := t.parse_amount(res.Currency, line.Offset)
+		if err != nil {
+			return shim.Error("Corrupt offset on netting proposal " + proposal.ProposalId)
+		}
+		if offset == 0 {
+			continue
+		}
+		txn, err := t.post_transaction(stub, &res, offset, Transaction{Type: NETTING, Reason: "Netting " + proposal.ProposalId})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		proposal.TransactionIds = append(proposal.TransactionIds, txn.TransactionId)
+	}
+	proposal.Status = NETTING_EXECUTED
+
+	err = t.save_netting_proposal(stub, proposal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emit_event(stub, "execute_netting", proposal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Get Netting Proposal - Retrieve a netting proposal by its id
+// ============================================================================================================================
+func (t *SimpleChaincode) get_netting_proposal(stub shim.ChaincodeStubInterface, proposalId string) (NettingProposal, error) {
+	proposal := NettingProposal{}
+
+	key, err := stub.CreateCompositeKey(nettingPrefix, []string{proposalId})
+	if err != nil {
+		return proposal, err
+	}
+	proposalAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return proposal, fmt.Errorf("Failed to get netting proposal %s", proposalId)
+	}
+	if proposalAsBytes == nil {
+		return proposal, fmt.Errorf("Netting proposal %s does not exist", proposalId)
+	}
+
+	err = json.Unmarshal(proposalAsBytes, &proposal)
+	if err != nil {
+		return proposal, fmt.Errorf("Corrupt netting proposal %s", proposalId)
+	}
+
+	return proposal, nil
+}
+
+// ============================================================================================================================
+// Save Netting Proposal - Write a netting proposal into the world state
+// ============================================================================================================================
+func (t *SimpleChaincode) save_netting_proposal(stub shim.ChaincodeStubInterface, proposal NettingProposal) error {
+	key, err := stub.CreateCompositeKey(nettingPrefix, []string{proposal.ProposalId})
+	if err != nil {
+		return err
+	}
+
+	jsonAsBytes, err := json.Marshal(proposal)
+	if err != nil {
+		return fmt.Errorf("Error converting netting proposal %s", proposal.ProposalId)
+	}
+
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return fmt.Errorf("Error storing netting proposal %s", proposal.ProposalId)
+	}
+
+	return nil
+}
+
+
+// ============================================================================================================================
+// Mark Reconciled - Stamp an account's period as reconciled by the calling identity with a reconciliation reference
+// ============================================================================================================================
+func (t *SimpleChaincode) mark_reconciled(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0           1           2
+	// "accountNo", "2017-06", "REC-2017-06-014"
+
+	var err error
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		return shim.Error("3rd argument must be a non-empty string")
+	}
+
+	res, err := t.get_account(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	reconciliation := Reconciliation{AccountNo: res.AccountNo, Period: args[1], Status: RECONCILED, Reference: args[2]}
+	reconciliation.ReconciledBy, err = t.get_caller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	reconciliation.Timestamp, err = t.get_timestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.save_reconciliation(stub, reconciliation)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Get Unreconciled - List every account that is not reconciled for a period, either because it never was or because
+//					  it was posted to after being reconciled
+// ============================================================================================================================
+func (t *SimpleChaincode) get_unreconciled(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//     0
+	// "2017-06"
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	period := args[0]
+
+	accountIndex, err := t.get_account_index(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	unreconciled := []Reconciliation{}
+	for _, accountNo := range accountIndex {
+		reconciliation, err := t.get_reconciliation(stub, accountNo, period)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if reconciliation.Status != RECONCILED {
+			unreconciled = append(unreconciled, reconciliation)
+		}
+	}
+
+	jsonAsBytes, _ := json.Marshal(unreconciled)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Flag For Review - Move a reconciled account/period back to requires-review when a transaction is posted into it
+// ============================================================================================================================
+func (t *SimpleChaincode) flag_for_review(stub shim.ChaincodeStubInterface, txn Transaction) error {
+	reconciliation, err := t.get_reconciliation(stub, txn.AccountNo, txn.Period)
+	if err != nil {
+		return err
+	}
+	if reconciliation.Status != RECONCILED {
+		return nil
+	}
+
+	reconciliation.Status = REQUIRES_REVIEW
+	reconciliation.ReviewTransactionId = txn.TransactionId
+	return t.save_reconciliation(stub, reconciliation)
+}
+
+// ============================================================================================================================
+// Get Reconciliation - Read the reconciliation status of an account for a period, unreconciled if none was recorded
+// ============================================================================================================================
+func (t *SimpleChaincode) get_reconciliation(stub shim.ChaincodeStubInterface, accountNo string, period string) (Reconciliation, error) {
+	reconciliation := Reconciliation{AccountNo: accountNo, Period: period, Status: UNRECONCILED}
+
+	key, err := stub.CreateCompositeKey(reconciliationPrefix, []string{period, accountNo})
+	if err != nil {
+		return reconciliation, err
+	}
+	reconciliationAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return reconciliation, fmt.Errorf("Failed to get reconciliation of account %s for %s", accountNo, period)
+	}
+	if reconciliationAsBytes == nil {
+		return reconciliation, nil
+	}
+
+	err = json.Unmarshal(reconciliationAsBytes, &reconciliation)
+	if err != nil {
+		return reconciliation, fmt.Errorf("Corrupt reconciliation of account %s for %s", accountNo, period)
+	}
+
+	return reconciliation, nil
+}
+
+// ============================================================================================================================
+// Save Reconciliation - Write a reconciliation status into the world state
+// ============================================================================================================================
+func (t *SimpleChaincode) save_reconciliation(stub shim.ChaincodeStubInterface, reconciliation Reconciliation) error {
+	key, err := stub.CreateCompositeKey(reconciliationPrefix, []string{reconciliation.Period, reconciliation.AccountNo})
+	if err != nil {
+		return err
+	}
+
+	jsonAsBytes, err := json.Marshal(reconciliation)
+	if err != nil {
+		return fmt.Errorf("Error converting reconciliation of account %s", reconciliation.AccountNo)
+	}
+
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return fmt.Errorf("Error storing reconciliation of account %s", reconciliation.AccountNo)
+	}
+
+	return nil
+}
+
+
+// ============================================================================================================================
+// Create Recurring Template - Store a standing posting for an account. The template id is the transaction id of this
+//							   invoke and is returned in the payload.
+// ============================================================================================================================
+func (t *SimpleChaincode) create_recurring_template(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0           1               2                  3
+	// "accountNo", "1250.00", "Management fee recharge", "monthly"
+
+	var err error
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		return shim.Error("3rd argument must be a non-empty string")
+	}
+	if args[3] != MONTHLY && args[3] != QUARTERLY && args[3] != YEARLY {
+		return shim.Error("4th argument must be one of " + MONTHLY + ", " + QUARTERLY + " or " + YEARLY)
+	}
+
+	res, err := t.get_account(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amount, err := t.parse_amount(res.Currency, args[1])
+	if err != nil || amount == 0 {
+		return shim.Error("2nd argument must be a non-zero decimal string with at most " + strconv.Itoa(money.Decimals(res.Currency)) + " decimals")
+	}
+
+	template := RecurringTemplate{TemplateId: stub.GetTxID(), AccountNo: res.AccountNo, Amount: t.format_amount(res.Currency, amount), Memo: args[2], Frequency: args[3]}
+	template.CreatedBy, err = t.get_caller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := stub.CreateCompositeKey(recurringPrefix, []string{template.TemplateId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	jsonAsBytes, _ := json.Marshal(template)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Get Recurring Templates - List every recurring template
+// ============================================================================================================================
+func (t *SimpleChaincode) get_recurring_templates(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	templates, err := t.get_all_recurring_templates(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	jsonAsBytes, _ := json.Marshal(templates)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Run Recurring - Post every recurring template that is due in its account's current period and has not been posted
+//				   for that period yet. Returns the transactions posted; templates above the approval threshold are
+//				   held as pending postings instead and count as run for the period.
+// ============================================================================================================================
+func (t *SimpleChaincode) run_recurring(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	templates, err := t.get_all_recurring_templates(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// GetState does not see this transaction's own writes, so accounts posted to more than once are kept here
+	accounts := map[string]*Account{}
+	posted := []Transaction{}
+	for _, template := range templates {
+		res, ok := accounts[template.AccountNo]
+		if !ok {
+			account, err := t.get_account(stub, template.AccountNo)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			res = &account
+			accounts[template.AccountNo] = res
+		}
+		if !t.is_recurring_due(template.Frequency, res.Period) {
+			continue
+		}
+
+		runKey, err := stub.CreateCompositeKey(recurringRunPrefix, []string{template.TemplateId, res.Period})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		runAsBytes, err := stub.GetState(runKey)
+		if err != nil {
+			return shim.Error("Failed to get the run of recurring template " + template.TemplateId)
+		}
+		if runAsBytes != nil {
+			continue
+		}
+
+		amount, err := t.parse_amount(res.Currency, template.Amount)
+		if err != nil {
+			return shim.Error("Corrupt amount on recurring template " + template.TemplateId)
+		}
+		reason := "Recurring template " + template.TemplateId
+		txn, err := t.post_transaction(stub, res, amount, Transaction{Type: RECURRING, Memo: template.Memo, Reason: reason})
+		if errors.Is(err, errApprovalRequired) {
+			posting, err := t.hold_posting(stub, PendingPosting{PostingId: stub.GetTxID() + ":" + template.TemplateId, Type: RECURRING, AccountNo: res.AccountNo, Amount: template.Amount, Memo: template.Memo, RequestReason: reason})
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			err = stub.PutState(runKey, []byte(posting.PostingId))
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			continue
+		}
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		err = stub.PutState(runKey, []byte(txn.TransactionId))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		posted = append(posted, txn)
+	}
+
+	jsonAsBytes, _ := json.Marshal(posted)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Is Recurring Due - Monthly templates are due every period, quarterly ones in periods ending a quarter and yearly ones
+//					  in December
+// ============================================================================================================================
+func (t *SimpleChaincode) is_recurring_due(frequency string, period string) bool {
+	if frequency == MONTHLY {
+		return true
+	}
+
+	date, err := time.Parse("2006-01", period)
+	if err != nil {
+		return false
+	}
+	if frequency == QUARTERLY {
+		return date.Month() % 3 == 0
+	}
+	return frequency == YEARLY && date.Month() == time.December
+}
+
+// ============================================================================================================================
+// Get All Recurring Templates - Read every recurring template from the world state
+// ============================================================================================================================
+func (t *SimpleChaincode) get_all_recurring_templates(stub shim.ChaincodeStubInterface) ([]RecurringTemplate, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(recurringPrefix, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get recurring templates")
+	}
+	defer resultsIterator.Close()
+
+	templates := []RecurringTemplate{}
+	for resultsIterator.HasNext() {
+		result, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		template := RecurringTemplate{}
+		err = json.Unmarshal(result.Value, &template)
+		if err != nil {
+			return nil, fmt.Errorf("Corrupt recurring template %s", result.Key)
+		}
+		templates = append(templates, template)
+	}
+
+	return templates, nil
+}
+
+
+// ============================================================================================================================
+// Close Account - Close an account whose period-to-date balance is zero, or transfer the residual balance to a
+//				   destination account in the same currency first. A closed account is removed from the account index
+//				   and rejects any further postings. When the residual balance is above the approval threshold the
+//				   transfer is held as a PendingPosting, the account is closed once it is approved and the payload is
+//				   a PostingResponse.
+// ============================================================================================================================
+func (t *SimpleChaincode) close_account(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0                1
+	// "accountNo", "destinationAccountNo"
+
+	var err error
+
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	res, err := t.get_account(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if res.Status == CLOSED {
+		return shim.Error("Account " + res.AccountNo + " is already closed")
+	}
+
+	balance, err := t.parse_amount(res.Currency, res.PeriodToDateBalance)
+	if err != nil {
+		return shim.Error("Corrupt period-to-date balance on account " + res.AccountNo)
+	}
+
+	if balance != 0 {
+		if len(args) != 2 || len(args[1]) <= 0 {
+			return shim.Error("Account " + res.AccountNo + " has a balance of " + res.PeriodToDateBalance + ", a destination account is required")
+		}
+		if args[1] == res.AccountNo {
+			return shim.Error("The destination account must differ from the account being closed")
+		}
+		destination, err := t.get_account(stub, args[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if destination.Currency != res.Currency {
+			return shim.Error("The destination account must be held in " + res.Currency)
+		}
+
+		reason := "Closing transfer from " + res.AccountNo + " to " + destination.AccountNo
+		_, err = t.post_transfer(stub, &res, &destination, balance, Transaction{Type: CLOSING_TRANSFER, Reason: reason})
+		if errors.Is(err, errApprovalRequired) {
+			return t.hold_for_approval(stub, PendingPosting{Type: CLOSING_TRANSFER, AccountNo: res.AccountNo, ToAccountNo: destination.AccountNo, Amount: t.format_amount(res.Currency, balance), RequestReason: reason})
+		}
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	err = t.mark_closed(stub, res)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Mark Closed - Save an account as closed and remove it from the account indexes
+// ============================================================================================================================
+func (t *SimpleChaincode) mark_closed(stub shim.ChaincodeStubInterface, res Account) error {
+	res.Status = CLOSED
+	err := t.save_account(stub, res)
+	if err != nil {
+		return err
+	}
+
+	err = t.unindex_account(stub, res)
+	if err != nil {
+		return err
+	}
+
+	return index.RemoveIndex(stub, accountIndexName, []string{res.AccountNo})
+}
+
+
+// ============================================================================================================================
+// Bulk Create Accounts - Create every account in a JSON array of account definitions (the same fields as an account
+//						  record). Each definition, including the posting of its activity, is validated on its own before
+//						  anything is written; valid ones are created and the payload reports the outcome of every record.
+//						  An activity above the approval threshold is held as a PendingPosting named in the result.
+//						  A write that fails fails the whole batch, so no account is left half created.
+// ============================================================================================================================
+func (t *SimpleChaincode) bulk_create_accounts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "[{"accountNo": "1000", "dueTo": "ENT001", "dueFrom": "ENT002", "currency": "USD", "period": "2017-06",
+	//    "openingBalance": "45000.00", "activity": "3000.00", "transactionType": "Cash Transactions"}, ...]"
+
+	var err error
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	var definitions []Account
+	err = json.Unmarshal([]byte(args[0]), &definitions)
+	if err != nil {
+		return shim.Error("1st argument must be a JSON array of account definitions")
+	}
+
+	results := []BulkResult{}
+	seen := map[string]bool{}
+	for i, definition := range definitions {
+		result := BulkResult{Index: i, AccountNo: definition.AccountNo}
+
+		res, activity, err := t.validate_account_definition(definition)
+		if err == nil && seen[res.AccountNo] {
+			err = fmt.Errorf("Account %s appears more than once in the batch", res.AccountNo)
+		}
+		if err == nil {
+			var existing []byte
+			existing, err = stub.GetState(res.AccountNo)
+			if err == nil && existing != nil {
+				err = fmt.Errorf("This account arleady exists")
+			}
+		}
+		hold := false
+		if err == nil && activity != 0 {
+			err = t.check_posting(stub, res, activity, Transaction{Type: ACTIVITY})
+			if errors.Is(err, errApprovalRequired) {
+				hold, err = true, nil
+			}
+		}
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+
+		// The initial activity is posted on the in-memory account, which post_transaction saves with it
+		if activity != 0 && !hold {
+			_, err = t.post_transaction(stub, &res, activity, Transaction{Type: ACTIVITY})
+		} else {
+			err = t.save_account(stub, res)
+		}
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if hold {
+			posting, err := t.hold_posting(stub, PendingPosting{PostingId: stub.GetTxID() + ":" + strconv.Itoa(i), AccountNo: res.AccountNo, Amount: t.format_amount(res.Currency, activity)})
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			result.PostingId = posting.PostingId
+		}
+		err = t.index_account(stub, res)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = index.CreateIndex(stub, accountIndexName, []string{res.AccountNo})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		result.Created = true
+		seen[res.AccountNo] = true
+		results = append(results, result)
+	}
+
+	jsonAsBytes, _ := json.Marshal(results)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Validate Account Definition - Check an account definition has every field create_account requires and numeric
+//								 balances. Returns the account to store, with its activity still to be posted.
+// ============================================================================================================================
+func (t *SimpleChaincode) validate_account_definition(definition Account) (Account, int64, error) {
+	fields := []string{definition.AccountNo, definition.DueTo, definition.DueFrom, definition.Currency, definition.Period, definition.OpeningBalance, definition.Activity, definition.TransactionType}
+	names := []string{"accountNo", "dueTo", "dueFrom", "currency", "period", "openingBalance", "activity", "transactionType"}
+	for i, field := range fields {
+		if len(field) <= 0 {
+			return Account{}, 0, fmt.Errorf("%s must be a non-empty string", names[i])
+		}
+	}
+
+	decimals := money.Decimals(definition.Currency)
+	openingBalance, err := t.parse_amount(definition.Currency, definition.OpeningBalance)
+	if err != nil {
+		return Account{}, 0, fmt.Errorf("openingBalance must be a decimal string with at most %d decimals", decimals)
+	}
+	activity, err := t.parse_amount(definition.Currency, definition.Activity)
+	if err != nil {
+		return Account{}, 0, fmt.Errorf("activity must be a decimal string with at most %d decimals", decimals)
+	}
+
+	if definition.CreditLimit != "" {
+		limit, err := t.parse_amount(definition.Currency, definition.CreditLimit)
+		if err != nil || limit <= 0 {
+			return Account{}, 0, fmt.Errorf("creditLimit must be a positive decimal string with at most %d decimals", decimals)
+		}
+		definition.CreditLimit = t.format_amount(definition.Currency, limit)
+	}
+
+	res := Account{AccountNo: definition.AccountNo, DueTo: definition.DueTo, DueFrom: definition.DueFrom, Currency: definition.Currency, Period: definition.Period, TransactionType: definition.TransactionType, AccountName: definition.AccountName, AllowNegative: definition.AllowNegative, CreditLimit: definition.CreditLimit, Tags: definition.Tags}
+	res.OpeningBalance = t.format_amount(res.Currency, openingBalance)
+	res.Activity = t.format_amount(res.Currency, 0)
+	res.PeriodToDateBalance = res.OpeningBalance
+
+	return res, activity, nil
+}
+
+// ============================================================================================================================
+// Get Accounts By Entity - List the open accounts an entity is due to or due from, using the entity~account index
+// ============================================================================================================================
+func (t *SimpleChaincode) get_accounts_by_entity(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//     0
+	// "ENT001"
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	accountNos, err := index.IDs(stub, entityAccountPrefix, args[0])
+	if err != nil {
+		return shim.Error("Failed to get accounts of entity " + args[0])
+	}
+
+	accounts := []Account{}
+	for _, accountNo := range accountNos {
+		res, err := t.get_account(stub, accountNo)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		accounts = append(accounts, res)
+	}
+
+	jsonAsBytes, _ := json.Marshal(accounts)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Index Account - Write the entity~account composite keys of an account for both its due to and due from entity
+// ============================================================================================================================
+func (t *SimpleChaincode) index_account(stub shim.ChaincodeStubInterface, res Account) error {
+	for _, entity := range []string{res.DueTo, res.DueFrom} {
+		err := index.CreateIndex(stub, entityAccountPrefix, []string{entity, res.AccountNo})
+		if err != nil {
+			return fmt.Errorf("Error indexing account %s", res.AccountNo)
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Unindex Account - Remove the entity~account composite keys of an account
+// ============================================================================================================================
+func (t *SimpleChaincode) unindex_account(stub shim.ChaincodeStubInterface, res Account) error {
+	for _, entity := range []string{res.DueTo, res.DueFrom} {
+		err := index.RemoveIndex(stub, entityAccountPrefix, []string{entity, res.AccountNo})
+		if err != nil {
+			return fmt.Errorf("Error removing the index of account %s", res.AccountNo)
+		}
+	}
+	return nil
+}
+
+
+// ============================================================================================================================
+// Query Accounts - Page through the accounts whose transactionType or currency equals a value. Uses a CouchDB rich query
+//					and falls back to filtering a range scan when the peer's state database is LevelDB, in which case a
+//					page can hold fewer matches than the page size even though more follow.
+// ============================================================================================================================
+func (t *SimpleChaincode) query_accounts(stub shim.ChaincodeStubInterface, field string, args []string) pb.Response {
+
+	//           0               1        2
+	// "Cash Transactions",    "20",   "bookmark"
+
+	if len(args) < 2 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	pageSize, err := strconv.ParseInt(args[1], 10, 32)
+	if err != nil || pageSize <= 0 {
+		return shim.Error("2nd argument must be a positive integer")
+	}
+	bookmark := ""
+	if len(args) == 3 {
+		bookmark = args[2]
+	}
+
+	// periodToDateBalance keeps other records with a currency field (revaluations, netting proposals) out of the result
+	selector := map[string]interface{}{field: args[0], "periodToDateBalance": map[string]bool{"$exists": true}}
+	queryAsBytes, _ := json.Marshal(map[string]interface{}{"selector": selector})
+
+	page := AccountPage{Records: []Account{}}
+	resultsIterator, metadata, err := stub.GetQueryResultWithPagination(string(queryAsBytes), int32(pageSize), bookmark)
+	if err != nil {
+		resultsIterator, metadata, err = stub.GetStateByRangeWithPagination("", "", int32(pageSize), bookmark)
+		if err != nil {
+			return shim.Error("Failed to query accounts by " + field)
+		}
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		result, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		res := Account{}
+		if json.Unmarshal(result.Value, &res) != nil || res.AccountNo == "" || res.PeriodToDateBalance == "" {
+			continue
+		}
+		if (field == "transactionType" && res.TransactionType != args[0]) || (field == "currency" && res.Currency != args[0]) {
+			continue
+		}
+		page.Records = append(page.Records, res)
+	}
+	page.FetchedRecordsCount = int32(len(page.Records))
+	if metadata != nil {
+		page.Bookmark = metadata.Bookmark
+	}
+
+	jsonAsBytes, _ := json.Marshal(page)
+	return shim.Success(jsonAsBytes)
+}
+
+
+// ============================================================================================================================
+// Get Account History - Return every historical version of an account record with the id and timestamp of the
+//						 transaction that wrote it, oldest first. Needs the history database enabled on the peer.
+// ============================================================================================================================
+func (t *SimpleChaincode) get_account_history(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "accountNo"
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	versions, err := t.get_account_versions(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	jsonAsBytes, _ := json.Marshal(versions)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Get Balance At - Reconstruct the balances of an account as of a date (RFC 3339, or YYYY-MM-DD for the end of that day
+//					in UTC) from the last version of the account written at or before it
+// ============================================================================================================================
+func (t *SimpleChaincode) get_balance_at(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0             1
+	// "accountNo", "2017-06-30"
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	asOf, err := time.Parse(time.RFC3339, args[1])
+	if err != nil {
+		day, err := time.Parse("2006-01-02", args[1])
+		if err != nil {
+			return shim.Error("2nd argument must be a date in RFC 3339 or YYYY-MM-DD format")
+		}
+		asOf = day.Add(24 * time.Hour - time.Nanosecond)
+	}
+
+	versions, err := t.get_account_versions(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var found *AccountVersion
+	for i := range versions {
+		timestamp, err := time.Parse(time.RFC3339, versions[i].Timestamp)
+		if err != nil {
+			return shim.Error("Corrupt timestamp on transaction " + versions[i].TxID)
+		}
+		if timestamp.After(asOf) {
+			break
+		}
+		found = &versions[i]
+	}
+	if found == nil || found.IsDelete {
+		return shim.Error("Account " + args[0] + " did not exist on " + args[1])
+	}
+
+	balance := BalanceAt{AccountNo: args[0], AsOf: asOf.Format(time.RFC3339), TxID: found.TxID, Timestamp: found.Timestamp, Balances: t.balances_of(*found.Account)}
+	jsonAsBytes, _ := json.Marshal(balance)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Get Account Versions - Read the history of an account key, oldest first
+// ============================================================================================================================
+func (t *SimpleChaincode) get_account_versions(stub shim.ChaincodeStubInterface, accountNo string) ([]AccountVersion, error) {
+	resultsIterator, err := stub.GetHistoryForKey(accountNo)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the history of account %s", accountNo)
+	}
+	defer resultsIterator.Close()
+
+	versions := []AccountVersion{}
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		version := AccountVersion{TxID: modification.TxId, IsDelete: modification.IsDelete}
+		if modification.Timestamp != nil {
+			version.Timestamp = time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos)).UTC().Format(time.RFC3339)
+		}
+		if !modification.IsDelete {
+			res := Account{}
+			err = json.Unmarshal(modification.Value, &res)
+			if err != nil {
+				return nil, fmt.Errorf("Corrupt version of account %s in transaction %s", accountNo, modification.TxId)
+			}
+			version.Account = &res
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, nil
+}
+
+
+// ============================================================================================================================
+// Transfer Between Accounts - Move an amount from one account to another in the same currency as a linked pair of
+//							   transactions. A source account that does not allow a negative balance must hold enough
+//							   balance, which post_transaction enforces. A transfer above the approval threshold is held
+//							   as a PendingPosting and the payload is then a PostingResponse instead of the transactions.
+// ============================================================================================================================
+func (t *SimpleChaincode) transfer_between_accounts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//       0              1          2             3
+	// "fromAccountNo", "toAccountNo", "500.00", "Cash pooling sweep"
+
+	var err error
+
+	if len(args) < 3 || len(args) > 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	if args[0] == args[1] {
+		return shim.Error("Cannot transfer from an account to itself")
+	}
+	_, err = money.ParseDecimal(args[2])
+	if err != nil {
+		return shim.Error("3rd argument must be a positive decimal string")
+	}
+	memo := ""
+	if len(args) == 4 {
+		memo = args[3]
+	}
+
+	from, err := t.get_account(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := t.get_account(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amount, err := t.parse_amount(from.Currency, args[2])
+	if err != nil || amount <= 0 {
+		return shim.Error("3rd argument must be a positive decimal string with at most " + strconv.Itoa(money.Decimals(from.Currency)) + " decimals")
+	}
+
+	transactions, err := t.post_transfer(stub, &from, &to, amount, Transaction{Type: TRANSFER, Memo: memo})
+	if errors.Is(err, errApprovalRequired) {
+		return t.hold_for_approval(stub, PendingPosting{Type: TRANSFER, AccountNo: from.AccountNo, ToAccountNo: to.AccountNo, Amount: t.format_amount(from.Currency, amount), Memo: memo})
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emit_event(stub, "transfer_between_accounts", transactions)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	jsonAsBytes, _ := json.Marshal(transactions)
+	return shim.Success(jsonAsBytes)
+}
+
+
+// ============================================================================================================================
+// Post Transfer - Debit an amount from one account and credit it to another in the same currency as a pair of
+//				   transactions linked to each other. The caller fills in the type and the type specific fields of txn,
+//				   which both transactions get. Returns the debit and the credit.
+// ============================================================================================================================
+func (t *SimpleChaincode) post_transfer(stub shim.ChaincodeStubInterface, from *Account, to *Account, amount int64, txn Transaction) ([]Transaction, error) {
+	if from.Currency != to.Currency {
+		return nil, fmt.Errorf("Cannot transfer between %s and %s accounts", from.Currency, to.Currency)
+	}
+
+	debit := txn
+	debit.LinkedTransactionId = t.next_transaction_id(*to)
+	credit := txn
+	credit.LinkedTransactionId = t.next_transaction_id(*from)
+
+	debit, err := t.post_transaction(stub, from, -amount, debit)
+	if err != nil {
+		return nil, err
+	}
+	credit, err = t.post_transaction(stub, to, amount, credit)
+	if err != nil {
+		return nil, err
+	}
+
+	return []Transaction{debit, credit}, nil
+}
+
+
+// ============================================================================================================================
+// Set Approval Threshold - Admin-only. Sets the threshold of one currency: postings to accounts held in it whose
+//							absolute amount exceeds the threshold are held as a pending posting until approved, see
+//							approvalExemptTypes for the ones that are not. An empty threshold switches approval off for
+//							the currency, as does never setting one.
+// ============================================================================================================================
+func (t *SimpleChaincode) set_approval_threshold(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//    0          1
+	// "USD", "100000.00"
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	currency := args[0]
+	threshold := ""
+	if len(args[1]) > 0 {
+		units, err := money.ParseUnits(args[1], money.Decimals(currency))
+		if err != nil || units < 0 {
+			return shim.Error("2nd argument must be empty or a non-negative decimal string with at most " + strconv.Itoa(money.Decimals(currency)) + " decimals")
+		}
+		threshold = t.format_amount(currency, units)
+	}
+
+	if !t.is_admin(stub) {
+		return shim.Error("Permission Denied. set_approval_threshold requires the " + adminAttribute + " attribute")
+	}
+
+	config, err := t.get_config(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if config.ApprovalThresholds == nil {
+		config.ApprovalThresholds = map[string]string{}
+	}
+	if threshold == "" {
+		delete(config.ApprovalThresholds, currency)
+	} else {
+		config.ApprovalThresholds[currency] = threshold
+	}
+
+	jsonAsBytes, _ := json.Marshal(config)
+	err = stub.PutState(configStr, jsonAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Approve Posting - Post a pending posting. Requires the approver attribute and a different identity than the one that
+//					 requested the posting. Reversals, transfers and closing transfers are checked again as when they
+//					 were requested, since the accounts may have changed in between. The payload is a PostingResponse.
+// ============================================================================================================================
+func (t *SimpleChaincode) approve_posting(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "postingId"
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	posting, err := t.decide_posting(stub, args[0], APPROVED, "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	res, err := t.get_account(stub, posting.AccountNo)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amount, err := t.parse_amount(res.Currency, posting.Amount)
+	if err != nil {
+		return shim.Error("Corrupt amount on pending posting " + posting.PostingId)
+	}
+
+	before := t.balances_of(res)
+	var txn Transaction
+	switch posting.Type {
+	case REVERSAL:
+		original, err := t.get_transaction(stub, posting.ReversalOf)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		txn, err = t.post_reversal(stub, &res, original, Transaction{PostingId: posting.PostingId, Reason: posting.RequestReason})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	case TRANSFER, CLOSING_TRANSFER:
+		if posting.Type == CLOSING_TRANSFER && res.PeriodToDateBalance != posting.Amount {
+			return shim.Error("The balance of account " + res.AccountNo + " changed since closing it was requested, close it again")
+		}
+		to, err := t.get_account(stub, posting.ToAccountNo)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		transactions, err := t.post_transfer(stub, &res, &to, amount, Transaction{Type: posting.Type, PostingId: posting.PostingId, Memo: posting.Memo, Reason: posting.RequestReason})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		txn = transactions[0]
+		if posting.Type == CLOSING_TRANSFER {
+			err = t.mark_closed(stub, res)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	default:
+		txnType := posting.Type
+		if txnType == "" {
+			txnType = ACTIVITY
+		}
+		reason := posting.RequestReason
+		if reason == "" {
+			reason = "Approved posting " + posting.PostingId
+		}
+		txn, err = t.post_transaction(stub, &res, amount, Transaction{Type: txnType, PostingId: posting.PostingId, Reason: reason, Memo: posting.Memo, References: posting.References, DocumentHashes: posting.DocumentHashes})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	posting.TransactionId = txn.TransactionId
+	err = t.save_pending_posting(stub, posting)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.emit_event(stub, "approve_posting", AccountEvent{AccountNo: res.AccountNo, Tags: res.Tags, TransactionId: txn.TransactionId, Before: before, After: t.balances_of(res)})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	jsonAsBytes, _ := json.Marshal(PostingResponse{Status: POSTED, Account: &res, Transaction: &txn, PendingPosting: &posting})
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Reject Posting - Reject a pending posting with a reason. Requires the approver attribute.
+// ============================================================================================================================
+func (t *SimpleChaincode) reject_posting(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0                  1
+	// "postingId", "Duplicate of the June recharge"
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+
+	posting, err := t.decide_posting(stub, args[0], REJECTED, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.save_pending_posting(stub, posting)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Get Pending Postings - List the postings still waiting for approval
+// ============================================================================================================================
+func (t *SimpleChaincode) get_pending_postings(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(pendingPostingPrefix, []string{})
+	if err != nil {
+		return shim.Error("Failed to get pending postings")
+	}
+	defer resultsIterator.Close()
+
+	postings := []PendingPosting{}
+	for resultsIterator.HasNext() {
+		result, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		posting := PendingPosting{}
+		err = json.Unmarshal(result.Value, &posting)
+		if err != nil {
+			return shim.Error("Corrupt pending posting " + result.Key)
+		}
+		if posting.Status == PENDING {
+			postings = append(postings, posting)
+		}
+	}
+
+	jsonAsBytes, _ := json.Marshal(postings)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Requires Approval - Check an amount in the minor units of a currency against the approval threshold of that currency
+// ============================================================================================================================
+func (t *SimpleChaincode) requires_approval(stub shim.ChaincodeStubInterface, currency string, amount int64) (bool, error) {
+	config, err := t.get_config(stub)
+	if err != nil {
+		return false, err
+	}
+	value, found := config.ApprovalThresholds[currency]
+	if !found {
+		return false, nil
+	}
+
+	threshold, err := t.parse_amount(currency, value)
+	if err != nil {
+		return false, fmt.Errorf("Corrupt %s approval threshold in the configuration", currency)
+	}
+	if amount < 0 {
+		amount, err = money.SubUnits(0, amount)
+		if err != nil {
+			return false, err
+		}
+	}
+	return amount > threshold, nil
+}
+
+// ============================================================================================================================
+// Hold Posting - Store a posting as pending instead of applying it. The caller fills in what to post; the posting id is
+//				  the transaction id unless the caller sets one, which it must when holding several in one transaction.
+// ============================================================================================================================
+func (t *SimpleChaincode) hold_posting(stub shim.ChaincodeStubInterface, posting PendingPosting) (PendingPosting, error) {
+	if posting.PostingId == "" {
+		posting.PostingId = stub.GetTxID()
+	}
+	posting.Status = PENDING
+
+	var err error
+	posting.RequestedBy, err = t.get_caller(stub)
+	if err != nil {
+		return posting, err
+	}
+	posting.RequestedAt, err = t.get_timestamp(stub)
+	if err != nil {
+		return posting, err
+	}
+
+	return posting, t.save_pending_posting(stub, posting)
+}
+
+// ============================================================================================================================
+// Hold For Approval - Hold a posting check_posting refused for being above the approval threshold and respond with the
+//					   PostingResponse carrying the PendingPosting
+// ============================================================================================================================
+func (t *SimpleChaincode) hold_for_approval(stub shim.ChaincodeStubInterface, posting PendingPosting) pb.Response {
+	posting, err := t.hold_posting(stub, posting)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	jsonAsBytes, _ := json.Marshal(PostingResponse{Status: PENDING, PendingPosting: &posting})
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Decide Posting - Check the caller may decide on a pending posting and stamp the decision on it
+// ============================================================================================================================
+func (t *SimpleChaincode) decide_posting(stub shim.ChaincodeStubInterface, postingId string, status string, reason string) (PendingPosting, error) {
+	posting := PendingPosting{}
+
+	value, found, err := cid.GetAttributeValue(stub, approverAttribute)
+	if err != nil || !found || value != "true" {
+		return posting, fmt.Errorf("Permission Denied. Deciding on pending postings requires the %s attribute", approverAttribute)
+	}
+
+	key, err := stub.CreateCompositeKey(pendingPostingPrefix, []string{postingId})
+	if err != nil {
+		return posting, err
+	}
+	postingAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return posting, fmt.Errorf("Failed to get pending posting %s", postingId)
+	}
+	if postingAsBytes == nil {
+		return posting, fmt.Errorf("Pending posting %s does not exist", postingId)
+	}
+	err = json.Unmarshal(postingAsBytes, &posting)
+	if err != nil {
+		return posting, fmt.Errorf("Corrupt pending posting %s", postingId)
+	}
+	if posting.Status != PENDING {
+		return posting, fmt.Errorf("Pending posting %s has already been %s", postingId, posting.Status)
+	}
+
+	caller, err := t.get_caller(stub)
+	if err != nil {
+		return posting, err
+	}
+	if caller == posting.RequestedBy {
+		return posting, fmt.Errorf("Permission Denied. %s cannot decide on a posting they requested", caller)
+	}
+
+	posting.Status = status
+	posting.DecidedBy = caller
+	posting.Reason = reason
+	posting.DecidedAt, err = t.get_timestamp(stub)
+	if err != nil {
+		return posting, err
+	}
+
+	return posting, nil
+}
+
+// ============================================================================================================================
+// Save Pending Posting - Write a pending posting into the world state
+// ============================================================================================================================
+func (t *SimpleChaincode) save_pending_posting(stub shim.ChaincodeStubInterface, posting PendingPosting) error {
+	key, err := stub.CreateCompositeKey(pendingPostingPrefix, []string{posting.PostingId})
+	if err != nil {
+		return err
+	}
+
+	jsonAsBytes, err := json.Marshal(posting)
+	if err != nil {
+		return fmt.Errorf("Error converting pending posting %s", posting.PostingId)
+	}
+
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return fmt.Errorf("Error storing pending posting %s", posting.PostingId)
+	}
+
+	return nil
+}
+
+
+// ============================================================================================================================
+// Get Transactions By Reference - List every transaction that carries a reference number, e.g. to trace the ledger
+//								   impact of one invoice
+// ============================================================================================================================
+func (t *SimpleChaincode) get_transactions_by_reference(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0
+	// "INV-1001"
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	transactionIds, err := index.IDs(stub, referenceTransactionPrefix, args[0])
+	if err != nil {
+		return shim.Error("Failed to get transactions for reference " + args[0])
+	}
+
+	transactions := []Transaction{}
+	for _, transactionId := range transactionIds {
+		txn, err := t.get_transaction(stub, transactionId)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		transactions = append(transactions, txn)
+	}
+
+	jsonAsBytes, _ := json.Marshal(transactions)
+	return shim.Success(jsonAsBytes)
+}
+
+
+// ============================================================================================================================
+// Migrate Accounts - Admin-only. Rewrite every indexed account still stored with the legacy "accountno" field (or with
+//					  no account number at all), with amounts in scientific notation or with the noOverdraft flag in the
+//					  canonical schema, together with its transactions, then record the new schema version. Running it again once the ledger is at
+//					  the current version does nothing.
+// ============================================================================================================================
+func (t *SimpleChaincode) migrate_accounts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	if !t.is_admin(stub) {
+		return shim.Error("Permission Denied. migrate_accounts requires the " + adminAttribute + " attribute")
+	}
+
+	result := MigrationResult{FromVersion: 1, ToVersion: accountSchemaVersion, Migrated: []string{}}
+	versionAsBytes, err := stub.GetState(schemaVersionStr)
+	if err != nil {
+		return shim.Error("Failed to get the schema version")
+	}
+	if versionAsBytes != nil {
+		result.FromVersion, err = strconv.Atoi(string(versionAsBytes))
+		if err != nil {
+			return shim.Error("Corrupt schema version")
+		}
+	}
+	if result.FromVersion >= accountSchemaVersion {
+		jsonAsBytes, _ := json.Marshal(result)
+		return shim.Success(jsonAsBytes)
+	}
+
+	accountIndex, err := t.get_account_index(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	for _, accountNo := range accountIndex {
+		accountAsBytes, err := stub.GetState(accountNo)
+		if err != nil {
+			return shim.Error("Failed to get account " + accountNo)
+		}
+		if accountAsBytes == nil {
+			continue
+		}
+
+		var fields map[string]interface{}
+		err = json.Unmarshal(accountAsBytes, &fields)
+		if err != nil {
+			return shim.Error("Corrupt account record " + accountNo)
+		}
+		_, canonical := fields["accountNo"]
+		legacyKey := !canonical || fields["accountNo"] != accountNo
+
+		res := Account{}
+		err = json.Unmarshal(accountAsBytes, &res)
+		if err != nil {
+			return shim.Error("Corrupt account record " + accountNo)
+		}
+		res.AccountNo = accountNo
+
+		// Version 2 to 4: rewrite the amounts of the account and of its transactions as plain decimals with the
+		// decimals of the account's currency
+		legacyAmounts := false
+		if result.FromVersion < 4 {
+			legacyAmounts, err = t.normalize_amounts(res.Currency, &res.OpeningBalance, &res.Activity, &res.PeriodToDateBalance, &res.CreditLimit)
+			if err != nil {
+				return shim.Error("Corrupt amounts on account " + accountNo + ", they do not fit the decimals of " + res.Currency)
+			}
+			err = t.migrate_transactions(stub, res)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		// Version 4 to 5: replace noOverdraft by allowNegative
+		legacyOverdraft := t.normalize_overdraft(&res)
+		if !legacyKey && !legacyAmounts && !legacyOverdraft {
+			continue
+		}
+
+		err = t.save_account(stub, res)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result.Migrated = append(result.Migrated, accountNo)
+	}
+
+	err = stub.PutState(schemaVersionStr, []byte(strconv.Itoa(accountSchemaVersion)))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	jsonAsBytes, _ := json.Marshal(result)
+	return shim.Success(jsonAsBytes)
+}
+
+
+// ============================================================================================================================
+// List Error Queue - List the error queue entries, by default only those still parked. Pass "all" to include the ones
+//					  already reposted.
+// ============================================================================================================================
+func (t *SimpleChaincode) list_error_queue(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//    0
+	// "all"
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+	all := len(args) == 1 && args[0] == "all"
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(errorQueuePrefix, []string{})
+	if err != nil {
+		return shim.Error("Failed to get the error queue")
+	}
+	defer resultsIterator.Close()
+
+	entries := []ErrorQueueEntry{}
+	for resultsIterator.HasNext() {
+		result, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		entry := ErrorQueueEntry{}
+		err = json.Unmarshal(result.Value, &entry)
+		if err != nil {
+			return shim.Error("Corrupt error queue entry " + result.Key)
+		}
+		if all || entry.Status == PARKED {
+			entries = append(entries, entry)
+		}
+	}
+
+	jsonAsBytes, _ := json.Marshal(entries)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Repost From Queue - Replay a parked posting, optionally against a corrected account number. The posting goes through
+//					   the approval threshold like any other and the entry records what it became.
+// ============================================================================================================================
+func (t *SimpleChaincode) repost_from_queue(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//     0              1
+	// "entryId", "correctedAccountNo"
+
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	key, err := stub.CreateCompositeKey(errorQueuePrefix, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	entryAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error("Failed to get error queue entry " + args[0])
+	}
+	if entryAsBytes == nil {
+		return shim.Error("Error queue entry " + args[0] + " does not exist")
+	}
+	entry := ErrorQueueEntry{}
+	err = json.Unmarshal(entryAsBytes, &entry)
+	if err != nil {
+		return shim.Error("Corrupt error queue entry " + args[0])
+	}
+	if entry.Status != PARKED {
+		return shim.Error("Error queue entry " + entry.EntryId + " has already been reposted")
+	}
+
+	accountNo := entry.AccountNo
+	if len(args) == 2 && len(args[1]) > 0 {
+		accountNo = args[1]
+	}
+	res, err := t.get_account(stub, accountNo)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amount, err := t.parse_amount(res.Currency, entry.Amount)
+	if err != nil {
+		return shim.Error("The amount " + entry.Amount + " of error queue entry " + entry.EntryId + " has more decimals than " + res.Currency + " has")
+	}
+
+	entry.Status = REPOSTED
+	entry.RepostedToAccountNo = res.AccountNo
+	entry.RepostedBy, err = t.get_caller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	entry.RepostedAt, err = t.get_timestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	reason := "Reposted from error queue entry " + entry.EntryId
+	txn, err := t.post_transaction(stub, &res, amount, Transaction{Type: ACTIVITY, Reason: reason, References: entry.References, DocumentHashes: entry.DocumentHashes})
+	if errors.Is(err, errApprovalRequired) {
+		posting, err := t.hold_posting(stub, PendingPosting{AccountNo: res.AccountNo, Amount: t.format_amount(res.Currency, amount), RequestReason: reason, References: entry.References, DocumentHashes: entry.DocumentHashes})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		entry.PostingId = posting.PostingId
+	} else if err != nil {
+		return shim.Error(err.Error())
+	} else {
+		entry.TransactionId = txn.TransactionId
+	}
+
+	err = t.save_error_queue_entry(stub, entry)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	jsonAsBytes, _ := json.Marshal(entry)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Park Posting - Store a posting that cannot be applied in the error queue. The entry id is the transaction id.
+// ============================================================================================================================
+func (t *SimpleChaincode) park_posting(stub shim.ChaincodeStubInterface, accountNo string, amount string, references []string, documentHashes []string, reason string) (ErrorQueueEntry, error) {
+	entry := ErrorQueueEntry{EntryId: stub.GetTxID(), AccountNo: accountNo, Amount: amount, References: references, DocumentHashes: documentHashes, Error: reason, Status: PARKED}
+
+	var err error
+	entry.ParkedBy, err = t.get_caller(stub)
+	if err != nil {
+		return entry, err
+	}
+	entry.ParkedAt, err = t.get_timestamp(stub)
+	if err != nil {
+		return entry, err
+	}
+
+	return entry, t.save_error_queue_entry(stub, entry)
+}
+
+// ============================================================================================================================
+// Save Error Queue Entry - Write an error queue entry into the world state
+// ============================================================================================================================
+func (t *SimpleChaincode) save_error_queue_entry(stub shim.ChaincodeStubInterface, entry ErrorQueueEntry) error {
+	key, err := stub.CreateCompositeKey(errorQueuePrefix, []string{entry.EntryId})
+	if err != nil {
+		return err
+	}
+
+	jsonAsBytes, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("Error converting error queue entry %s", entry.EntryId)
+	}
+
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return fmt.Errorf("Error storing error queue entry %s", entry.EntryId)
+	}
+
+	return nil
+}
+
+
+// ============================================================================================================================
+// Get Accounts Near Limit - List the accounts with a credit limit whose period-to-date balance uses at least the given
+//							 percentage of it
+// ============================================================================================================================
+func (t *SimpleChaincode) get_accounts_near_limit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "80"
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	percentage, err := money.ParseDecimal(args[0])
+	if err != nil || percentage.Sign() < 0 {
+		return shim.Error("1st argument must be a non-negative numeric string")
+	}
+
+	accountIndex, err := t.get_account_index(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	utilizations := []LimitUtilization{}
+	for _, accountNo := range accountIndex {
+		res, err := t.get_account(stub, accountNo)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if res.CreditLimit == "" {
+			continue
+		}
+
+		limit, err := t.parse_amount(res.Currency, res.CreditLimit)
+		if err != nil || limit <= 0 {
+			return shim.Error("Corrupt credit limit on account " + res.AccountNo)
+		}
+		balance, err := t.parse_amount(res.Currency, res.PeriodToDateBalance)
+		if err != nil {
+			return shim.Error("Corrupt period-to-date balance on account " + res.AccountNo)
+		}
+		utilization := new(big.Rat).Mul(big.NewRat(balance, limit), big.NewRat(100, 1))
+		if utilization.Cmp(percentage) >= 0 {
+			utilizations = append(utilizations, LimitUtilization{AccountNo: res.AccountNo, Currency: res.Currency, CreditLimit: t.format_amount(res.Currency, limit), PeriodToDateBalance: t.format_amount(res.Currency, balance), Utilization: money.FormatDecimal(utilization, 2)})
+		}
+	}
+
+	jsonAsBytes, _ := json.Marshal(utilizations)
+	return shim.Success(jsonAsBytes)
+}
+
+// ============================================================================================================================
+// Check Limits - Reject a posting that takes the balance of an account that does not allow it below zero, or above its
+//				  credit limit. Postings moving the balance back towards the limits are always accepted.
+// ============================================================================================================================
+func (t *SimpleChaincode) check_limits(res Account, balance int64, amount int64) error {
+	newBalance := balance + amount
+
+	if amount < 0 && newBalance < 0 && !t.allows_negative(res) {
+		return fmt.Errorf("%s: account %s does not allow a negative balance", NEGATIVE_BALANCE_NOT_ALLOWED, res.AccountNo)
+	}
+
+	if amount > 0 && res.CreditLimit != "" {
+		limit, err := t.parse_amount(res.Currency, res.CreditLimit)
+		if err != nil {
+			return fmt.Errorf("Corrupt credit limit on account %s", res.AccountNo)
+		}
+		if newBalance > limit {
+			return fmt.Errorf("%s: posting would take account %s above its credit limit of %s", CREDIT_LIMIT_EXCEEDED, res.AccountNo, res.CreditLimit)
+		}
+	}
+
+	return nil
+}
+
+// ============================================================================================================================
+// Allows Negative - Accounts allow a negative balance unless allowNegative has been set to false
+// ============================================================================================================================
+func (t *SimpleChaincode) allows_negative(res Account) bool {
+	return res.AllowNegative == nil || *res.AllowNegative
+}
+
+
+// ============================================================================================================================
+// Migrate Transactions - Rewrite the amounts of every transaction of an account as plain decimals in its currency
+// ============================================================================================================================
+func (t *SimpleChaincode) migrate_transactions(stub shim.ChaincodeStubInterface, res Account) error {
+	transactions, err := t.get_account_transactions(stub, res.AccountNo)
+	if err != nil {
+		return err
+	}
+
+	for _, txn := range transactions {
+		changed, err := t.normalize_amounts(res.Currency, &txn.Amount, &txn.BalanceAfter)
+		if err != nil {
+			return fmt.Errorf("Corrupt amounts on transaction %s", txn.TransactionId)
+		}
+		if !changed {
+			continue
+		}
+		err = t.save_transaction(stub, txn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ============================================================================================================================
+// Normalize Amounts - Rewrite stored amount strings, legacy scientific notation included, in the canonical decimal
+//					   format of a currency, leaving empty ones alone. Reports whether any of them changed.
+// ============================================================================================================================
+func (t *SimpleChaincode) normalize_amounts(currency string, amounts ...*string) (bool, error) {
+	changed := false
+	for _, amount := range amounts {
+		if *amount == "" {
+			continue
+		}
+		value, err := t.parse_legacy_amount(currency, *amount)
+		if err != nil {
+			return false, err
+		}
+		if t.format_amount(currency, value) != *amount {
+			*amount = t.format_amount(currency, value)
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// ============================================================================================================================
+// Parse Amount - Convert a decimal string ("45000.00", "-25.5") into integer minor units of a currency, which must not
+//				  have more decimals than the currency has (2 for EUR, 0 for JPY, 3 for BHD). Scientific notation is
+//				  rejected; records written with it before schema version 3 are read by migrate_accounts only.
+// ============================================================================================================================
+func (t *SimpleChaincode) parse_amount(currency string, value string) (int64, error) {
+	m, err := money.Parse(currency, value)
+	return m.Units, err
+}
+
+// ============================================================================================================================
+// Parse Legacy Amount - Like parse_amount, but amounts in the scientific notation written before schema version 3
+//						 ("4.5E+04") are rounded to the nearest minor unit. Only for migrating stored records.
+// ============================================================================================================================
+func (t *SimpleChaincode) parse_legacy_amount(currency string, value string) (int64, error) {
+	if strings.ContainsAny(value, "eE") {
+		return money.RoundUnits(value, money.Decimals(currency))
+	}
+	return t.parse_amount(currency, value)
+}
+
+// ============================================================================================================================
+// Format Amount - Convert integer minor units of a currency into the stored decimal string, e.g. EUR 4500000 ->
+//				   "45000.00", JPY 4500000 -> "4500000"
+// ============================================================================================================================
+func (t *SimpleChaincode) format_amount(currency string, units int64) string {
+	return money.New(currency, units).String()
+}
+
+
+// ============================================================================================================================
+// Tag Account - Replace the subscriber tags of an account (e.g. "treasury", "tax"). Events about the account and the
+//				 transactions posted to it carry the tags; passing no tags clears them.
+// ============================================================================================================================
+func (t *SimpleChaincode) tag_account(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//      0            1         2
+	// "accountNo", "treasury", "tax"
+
+	var err error
+
+	if len(args) < 1 {
+		return shim.Error("Incorrect number of arguments. Expecting at least 1")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, tag := range args[1:] {
+		if len(tag) <= 0 {
+			return shim.Error("Tags must be non-empty strings")
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	res, err := t.get_account(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	oldValue := strings.Join(res.Tags, ",")
+	res.Tags = tags
+	if oldValue == strings.Join(tags, ",") {
+		return shim.Success(nil)
+	}
+
+	changedBy, err := t.get_caller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	timestamp, err := t.get_timestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	res.Changes = append(res.Changes, AccountChange{Field: "tags", OldValue: oldValue, NewValue: strings.Join(tags, ","), ChangedBy: changedBy, TxID: stub.GetTxID(), Timestamp: timestamp})
+
+	err = t.save_account(stub, res)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+
+// ============================================================================================================================
+// Get Control Totals - Recompute, per currency, the number of accounts and the sums of their opening balances,
+//						activity and period-to-date balances, flagging any account that does not add up. Read only.
+// ============================================================================================================================
+func (t *SimpleChaincode) get_control_totals(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	accountIndex, err := t.get_account_index(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	type sums struct {
+		count int
+		openingBalance, activity, periodToDateBalance int64
+		outOfBalance []string
+	}
+	totals := map[string]*sums{}
+	for _, accountNo := range accountIndex {
+		res, err := t.get_account(stub, accountNo)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		openingBalance, err := t.parse_amount(res.Currency, res.OpeningBalance)
+		if err != nil {
+			return shim.Error("Corrupt opening balance on account " + res.AccountNo)
+		}
+		activity, err := t.parse_amount(res.Currency, res.Activity)
+		if err != nil {
+			return shim.Error("Corrupt activity on account " + res.AccountNo)
+		}
+		periodToDateBalance, err := t.parse_amount(res.Currency, res.PeriodToDateBalance)
+		if err != nil {
+			return shim.Error("Corrupt period-to-date balance on account " + res.AccountNo)
+		}
+
+		total, ok := totals[res.Currency]
+		if !ok {
+			total = &sums{outOfBalance: []string{}}
+			totals[res.Currency] = total
+		}
+		total.count++
+		total.openingBalance, err = money.AddUnits(total.openingBalance, openingBalance)
+		if err != nil {
+			return shim.Error("The " + res.Currency + " opening balance total overflows at account " + res.AccountNo)
+		}
+		total.activity, err = money.AddUnits(total.activity, activity)
+		if err != nil {
+			return shim.Error("The " + res.Currency + " activity total overflows at account " + res.AccountNo)
+		}
+		total.periodToDateBalance, err = money.AddUnits(total.periodToDateBalance, periodToDateBalance)
+		if err != nil {
+			return shim.Error("The " + res.Currency + " period-to-date balance total overflows at account " + res.AccountNo)
+		}
+		expected, err := money.AddUnits(openingBalance, activity)
+		if err != nil || expected != periodToDateBalance {
+			total.outOfBalance = append(total.outOfBalance, res.AccountNo)
+		}
+	}
+
+	currencies := []string{}
+	for currency := range totals {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+
+	controlTotals := []ControlTotals{}
+	for _, currency := range currencies {
+		total := totals[currency]
+		controlTotals = append(controlTotals, ControlTotals{Currency: currency, AccountCount: total.count, OpeningBalance: t.format_amount(currency, total.openingBalance), Activity: t.format_amount(currency, total.activity), PeriodToDateBalance: t.format_amount(currency, total.periodToDateBalance), OutOfBalance: total.outOfBalance})
+	}
+
+	jsonAsBytes, _ := json.Marshal(controlTotals)
+	return shim.Success(jsonAsBytes)
+}
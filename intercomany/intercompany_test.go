@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/common/attrmgr"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// testStub invokes the chaincode as a given identity. MockStub has no creator and keeps the arguments of MockInvoke to
+// itself, so both are set here and the chaincode is called with the testStub directly.
+type testStub struct {
+	*shim.MockStub
+	creator []byte
+	args    [][]byte
+	txs     int
+}
+
+func (stub *testStub) GetCreator() ([]byte, error) { return stub.creator, nil }
+func (stub *testStub) GetArgs() [][]byte          { return stub.args }
+
+func (stub *testStub) GetStringArgs() []string {
+	args := []string{}
+	for _, arg := range stub.args {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func (stub *testStub) GetFunctionAndParameters() (string, []string) {
+	args := stub.GetStringArgs()
+	return args[0], args[1:]
+}
+
+func newTestStub(t *testing.T) *testStub {
+	stub := &testStub{MockStub: shim.NewMockStub("intercompany", new(SimpleChaincode)), args: [][]byte{[]byte("init"), []byte("0")}}
+	stub.MockTransactionStart("init")
+	defer stub.MockTransactionEnd("init")
+
+	if res := new(SimpleChaincode).Init(stub); res.Status != shim.OK {
+		t.Fatalf("Init: %s", res.Message)
+	}
+	return stub
+}
+
+func (stub *testStub) invoke(caller []byte, function string, args ...string) pb.Response {
+	stub.txs++
+	txID := fmt.Sprintf("tx%d", stub.txs)
+	stub.creator = caller
+	stub.args = [][]byte{[]byte(function)}
+	for _, arg := range args {
+		stub.args = append(stub.args, []byte(arg))
+	}
+
+	stub.MockTransactionStart(txID)
+	defer stub.MockTransactionEnd(txID)
+	return new(SimpleChaincode).Invoke(stub)
+}
+
+// identity is the serialized identity of a caller with a certificate for name carrying attrs, the way cid reads them
+func identity(t *testing.T, name string, attrs map[string]string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: name}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	err = attrmgr.New().AddAttributesToCert(&attrmgr.Attributes{Attrs: attrs}, template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.ExtraExtensions = template.Extensions	// x509 only writes the extensions of a template from ExtraExtensions
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: "Org1MSP", IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creator
+}
+
+func succeed(t *testing.T, res pb.Response, what string) []byte {
+	t.Helper()
+	if res.Status != shim.OK {
+		t.Fatalf("%s: %s", what, res.Message)
+	}
+	return res.Payload
+}
+
+func fail(t *testing.T, res pb.Response, what string, message string) {
+	t.Helper()
+	if res.Status == shim.OK {
+		t.Fatalf("%s succeeded, want an error containing %q", what, message)
+	}
+	if !strings.Contains(res.Message, message) {
+		t.Fatalf("%s: %q, want an error containing %q", what, res.Message, message)
+	}
+}
+
+func postingResponse(t *testing.T, payload []byte) PostingResponse {
+	t.Helper()
+	response := PostingResponse{}
+	if err := json.Unmarshal(payload, &response); err != nil {
+		t.Fatalf("Payload %s is not a PostingResponse: %v", payload, err)
+	}
+	return response
+}
+
+func balance(t *testing.T, stub *testStub, accountNo string) string {
+	t.Helper()
+	res, err := new(SimpleChaincode).get_account(stub, accountNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.PeriodToDateBalance
+}
+
+// lastEvent is the name of the event of the latest transaction, the others are dropped
+func lastEvent(stub *testStub) string {
+	name := ""
+	for len(stub.ChaincodeEventsChannel) > 0 {
+		name = (<-stub.ChaincodeEventsChannel).EventName
+	}
+	return name
+}
+
+func TestApprovalFlow(t *testing.T) {
+	stub := newTestStub(t)
+	admin := identity(t, "admin", map[string]string{"admin": "true"})
+	clerk := identity(t, "clerk", nil)
+	approver := identity(t, "approver", map[string]string{"approver": "true"})
+
+	fail(t, stub.invoke(clerk, "set_approval_threshold", "USD", "1000.00"), "set_approval_threshold by a clerk", "Permission Denied")
+	fail(t, stub.invoke(admin, "set_approval_threshold", "USD", "1000.001"), "set_approval_threshold with too many decimals", "at most 2 decimals")
+	succeed(t, stub.invoke(admin, "set_approval_threshold", "USD", "1000.00"), "set_approval_threshold")
+	succeed(t, stub.invoke(clerk, "create_account", "1000", "ENT001", "ENT002", "USD", "2017-06", "0.00", "0.00", "Cash Transactions"), "create_account 1000")
+	succeed(t, stub.invoke(clerk, "create_account", "2000", "ENT002", "ENT001", "USD", "2017-06", "0.00", "0.00", "Cash Transactions"), "create_account 2000")
+
+	// At or below the threshold postings go straight through
+	response := postingResponse(t, succeed(t, stub.invoke(clerk, "transaction_activity", "1000", "1000.00"), "transaction_activity of 1000.00"))
+	if response.Status != POSTED || balance(t, stub, "1000") != "1000.00" {
+		t.Fatalf("transaction_activity of 1000.00 = %s, balance %s; want posted, 1000.00", response.Status, balance(t, stub, "1000"))
+	}
+
+	// Above it the balance only changes once a different identity with the approver attribute approves
+	response = postingResponse(t, succeed(t, stub.invoke(clerk, "transaction_activity", "1000", "-5000.00"), "transaction_activity of -5000.00"))
+	if response.Status != PENDING || balance(t, stub, "1000") != "1000.00" {
+		t.Fatalf("transaction_activity of -5000.00 = %s, balance %s; want pending, 1000.00", response.Status, balance(t, stub, "1000"))
+	}
+	postingId := response.PendingPosting.PostingId
+
+	fail(t, stub.invoke(clerk, "approve_posting", postingId), "approve_posting without the approver attribute", "Permission Denied")
+	requester := identity(t, "clerk", map[string]string{"approver": "true"})
+	fail(t, stub.invoke(requester, "approve_posting", postingId), "approve_posting by the requester", "cannot decide on a posting they requested")
+	response = postingResponse(t, succeed(t, stub.invoke(approver, "approve_posting", postingId), "approve_posting"))
+	if response.Status != POSTED || response.Transaction.PostingId != postingId || balance(t, stub, "1000") != "-4000.00" {
+		t.Fatalf("approve_posting = %s, transaction %+v, balance %s; want posted, -4000.00", response.Status, response.Transaction, balance(t, stub, "1000"))
+	}
+	fail(t, stub.invoke(approver, "approve_posting", postingId), "approving twice", "has already been approved")
+
+	// Transfers, reversals and closing transfers above the threshold are held the same way
+	response = postingResponse(t, succeed(t, stub.invoke(clerk, "transfer_between_accounts", "2000", "1000", "4000.00"), "transfer_between_accounts"))
+	if response.Status != PENDING || balance(t, stub, "2000") != "0.00" {
+		t.Fatalf("transfer_between_accounts = %s, balance %s; want pending, 0.00", response.Status, balance(t, stub, "2000"))
+	}
+	succeed(t, stub.invoke(approver, "approve_posting", response.PendingPosting.PostingId), "approve_posting of the transfer")
+	if balance(t, stub, "1000") != "0.00" || balance(t, stub, "2000") != "-4000.00" {
+		t.Fatalf("Balances after the transfer = %s, %s; want 0.00, -4000.00", balance(t, stub, "1000"), balance(t, stub, "2000"))
+	}
+
+	response = postingResponse(t, succeed(t, stub.invoke(clerk, "reverse_transaction", "1000:00000003", "Booked to the wrong entity"), "reverse_transaction"))
+	if response.Status != PENDING || response.PendingPosting.Amount != "-4000.00" {
+		t.Fatalf("reverse_transaction = %s, %+v; want a pending posting of -4000.00", response.Status, response.PendingPosting)
+	}
+	succeed(t, stub.invoke(approver, "approve_posting", response.PendingPosting.PostingId), "approve_posting of the reversal")
+	if balance(t, stub, "1000") != "-4000.00" {
+		t.Fatalf("Balance after the reversal = %s, want -4000.00", balance(t, stub, "1000"))
+	}
+	fail(t, stub.invoke(clerk, "reverse_transaction", "1000:00000003"), "reversing twice", "has already been reversed")
+
+	response = postingResponse(t, succeed(t, stub.invoke(clerk, "close_account", "2000", "1000"), "close_account"))
+	if response.Status != PENDING {
+		t.Fatalf("close_account = %s, want pending", response.Status)
+	}
+	succeed(t, stub.invoke(approver, "approve_posting", response.PendingPosting.PostingId), "approve_posting of the closing transfer")
+	closed, _ := new(SimpleChaincode).get_account(stub, "2000")
+	if closed.Status != CLOSED || balance(t, stub, "1000") != "-8000.00" {
+		t.Fatalf("After closing, account 2000 is %q and 1000 has %s; want Closed, -8000.00", closed.Status, balance(t, stub, "1000"))
+	}
+
+	// Admin adjustments are exempt, and only an admin reverses them
+	succeed(t, stub.invoke(admin, "adjust_balance", "1000", "8000.00", "Opening balance correction"), "adjust_balance")
+	if balance(t, stub, "1000") != "0.00" {
+		t.Fatalf("Balance after the adjustment = %s, want 0.00", balance(t, stub, "1000"))
+	}
+	fail(t, stub.invoke(clerk, "reverse_transaction", "1000:00000006"), "reversing an adjustment as a clerk", "Permission Denied")
+	succeed(t, stub.invoke(admin, "reverse_transaction", "1000:00000006"), "reversing an adjustment as an admin")
+}
+
+func TestApprovalThresholdPerCurrency(t *testing.T) {
+	stub := newTestStub(t)
+	admin := identity(t, "admin", map[string]string{"admin": "true"})
+	clerk := identity(t, "clerk", nil)
+
+	succeed(t, stub.invoke(admin, "set_approval_threshold", "USD", "1000.00"), "set_approval_threshold USD")
+	succeed(t, stub.invoke(admin, "set_approval_threshold", "JPY", "100000"), "set_approval_threshold JPY")
+	succeed(t, stub.invoke(clerk, "create_account", "3000", "ENT001", "ENT002", "JPY", "2017-06", "0", "0", "Cash Transactions"), "create_account")
+
+	// 50000 yen are below the yen threshold although far above the number of the dollar one
+	response := postingResponse(t, succeed(t, stub.invoke(clerk, "transaction_activity", "3000", "50000"), "transaction_activity of 50000 yen"))
+	if response.Status != POSTED {
+		t.Fatalf("transaction_activity of 50000 yen = %s, want posted", response.Status)
+	}
+	response = postingResponse(t, succeed(t, stub.invoke(clerk, "transaction_activity", "3000", "150000"), "transaction_activity of 150000 yen"))
+	if response.Status != PENDING {
+		t.Fatalf("transaction_activity of 150000 yen = %s, want pending", response.Status)
+	}
+
+	// check_posting reports the threshold with an error callers can recognize
+	res, _ := new(SimpleChaincode).get_account(stub, "3000")
+	err := new(SimpleChaincode).check_posting(stub, res, 150000, Transaction{Type: ACTIVITY})
+	if !errors.Is(err, errApprovalRequired) {
+		t.Fatalf("check_posting of 150000 yen = %v, want %v", err, errApprovalRequired)
+	}
+
+	succeed(t, stub.invoke(admin, "set_approval_threshold", "JPY", ""), "clearing the JPY threshold")
+	response = postingResponse(t, succeed(t, stub.invoke(clerk, "transaction_activity", "3000", "150000"), "transaction_activity without a threshold"))
+	if response.Status != POSTED || balance(t, stub, "3000") != "200000" {
+		t.Fatalf("transaction_activity without a threshold = %s, balance %s; want posted, 200000", response.Status, balance(t, stub, "3000"))
+	}
+}
+
+func TestNextPeriod(t *testing.T) {
+	stub := newTestStub(t)
+	clerk := identity(t, "clerk", nil)
+
+	succeed(t, stub.invoke(clerk, "create_account", "1000", "ENT001", "ENT002", "USD", "2017-12", "100.00", "50.00", "Cash Transactions"), "create_account 1000")
+	succeed(t, stub.invoke(clerk, "create_account", "2000", "ENT001", "ENT002", "USD", "Monthly", "0.00", "0.00", "Cash Transactions"), "create_account 2000")
+
+	succeed(t, stub.invoke(clerk, "next_period", "1000"), "next_period without a label")
+	res, _ := new(SimpleChaincode).get_account(stub, "1000")
+	if res.Period != "2018-01" || res.OpeningBalance != "150.00" || res.Activity != "0.00" {
+		t.Fatalf("After next_period account 1000 is in %s with %s opening and %s activity; want 2018-01, 150.00, 0.00", res.Period, res.OpeningBalance, res.Activity)
+	}
+
+	fail(t, stub.invoke(clerk, "next_period", "2000"), "next_period of a period not labelled YYYY-MM", "must name the new period")
+	fail(t, stub.invoke(clerk, "next_period", "1000", "2018-01"), "next_period into the same period", "is already in period")
+	succeed(t, stub.invoke(clerk, "next_period", "2000", "2017-Q3"), "next_period with a label")
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		currency string
+		value    string
+		units    int64
+		ok       bool
+		legacy   bool
+	}{
+		{"USD", "45000.00", 4500000, true, true},
+		{"JPY", "1000.00", 1000, true, true},
+		{"USD", "4.5E+04", 4500000, false, true},
+		{"USD", "1e-3", 0, false, true},
+		{"USD", "0.005", 0, false, false},
+	}
+
+	cc := new(SimpleChaincode)
+	for _, test := range tests {
+		units, err := cc.parse_amount(test.currency, test.value)
+		if test.ok && (err != nil || units != test.units) || !test.ok && err == nil {
+			t.Errorf("parse_amount(%s, %q) = %d, %v; want %d, ok %v", test.currency, test.value, units, err, test.units, test.ok)
+		}
+		units, err = cc.parse_legacy_amount(test.currency, test.value)
+		if test.legacy && (err != nil || units != test.units) || !test.legacy && err == nil {
+			t.Errorf("parse_legacy_amount(%s, %q) = %d, %v; want %d, ok %v", test.currency, test.value, units, err, test.units, test.legacy)
+		}
+	}
+}
+
+func TestControlTotals(t *testing.T) {
+	stub := newTestStub(t)
+	clerk := identity(t, "clerk", nil)
+
+	succeed(t, stub.invoke(clerk, "create_account", "1000", "ENT001", "ENT002", "USD", "2017-06", "50000000000000000.00", "0.00", "Cash Transactions"), "create_account 1000")
+	succeed(t, stub.invoke(clerk, "create_account", "3000", "ENT001", "ENT003", "JPY", "2017-06", "1000", "0", "Cash Transactions"), "create_account 3000")
+
+	totals := []ControlTotals{}
+	if err := json.Unmarshal(succeed(t, stub.invoke(clerk, "get_control_totals"), "get_control_totals"), &totals); err != nil {
+		t.Fatal(err)
+	}
+	if len(totals) != 2 || totals[0].Currency != "JPY" || totals[0].OpeningBalance != "1000" || totals[1].Currency != "USD" || totals[1].OpeningBalance != "50000000000000000.00" {
+		t.Fatalf("get_control_totals = %+v; want JPY 1000 and USD 50000000000000000.00", totals)
+	}
+
+	// A second such balance no longer fits in the minor units of the USD total
+	succeed(t, stub.invoke(clerk, "create_account", "2000", "ENT002", "ENT001", "USD", "2017-06", "50000000000000000.00", "0.00", "Cash Transactions"), "create_account 2000")
+	fail(t, stub.invoke(clerk, "get_control_totals"), "get_control_totals of an overflowing total", "USD opening balance total overflows")
+}
+
+func TestNetting(t *testing.T) {
+	stub := newTestStub(t)
+	clerk := identity(t, "clerk", nil)
+	ent001 := identity(t, "treasurer1", map[string]string{entityAttribute: "ENT001"})
+	ent002 := identity(t, "treasurer2", map[string]string{entityAttribute: "ENT002"})
+	ent003 := identity(t, "treasurer3", map[string]string{entityAttribute: "ENT003"})
+
+	// ENT001 owes ENT002 6000.00 on two accounts and is owed 4000.00 back; the EUR account is not netted
+	succeed(t, stub.invoke(clerk, "create_account", "1000", "ENT002", "ENT001", "USD", "2017-06", "5000.00", "0.00", "Cash Transactions"), "create_account 1000")
+	succeed(t, stub.invoke(clerk, "create_account", "1001", "ENT002", "ENT001", "USD", "2017-06", "1000.00", "0.00", "Cash Transactions"), "create_account 1001")
+	succeed(t, stub.invoke(clerk, "create_account", "2000", "ENT001", "ENT002", "USD", "2017-06", "4000.00", "0.00", "Cash Transactions"), "create_account 2000")
+	succeed(t, stub.invoke(clerk, "create_account", "3000", "ENT002", "ENT001", "EUR", "2017-06", "700.00", "0.00", "Cash Transactions"), "create_account 3000")
+
+	fail(t, stub.invoke(clerk, "propose_netting", "ENT001", "ENT001", "USD"), "propose_netting of an entity against itself", "cannot be netted against itself")
+	fail(t, stub.invoke(clerk, "propose_netting", "ENT001", "ENT003", "USD"), "propose_netting without mutual balances", "nothing to net")
+
+	proposal := NettingProposal{}
+	if err := json.Unmarshal(succeed(t, stub.invoke(clerk, "propose_netting", "ENT001", "ENT002", "USD"), "propose_netting"), &proposal); err != nil {
+		t.Fatal(err)
+	}
+	offsets := map[string]string{}
+	for _, line := range proposal.Lines {
+		offsets[line.AccountNo] = line.Offset
+	}
+	if proposal.TotalAToB != "6000.00" || proposal.TotalBToA != "4000.00" || proposal.NetAmount != "2000.00" || proposal.NetDebtor != "ENT001" || proposal.Status != NETTING_PROPOSED {
+		t.Fatalf("propose_netting = %+v; want 6000.00 against 4000.00, ENT001 owing 2000.00 net", proposal)
+	}
+	if len(offsets) != 3 || offsets["1000"] != "-4000.00" || offsets["1001"] != "0.00" || offsets["2000"] != "-4000.00" {
+		t.Fatalf("Netting offsets = %v; want 1000 and 2000 reduced by 4000.00, 1001 untouched", offsets)
+	}
+	if event := lastEvent(stub); event != "propose_netting" {
+		t.Fatalf("propose_netting emitted %q", event)
+	}
+
+	// Both entities must confirm before anything is posted
+	fail(t, stub.invoke(clerk, "execute_netting", proposal.ProposalId), "execute_netting without an entity", "requires the entity attribute")
+	fail(t, stub.invoke(ent003, "execute_netting", proposal.ProposalId), "execute_netting by a third entity", "not a party")
+	succeed(t, stub.invoke(ent001, "execute_netting", proposal.ProposalId), "execute_netting by ENT001")
+	if event := lastEvent(stub); event != "confirm_netting" || balance(t, stub, "1000") != "5000.00" {
+		t.Fatalf("After one confirmation, event %q and balance %s; want confirm_netting, 5000.00", event, balance(t, stub, "1000"))
+	}
+	fail(t, stub.invoke(ent001, "execute_netting", proposal.ProposalId), "confirming twice", "already been confirmed by ENT001")
+
+	succeed(t, stub.invoke(ent002, "execute_netting", proposal.ProposalId), "execute_netting by ENT002")
+	if event := lastEvent(stub); event != "execute_netting" {
+		t.Fatalf("execute_netting emitted %q", event)
+	}
+	for accountNo, want := range map[string]string{"1000": "1000.00", "1001": "1000.00", "2000": "0.00", "3000": "700.00"} {
+		if got := balance(t, stub, accountNo); got != want {
+			t.Errorf("Balance of %s after netting = %s, want %s", accountNo, got, want)
+		}
+	}
+	fail(t, stub.invoke(ent002, "execute_netting", proposal.ProposalId), "executing twice", "is "+NETTING_EXECUTED)
+
+	// A proposal is only executed on the balances it was computed from
+	succeed(t, stub.invoke(clerk, "transaction_activity", "2000", "500.00"), "transaction_activity on 2000")
+	if err := json.Unmarshal(succeed(t, stub.invoke(clerk, "propose_netting", "ENT001", "ENT002", "USD"), "propose_netting again"), &proposal); err != nil {
+		t.Fatal(err)
+	}
+	succeed(t, stub.invoke(clerk, "transaction_activity", "2000", "100.00"), "transaction_activity after the proposal")
+	succeed(t, stub.invoke(ent001, "execute_netting", proposal.ProposalId), "execute_netting by ENT001")
+	fail(t, stub.invoke(ent002, "execute_netting", proposal.ProposalId), "execute_netting of a stale proposal", "changed since netting proposal")
+}
@@ -4,10 +4,15 @@ import (
 	"fmt"
 	"strconv"
 	"encoding/json"
+	"math/big"
+	"strings"
 	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
+
+	"github.com/EnzoX/learn-chaincode/index"
+	"github.com/EnzoX/learn-chaincode/money"
 )
 
 //==============================================================================================================================
@@ -56,8 +61,13 @@ type IntercompanyAccount struct{
 	AccountName  string `json:"accountName"`
 }
 
-var LicenseIndexStr = "_licenseindex"	  // Define an index varibale to track all the licenses stored in the world state
-var AccountIndexStr = "_accountindex"	  // Define an index varibale to track all the entities stored in the world state
+const LicenseIndexName = "license"	  // Index of every license stored in the world state
+const AccountIndexName = "account"	  // Index of every account stored in the world state
+
+const dateFormat = "01-02-2006"	  // Layout of license and settlement dates
+
+var LicenseIndexStr = "_licenseindex"	  // Key of the JSON array of licenses kept by earlier versions
+var AccountIndexStr = "_accountindex"	  // Key of the JSON array of accounts kept by earlier versions
 
 // ============================================================================================================================
 //  Main - main - Starts up the chaincode
@@ -95,13 +105,12 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 		return shim.Error(err.Error())
 	}
 	
-	var empty []string
-	jsonAsBytes, _ := json.Marshal(empty)						//marshal an emtpy array of strings to clear the license & user index
-	err = stub.PutState(LicenseIndexStr, jsonAsBytes)
+	// Move the license & account index of an upgraded version onto composite keys
+	err = t.migrate_index(stub, LicenseIndexStr, LicenseIndexName)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	err = stub.PutState(AccountIndexStr, jsonAsBytes)
+	err = t.migrate_index(stub, AccountIndexStr, AccountIndexName)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -109,6 +118,29 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	return shim.Success(nil)
 }
 
+// ============================================================================================================================
+// Migrate Index - Add every key of a JSON array index to the composite key index and remove the array
+// ============================================================================================================================
+func (t *SimpleChaincode) migrate_index(stub shim.ChaincodeStubInterface, legacyKey string, indexName string) error {
+	keysAsBytes, err := stub.GetState(legacyKey)
+	if err != nil {
+		return fmt.Errorf("Failed to get %s", legacyKey)
+	}
+	if keysAsBytes == nil {
+		return nil
+	}
+	var keys []string
+	json.Unmarshal(keysAsBytes, &keys)
+
+	for _, key := range keys {
+		err = index.CreateIndex(stub, indexName, []string{key})
+		if err != nil {
+			return err
+		}
+	}
+	return stub.DelState(legacyKey)
+}
+
 // ============================================================================================================================
 // Invoke - Called on chaincode invoke. Takes a function name passed and calls that function. Converts some
 //		    initial arguments passed to other things for use in the called function.
@@ -190,17 +222,20 @@ func (t *SimpleChaincode) create_account(stub shim.ChaincodeStubInterface, args
 
 	accountKey := dueToEntityCode + "_" + dueFromEntityCode + "_" + accountNo
 
-	openingBalance, err := strconv.ParseFloat(args[6],64)
+	openingBalance, err := money.Parse(args[4], args[6])
 	if err != nil {
 		return shim.Error("7th argument must be a numeric string")
 	}
 
-	activity, err := strconv.ParseFloat(args[7],64)
+	activity, err := money.Parse(args[4], args[7])
 	if err != nil {
 		return shim.Error("8th argument must be a numeric string")
 	}
 
-	periodToDateBalance := openingBalance + activity
+	periodToDateBalance, err := openingBalance.Add(activity)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	//check if account already exists
 	accountAsBytes, err := stub.GetState(accountKey)
@@ -213,9 +248,9 @@ func (t *SimpleChaincode) create_account(stub shim.ChaincodeStubInterface, args
 		return shim.Error("This account arleady exists")			
 	}
 
-	openingBalanceStr := strconv.FormatFloat(openingBalance, 'E', -1, 64)
-	activityStr := strconv.FormatFloat(activity, 'E', -1, 64)
-	periodToDateBalanceStr := strconv.FormatFloat(periodToDateBalance, 'E', -1, 64)
+	openingBalanceStr := openingBalance.String()
+	activityStr := activity.String()
+	periodToDateBalanceStr := periodToDateBalance.String()
 
 	//build the account json string 
 	str := `{"accountKey": "` + accountKey + `", "dueToEntityCode": "` + dueToEntityCode + `", "dueFromEntityCode": "` + dueFromEntityCode + `", "dueToEntityName": "` + args[2] + `", "dueFromEntityName": "` + args[3] + `", "currency": "` + args[4] + `", "period": "` + args[5] + `", "openingBalance": "` + openingBalanceStr + `", "activity": "` + activityStr + `", "periodToDateBalance": "` + periodToDateBalanceStr + `", "accountNo": "` + accountNo + `", "accountName": "` + args[9] + `"}`
@@ -223,19 +258,12 @@ func (t *SimpleChaincode) create_account(stub shim.ChaincodeStubInterface, args
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-		
-	//get the account index
-	accountsAsBytes, err := stub.GetState(AccountIndexStr)
+
+	//append the index
+	err = index.CreateIndex(stub, AccountIndexName, []string{accountKey})
 	if err != nil {
-		return shim.Error("Failed to get user index")
+		return shim.Error(err.Error())
 	}
-	var accountIndex []string
-	json.Unmarshal(accountsAsBytes, &accountIndex)							
-	
-	//append the index 
-	accountIndex = append(accountIndex, accountKey)	
-	jsonAsBytes, _ := json.Marshal(accountIndex)
-	err = stub.PutState(AccountIndexStr, jsonAsBytes)						
 
 	return shim.Success(nil)
 }
@@ -257,17 +285,17 @@ func (t *SimpleChaincode) create_license(stub shim.ChaincodeStubInterface, args
 
 	licenseKey := args[0] + "_" + args[1]
 
-	quantity, err := strconv.ParseFloat(args[2],64)
+	quantity, err := strconv.ParseInt(args[2], 10, 64)
 	if err != nil {
-		return shim.Error("3rd argument must be a numeric string")
+		return shim.Error("3rd argument must be a whole number")
 	}
 
-	licensePrice, err := strconv.ParseFloat(args[3],64)
+	licensePrice, err := money.Parse(args[9], args[3])
 	if err != nil {
 		return shim.Error("4th argument must be a numeric string")
 	}
 
-	supportFee, err := strconv.ParseFloat(args[4],64)
+	supportFee, err := money.Parse(args[9], args[4])
 	if err != nil {
 		return shim.Error("5th argument must be a numeric string")
 	}
@@ -283,9 +311,9 @@ func (t *SimpleChaincode) create_license(stub shim.ChaincodeStubInterface, args
 		return shim.Error("This license arleady exists")			
 	}
 
-	quantityStr := strconv.FormatFloat(quantity, 'E', -1, 64)
-	licensePriceStr := strconv.FormatFloat(licensePrice, 'E', -1, 64)
-	supportFeeStr := strconv.FormatFloat(supportFee, 'E', -1, 64)
+	quantityStr := strconv.FormatInt(quantity, 10)
+	licensePriceStr := licensePrice.String()
+	supportFeeStr := supportFee.String()
 
 	//build the license json string 
 	str := `{"licenseKey": "` + licenseKey + `", "licensePartNo": "` + args[0] + `", "baseEntityCode": "` + args[1] + `", "quantity": "` + quantityStr + `", "licensePrice": "` + licensePriceStr + `", "supportFee": "` + supportFeeStr + `", "licenseStartDate": "` + args[5] + `", "licenseEndDate": "` + args[6] + `", "supportStartDate": "` + args[7] + `", "supportEndDate": "` + args[8] + `", "currency": "` + args[9] + `", "LastSettlementDate": "` + args[10] + `"}`
@@ -293,19 +321,12 @@ func (t *SimpleChaincode) create_license(stub shim.ChaincodeStubInterface, args
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-		
-	//get the license index
-	licensesAsBytes, err := stub.GetState(LicenseIndexStr)
+
+	//append the index
+	err = index.CreateIndex(stub, LicenseIndexName, []string{licenseKey})
 	if err != nil {
-		return shim.Error("Failed to get license index")
+		return shim.Error(err.Error())
 	}
-	var licenseIndex []string
-	json.Unmarshal(licensesAsBytes, &licenseIndex)							
-	
-	//append the index 
-	licenseIndex = append(licenseIndex, licenseKey)	
-	jsonAsBytes, _ := json.Marshal(licenseIndex)
-	err = stub.PutState(LicenseIndexStr, jsonAsBytes)						
 
 	return shim.Success(nil)
 }
@@ -329,25 +350,36 @@ func (t *SimpleChaincode) transfer_license(stub shim.ChaincodeStubInterface, arg
 	resLicenseA := License{}
 	json.Unmarshal(licenseAAsBytes, &resLicenseA)																
 
-	licensePartNo := resLicenseA.licensePartNo
-	originalQuantity,err := strconv.ParseFloat(resLicenseA.Quantity,64)
+	licensePartNo := resLicenseA.LicensePartNo
+	originalQuantity, err := t.parseQuantity(resLicenseA.Quantity)
+	if err != nil {
+		return shim.Error("Corrupt license quantity " + resLicenseA.Quantity)
+	}
 
 	licenseStartDate := resLicenseA.LicenseStartDate
-	currentDate := time.Now().Format("01-02-2006")
-	months := t.monthDiff(licenseStartDate,currentDate)
-	licensePrice := strconv.ParseFloat(resLicenseA.LicensePrice,64)
-
-	transferedQuantity, err := strconv.ParseFloat(args[2],64)
-
-	licenseCharge := transferedQuantity * months * licensePrice / 60
-	negLicenseCharge := -(licenseCharge)
+	currentDate := time.Now().Format(dateFormat)
+	months, err := t.monthDiff(licenseStartDate,currentDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	licensePrice, err := t.parseAmount(resLicenseA.Currency, resLicenseA.LicensePrice)
+	if err != nil {
+		return shim.Error("Corrupt license price " + resLicenseA.LicensePrice)
+	}
 
-	licenseChargeStr := strconv.FormatFloat(licenseCharge, 'E', -1, 64)
-	negLicenseChargeStr := strconv.FormatFloat(negLicenseCharge, 'E', -1, 64)
+	transferedQuantity, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return shim.Error("3rd argument must be a whole number")
+	}
 
+	licenseCharge, err := licensePrice.Mul(big.NewRat(transferedQuantity * int64(months), 60))
 	if err != nil {
-		return shim.Error("3rd argument must be a numeric string")
+		return shim.Error(err.Error())
 	}
+	negLicenseCharge := money.New(licenseCharge.Currency, -licenseCharge.Units)
+
+	licenseChargeStr := licenseCharge.String()
+	negLicenseChargeStr := negLicenseCharge.String()
 
 	if (originalQuantity < transferedQuantity) {
 		return shim.Error("No enough license to transfer")
@@ -362,11 +394,17 @@ func (t *SimpleChaincode) transfer_license(stub shim.ChaincodeStubInterface, arg
 	resLicenseB := License{}
 	json.Unmarshal(licenseBAsBytes, &resLicenseB)
 
+	var response pb.Response
 	if resLicenseB.LicenseKey == newLicenseKey{   // Has this license key
-		args1 := [newLicenseKey, args[6]]
-		t.settle_bill(stub, args1) // settle bill for the targeted license
-		previousQuantity := strconv.ParseFloat(resLicenseB.Quantity,64)
-		resLicenseB.Quantity = strconv.FormatFloat(previousQuantity + transferedQuantity, 'E', -1, 64)
+		response = t.settle_bill(stub, []string{newLicenseKey, args[6]}) // settle bill for the targeted license
+		if response.Status != shim.OK {
+			return response
+		}
+		previousQuantity, err := t.parseQuantity(resLicenseB.Quantity)
+		if err != nil {
+			return shim.Error("Corrupt license quantity " + resLicenseB.Quantity)
+		}
+		resLicenseB.Quantity = strconv.FormatInt(previousQuantity + transferedQuantity, 10)
 		resLicenseB.LastSettlementDate = currentDate
 		// update quantity and last settlement date
 		licenseB, _ := json.Marshal(resLicenseB)
@@ -374,41 +412,42 @@ func (t *SimpleChaincode) transfer_license(stub shim.ChaincodeStubInterface, arg
 		if err != nil {
 			return shim.Error(err.Error())
 		}
-		args1 := [args[3], licenseChargeStr]
-	    t.addActivityToAccount(stub,args1)
-	    args2 := [args[4], negLicenseChargeStr]
-	    t.addActivityToAccount(stub,args2)
-		// bill the remaining license fee
 	} else {
-		args2 := [licensePartNo, args[1], args[2], resLicenseA.LicensePrice, resLicenseA.SupportFee, resLicenseA.LicenseStartDate, resLicenseA.LicenseEndDate,resLicenseA.SupportStartDate, resLicenseA.SupportEndDate,resLicenseA.Currency, currentDate]
-		t.create_license(stub,args2)
+		response = t.create_license(stub, []string{licensePartNo, args[1], args[2], resLicenseA.LicensePrice, resLicenseA.SupportFee, resLicenseA.LicenseStartDate, resLicenseA.LicenseEndDate,resLicenseA.SupportStartDate, resLicenseA.SupportEndDate,resLicenseA.Currency, currentDate})
+		if response.Status != shim.OK {
+			return response
+		}
 		// create license for this key
-		args1 := [args[3], licenseChargeStr]
-	    t.addActivityToAccount(stub,args1)
-	    args2 := [args[4], negLicenseChargeStr]
-	    t.addActivityToAccount(stub,args2)
-		// bill the remaining license fee
+	}
+
+	// bill the remaining license fee
+	response = t.addActivityToAccount(stub, []string{args[3], licenseChargeStr})
+	if response.Status != shim.OK {
+		return response
+	}
+	response = t.addActivityToAccount(stub, []string{args[4], negLicenseChargeStr})
+	if response.Status != shim.OK {
+		return response
+	}
+
+	//settle bill for the original license
+	response = t.settle_bill(stub, []string{args[0], args[5]})
+	if response.Status != shim.OK {
+		return response
 	}
 
 	if (originalQuantity == transferedQuantity) {
-		args3 := [args[0], args[5]]
-		t.settle_bill(stub, args3)
-		//settle bill for the original license
-		args4 := [args[0]]
-		t.delete_license(stub,args4)
 		//delete this license key
-	} else {
-		args5 := [args[0], args[5]]
-		t.settle_bill(stub, args5)
-		//settle bill for the original license
-		resLicenseA.Quantity = strconv.FormatFloat(originalQuantity - transferedQuantity, 'E', -1, 64)
-		resLicenseA.LastSettlementDate = currentDate
-		licenseA, _ := json.Marshal(resLicenseA)
-		err = stub.PutState(args[0], licenseA)						
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		//update the quantity and last settlement date
+		return t.delete_license(stub, []string{args[0]})
+	}
+
+	//update the quantity and last settlement date
+	resLicenseA.Quantity = strconv.FormatInt(originalQuantity - transferedQuantity, 10)
+	resLicenseA.LastSettlementDate = currentDate
+	licenseA, _ := json.Marshal(resLicenseA)
+	err = stub.PutState(args[0], licenseA)						
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 	
 	return shim.Success(nil)
@@ -418,13 +457,47 @@ func (t *SimpleChaincode) transfer_license(stub shim.ChaincodeStubInterface, arg
 // Utility Func monthDiff - Calculate month difference between two dates
 // ============================================================================================================================
 
-func (t *SimpleChaincode) monthDiff(string dateA, string dateB) int {
-	var int res
-	monthDateA := strconv.ParseInt(dateA[0,2],10,64)
-	monthDateB := strconv.ParseInt(dateB[0,2],10,64)
-	yearDateA := strconv.ParseInt(dateA[6,10],10,64)
-	yearDateB := strconv.ParseInt(dateB[6,10],10,64)
-	res = (yearDateB - yearDateA) * 12 + monthDateB - monthDateA
+func (t *SimpleChaincode) monthDiff(dateA string, dateB string) (int, error) {
+	timeA, err := time.Parse(dateFormat, dateA)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid date %s", dateA)
+	}
+	timeB, err := time.Parse(dateFormat, dateB)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid date %s", dateB)
+	}
+	return (timeB.Year() - timeA.Year()) * 12 + int(timeB.Month()) - int(timeA.Month()), nil
+}
+
+// ============================================================================================================================
+// Utility Func parseAmount - Read a stored amount of a currency. Earlier versions stored amounts in the scientific
+//							  notation ("4.5E+04"), which are rounded to the minor unit of the currency.
+// ============================================================================================================================
+
+func (t *SimpleChaincode) parseAmount(currency string, value string) (money.Money, error) {
+	if strings.ContainsAny(value, "eE") {
+		units, err := money.RoundUnits(value, money.Decimals(currency))
+		if err != nil {
+			return money.Money{}, err
+		}
+		return money.New(currency, units), nil
+	}
+	return money.Parse(currency, value)
+}
+
+// ============================================================================================================================
+// Utility Func parseQuantity - Read a stored license quantity, also in the scientific notation of earlier versions ("1E+01")
+// ============================================================================================================================
+
+func (t *SimpleChaincode) parseQuantity(value string) (int64, error) {
+	if strings.ContainsAny(value, "eE") {
+		quantity, ok := new(big.Rat).SetString(value)
+		if !ok || !quantity.IsInt() || !quantity.Num().IsInt64() {
+			return 0, fmt.Errorf("Invalid quantity %s", value)
+		}
+		return quantity.Num().Int64(), nil
+	}
+	return strconv.ParseInt(value, 10, 64)
 }
 
 // ============================================================================================================================
@@ -446,20 +519,33 @@ func (t *SimpleChaincode) addActivityToAccount(stub shim.ChaincodeStubInterface,
 	resAccount := IntercompanyAccount{}
 	json.Unmarshal(account, &resAccount)
 
-	amount := strconv.ParseFloat(args[1],64)
+	amount, err := money.Parse(resAccount.Currency, args[1])
+	if err != nil {
+		return shim.Error("2nd argument must be a numeric string")
+	}
 
-	activity := strconv.ParseFloat(resAccount.Activity,64)
-	newActivity := activity + amount
-	newActivityStr := strconv.FormatFloat(newActivity, 'E', -1, 64)
-	resAccount.Activity = newActivityStr
+	activity, err := t.parseAmount(resAccount.Currency, resAccount.Activity)
+	if err != nil {
+		return shim.Error("Corrupt activity " + resAccount.Activity)
+	}
+	newActivity, err := activity.Add(amount)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	resAccount.Activity = newActivity.String()
 
-	periodToDateBalance := strconv.ParseFloat(resAccount.PeriodToDateBalance,64)
-	newPeriodToDateBalance := periodToDateBalance + amount
-	newPeriodToDateBalanceStr := strconv.FormatFloat(newPeriodToDateBalance, 'E', -1, 64)
-	resAccount.PeriodToDateBalance = newPeriodToDateBalanceStr
+	periodToDateBalance, err := t.parseAmount(resAccount.Currency, resAccount.PeriodToDateBalance)
+	if err != nil {
+		return shim.Error("Corrupt period-to-date balance " + resAccount.PeriodToDateBalance)
+	}
+	newPeriodToDateBalance, err := periodToDateBalance.Add(amount)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	resAccount.PeriodToDateBalance = newPeriodToDateBalance.String()
 
 	accountAsBytes, _ := json.Marshal(resAccount)
-	err = stub.PutState(args[1], accountAsBytes)								
+	err = stub.PutState(args[0], accountAsBytes)								
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -479,7 +565,7 @@ func (t *SimpleChaincode) settle_bill(stub shim.ChaincodeStubInterface, args []s
 		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
 
-	currentDate := time.Now().Format("01-02-2006")
+	currentDate := time.Now().Format(dateFormat)
 
 	license, err := stub.GetState(args[0])
 	if err != nil {
@@ -490,18 +576,32 @@ func (t *SimpleChaincode) settle_bill(stub shim.ChaincodeStubInterface, args []s
 
 	lastSettlementDate := resLicense.LastSettlementDate
 
-	months := t.monthDiff(lastSettlementDate, currentDate)
+	months, err := t.monthDiff(lastSettlementDate, currentDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	quantity := strconv.ParseFloat(resLicense.Quantity,64)
+	quantity, err := t.parseQuantity(resLicense.Quantity)
+	if err != nil {
+		return shim.Error("Corrupt license quantity " + resLicense.Quantity)
+	}
 
-	supportFee := strconv.ParseFloat(resLicense.SupportFee,64)
+	supportFee, err := t.parseAmount(resLicense.Currency, resLicense.SupportFee)
+	if err != nil {
+		return shim.Error("Corrupt support fee " + resLicense.SupportFee)
+	}
 
-	supportCharge := supportFee * quantity * months / 12
+	supportCharge, err := supportFee.Mul(big.NewRat(quantity * int64(months), 12))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	supportChargeStr := strconv.FormatFloat(supportCharge, 'E', -1, 64)
+	supportChargeStr := supportCharge.String()
 
-	args1 := [args[1], supportChargeStr]
-	t.addActivityToAccount(stub,args1)
+	response := t.addActivityToAccount(stub, []string{args[1], supportChargeStr})
+	if response.Status != shim.OK {
+		return response
+	}
 	
 	resLicense.LastSettlementDate = currentDate
 	licenseAsBytes, _ := json.Marshal(resLicense)
@@ -533,33 +633,45 @@ func (t *SimpleChaincode) next_period(stub shim.ChaincodeStubInterface, args []s
 	resAccount := IntercompanyAccount{}
 	json.Unmarshal(account, &resAccount)
 
-	monthPeriod := resAccount.Period[0,3]
-	yearPeriod := strconv.ParseInt(Period[4,6],10,64)
+	if len(resAccount.Period) < 5 {
+		return shim.Error("Corrupt period " + resAccount.Period)
+	}
+	monthPeriod := resAccount.Period[0:3]
+	yearDigits := resAccount.Period[4:]
+	yearPeriod, err := strconv.ParseInt(yearDigits,10,64)
+	if err != nil {
+		return shim.Error("Corrupt period " + resAccount.Period)
+	}
 
-	var months = ["Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"]
+	var months = []string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}
 
+	newPeriod := ""
 	for i := 0; i < len(months); i++ {
 		if monthPeriod == months[i] {
 			if (i < len(months) - 1 ){
-				newMonthPeriod := months[i+1]
-				newYearPeriod := strconv.FormatInt(yearPeriod, 10)
+				newPeriod = months[i+1] + "-" + fmt.Sprintf("%0*d", len(yearDigits), yearPeriod)
 			} else {
-				newMonthPeriod := "Jan"
-				newYearPeriod := strconv.FormatInt(yearPeriod+1, 10)
+				newPeriod = "Jan-" + fmt.Sprintf("%0*d", len(yearDigits), yearPeriod+1)
 			}
 		}
 	}
-
-	newPeriod := newMonthPeriod + "-" + newYearPeriod
+	if newPeriod == "" {
+		return shim.Error("Corrupt period " + resAccount.Period)
+	}
 
 	resAccount.Period = newPeriod
 
-	resAccount.OpeningBalance = resAccount.PeriodToDateBalance
+	periodToDateBalance, err := t.parseAmount(resAccount.Currency, resAccount.PeriodToDateBalance)
+	if err != nil {
+		return shim.Error("Corrupt period-to-date balance " + resAccount.PeriodToDateBalance)
+	}
+	resAccount.OpeningBalance = periodToDateBalance.String()
+	resAccount.PeriodToDateBalance = periodToDateBalance.String()
 
-	resAccount.Activity = strconv.FormatFloat("0", 'E', -1, 64)
+	resAccount.Activity = money.New(resAccount.Currency, 0).String()
 
 	accountAsBytes, _ := json.Marshal(resAccount)
-	err = stub.PutState(args[1], accountAsBytes)								
+	err = stub.PutState(args[0], accountAsBytes)								
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -585,22 +697,10 @@ func (t *SimpleChaincode) delete_license(stub shim.ChaincodeStubInterface, args
 		return shim.Error("Failed to delete state")
 	}
 
-	//get the license index
-	licensesAsBytes, err := stub.GetState(LicenseIndexStr)
-	if err != nil {
-		return shim.Error("Failed to get license index")
-	}
-	var licenseIndex []string
-	json.Unmarshal(licensesAsBytes, &licenseIndex)						
-	
 	//remove license from index
-	for i,val := range licenseIndex{
-		if val == licenseKey{													    //find the correct license
-			licenseIndex = append(licenseIndex[:i], licenseIndex[i+1:]...)			//remove it
-			break
-		}
+	err = index.RemoveIndex(stub, LicenseIndexName, []string{licenseKey})
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	jsonAsBytes, _ := json.Marshal(licenseIndex)									//save the new index
-	err = stub.PutState(LicenseIndexStr, jsonAsBytes)
 	return shim.Success(nil)
 }
\ No newline at end of file
@@ -1,10 +1,23 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"encoding/json"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	pb "github.com/hyperledger/fabric/protos/peer"
+
+	"github.com/EnzoX/learn-chaincode/index"
+	"github.com/EnzoX/learn-chaincode/money"
 )
 
 //==============================================================================================================================
@@ -14,6 +27,239 @@ import (
 const   SELLER   =  "seller"
 const   BUYER   =  "buyer"
 const   FINANCIER =  "financier"
+const   COMPLIANCE =  "compliance"			// Screens parties, see blacklist_participant
+const   GUARANTOR  =  "guarantor"			// Guarantees or insures invoices, see attach_guarantee
+
+const   KYC_PENDING  =  "pending"			// Participants start here until compliance approves them
+const   KYC_APPROVED =  "approved"			// Current until the end of the KYC expiry date
+const   KYC_EXPIRED  =  "expired"
+
+//==============================================================================================================================
+//	 Invoice statuses - Every status change goes through transition(), which only allows the moves listed in
+//						STATUS_TRANSITIONS and otherwise fails with ERR_INVALID_TRANSITION.
+//==============================================================================================================================
+
+const   ISSUED          =  "ISSUED"				// Created by the seller, open to financiers
+const   FINANCE_OFFERED =  "FINANCE_OFFERED"	// A financier has offered to finance it, awaiting the buyer
+const   APPROVED        =  "APPROVED"			// The buyer has approved the financing
+const   REJECTED        =  "REJECTED"			// The buyer has rejected the financing, open to financiers again
+const   PAID            =  "PAID"
+const   SETTLED         =  "SETTLED"			// Settled at maturity by settle_at_maturity
+const   CANCELLED       =  "CANCELLED"
+const   VOID            =  "VOID"				// Raised in error and voided, see void_invoice
+const   OVERDUE         =  "OVERDUE"
+const   DISPUTED        =  "DISPUTED"			// The buyer disputes it; it cannot be financed or settled until resolved
+const   PAYABLE_PENDING =  "PAYABLE_PENDING"	// An approved payable uploaded by the buyer, awaiting the seller's confirmation
+
+const   DATE_FORMAT     =  "2006-01-02"			// Due dates and payment dates, e.g. 2017-09-30
+const   UNDEFINED       =  "UNDEFINED"
+const   DEFAULT_CURRENCY =  "USD"				// Always accepted, whether or not it is in the currency master
+
+const   HUNDREDTHS      =  100					// Percentages, rates and scores are stored with 2 places and computed in hundredths
+const   FULL_SHARE      =  100 * HUNDREDTHS		// 100.00 percent
+
+//==============================================================================================================================
+//	 Error codes - Stable codes carried in the Chaincode_Error envelope, so clients can tell failures apart without
+//				   parsing the message. Errors without a code (bad arguments, ledger failures) stay plain text.
+//==============================================================================================================================
+
+const   ERR_PERMISSION         = "ERR_PERMISSION"			// The caller's role or identity may not do this
+const   ERR_NOT_FOUND          = "ERR_NOT_FOUND"
+const   ERR_INVALID_STATE      = "ERR_INVALID_STATE"		// Not allowed in the invoice's current status
+const   ERR_INVALID_TRANSITION = "ERR_INVALID_TRANSITION"	// STATUS_TRANSITIONS does not allow the status change
+const   ERR_DUPLICATE          = "ERR_DUPLICATE"
+const   ERR_PARTY_BLOCKED      = "ERR_PARTY_BLOCKED"
+const   ERR_KYC_REQUIRED       = "ERR_KYC_REQUIRED"			// A party has no current KYC approval, see set_kyc_status
+const   ERR_VALIDATION         = "ERR_VALIDATION"			// An amount or rate is invalid; the fields name the field and the reason
+const   ERR_LIMIT_EXCEEDED     = "ERR_LIMIT_EXCEEDED"		// An amount is over what is left or allowed; the fields give the value and the limit
+
+const   BULK_LIMIT      =  500					// Most invoices bulk_create_invoices takes in one transaction
+const   BULK_CREATED    =  "CREATED"			// Bulk upload results, see Bulk_Result
+const   BULK_SKIPPED    =  "SKIPPED"			// A duplicate of an existing invoice or of an earlier record
+const   BULK_FAILED     =  "FAILED"
+
+var STATUS_TRANSITIONS = map[string][]string{
+	ISSUED:          {FINANCE_OFFERED, PAID, SETTLED, CANCELLED, OVERDUE, DISPUTED, VOID},
+	FINANCE_OFFERED: {APPROVED, REJECTED, CANCELLED, OVERDUE, DISPUTED, ISSUED},	// ISSUED when the financing lapses
+	APPROVED:        {PAID, SETTLED, OVERDUE, DISPUTED},
+	REJECTED:        {FINANCE_OFFERED, PAID, SETTLED, CANCELLED, OVERDUE, DISPUTED, VOID},
+	OVERDUE:         {PAID, SETTLED, DISPUTED},
+	DISPUTED:        {ISSUED, FINANCE_OFFERED, APPROVED, REJECTED, OVERDUE, PAID},	// Back to where it was, see resolve_dispute
+	PAYABLE_PENDING: {ISSUED, CANCELLED, VOID},
+}
+
+// Reason codes of void_invoice
+var VOID_REASONS = []string{"duplicate", "issued_in_error", "wrong_buyer", "wrong_amount", "test"}
+
+// Buyer credit ratings, best first, see Credit_Profile
+var BUYER_RATINGS = []string{"AAA", "AA", "A", "BBB", "BB", "B", "CCC", "CC", "C", "D"}
+
+// Statuses written before named statuses were introduced
+var LEGACY_STATUSES = map[string]string{
+	"0": ISSUED,
+	"1": FINANCE_OFFERED,
+	"2": APPROVED,
+}
+
+//==============================================================================================================================
+//	 Dispute outcomes
+//==============================================================================================================================
+
+const   DISPUTE_UPHELD    =  "UPHELD"		// The seller conceded or an admin ruled for the buyer; the disputed amount is written off
+const   DISPUTE_DISMISSED =  "DISMISSED"	// The buyer withdrew or an admin ruled for the seller; nothing changes
+
+//==============================================================================================================================
+//	 Credit note statuses
+//==============================================================================================================================
+
+const   CREDIT_PENDING      =  "PENDING"			// Issued by the seller, awaiting the buyer's acknowledgement
+const   CREDIT_ACKNOWLEDGED =  "ACKNOWLEDGED"		// Acknowledged by the buyer and taken off the outstanding balance
+
+//==============================================================================================================================
+//	 Document types - The off-chain documents whose hashes can be anchored on an invoice with attach_document
+//==============================================================================================================================
+
+const   DOCUMENT_INVOICE    =  "invoice"			// The invoice PDF
+const   DOCUMENT_DELIVERY   =  "deliverynote"
+const   DOCUMENT_ASSIGNMENT =  "assignment"		// The agreement assigning the receivable to the financier
+
+//==============================================================================================================================
+//	 Guarantee types
+//==============================================================================================================================
+
+const   GUARANTEE_BANK      =  "guarantee"		// A bank or parent company guarantee
+const   GUARANTEE_INSURANCE =  "insurance"		// A trade credit insurance policy
+
+//==============================================================================================================================
+//	 Three-way match statuses - The outcome of matching an invoice against its purchase order and goods receipts
+//==============================================================================================================================
+
+const   SCHEDULE_PROPOSED   =  "PROPOSED"			// Awaiting acceptance by the buyer and every financier
+const   SCHEDULE_AGREED     =  "AGREED"
+const   INSTALLMENT_DUE     =  "DUE"
+const   INSTALLMENT_PAID    =  "PAID"
+const   INSTALLMENT_OVERDUE =  "OVERDUE"		// Set by mark_overdue
+
+const   MATCH_MATCHED    =  "MATCHED"
+const   MATCH_EXCEPTIONS =  "EXCEPTIONS"		// Recorded for the buyer to review, the invoice cannot be financed
+const   MATCH_ACCEPTED   =  "ACCEPTED"			// The buyer accepted the exceptions with accept_match
+
+//==============================================================================================================================
+//	 Offer statuses
+//==============================================================================================================================
+
+const   OFFER_OPEN     =  "OPEN"
+const   OFFER_SELECTED =  "SELECTED"
+const   OFFER_EXPIRED  =  "EXPIRED"			// Past its expiry, or lost when the seller selected another offer
+
+const   PRICING_FIXED  =  "fixed"			// The financier names the purchase price
+const   PRICING_RATE   =  "rate"			// The purchase price is computed from an annual rate by price_offer
+const   DAY_COUNT_BASIS =  365				// Actual/365, days in a year when pricing from an annual rate
+
+const   OFFER_PREFIX   =  "offer"			// Composite key prefix for offers, keyed by invoice ID and offer ID
+
+const   AUCTION_OPEN   =  "OPEN"			// Auction statuses, see Auction
+const   AUCTION_CLOSED =  "CLOSED"
+const   AUCTION_BID_PREFIX = "auctionbid"	// Composite key prefix for sealed bids, keyed by invoice ID, auction ID and financier
+const   BIDS_COLLECTION =  "auctionBids"		// Private data collection of the seller orgs holding auction bids, sealed from other financiers
+const   ASSIGNMENT_PREFIX = "assignment"		// Composite key prefix for assignment records, keyed by invoice ID, transaction ID and assignee
+const   STATUS_INDEX   =  "status~invoice"			// Composite key index of invoices by status
+const   OWNER_INDEX    =  "owner~status~invoice"	// Composite key index of invoices by seller, buyer and financier, then status
+const   REFERENCE_INDEX =  "kind~reference~invoice"	// Composite key index of invoices by the ERP numbers below
+const   REFERENCE_EXTERNAL = "externalnumber"		// The seller's own invoice number
+const   REFERENCE_ERP  =  "erpdocid"				// The document ID in the seller's ERP
+const   REFERENCE_SELLER = "sellerreference"		// Any other reference the seller quotes, e.g. a contract or project
+const   ARCHIVE_PREFIX =  "archive"				// Composite key prefix for archived invoices, keyed by invoice ID
+const   ARCHIVE_INDEX  =  "archive~owner~invoice"	// Composite key index of archived invoices by seller, buyer and financier
+const   ARCHIVE_AFTER_DAYS = 365				// Days an invoice stays in the world state after it was settled, paid, cancelled or voided
+const   TERMS_COLLECTION = "invoiceTerms"		// Private data collection of the seller and financier orgs holding discounts and offer terms
+const   TERMS_TRANSIENT  = "terms"				// Transient field carrying terms into create_invoice, amend_invoice and submit_offer
+const   SALT_TRANSIENT   = "salt"				// Transient field carrying the random salt of the private records a transaction writes
+const   MIN_SALT_BYTES   =  16					// Shortest salt accepted, so hashes cannot be matched by hashing guessed terms
+const   SETTLEMENT_PREFIX = "settlement"		// Composite key prefix for settlements in the terms collection, keyed by invoice ID
+const   CREDIT_PREFIX  =  "creditprofile"		// Composite key prefix for buyer credit profiles, keyed by buyer
+const   FINGERPRINT_PREFIX = "fingerprint"	// Composite key prefix claiming an invoice fingerprint, see fingerprint()
+const   HISTORY_PREFIX =  "invoicehistory"	// Composite key prefix for superseded invoice versions, keyed by invoice ID and version
+const   CREDIT_NOTE_PREFIX = "creditnote"	// Composite key prefix for credit notes, keyed by invoice ID and credit note ID
+const   PURCHASE_ORDER_PREFIX = "purchaseorder"	// Composite key prefix for purchase orders, keyed by buyer and PO number
+const   GOODS_RECEIPT_PREFIX = "goodsreceipt"	// Composite key prefix for goods receipts, keyed by buyer, PO number and receipt ID
+const   BLACKLIST_PREFIX = "blacklist"		// Composite key prefix for blocked parties, keyed by username
+const   CURRENCY_PREFIX =  "currency"			// Composite key prefix for the currency master, keyed by ISO 4217 code
+const   LATE_FEE_POLICY =  "latefeepolicy"	// Composite key prefix, without attributes, of the late fee policy
+const   DISCOUNT_BAND  =  "discountband"		// Composite key prefix, without attributes, of the discount band
+
+const   LATE_FEE_DAILY   =  "daily"			// Late fee bases, see Late_Fee_Policy
+const   LATE_FEE_MONTHLY =  "monthly"
+
+const   FEE_SCHEDULE     =  "feeschedule"		// Composite key prefix, without attributes, of the platform fee schedule
+const   FEE_PREFIX       =  "platformfee"		// Composite key prefix for platform fees, keyed by invoice ID, transaction ID and payer
+const   FEE_FINANCING    =  "financing"			// Platform fee bases, see Platform_Fee
+const   FEE_SETTLEMENT   =  "settlement"
+const   BPS_PER_UNIT     =  10000				// Basis points in a whole
+
+const   AUTO_APPROVAL_PREFIX = "autoapprovalrule"	// Composite key prefix for auto-approval rules, keyed by buyer and rule ID
+
+const   INTERCOMPANY_PREFIX    =  "intercompanyroute"	// Composite key prefix for intercompany routes, keyed by seller and buyer
+const   INTERCOMPANY_CHAINCODE =  "intercompany"		// Chaincode that approved intercompany invoices are posted to by default
+
+//==============================================================================================================================
+//	 Event names - Every invoice state change emits one chaincode event
+//==============================================================================================================================
+
+const   EVENT_CREATED          =  "invoice_created"
+const   EVENT_BULK_CREATED     =  "invoices_created"
+const   EVENT_AMENDED          =  "invoice_amended"
+const   EVENT_CANCELLED        =  "invoice_cancelled"
+const   EVENT_VOID_REQUESTED   =  "void_requested"		// One of the seller and buyer asked to void, awaiting the other
+const   EVENT_VOIDED           =  "invoice_voided"
+const   EVENT_OFFER_MADE       =  "offer_made"
+const   EVENT_OFFER_SELECTED   =  "offer_selected"
+const   EVENT_AUCTION_OPENED   =  "auction_opened"
+const   EVENT_BID_SUBMITTED    =  "bid_submitted"
+const   EVENT_AUCTION_CLOSED   =  "auction_closed"
+const   EVENT_APPROVAL_PENDING =  "approval_pending"	// Approved by a buyer under dual control, awaiting countersign_approval
+const   EVENT_APPROVED         =  "invoice_approved"
+const   EVENT_REJECTED         =  "invoice_rejected"
+const   EVENT_BATCH_APPROVED   =  "invoices_approved"
+const   EVENT_BATCH_REJECTED   =  "invoices_rejected"
+const   EVENT_DUE_DATE_CHANGED =  "due_date_changed"
+const   EVENT_OVERDUE          =  "invoices_overdue"
+const   EVENT_DUE_IN_7_DAYS    =  "payments_due_in_7_days"	// Reminders emitted by run_reminders
+const   EVENT_DUE_IN_1_DAY     =  "payments_due_tomorrow"
+const   EVENT_FEES_ACCRUED     =  "late_fees_accrued"
+const   EVENT_CREDIT_ISSUED    =  "credit_note_issued"
+const   EVENT_CREDIT_ACKNOWLEDGED = "credit_note_acknowledged"
+const   EVENT_SCHEDULE_PROPOSED =  "schedule_proposed"
+const   EVENT_SCHEDULE_ACCEPTED =  "schedule_accepted"	// Accepted by one party, others still to accept
+const   EVENT_SCHEDULE_AGREED  =  "schedule_agreed"
+const   EVENT_PAYMENT          =  "payment_recorded"
+const   EVENT_PAID             =  "invoice_paid"
+const   EVENT_DELIVERY         =  "delivery_confirmed"
+const   EVENT_MATCHED          =  "invoice_matched"
+const   EVENT_SETTLED          =  "invoice_settled"
+const   EVENT_DISPUTE_RAISED   =  "dispute_raised"
+const   EVENT_DISPUTE_RESPONDED =  "dispute_responded"
+const   EVENT_DISPUTE_RESOLVED =  "dispute_resolved"
+const   EVENT_DOCUMENT         =  "document_attached"
+const   EVENT_GUARANTEE        =  "guarantee_attached"
+const   EVENT_GUARANTEE_DRAWN  =  "guarantee_drawn"
+const   EVENT_TRANCHE          =  "tranche_accepted"
+const   EVENT_POSITION_TRANSFERRED = "position_transferred"	// Tells the buyer whom the invoice is now payable to
+const   EVENT_OFFERS_LAPSED    =  "offers_lapsed"
+const   EVENT_PAYABLE_CREATED  =  "payable_created"
+const   EVENT_PAYABLE_CONFIRMED =  "payable_confirmed"
+const   EVENT_PAYABLE_DECLINED =  "payable_declined"
+
+const   REMINDER_PREFIX        =  "reminder"			// Composite key prefix marking a reminder sent, keyed by invoice ID, due date and days
+
+var REMINDER_DAYS = map[int]string{								// Days before the due date run_reminders reminds of, and the event it emits
+	7: EVENT_DUE_IN_7_DAYS,
+	1: EVENT_DUE_IN_1_DAY,
+}
+
+const   NOTIFY_PREFIX      =  "notifypreference"	// Composite key prefix for notification preferences, keyed by username
+const   ADMIN_ATTRIBUTE    =  "admin"			// Certificate attribute that allows managing the participant registry
+const   PARTICIPANT_PREFIX =  "participant"		// Composite key prefix for the participant registry, keyed by MSP ID and identity ID
 
 
 //==============================================================================================================================
@@ -32,314 +278,7481 @@ type  SimpleChaincode struct {
 type Invoice struct {
 	InvoiceId        string `json:"invoiceid"`
 	Amount           string `json:"amount"`
+	AmountUnits      int64  `json:"amountunits"`
 	Currency         string `json:"currency"`
 	Seller         string `json:"seller"`
 	Buyer            string `json:"buyer"`
 	DueDate          string `json:"duedate"`
 	Status           string `json:"status"`
 	Financier            string `json:"financier"`
+	Discount         string `json:"discount,omitempty"`			// Private, see Invoice_Terms
+	FinancedAmount   string `json:"financedamount,omitempty"`	// Private, see Invoice_Terms
+	TermsHash        string `json:"termshash,omitempty"`
+	Outstanding      string `json:"outstanding"`
+	PendingDueDate   string `json:"pendingduedate,omitempty"`
+	Version          int    `json:"version"`
+	IssuedAt         string `json:"issuedat,omitempty"`
+	LineItems        []Line_Item `json:"lineitems,omitempty"`
+	PONumber         string `json:"ponumber,omitempty"`
+	ExternalNumber   string `json:"externalnumber,omitempty"`
+	ErpDocId         string `json:"erpdocid,omitempty"`
+	SellerReference  string `json:"sellerreference,omitempty"`
+	Delivery         *Delivery_Confirmation `json:"delivery,omitempty"`
+	Match            *Invoice_Match `json:"match,omitempty"`		// Set by match_invoice when the invoice has a purchase order
+	SettlementHash   string `json:"settlementhash,omitempty"`
+	Payments         []Payment `json:"payments"`
+	Schedule         *Repayment_Schedule `json:"schedule,omitempty"`
+	Intercompany     *Intercompany_Posting `json:"intercompany,omitempty"`	// Set when approved between companies of a group
+	PendingApproval  *Pending_Approval `json:"pendingapproval,omitempty"`	// Cleared by transition on any status change
+	AutoApproval     *Auto_Approval `json:"autoapproval,omitempty"`		// Set when a buyer's rule approved the financing
+	Void             *Void_Record `json:"void,omitempty"`				// The void request, or the void once VOID
+	Disputes         []Dispute `json:"disputes,omitempty"`
+	Documents        []Document `json:"documents,omitempty"`
+	Guarantee        *Guarantee `json:"guarantee,omitempty"`
+	Auction          *Auction `json:"auction,omitempty"`
+	Tranches         []Tranche `json:"tranches,omitempty"`
+	Transfers        []Position_Transfer `json:"transfers,omitempty"`	// Chain of ownership after financing, oldest first
+	BuyerInitiated   bool   `json:"buyerinitiated,omitempty"`		// An approved payable, see create_approved_payable
+	Fees             []Late_Fee `json:"fees,omitempty"`
+	LastChange       *Change_Record `json:"lastchange,omitempty"`		// Stamped by save_changes on every write
+	Transitions      []Status_Transition `json:"transitions,omitempty"`	// Appended by save_changes on every write
+	FinancedCurrency string `json:"financedcurrency,omitempty"`	// Set when the selected offer was in another currency
+	FxRate           string `json:"fxrate,omitempty"`				// Units of the financed currency per unit of the invoice currency
+	Credited         string `json:"credited,omitempty"`			// Total of the acknowledged credit notes
+	ArchivedAt       string `json:"archivedat,omitempty"`			// Set on the copy in the archive, see archive_invoice
+}
+
+
+//==============================================================================================================================
+//	Invoice Event - The payload of every chaincode event, naming who made the change. Events about several invoices
+//					at once (invoices_overdue) list their IDs instead of carrying an invoice. Recipients are the actor
+//					and the parties of the invoices whose notification preferences include the event. Settlement
+//					milestones (reminders, overdue, paid and settled) also carry a summary of each invoice.
+//	Invoice Summary - The public figures of an invoice, for treasury systems to run payments and dunning from.
+//==============================================================================================================================
+type Invoice_Event struct {
+	Event            string   `json:"event"`
+	Actor            string   `json:"actor"`
+	ActorId          string   `json:"actorid"`
+	ActorMspId       string   `json:"actormspid"`
+	TxId             string   `json:"txid"`
+	Invoice          *Invoice `json:"invoice,omitempty"`
+	Offer            *Offer   `json:"offer,omitempty"`
+	InvoiceIds       []string `json:"invoiceids,omitempty"`
+	CreditNote       *Credit_Note `json:"creditnote,omitempty"`
+	Summaries        []Invoice_Summary `json:"summaries,omitempty"`
+	Recipients       []string `json:"recipients"`
+}
+
+type Invoice_Summary struct {
+	InvoiceId        string `json:"invoiceid"`
+	ExternalNumber   string `json:"externalnumber,omitempty"`
+	Seller           string `json:"seller"`
+	Buyer            string `json:"buyer"`
+	Financier        string `json:"financier"`
+	Amount           string `json:"amount"`
+	Outstanding      string `json:"outstanding"`
+	Currency         string `json:"currency"`
+	DueDate          string `json:"duedate"`						// Of the earliest unpaid installment under an agreed schedule
+	Status           string `json:"status"`
+	DaysPastDue      int    `json:"dayspastdue"`					// Negative while the invoice is not yet due
+}
+
+
+//==============================================================================================================================
+//	Notification Preference - The events a participant wants to be notified of, see set_notification_preferences.
+//==============================================================================================================================
+type Notification_Preference struct {
+	Username         string `json:"username"`
+	Events           []string `json:"events"`
+	UpdatedAt        string `json:"updatedat"`
+}
+
+
+//==============================================================================================================================
+//	Chaincode Error - The error envelope returned as the message of a failed invoke, as JSON. Fields carry the context
+//					  of the failure, e.g. the invoice ID and its status, for clients to build their own message from.
+//==============================================================================================================================
+type Chaincode_Error struct {
+	Code             string `json:"code"`
+	Message          string `json:"message"`
+	Fields           map[string]string `json:"fields,omitempty"`
+}
+
+func (e *Chaincode_Error) Error() string {
+
+	bytes, _ := json.Marshal(e)
+	return string(bytes)
+}
+
+
+//==============================================================================================================================
+//	Change Record - Who wrote the current version of an invoice and through which function. Every version in the key
+//					history carries the change that produced it, which is what get_invoice_audit reads back.
+//	Status Transition - One change in the timeline embedded in an invoice, with the status it moved from and to, which
+//						are the same for changes that kept the status. Invoices written before the timeline was kept
+//						start it at their first change after that.
+//	Audit Entry - One version of an invoice in its audit trail.
+//==============================================================================================================================
+type Change_Record struct {
+	Function         string `json:"function"`
+	Actor            string `json:"actor"`
+	ActorId          string `json:"actorid"`
+	ActorMspId       string `json:"actormspid"`
+	Role             string `json:"role"`
+}
+
+type Status_Transition struct {
+	From             string `json:"from,omitempty"`
+	Status           string `json:"status"`
+	Actor            string `json:"actor"`
+	Function         string `json:"function"`
+	TxId             string `json:"txid"`
+	Timestamp        string `json:"timestamp"`
+}
+
+type Audit_Entry struct {
+	TxId             string `json:"txid"`
+	Timestamp        string `json:"timestamp"`
+	Function         string `json:"function"`
+	Actor            string `json:"actor"`
+	ActorId          string `json:"actorid"`
+	ActorMspId       string `json:"actormspid"`
+	Role             string `json:"role"`
+	StatusBefore     string `json:"statusbefore"`
+	StatusAfter      string `json:"statusafter"`
+	Deleted          bool   `json:"deleted,omitempty"`
+}
+
+
+//==============================================================================================================================
+//	Seller Score - A seller's track record derived by get_seller_score from its invoices and their key history. Rates are
+//				   percentages. The score starts at 100.00 and loses 0.3 points per percent of invoices disputed, 0.5 per
+//				   percent of financed invoices that went overdue, and a third of a point per day the buyer took on
+//				   average to approve, at most 20 points, never going below zero.
+//==============================================================================================================================
+type Seller_Score struct {
+	Seller           string `json:"seller"`
+	InvoicesIssued   int    `json:"invoicesissued"`
+	Disputed         int    `json:"disputed"`
+	DisputeRate      string `json:"disputerate"`
+	Approved         int    `json:"approved"`
+	AvgDaysToApproval string `json:"avgdaystoapproval"`
+	Financed         int    `json:"financed"`
+	Defaulted        int    `json:"defaulted"`
+	DefaultRate      string `json:"defaultrate"`
+	Score            string `json:"score"`
+}
+
+
+//==============================================================================================================================
+//	Invoice Upload - An invoice to create, as create_invoice takes it in arguments and bulk_create_invoices in records.
+//	Bulk Result - What became of one record of a bulk upload, or of one invoice of approve_trades or reject_trades.
+//==============================================================================================================================
+type Invoice_Upload struct {
+	InvoiceId        string `json:"invoiceid"`
+	Amount           string `json:"amount"`
 	Discount         string `json:"discount"`
+	Buyer            string `json:"buyer"`
+	DueDate          string `json:"duedate"`
+	LineItems        []Line_Item `json:"lineitems"`
+	PONumber         string `json:"ponumber"`
+	ExternalNumber   string `json:"externalnumber"`
+	ErpDocId         string `json:"erpdocid"`
+	SellerReference  string `json:"sellerreference"`
+	Currency         string `json:"currency"`
+}
+
+type Bulk_Result struct {
+	InvoiceId        string `json:"invoiceid"`
+	Status           string `json:"status"`
+	Code             string `json:"code,omitempty"`
+	Error            string `json:"error,omitempty"`
 }
 
 
 //==============================================================================================================================
-//	Invoice Holder - Defines the structure that holds all the invoiceIDs for invoices that have been created.
-//				     Used as an index when querying all invoices.
+//	Invoice Filter - The criteria accepted by query_invoices. Empty fields match everything; amounts are inclusive.
 //==============================================================================================================================
+type Invoice_Filter struct {
+	Status           string `json:"status"`
+	Buyer            string `json:"buyer"`
+	Seller           string `json:"seller"`
+	Currency         string `json:"currency"`
+	MinAmount        string `json:"minamount"`
+	MaxAmount        string `json:"maxamount"`
+	Guaranteed       bool   `json:"guaranteed"`				// Only invoices with an unexpired guarantee
+}
 
-type Invoice_Holder struct {
-	Invoices 	[]string `json:"invoices"`
+
+//==============================================================================================================================
+//	Market Filter - The mandate accepted by browse_market. Empty fields match every open invoice; amounts are inclusive.
+//					Days to maturity count from the transaction date and leave out invoices without a due date.
+//==============================================================================================================================
+type Market_Filter struct {
+	MinAmount        string `json:"minamount"`
+	MaxAmount        string `json:"maxamount"`
+	Currency         string `json:"currency"`
+	MaxDaysToMaturity int   `json:"maxdaystomaturity"`
+	MinBuyerRating   string `json:"minbuyerrating"`
+	Guaranteed       bool   `json:"guaranteed"`
+	Sort             string `json:"sort"`						// amount, duedate or issuedat, with a leading - for descending
 }
 
 
 //==============================================================================================================================
-//	Init Function - Called when the user deploys the chaincode
+//	Invoice Page - One page of query_invoices results. Pass the bookmark back to fetch the next page.
 //==============================================================================================================================
-func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+type Invoice_Page struct {
+	Records              []Invoice `json:"records"`
+	FetchedRecordsCount  int32  `json:"fetchedrecordscount"`
+	Bookmark             string `json:"bookmark"`
+}
 
 
-	var invoiceIDs Invoice_Holder
+//==============================================================================================================================
+//	Credit Profile - A buyer's credit limit and optional rating, set by an admin or a financier. Buyers without a
+//					 profile have no limit and no rating.
+//	Buyer Exposure - The limit against the buyer's current exposure: the outstanding balance of its financed invoices.
+//					 Both are in DEFAULT_CURRENCY; invoices in other currencies count at the rate of the currency master.
+//==============================================================================================================================
+type Credit_Profile struct {
+	Buyer            string `json:"buyer"`
+	Limit            string `json:"limit"`
+	Rating           string `json:"rating,omitempty"`
+	UpdatedBy        string `json:"updatedby"`
+}
+
+type Buyer_Exposure struct {
+	Buyer            string `json:"buyer"`
+	Limit            string `json:"limit"`
+	Exposure         string `json:"exposure"`
+	Available        string `json:"available"`
+	Utilization      string `json:"utilization"`				// Exposure as a percentage of the limit
+	Invoices         []string `json:"invoices"`
+}
+
+
+//==============================================================================================================================
+//	Receivables Aging - A seller's open invoices bucketed by age, returned by get_receivables_aging. Each bucket splits
+//						the invoices into financed and unfinanced ones, with outstanding totals in DEFAULT_CURRENCY.
+//==============================================================================================================================
+type Receivables_Split struct {
+	Count            int    `json:"count"`
+	Outstanding      string `json:"outstanding"`
+	Invoices         []string `json:"invoices"`
+}
+
+type Receivables_Bucket struct {
+	Bucket           string `json:"bucket"`
+	Financed         Receivables_Split `json:"financed"`
+	Unfinanced       Receivables_Split `json:"unfinanced"`
+}
+
+
+//==============================================================================================================================
+//	Statement - The invoices between the caller and one counterparty, returned by get_statement_with, grouped by status.
+//				Outstanding totals are by currency; cancelled invoices count nothing outstanding.
+//==============================================================================================================================
+type Statement struct {
+	Party            string `json:"party"`
+	Counterparty     string `json:"counterparty"`
+	Outstanding      map[string]string `json:"outstanding"`
+	Groups           []Statement_Group `json:"groups"`
+}
+
+type Statement_Group struct {
+	Status           string `json:"status"`
+	Count            int    `json:"count"`
+	Outstanding      map[string]string `json:"outstanding"`
+	Invoices         []Invoice `json:"invoices"`
+}
+
+
+//==============================================================================================================================
+//	Portfolio - The invoices financed by a financier, returned by get_portfolio. Expected yield is the face value over
+//				the purchase price; the yield rate is that as a percentage of the purchase price. Days to maturity is
+//				negative once the due date has passed and missing when the invoice has no due date. The totals are
+//				in DEFAULT_CURRENCY, see nominal_amount.
+//==============================================================================================================================
+type Portfolio_Entry struct {
+	InvoiceId        string `json:"invoiceid"`
+	Status           string `json:"status"`
+	Currency         string `json:"currency"`					// Of every amount of the entry, purchase prices are converted
+	Seller           string `json:"seller"`
+	Buyer            string `json:"buyer"`
+	FaceValue        string `json:"facevalue"`
+	Outstanding      string `json:"outstanding"`
+	PurchasePrice    string `json:"purchaseprice"`
+	ExpectedYield    string `json:"expectedyield"`
+	YieldRate        string `json:"yieldrate"`
+	DueDate          string `json:"duedate"`
+	DaysToMaturity   *int   `json:"daystomaturity,omitempty"`
+	Share            string `json:"share,omitempty"`				// The percentage held, for invoices financed in tranches
+}
+
+type Portfolio struct {
+	Financier        string `json:"financier"`
+	Count            int    `json:"count"`
+	FaceValue        string `json:"facevalue"`
+	Outstanding      string `json:"outstanding"`
+	PurchasePrice    string `json:"purchaseprice"`
+	ExpectedYield    string `json:"expectedyield"`
+	Invoices         []Portfolio_Entry `json:"invoices"`
+}
+
+
+//==============================================================================================================================
+//	Concentration Report - A financier's open exposure grouped by buyer, currency and maturity bucket, returned by
+//						   get_concentration_report. Amounts are in the report's currency; percentages are of the total.
+//==============================================================================================================================
+type Concentration_Line struct {
+	Key              string `json:"key"`
+	Exposure         string `json:"exposure"`
+	Percentage       string `json:"percentage"`
+	Count            int    `json:"count"`
+	units            int64
+}
+
+type Concentration_Report struct {
+	Financier        string `json:"financier"`
+	Currency         string `json:"currency"`
+	Exposure         string `json:"exposure"`
+	Count            int    `json:"count"`
+	ByBuyer          []Concentration_Line `json:"bybuyer"`
+	ByCurrency       []Concentration_Line `json:"bycurrency"`
+	ByMaturity       []Concentration_Line `json:"bymaturity"`
+}
+
+
+//==============================================================================================================================
+//	Settlement - The maturity settlement of an invoice: who the buyer paid and, for a financed invoice, the discount the
+//				 financier earned over its purchase price. An invoice financed in tranches is paid out pro rata, one
+//				 allocation per tranche. Kept in the terms collection, hashed on the invoice.
+//==============================================================================================================================
+type Settlement struct {
+	InvoiceId        string `json:"invoiceid"`
+	PaidTo           string `json:"paidto,omitempty"`					// Unset when the invoice was financed in tranches
+	PurchaseCurrency string `json:"purchasecurrency,omitempty"`		// The currency of the purchase price, when not the invoice's
+	Credited         string `json:"credited,omitempty"`				// Credit notes taken off the face amount before settlement
+	FaceAmount       string `json:"faceamount"`
+	AmountPaid       string `json:"amountpaid"`
+	PurchasePrice    string `json:"purchaseprice"`
+	EarnedDiscount   string `json:"earneddiscount"`
+	SettledBy        string `json:"settledby"`
+	SettledAt        string `json:"settledat"`
+	TxId             string `json:"txid"`
+	Allocations      []Settlement_Allocation `json:"allocations,omitempty"`
+	GuaranteeDrawn   bool   `json:"guaranteedrawn"`
+	GuaranteeAmount  string `json:"guaranteeamount,omitempty"`		// What the financiers drew from the guarantor
+	Salt             string `json:"salt,omitempty"`
+}
+
+//	The part of a settlement paid to one tranche holder, or to the seller for the unsubscribed rest of the invoice
+type Settlement_Allocation struct {
+	PaidTo           string `json:"paidto"`
+	Percentage       string `json:"percentage"`
+	AmountPaid       string `json:"amountpaid"`
+	PurchasePrice    string `json:"purchaseprice"`
+	EarnedDiscount   string `json:"earneddiscount"`
+}
+
+
+//==============================================================================================================================
+//	Delivery Confirmation - The buyer's attestation that the goods or services on an invoice were received. Financiers
+//							can only finance invoices that carry one.
+//==============================================================================================================================
+type Delivery_Confirmation struct {
+	ConfirmedBy      string `json:"confirmedby"`
+	ConfirmedAt      string `json:"confirmedat"`
+	DocumentHash     string `json:"documenthash,omitempty"`
+}
+
+
+//==============================================================================================================================
+//	Purchase Order & Goods Receipt - What a buyer ordered from a seller, and what it received against the order, created
+//									 by the buyer for match_invoice to check invoices against.
+//==============================================================================================================================
+type Purchase_Order struct {
+	PONumber         string `json:"ponumber"`
+	Buyer            string `json:"buyer"`
+	Seller           string `json:"seller"`
+	Currency         string `json:"currency"`
+	Lines            []Order_Line `json:"lines"`
+	CreatedAt        string `json:"createdat"`
+	TxId             string `json:"txid"`
+}
+
+type Order_Line struct {
+	Description      string `json:"description"`
+	Quantity         int64  `json:"quantity"`
+	UnitPrice        string `json:"unitprice"`
+}
+
+type Goods_Receipt struct {
+	ReceiptId        string `json:"receiptid"`
+	PONumber         string `json:"ponumber"`
+	Buyer            string `json:"buyer"`
+	Lines            []Receipt_Line `json:"lines"`
+	ReceivedAt       string `json:"receivedat"`
+	TxId             string `json:"txid"`
+}
+
+type Receipt_Line struct {
+	Description      string `json:"description"`
+	Quantity         int64  `json:"quantity"`
+}
+
+
+//==============================================================================================================================
+//	Invoice Match - The result of the three-way match of an invoice against its purchase order and goods receipts. An
+//					invoice with a purchase order on the ledger can only be financed once matched, or once the buyer
+//					accepted its exceptions.
+//==============================================================================================================================
+type Invoice_Match struct {
+	Status           string `json:"status"`
+	Exceptions       []Match_Exception `json:"exceptions,omitempty"`
+	MatchedBy        string `json:"matchedby"`
+	MatchedAt        string `json:"matchedat"`
+	AcceptedBy       string `json:"acceptedby,omitempty"`
+	TxId             string `json:"txid"`
+}
+
+type Match_Exception struct {
+	Line             int    `json:"line"`							// The invoice line, from 1, or 0 for the invoice as a whole
+	Description      string `json:"description"`
+	Reason           string `json:"reason"`
+}
 
-	bytes, err := json.Marshal(invoiceIDs)
 
-    if err != nil { return nil, errors.New("Error creating Invoice_Holder record") }
+//==============================================================================================================================
+//	Tranche - A financier's share of an invoice financed by several financiers, taken with accept_trade_partial. The
+//			  face amount is the financier's percentage of the invoice amount.
+//==============================================================================================================================
+type Tranche struct {
+	Financier        string `json:"financier"`
+	Percentage       string `json:"percentage"`
+	FaceAmount       string `json:"faceamount"`
+	PurchasePrice    string `json:"purchaseprice,omitempty"`	// Private, see Invoice_Terms
+	AcceptedAt       string `json:"acceptedat"`
+	ExpiresAt        string `json:"expiresat,omitempty"`			// Lapses unless the buyer approved the financing by then
+	TxId             string `json:"txid"`
+}
+
+
+//==============================================================================================================================
+//	Assignment Record - Evidence that the seller assigned an invoice, or a percentage of it, to a financier, written
+//						when a financier's offer is selected or its tranche accepted. The consideration it paid is
+//						private, see Assignment_Terms.
+//==============================================================================================================================
+type Assignment_Record struct {
+	InvoiceId        string `json:"invoiceid"`
+	InvoiceReference string `json:"invoicereference,omitempty"`	// The seller's own invoice number
+	Assignor         string `json:"assignor"`
+	Assignee         string `json:"assignee"`
+	Debtor           string `json:"debtor"`
+	Percentage       string `json:"percentage"`
+	FaceAmount       string `json:"faceamount"`
+	Consideration    string `json:"consideration,omitempty"`		// Private, see Assignment_Terms
+	ConsiderationHash string `json:"considerationhash"`
+	Currency         string `json:"currency"`					// The currency of the consideration
+	EffectiveAt      string `json:"effectiveat"`
+	TxId             string `json:"txid"`
+}
+
+type Assignment_Terms struct {
+	InvoiceId        string `json:"invoiceid"`
+	TxId             string `json:"txid"`
+	Consideration    string `json:"consideration"`
+	Salt             string `json:"salt,omitempty"`
+}
+
+
+//==============================================================================================================================
+//	Position Transfer - A financed invoice, or one tranche of it, sold on to another financier with transfer_position.
+//						Settlement at maturity pays whoever holds the position then.
+//==============================================================================================================================
+type Position_Transfer struct {
+	From             string `json:"from"`
+	To               string `json:"to"`
+	Percentage       string `json:"percentage"`
+	TransferredAt    string `json:"transferredat"`
+	TxId             string `json:"txid"`
+}
+
+
+//==============================================================================================================================
+//	Guarantee - A guarantee or credit insurance policy covering a percentage of an invoice, recorded by the guarantor
+//				with the SHA-256 hash of the policy document. It protects the financiers until it expires, and they
+//				can draw on it once the invoice is overdue.
+//==============================================================================================================================
+type Guarantee struct {
+	Type             string `json:"type"`
+	Guarantor        string `json:"guarantor"`
+	Coverage         string `json:"coverage"`
+	PolicyHash       string `json:"policyhash"`
+	ExpiresAt        string `json:"expiresat"`
+	AttachedAt       string `json:"attachedat"`
+	TxId             string `json:"txid"`
+	DrawnBy          string `json:"drawnby,omitempty"`
+	DrawnAmount      string `json:"drawnamount,omitempty"`
+	DrawnAt          string `json:"drawnat,omitempty"`
+}
+
+
+//==============================================================================================================================
+//	Auction - A sealed-bid auction of the financing of an invoice, see open_auction. The winner's rate is only
+//			  revealed once the auction is closed.
+//	Auction Bid - A financier's bid, kept in the BIDS_COLLECTION private data collection.
+//	Sealed Bid - The public record that a financier bid, carrying the SHA-256 hash of its Auction_Bid.
+//==============================================================================================================================
+type Auction struct {
+	AuctionId        string `json:"auctionid"`				// The transaction ID of the open_auction call
+	Status           string `json:"status"`
+	Deadline         string `json:"deadline"`
+	OpenedAt         string `json:"openedat"`
+	ClosedAt         string `json:"closedat,omitempty"`
+	Bids             int    `json:"bids"`
+	Winner           string `json:"winner,omitempty"`
+	WinningRate      string `json:"winningrate,omitempty"`
+	WinningOfferId   string `json:"winningofferid,omitempty"`
+}
+
+type Auction_Bid struct {
+	InvoiceId        string `json:"invoiceid"`
+	AuctionId        string `json:"auctionid"`
+	Financier        string `json:"financier"`
+	AnnualRate       string `json:"annualrate"`
+	SubmittedAt      string `json:"submittedat"`
+	TxId             string `json:"txid"`
+	Salt             string `json:"salt,omitempty"`
+}
+
+type Sealed_Bid struct {
+	InvoiceId        string `json:"invoiceid"`
+	AuctionId        string `json:"auctionid"`
+	Financier        string `json:"financier"`
+	BidHash          string `json:"bidhash"`
+	SubmittedAt      string `json:"submittedat"`
+	TxId             string `json:"txid"`
+}
+
+
+//==============================================================================================================================
+//	Document - The SHA-256 hash of an off-chain document anchored on an invoice by one of its parties. A newer document
+//			   of the same type does not replace the older ones, so every version stays verifiable.
+//==============================================================================================================================
+type Document struct {
+	Type             string `json:"type"`
+	Hash             string `json:"hash"`
+	UploadedBy       string `json:"uploadedby"`
+	UploaderMspId    string `json:"uploadermspid"`
+	UploadedAt       string `json:"uploadedat"`
+	TxId             string `json:"txid"`
+}
+
+
+//==============================================================================================================================
+//	Blacklist Entry - A party blocked by compliance, e.g. after a sanctions screening hit. Invoices cannot be created,
+//					  financed or approved while any of their parties is blocked.
+//==============================================================================================================================
+type Blacklist_Entry struct {
+	Username         string `json:"username"`
+	Reason           string `json:"reason"`
+	BlockedBy        string `json:"blockedby"`
+	BlockedAt        string `json:"blockedat"`
+}
+
+
+//==============================================================================================================================
+//	Currency - An entry of the currency master, which lists the currencies invoices and offers may be in. Maintained by
+//			   admins; DEFAULT_CURRENCY needs no entry. Its rate converts amounts to DEFAULT_CURRENCY for reports, amount
+//			   filters and credit limits, see nominal_amount.
+//	Discount Band - The lowest and highest discount rate an invoice or offer may carry, set by an admin.
+//==============================================================================================================================
+type Currency struct {
+	Code             string `json:"code"`
+	Name             string `json:"name"`
+	Decimals         *int   `json:"decimals,omitempty"`			// Decimal places of its amounts, its ISO 4217 minor unit when not set
+	Rate             string `json:"rate,omitempty"`				// Units of DEFAULT_CURRENCY per unit
+	UpdatedBy        string `json:"updatedby"`
+}
+
+type Discount_Band struct {
+	MinRate          string `json:"minrate"`
+	MaxRate          string `json:"maxrate"`
+	UpdatedBy        string `json:"updatedby"`
+}
+
+
+//==============================================================================================================================
+//	Line Item - A line of an invoice. Quantity times unit price plus tax is the line total; the line totals of an
+//				invoice add up to its amount.
+//==============================================================================================================================
+type Line_Item struct {
+	Description      string `json:"description"`
+	Quantity         int64  `json:"quantity"`
+	UnitPrice        string `json:"unitprice"`
+	Tax              string `json:"tax"`
+}
 
-	err = stub.PutState("invoiceIDs", bytes)
-	if err != nil { return nil, errors.New("Error putting state with invoiceIDs") }
 
-	return nil, nil
+//==============================================================================================================================
+//	Aging Bucket - Overdue invoices grouped by days past due, returned by get_overdue_invoices. The outstanding total
+//				   is in DEFAULT_CURRENCY, see nominal_amount.
+//==============================================================================================================================
+type Aging_Bucket struct {
+	Bucket           string `json:"bucket"`
+	Outstanding      string `json:"outstanding"`
+	Invoices         []Invoice `json:"invoices"`
+}
+
+var AGING_BUCKETS = []struct{ Name string; MaxDays int }{
+	{"1-30", 30},
+	{"31-60", 60},
+	{"61-90", 90},
+	{"90+", -1},
 }
 
+// Buckets of days to maturity in get_concentration_report, besides past due and undated invoices
+var MATURITY_BUCKETS = []struct{ Name string; MaxDays int }{
+	{"0-30", 30},
+	{"31-60", 60},
+	{"61-90", 90},
+	{"91-180", 180},
+	{"180+", -1},
+}
+
+const   MATURITY_PAST_DUE =  "pastdue"
+const   MATURITY_UNDATED  =  "undated"
+
+
 //==============================================================================================================================
-//	 General Functions: get_username & get_role
+//	Late Fee Policy - How accrue_late_fees charges overdue invoices: the rate is the fraction of the outstanding balance
+//					  added per day or per month past the due date, once the grace days are over. Set by an admin.
+//	Late Fee - One accrual on an invoice, covering whole periods from one date to another. The next accrual starts
+//			   where the last one ended.
 //==============================================================================================================================
+type Late_Fee_Policy struct {
+	Basis            string `json:"basis"`
+	Rate             string `json:"rate"`
+	GraceDays        int    `json:"gracedays"`
+	UpdatedBy        string `json:"updatedby"`
+}
+
+type Late_Fee struct {
+	Amount           string `json:"amount"`
+	Basis            string `json:"basis"`
+	Rate             string `json:"rate"`
+	Periods          int    `json:"periods"`
+	From             string `json:"from"`
+	To               string `json:"to"`
+	TxId             string `json:"txid"`
+}
+
+
+//==============================================================================================================================
+//	Fee Schedule - The platform operator's fee, in basis points of the face amount with a minimum per charge, and the
+//				   account fees are paid into. Set by an admin.
+//	Platform Fee - One fee charged by the platform. Financed invoices are charged when the buyer's approval makes the
+//				   financing final, each financier on the face amount it financed. Invoices settled without financing
+//				   are charged to the seller at settlement. Amounts are in the invoice's currency.
+//==============================================================================================================================
+type Fee_Schedule struct {
+	FeeBps           int    `json:"feebps"`
+	MinimumFee       string `json:"minimumfee"`
+	FeeAccount       string `json:"feeaccount"`
+	UpdatedBy        string `json:"updatedby"`
+}
+
+type Platform_Fee struct {
+	InvoiceId        string `json:"invoiceid"`
+	Payer            string `json:"payer"`
+	FeeAccount       string `json:"feeaccount"`
+	Basis            string `json:"basis"`
+	BaseAmount       string `json:"baseamount"`
+	FeeBps           int    `json:"feebps"`
+	Amount           string `json:"amount"`
+	Currency         string `json:"currency"`
+	ChargedAt        string `json:"chargedat"`
+	TxId             string `json:"txid"`
+}
+
+
+//==============================================================================================================================
+//	Intercompany Route - The intercompany chaincode account that invoices between a seller and buyer of the same group
+//						 are posted to, see set_intercompany_route.
+//	Intercompany Posting - The posting of an approved intercompany invoice. JournalRef is the transaction, pending
+//						   posting or error queue entry the intercompany chaincode answered with, as told by Status.
+//==============================================================================================================================
+type Intercompany_Route struct {
+	Seller           string `json:"seller"`
+	Buyer            string `json:"buyer"`
+	AccountNo        string `json:"accountno"`
+	Chaincode        string `json:"chaincode"`
+	UpdatedBy        string `json:"updatedby"`
+}
+
+type Intercompany_Posting struct {
+	Chaincode        string `json:"chaincode"`
+	AccountNo        string `json:"accountno"`
+	Status           string `json:"status"`
+	JournalRef       string `json:"journalref"`
+	PostedAt         string `json:"postedat"`
+}
+
+
+//==============================================================================================================================
+//	Credit Note - A seller's credit against an invoice, for a partial return or a price correction. The credit note ID
+//				  is the transaction ID of the issue_credit_note call.
+//==============================================================================================================================
+type Credit_Note struct {
+	CreditNoteId     string `json:"creditnoteid"`
+	InvoiceId        string `json:"invoiceid"`
+	Amount           string `json:"amount"`
+	Reason           string `json:"reason"`
+	Status           string `json:"status"`
+	IssuedBy         string `json:"issuedby"`
+	IssuedAt         string `json:"issuedat"`
+	AcknowledgedBy   string `json:"acknowledgedby,omitempty"`
+	AcknowledgedAt   string `json:"acknowledgedat,omitempty"`
+}
+
+
+//==============================================================================================================================
+//	Payment - A payment against an invoice, appended by record_payment.
+//==============================================================================================================================
+type Payment struct {
+	Amount           string `json:"amount"`
+	Date             string `json:"date"`
+	Payer            string `json:"payer"`
+	Reference        string `json:"reference"`
+	Installment      int    `json:"installment,omitempty"`		// The installment the buyer paid, spread over the earliest when 0
+	TxId             string `json:"txid"`
+}
+
+
+//==============================================================================================================================
+//	Repayment Schedule - Installments the buyer and financiers agreed the outstanding balance is paid in, see
+//						 propose_schedule. Once agreed, an invoice is overdue as soon as any installment is.
+//==============================================================================================================================
+type Repayment_Schedule struct {
+	Status           string `json:"status"`
+	Installments     []Installment `json:"installments"`
+	ProposedBy       string `json:"proposedby"`
+	ProposedAt       string `json:"proposedat"`
+	AcceptedBy       []string `json:"acceptedby"`
+	AgreedAt         string `json:"agreedat,omitempty"`
+	OriginalDueDate  string `json:"originalduedate,omitempty"`
+	TxId             string `json:"txid"`
+}
+
+type Installment struct {
+	Number           int    `json:"number"`
+	DueDate          string `json:"duedate"`
+	Amount           string `json:"amount"`
+	Paid             string `json:"paid"`
+	Status           string `json:"status"`
+}
+
+
+//==============================================================================================================================
+//	Dispute - A buyer's dispute over part or all of an invoice, appended by raise_dispute. Only the last dispute of an
+//			  invoice can be open, and only while the invoice is DISPUTED. Financiers is set when the invoice had
+//			  already been financed when the dispute was raised.
+//==============================================================================================================================
+type Dispute struct {
+	Reason           string `json:"reason"`
+	Amount           string `json:"amount"`
+	RaisedBy         string `json:"raisedby"`
+	RaisedAt         string `json:"raisedat"`
+	PriorStatus      string `json:"priorstatus"`
+	Financiers       []string `json:"financiers,omitempty"`
+	Response         string `json:"response,omitempty"`
+	RespondedAt      string `json:"respondedat,omitempty"`
+	Outcome          string `json:"outcome,omitempty"`
+	ResolvedBy       string `json:"resolvedby,omitempty"`
+	ResolvedAt       string `json:"resolvedat,omitempty"`
+}
+
+
+//==============================================================================================================================
+//	Offer - A financier's bid to finance an invoice. The seller picks one with select_offer; the offer ID is the
+//			transaction ID of the submit_offer call.
+//==============================================================================================================================
+type Offer struct {
+	OfferId          string `json:"offerid"`
+	InvoiceId        string `json:"invoiceid"`
+	Financier        string `json:"financier"`
+	DiscountRate     string `json:"discountrate,omitempty"`		// Private, see Offer_Terms
+	Amount           string `json:"amount,omitempty"`			// Private, see Offer_Terms
+	PricingMode      string `json:"pricingmode,omitempty"`
+	AnnualRate       string `json:"annualrate,omitempty"`		// Private, see Offer_Terms
+	TenorDays        int    `json:"tenordays,omitempty"`			// Days from submission to the due date, for rate pricing
+	Discount         string `json:"discount,omitempty"`			// Private, see Offer_Terms. In the invoice currency
+	Currency         string `json:"currency,omitempty"`			// The currency of the amount, when not the invoice's
+	FxRate           string `json:"fxrate,omitempty"`				// Units of the offer currency per unit of the invoice currency
+	TermsHash        string `json:"termshash"`
+	Expiry           string `json:"expiry"`
+	Status           string `json:"status"`
+	SubmittedAt      string `json:"submittedat"`
+}
+
+
+//==============================================================================================================================
+//	Invoice Terms & Offer Terms - The commercially sensitive part of invoices and offers, kept in the TERMS_COLLECTION
+//								  private data collection so buyers never see them. The public records carry the
+//								  SHA-256 hash of these records, salted, instead. Peers of member orgs merge them back
+//								  on read.
+//==============================================================================================================================
+type Invoice_Terms struct {
+	InvoiceId        string `json:"invoiceid"`
+	Discount         string `json:"discount"`
+	FinancedAmount   string `json:"financedamount"`
+	TranchePrices    map[string]string `json:"trancheprices,omitempty"`	// Purchase price of each tranche, by financier
+	Salt             string `json:"salt,omitempty"`
+}
+
+type Offer_Terms struct {
+	OfferId          string `json:"offerid"`
+	InvoiceId        string `json:"invoiceid"`
+	DiscountRate     string `json:"discountrate"`
+	Amount           string `json:"amount"`
+	AnnualRate       string `json:"annualrate,omitempty"`
+	Discount         string `json:"discount,omitempty"`
+	Salt             string `json:"salt,omitempty"`
+}
+
+
+//==============================================================================================================================
+//	Invoice Holder - Defines the structure that held all the invoiceIDs for invoices that had been created, before
+//				     invoices were indexed under composite keys. Init migrates and removes it.
+//==============================================================================================================================
+
+type Invoice_Holder struct {
+	Invoices 	[]string `json:"invoices"`
+}
+
+
+//==============================================================================================================================
+//	Participant - An entry in the participant registry mapping a client identity (MSP ID plus the cid identity ID)
+//				  to the username recorded on invoices and the role that identity acts in.
+//==============================================================================================================================
+type Participant struct {
+	Id               string `json:"id"`
+	MspId            string `json:"mspid"`
+	Username         string `json:"username"`
+	Role             string `json:"role"`
+	Active           bool   `json:"active"`
+	RegisteredBy     string `json:"registeredby"`
+	RevokedBy        string `json:"revokedby,omitempty"`
+	DualControl      bool   `json:"dualcontrol,omitempty"`		// The buyer's approvals need a second identity, see set_dual_control
+	KycStatus        string `json:"kycstatus,omitempty"`			// Pending when empty, see set_kyc_status
+	KycExpiry        string `json:"kycexpiry,omitempty"`
+	KycUpdatedBy     string `json:"kycupdatedby,omitempty"`
+}
+
+
+//==============================================================================================================================
+//	Auto-Approval Rule - Financing a buyer approves in advance, see add_auto_approval_rule. MaxDiscount is a percentage
+//						 of the face amount, MaxAmount a face amount in Currency.
+//	Auto-Approval - The rule that approved the financing of an invoice.
+//==============================================================================================================================
+type Auto_Approval_Rule struct {
+	RuleId           string `json:"ruleid"`
+	Buyer            string `json:"buyer"`
+	Sellers          []string `json:"sellers"`
+	MaxAmount        string `json:"maxamount"`
+	MaxDiscount      string `json:"maxdiscount"`
+	Currency         string `json:"currency"`
+	CreatedAt        string `json:"createdat"`
+}
+
+type Auto_Approval struct {
+	RuleId           string `json:"ruleid"`
+	ApprovedAt       string `json:"approvedat"`
+}
+
+
+//==============================================================================================================================
+//	Void Record - Why an invoice was voided, see void_invoice. ConfirmedBy and VoidedAt are empty while the request
+//				  awaits the other party.
+//==============================================================================================================================
+type Void_Record struct {
+	ReasonCode       string `json:"reasoncode"`
+	Note             string `json:"note"`
+	RequestedBy      string `json:"requestedby"`
+	RequestedAt      string `json:"requestedat"`
+	ConfirmedBy      string `json:"confirmedby,omitempty"`
+	VoidedAt         string `json:"voidedat,omitempty"`
+}
+
+
+//==============================================================================================================================
+//	Pending Approval - An approval by a buyer under dual control, awaiting a second identity's countersign_approval.
+//==============================================================================================================================
+type Pending_Approval struct {
+	Approver         string `json:"approver"`
+	ApproverId       string `json:"approverid"`
+	ApproverMspId    string `json:"approvermspid"`
+	ApprovedAt       string `json:"approvedat"`
+	TxId             string `json:"txid"`
+}
+
+
+//==============================================================================================================================
+//	Identity - The cid identity of the caller, returned by get_identity so it can be handed to an admin for registration.
+//==============================================================================================================================
+type Identity struct {
+	Id               string `json:"id"`
+	MspId            string `json:"mspid"`
+}
+
+
+//==============================================================================================================================
+//	Init Function - Called when the user deploys the chaincode
+//==============================================================================================================================
+func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+
+
+	bytes, err := stub.GetState("invoiceIDs")
+
+    if err != nil { return shim.Error("Unable to get invoiceIDs") }
+
+	if bytes == nil { return shim.Success(nil) }
+
+	// Upgrading from the Invoice_Holder index: index every invoice it lists under the composite keys, then drop it
+	var invoiceIDs Invoice_Holder
+
+	err = json.Unmarshal(bytes, &invoiceIDs)
+	if err != nil { return shim.Error("Corrupt Invoice_Holder record") }
+
+	for _, invoiceId := range invoiceIDs.Invoices {
+		inv, err := t.retrieve_invoice(stub, invoiceId)
+		if err != nil { return shim.Error(err.Error()) }
+
+		_, err = t.save_changes(stub, inv)
+		if err != nil { return shim.Error("Error indexing invoice " + invoiceId) }
+	}
+
+	err = stub.DelState("invoiceIDs")
+	if err != nil { return shim.Error("Error removing invoiceIDs") }
+
+	return shim.Success(nil)
+}
+
+//==============================================================================================================================
+//	 General Functions: get_identity, get_participant, get_username & get_role
+//==============================================================================================================================
+//	 The caller is identified by its MSP ID and cid identity ID. Its username and role come from the participant
+//	 registry, so only identities registered by an admin (and not since revoked) can act on invoices.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) get_identity(stub shim.ChaincodeStubInterface) (Identity, error) {
+
+	var identity Identity
+
+	id, err := cid.GetID(stub)
+	if err != nil { return identity, errors.New("Couldn't retrieve identity for caller.") }
+
+	mspId, err := cid.GetMSPID(stub)
+	if err != nil { return identity, errors.New("Couldn't retrieve MSP ID for caller.") }
+
+	identity.Id = id
+	identity.MspId = mspId
+	return identity, nil
+}
+
+func (t *SimpleChaincode) get_participant(stub shim.ChaincodeStubInterface) (Participant, error) {
+
+	var participant Participant
+
+	identity, err := t.get_identity(stub)
+	if err != nil { return participant, err }
+
+	participant, err = t.retrieve_participant(stub, identity.MspId, identity.Id)
+	if err != nil { return participant, err }
+
+	if !participant.Active { return participant, errors.New("Participant " + participant.Username + " has been revoked.") }
+	return participant, nil
+}
+
+func (t *SimpleChaincode) get_username(stub shim.ChaincodeStubInterface) (string, error) {
+
+	participant, err := t.get_participant(stub)
+	if err != nil { return "", err }
+	return participant.Username, nil
+}
+
+func (t *SimpleChaincode) get_role(stub shim.ChaincodeStubInterface) (string, error) {
+
+	participant, err := t.get_participant(stub)
+	if err != nil { return "", err }
+	return participant.Role, nil
+}
+
+func (t *SimpleChaincode) is_admin(stub shim.ChaincodeStubInterface) bool {
+
+	value, found, err := cid.GetAttributeValue(stub, ADMIN_ATTRIBUTE)
+	return err == nil && found && value == "true"
+}
+
+
+//==============================================================================================================================
+//	 retrieve_participant & save_participant - Read and write participant registry entries under their composite key.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_participant(stub shim.ChaincodeStubInterface, mspId string, id string) (Participant, error) {
+
+	var participant Participant
+
+	key, err := stub.CreateCompositeKey(PARTICIPANT_PREFIX, []string{mspId, id})
+	if err != nil { return participant, errors.New("RETRIEVE_PARTICIPANT: Error building participant key") }
+
+	bytes, err := stub.GetState(key)
+	if err != nil { return participant, errors.New("RETRIEVE_PARTICIPANT: Error retrieving participant") }
+	if bytes == nil { return participant, errors.New("Caller is not a registered participant.") }
+
+	err = json.Unmarshal(bytes, &participant)
+	if err != nil { return participant, errors.New("RETRIEVE_PARTICIPANT: Corrupt participant record " + string(bytes)) }
+
+	return participant, nil
+}
+
+func (t *SimpleChaincode) save_participant(stub shim.ChaincodeStubInterface, participant Participant) error {
+
+	key, err := stub.CreateCompositeKey(PARTICIPANT_PREFIX, []string{participant.MspId, participant.Id})
+	if err != nil { return errors.New("Error building participant key") }
+
+	bytes, err := json.Marshal(participant)
+	if err != nil { return errors.New("Error converting participant record") }
+
+	err = stub.PutState(key, bytes)
+	if err != nil { return errors.New("Error storing participant record") }
+
+	return nil
+}
+
+
+//==============================================================================================================================
+//	 retrieve_invoice
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_invoice(stub shim.ChaincodeStubInterface, invoiceId string) (Invoice, error) {
+
+	var inv Invoice
+
+	bytes, err := stub.GetState(invoiceId);
+
+	if err != nil { return inv, errors.New("RETRIEVE_INVOICE: Error retrieving invoice with invoice Id = " + invoiceId) }
+	if bytes == nil { return inv, t.coded(ERR_NOT_FOUND, "Invoice " + invoiceId + " not found", "invoiceid", invoiceId) }
+
+	err = json.Unmarshal(bytes, &inv);
+
+    if err != nil { return inv, errors.New("RETRIEVE_INVOICE: Corrupt invoice record " + string(bytes))	}
+
+	if status, ok := LEGACY_STATUSES[inv.Status]; ok { inv.Status = status }
+
+	// Peers outside the collection cannot read the terms, the invoice is returned without them
+	if private, err := stub.GetPrivateData(TERMS_COLLECTION, invoiceId); err == nil && private != nil {
+		var terms Invoice_Terms
+		if json.Unmarshal(private, &terms) == nil {
+			inv.Discount = terms.Discount
+			inv.FinancedAmount = terms.FinancedAmount
+			for i := range inv.Tranches { inv.Tranches[i].PurchasePrice = terms.TranchePrices[inv.Tranches[i].Financier] }
+		}
+	}
+
+	return inv, nil
+}
+
+//==============================================================================================================================
+//	 retrieve_offer, save_offer & retrieve_offers - Read and write offers under their composite key.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_offer(stub shim.ChaincodeStubInterface, invoiceId string, offerId string) (Offer, error) {
+
+	var offer Offer
+
+	key, err := stub.CreateCompositeKey(OFFER_PREFIX, []string{invoiceId, offerId})
+	if err != nil { return offer, errors.New("RETRIEVE_OFFER: Error building offer key") }
+
+	bytes, err := stub.GetState(key)
+	if err != nil { return offer, errors.New("RETRIEVE_OFFER: Error retrieving offer " + offerId) }
+	if bytes == nil { return offer, t.coded(ERR_NOT_FOUND, "Offer " + offerId + " not found for invoice " + invoiceId, "invoiceid", invoiceId, "offerid", offerId) }
+
+	err = json.Unmarshal(bytes, &offer)
+	if err != nil { return offer, errors.New("RETRIEVE_OFFER: Corrupt offer record " + string(bytes)) }
+
+	if private, err := stub.GetPrivateData(TERMS_COLLECTION, key); err == nil && private != nil {
+		var terms Offer_Terms
+		if json.Unmarshal(private, &terms) == nil {
+			offer.DiscountRate = terms.DiscountRate
+			offer.Amount = terms.Amount
+			offer.AnnualRate = terms.AnnualRate
+			offer.Discount = terms.Discount
+		}
+	}
+
+	return offer, nil
+}
+
+func (t *SimpleChaincode) save_offer(stub shim.ChaincodeStubInterface, offer Offer) error {
+
+	key, err := stub.CreateCompositeKey(OFFER_PREFIX, []string{offer.InvoiceId, offer.OfferId})
+	if err != nil { return errors.New("Error building offer key") }
+
+	offer.DiscountRate = ""
+	offer.Amount = ""
+	offer.AnnualRate = ""
+	offer.Discount = ""
+
+	bytes, err := json.Marshal(offer)
+	if err != nil { return errors.New("Error converting offer record") }
+
+	err = stub.PutState(key, bytes)
+	if err != nil { return errors.New("Error storing offer record") }
+
+	return nil
+}
+
+//	Write an offer's terms to the private collection and record their hash on the offer
+func (t *SimpleChaincode) save_offer_terms(stub shim.ChaincodeStubInterface, offer *Offer) error {
+
+	key, err := stub.CreateCompositeKey(OFFER_PREFIX, []string{offer.InvoiceId, offer.OfferId})
+	if err != nil { return errors.New("Error building offer key") }
+
+	salt, err := t.get_salt(stub)
+	if err != nil { return err }
+
+	bytes, err := json.Marshal(Offer_Terms{OfferId: offer.OfferId, InvoiceId: offer.InvoiceId, DiscountRate: offer.DiscountRate, Amount: offer.Amount, AnnualRate: offer.AnnualRate, Discount: offer.Discount, Salt: salt})
+	if err != nil { return errors.New("Error converting offer terms") }
+
+	err = stub.PutPrivateData(TERMS_COLLECTION, key, bytes)
+	if err != nil { return errors.New("Error storing offer terms") }
+
+	offer.TermsHash = t.hash(bytes)
+	return nil
+}
+
+func (t *SimpleChaincode) retrieve_offers(stub shim.ChaincodeStubInterface, invoiceId string) ([]Offer, error) {
+
+	iter, err := stub.GetStateByPartialCompositeKey(OFFER_PREFIX, []string{invoiceId})
+	if err != nil { return nil, errors.New("Unable to query offers for invoice " + invoiceId) }
+	defer iter.Close()
+
+	offers := []Offer{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil { return nil, errors.New("Unable to read offers for invoice " + invoiceId) }
+
+		var offer Offer
+		err = json.Unmarshal(kv.Value, &offer)
+		if err != nil { return nil, errors.New("Corrupt offer record " + string(kv.Value)) }
+
+		if private, err := stub.GetPrivateData(TERMS_COLLECTION, kv.Key); err == nil && private != nil {
+			var terms Offer_Terms
+			if json.Unmarshal(private, &terms) == nil {
+				offer.DiscountRate = terms.DiscountRate
+				offer.Amount = terms.Amount
+				offer.AnnualRate = terms.AnnualRate
+				offer.Discount = terms.Discount
+			}
+		}
+
+		offers = append(offers, offer)
+	}
+
+	return offers, nil
+}
+
+//==============================================================================================================================
+//	 get_invoice_ids - The IDs of the invoices in the given statuses, or of every invoice when none are given, from the
+//					   status index.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_invoice_ids(stub shim.ChaincodeStubInterface, statuses ...string) ([]string, error) {
+
+	if len(statuses) == 0 { return index.IDs(stub, STATUS_INDEX) }
+
+	invoiceIds := []string{}
+	for _, status := range statuses {
+		ids, err := index.IDs(stub, STATUS_INDEX, status)
+		if err != nil { return nil, err }
+		invoiceIds = append(invoiceIds, ids...)
+	}
+	return invoiceIds, nil
+}
+
+//==============================================================================================================================
+//	 get_owner_invoices - The invoices where the user is the seller, buyer or financier, from the owner index.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_owner_invoices(stub shim.ChaincodeStubInterface, owner string) ([]Invoice, error) {
+
+	invoiceIds, err := index.IDs(stub, OWNER_INDEX, owner)
+	if err != nil { return nil, err }
+
+	invoices := []Invoice{}
+	for _, invoiceId := range invoiceIds {
+		inv, err := t.retrieve_invoice(stub, invoiceId)
+		if err != nil { return nil, errors.New("Failed to retrieve Invoice " + invoiceId) }
+		invoices = append(invoices, inv)
+	}
+	return invoices, nil
+}
+
+//==============================================================================================================================
+//	 parse_amount & format_amount - Convert between decimal strings ("100.50", "15000" yen) and the minor units of a
+//									currency, with the decimals of its ISO 4217 minor unit. No currency is DEFAULT_CURRENCY.
+//==============================================================================================================================
+func (t *SimpleChaincode) parse_amount(currency string, value string) (int64, error) {
+
+	if currency == "" { currency = DEFAULT_CURRENCY }
+	amount, err := money.Parse(currency, value)
+	return amount.Units, err
+}
+
+func (t *SimpleChaincode) format_amount(currency string, units int64) string {
+
+	if currency == "" { currency = DEFAULT_CURRENCY }
+	return money.New(currency, units).String()
+}
+
+//==============================================================================================================================
+//	 parse_hundredths & format_hundredths - Convert between decimal strings with at most 2 places ("12.50") and
+//											hundredths, for percentages, rates and scores.
+//==============================================================================================================================
+func (t *SimpleChaincode) parse_hundredths(value string) (int64, error) {
+
+	return money.ParseUnits(value, 2)
+}
+
+func (t *SimpleChaincode) format_hundredths(units int64) string {
+
+	return money.FormatUnits(units, 2)
+}
+
+//	An amount of a currency in the minor units of DEFAULT_CURRENCY at the rate of the currency master, so amounts in
+//	different currencies can be filtered on, sorted and added up, as in amountunits, reports and the credit limit.
+//	Fails with ERR_NOT_FOUND when the currency has no rate.
+func (t *SimpleChaincode) nominal_amount(stub shim.ChaincodeStubInterface, currency string, units int64) (int64, error) {
+
+	if currency == "" || currency == DEFAULT_CURRENCY { return units, nil }
+
+	key, err := stub.CreateCompositeKey(CURRENCY_PREFIX, []string{currency})
+	if err != nil { return 0, errors.New("Error building currency key") }
+
+	bytes, err := stub.GetState(key)
+	if err != nil { return 0, errors.New("Error retrieving currency " + currency) }
+
+	var record Currency
+	if bytes != nil && json.Unmarshal(bytes, &record) != nil { return 0, errors.New("Corrupt currency record " + string(bytes)) }
+
+	rate, err := money.ParseDecimal(record.Rate)
+	if err != nil || rate.Sign() <= 0 {
+		return 0, t.coded(ERR_NOT_FOUND, fmt.Sprintf("No FX rate from %v to %v in the currency master", currency, DEFAULT_CURRENCY), "from", currency, "to", DEFAULT_CURRENCY)
+	}
+	return t.convert(units, currency, DEFAULT_CURRENCY, rate)
+}
+
+//	The currency an invoice was financed in, its own unless the selected offer was in another
+func (t *SimpleChaincode) financed_currency(inv Invoice) string {
+
+	if inv.FinancedCurrency != "" { return inv.FinancedCurrency }
+	return inv.Currency
+}
+
+//==============================================================================================================================
+//	 coded & fail - Build a Chaincode_Error from a code, a message and field name/value pairs, returned as an error or
+//					as the failed response of an invoke.
+//==============================================================================================================================
+func (t *SimpleChaincode) coded(code string, message string, fields ...string) error {
+
+	err := &Chaincode_Error{Code: code, Message: message}
+	if len(fields) > 1 {
+		err.Fields = map[string]string{}
+		for i := 0; i + 1 < len(fields); i += 2 { err.Fields[fields[i]] = fields[i + 1] }
+	}
+	return err
+}
+
+func (t *SimpleChaincode) fail(code string, message string, fields ...string) pb.Response {
+
+	return shim.Error(t.coded(code, message, fields...).Error())
+}
+
+//==============================================================================================================================
+//	 get_timestamp - The transaction timestamp, identical on every endorsing peer.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_timestamp(stub shim.ChaincodeStubInterface) (time.Time, error) {
+
+	ts, err := stub.GetTxTimestamp()
+	if err != nil { return time.Time{}, errors.New("Couldn't retrieve the transaction timestamp.") }
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+//==============================================================================================================================
+//	 transition - Moves the invoice to the given status if STATUS_TRANSITIONS allows it from its current status.
+//==============================================================================================================================
+func (t *SimpleChaincode) transition(inv *Invoice, status string) error {
+
+	for _, allowed := range STATUS_TRANSITIONS[inv.Status] {
+		if allowed == status {
+			inv.Status = status
+			inv.PendingApproval = nil
+			return nil
+		}
+	}
+
+	return t.coded(ERR_INVALID_TRANSITION, fmt.Sprintf("Invoice %s cannot move from %s to %s", inv.InvoiceId, inv.Status, status), "invoiceid", inv.InvoiceId, "status", inv.Status, "target", status)
+}
+
+//==============================================================================================================================
+// save_changes - Writes to the ledger the Vehicle struct passed in a JSON format. Uses the shim file's
+//				  method 'PutState'. Also moves the invoice's index entries when its status or parties have changed.
+//==============================================================================================================================
+func (t *SimpleChaincode) save_changes(stub shim.ChaincodeStubInterface, inv Invoice) (bool, error) {
+
+	previous, err := stub.GetState(inv.InvoiceId)
+
+	if err != nil { return false, errors.New("Error retrieving invoice record") }
+
+	if units, err := t.parse_amount(inv.Currency, inv.Amount); err == nil {
+		inv.AmountUnits, err = t.nominal_amount(stub, inv.Currency, units)
+		if err != nil { return false, err }
+	}
+
+	function, _ := stub.GetFunctionAndParameters()
+	change := Change_Record{Function: function}
+	change.Actor, _ = t.get_username(stub)
+	change.Role, _ = t.get_role(stub)
+	if identity, err := t.get_identity(stub); err == nil {
+		change.ActorId = identity.Id
+		change.ActorMspId = identity.MspId
+	}
+	inv.LastChange = &change
+
+	var old *Invoice
+	if previous != nil {
+		var prior Invoice
+		if json.Unmarshal(previous, &prior) == nil {
+			if status, ok := LEGACY_STATUSES[prior.Status]; ok { prior.Status = status }
+			old = &prior
+		}
+	}
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return false, err }
+
+	transition := Status_Transition{Status: inv.Status, Actor: change.Actor, Function: function, TxId: stub.GetTxID(), Timestamp: now.Format(time.RFC3339)}
+	if old != nil { transition.From = old.Status }
+	inv.Transitions = append(inv.Transitions, transition)
+
+	// Invoices written before the terms were private still carry them publicly
+	if inv.TermsHash == "" && (inv.Discount != "" || inv.FinancedAmount != "") {
+		err = t.save_terms(stub, &inv)
+		if err != nil { return false, err }
+	}
+
+	inv = t.without_terms(inv)
+
+	bytes, err := json.Marshal(inv)
+
+	if err != nil { return false, errors.New("Error converting invoice record") }
+
+	err = stub.PutState(inv.InvoiceId, bytes)
+
+	if err != nil { return false, errors.New("Error storing invoice record") }
+
+	keys, err := t.index_keys(stub, inv)
+
+	if err != nil { return false, err }
+
+	if old != nil {
+		oldKeys, err := t.index_keys(stub, *old)
+		if err != nil { return false, err }
+
+		for key := range oldKeys {
+			if keys[key] { continue }
+			err = stub.DelState(key)
+			if err != nil { return false, errors.New("Error removing invoice index") }
+		}
+	}
+
+	for key := range keys {
+		err = stub.PutState(key, []byte{0x00})
+		if err != nil { return false, errors.New("Error storing invoice index") }
+	}
+
+	return true, nil
+}
+
+//==============================================================================================================================
+// save_terms - Writes an invoice's discount and financed amount to the private collection and records their hash on
+//				the invoice. Call before save_changes whenever the terms change.
+//==============================================================================================================================
+func (t *SimpleChaincode) save_terms(stub shim.ChaincodeStubInterface, inv *Invoice) error {
+
+	salt, err := t.get_salt(stub)
+	if err != nil { return err }
+
+	terms := Invoice_Terms{InvoiceId: inv.InvoiceId, Discount: inv.Discount, FinancedAmount: inv.FinancedAmount, Salt: salt}
+	if len(inv.Tranches) > 0 {
+		terms.TranchePrices = map[string]string{}
+		for _, tranche := range inv.Tranches { terms.TranchePrices[tranche.Financier] = tranche.PurchasePrice }
+	}
+
+	bytes, err := json.Marshal(terms)
+	if err != nil { return errors.New("Error converting invoice terms") }
+
+	err = stub.PutPrivateData(TERMS_COLLECTION, inv.InvoiceId, bytes)
+	if err != nil { return errors.New("Error storing invoice terms") }
+
+	inv.TermsHash = t.hash(bytes)
+	return nil
+}
+
+//	Hex SHA-256 of a private record, anchored on the matching public record. The record carries a salt, see get_salt.
+func (t *SimpleChaincode) hash(bytes []byte) string {
+
+	sum := sha256.Sum256(bytes)
+	return hex.EncodeToString(sum[:])
+}
+
+//==============================================================================================================================
+// get_salt - The hex encoded salt passed in the transient "salt" field. Every private record hashed on a public one
+//			  carries it, so the terms cannot be recovered by hashing guesses. Chaincode has no randomness the endorsing
+//			  peers agree on, so the client supplies it.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_salt(stub shim.ChaincodeStubInterface) (string, error) {
+
+	transient, err := stub.GetTransient()
+	if err != nil { return "", errors.New("Couldn't retrieve the transient data.") }
+
+	salt := transient[SALT_TRANSIENT]
+	if len(salt) < MIN_SALT_BYTES {
+		return "", t.coded(ERR_VALIDATION, fmt.Sprintf("The transient %v field must carry at least %d random bytes", SALT_TRANSIENT, MIN_SALT_BYTES), "field", SALT_TRANSIENT, "reason", "missing salt")
+	}
+
+	return hex.EncodeToString(salt), nil
+}
+
+//==============================================================================================================================
+// get_transient_terms - The terms passed in the transient "terms" field as a JSON object, or nil when there are none.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_transient_terms(stub shim.ChaincodeStubInterface) (map[string]string, error) {
+
+	transient, err := stub.GetTransient()
+	if err != nil { return nil, errors.New("Couldn't retrieve the transient data.") }
+
+	bytes, ok := transient[TERMS_TRANSIENT]
+	if !ok { return nil, nil }
+
+	var terms map[string]string
+	err = json.Unmarshal(bytes, &terms)
+	if err != nil { return nil, errors.New("The transient terms must be a JSON object of strings") }
+
+	return terms, nil
+}
+
+//==============================================================================================================================
+// visible_terms - Removes the discount and financed amount unless the caller is the invoice's seller or financier, or a
+//				   financier looking at an invoice open to offers.
+//==============================================================================================================================
+func (t *SimpleChaincode) visible_terms(inv Invoice, username string, role string) Invoice {
+
+	if username == inv.Seller || t.is_financier(inv, username) { return inv }
+	if role == FINANCIER && (inv.Status == ISSUED || inv.Status == REJECTED) { return inv }
+
+	return t.without_terms(inv)
+}
+
+//	The invoice without its private terms. Tranches are copied so the caller's invoice keeps its purchase prices.
+func (t *SimpleChaincode) without_terms(inv Invoice) Invoice {
+
+	inv.Discount = ""
+	inv.FinancedAmount = ""
+
+	if inv.Tranches != nil {
+		tranches := make([]Tranche, len(inv.Tranches))
+		for i, tranche := range inv.Tranches {
+			tranche.PurchasePrice = ""
+			tranches[i] = tranche
+		}
+		inv.Tranches = tranches
+	}
+	return inv
+}
+
+//==============================================================================================================================
+// financiers - The financiers of an invoice: the one whose offer was selected, or every financier holding a tranche.
+//==============================================================================================================================
+func (t *SimpleChaincode) financiers(inv Invoice) []string {
+
+	if inv.Financier != "" && inv.Financier != UNDEFINED { return []string{inv.Financier} }
+
+	financiers := []string{}
+	for _, tranche := range inv.Tranches { financiers = append(financiers, tranche.Financier) }
+	return financiers
+}
+
+func (t *SimpleChaincode) is_financier(inv Invoice, username string) bool {
+
+	for _, financier := range t.financiers(inv) {
+		if financier == username { return true }
+	}
+	return false
+}
+
+//==============================================================================================================================
+// index_keys - The composite keys an invoice is indexed under: its status, each of its parties with its status, and
+//				its ERP numbers.
+//==============================================================================================================================
+func (t *SimpleChaincode) index_keys(stub shim.ChaincodeStubInterface, inv Invoice) (map[string]bool, error) {
+
+	keys := map[string]bool{}
+
+	key, err := stub.CreateCompositeKey(STATUS_INDEX, []string{inv.Status, inv.InvoiceId})
+	if err != nil { return nil, errors.New("Error building invoice status index") }
+	keys[key] = true
+
+	for _, owner := range append([]string{inv.Seller, inv.Buyer}, t.financiers(inv)...) {
+		if owner == "" || owner == UNDEFINED { continue }
+
+		key, err = stub.CreateCompositeKey(OWNER_INDEX, []string{owner, inv.Status, inv.InvoiceId})
+		if err != nil { return nil, errors.New("Error building invoice owner index") }
+		keys[key] = true
+	}
+
+	references := map[string]string{REFERENCE_EXTERNAL: inv.ExternalNumber, REFERENCE_ERP: inv.ErpDocId, REFERENCE_SELLER: inv.SellerReference}
+	for kind, reference := range references {
+		if reference == "" { continue }
+
+		key, err = stub.CreateCompositeKey(REFERENCE_INDEX, []string{kind, reference, inv.InvoiceId})
+		if err != nil { return nil, errors.New("Error building invoice reference index") }
+		keys[key] = true
+	}
+
+	return keys, nil
+}
+
+//==============================================================================================================================
+// emit_event - Sets the transaction's chaincode event. Fabric keeps one event per transaction, so each invoke
+//				emits at most once, after its state changes are written.
+//==============================================================================================================================
+func (t *SimpleChaincode) emit_event(stub shim.ChaincodeStubInterface, event Invoice_Event) error {
+
+	event.Actor, _ = t.get_username(stub)
+	if identity, err := t.get_identity(stub); err == nil {
+		event.ActorId = identity.Id
+		event.ActorMspId = identity.MspId
+	}
+	event.TxId = stub.GetTxID()
+
+	parties := append([]string{event.Actor}, event.Recipients...)				// Callers may name parties the ledger cannot show yet
+	if event.Invoice != nil { parties = append(parties, t.parties(*event.Invoice)...) }
+	if event.Offer != nil { parties = append(parties, event.Offer.Financier) }
+	for _, invoiceId := range event.InvoiceIds {
+		if inv, err := t.retrieve_invoice(stub, invoiceId); err == nil { parties = append(parties, t.parties(inv)...) }
+	}
+
+	recipients, err := t.recipients(stub, event.Event, parties)
+	if err != nil { return err }
+	event.Recipients = recipients
+
+	// Events reach every org on the channel, so they never carry private terms
+	if event.Invoice != nil {
+		inv := t.without_terms(*event.Invoice)
+		event.Invoice = &inv
+	}
+	if event.Offer != nil {
+		offer := *event.Offer
+		offer.DiscountRate = ""
+		offer.Amount = ""
+		offer.AnnualRate = ""
+		offer.Discount = ""
+		event.Offer = &offer
+	}
+
+	bytes, err := json.Marshal(event)
+	if err != nil { return errors.New("Error converting " + event.Event + " event") }
+
+	err = stub.SetEvent(event.Event, bytes)
+	if err != nil { return errors.New("Error setting " + event.Event + " event") }
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 Router Functions
+//==============================================================================================================================
+//	Invoke - Called on chaincode invoke and query. Takes the function name passed and calls that function. Converts
+//		  some initial arguments passed to other things for use in the called function.
+//==============================================================================================================================
+func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+
+	function, args := stub.GetFunctionAndParameters()
+
+	if function == "create_invoice" {
+        return t.create_invoice(stub, args)
+	} else if function == "bulk_create_invoices"{
+		return t.bulk_create_invoices(stub, args)
+	} else if function == "create_approved_payable"{
+		return t.create_approved_payable(stub, args)
+	} else if function == "confirm_payable"{
+		return t.confirm_payable(stub, args)
+	} else if function == "decline_payable"{
+		return t.decline_payable(stub, args)
+	} else if function == "approve_trade"{
+		return t.approve_trade(stub, args)
+	} else if function == "reject_trade"{
+		return t.reject_trade(stub, args)
+	} else if function == "countersign_approval"{
+		return t.countersign_approval(stub, args)
+	} else if function == "approve_trades"{
+		return t.approve_trades(stub, args)
+	} else if function == "reject_trades"{
+		return t.reject_trades(stub, args)
+	} else if function == "add_auto_approval_rule"{
+		return t.add_auto_approval_rule(stub, args)
+	} else if function == "remove_auto_approval_rule"{
+		return t.remove_auto_approval_rule(stub, args)
+	} else if function == "get_auto_approval_rules"{
+		return t.get_auto_approval_rules(stub, args)
+	} else if function == "submit_offer"{
+		return t.submit_offer(stub, args)
+	} else if function == "list_offers"{
+		return t.list_offers(stub, args)
+	} else if function == "select_offer"{
+		return t.select_offer(stub, args)
+	} else if function == "open_auction"{
+		return t.open_auction(stub, args)
+	} else if function == "submit_bid"{
+		return t.submit_bid(stub, args)
+	} else if function == "close_auction"{
+		return t.close_auction(stub, args)
+	} else if function == "accept_trade_partial"{
+		return t.accept_trade_partial(stub, args)
+	} else if function == "lapse_expired_offers"{
+		return t.lapse_expired_offers(stub, args)
+	} else if function == "transfer_position"{
+		return t.transfer_position(stub, args)
+	} else if function == "void_invoice"{
+		return t.void_invoice(stub, args)
+	} else if function == "cancel_invoice"{
+		return t.cancel_invoice(stub, args)
+	} else if function == "amend_invoice"{
+		return t.amend_invoice(stub, args)
+	} else if function == "update_due_date"{
+		return t.update_due_date(stub, args)
+	} else if function == "mark_overdue"{
+		return t.mark_overdue(stub, args)
+	} else if function == "run_reminders"{
+		return t.run_reminders(stub, args)
+	} else if function == "get_overdue_invoices"{
+		return t.get_overdue_invoices(stub, args)
+	} else if function == "set_late_fee_policy"{
+		return t.set_late_fee_policy(stub, args)
+	} else if function == "get_late_fee_policy"{
+		policy, err := t.retrieve_late_fee_policy(stub)
+		if err != nil { return shim.Error(err.Error()) }
+		bytes, _ := json.Marshal(policy)
+		return shim.Success(bytes)
+	} else if function == "accrue_late_fees"{
+		return t.accrue_late_fees(stub, args)
+	} else if function == "set_intercompany_route"{
+		return t.set_intercompany_route(stub, args)
+	} else if function == "set_fee_schedule"{
+		return t.set_fee_schedule(stub, args)
+	} else if function == "get_fee_schedule"{
+		schedule, err := t.retrieve_fee_schedule(stub)
+		if err != nil { return shim.Error(err.Error()) }
+		bytes, _ := json.Marshal(schedule)
+		return shim.Success(bytes)
+	} else if function == "get_platform_fees"{
+		return t.get_platform_fees(stub, args)
+	} else if function == "confirm_delivery"{
+		return t.confirm_delivery(stub, args)
+	} else if function == "create_purchase_order"{
+		return t.create_purchase_order(stub, args)
+	} else if function == "create_goods_receipt"{
+		return t.create_goods_receipt(stub, args)
+	} else if function == "match_invoice"{
+		return t.match_invoice(stub, args)
+	} else if function == "accept_match"{
+		return t.accept_match(stub, args)
+	} else if function == "propose_schedule"{
+		return t.propose_schedule(stub, args)
+	} else if function == "accept_schedule"{
+		return t.accept_schedule(stub, args)
+	} else if function == "record_payment"{
+		return t.record_payment(stub, args)
+	} else if function == "set_credit_limit"{
+		return t.set_credit_limit(stub, args)
+	} else if function == "set_currency"{
+		return t.set_currency(stub, args)
+	} else if function == "set_discount_band"{
+		return t.set_discount_band(stub, args)
+	} else if function == "get_currencies"{
+		return t.get_currencies(stub, args)
+	} else if function == "get_buyer_exposure"{
+		return t.get_buyer_exposure(stub, args)
+	} else if function == "get_concentration_report"{
+		return t.get_concentration_report(stub, args)
+	} else if function == "get_receivables_aging"{
+		return t.get_receivables_aging(stub, args)
+	} else if function == "get_statement_with"{
+		return t.get_statement_with(stub, args)
+	} else if function == "get_seller_score"{
+		return t.get_seller_score(stub, args)
+	} else if function == "archive_invoice"{
+		return t.archive_invoice(stub, args)
+	} else if function == "get_archived_invoices"{
+		return t.get_archived_invoices(stub, args)
+	} else if function == "get_portfolio"{
+		return t.get_portfolio(stub, args)
+	} else if function == "settle_at_maturity"{
+		return t.settle_at_maturity(stub, args)
+	} else if function == "get_payments"{
+		return t.get_payments(stub, args)
+	} else if function == "issue_credit_note"{
+		return t.issue_credit_note(stub, args)
+	} else if function == "acknowledge_credit_note"{
+		return t.acknowledge_credit_note(stub, args)
+	} else if function == "get_credit_notes"{
+		return t.get_credit_notes(stub, args)
+	} else if function == "get_invoice_audit"{
+		return t.get_invoice_audit(stub, args)
+	} else if function == "raise_dispute"{
+		return t.raise_dispute(stub, args)
+	} else if function == "respond_dispute"{
+		return t.respond_dispute(stub, args)
+	} else if function == "resolve_dispute"{
+		return t.resolve_dispute(stub, args)
+	} else if function == "get_disputed_invoices"{
+		return t.get_disputed_invoices(stub, args)
+	} else if function == "attach_guarantee"{
+		return t.attach_guarantee(stub, args)
+	} else if function == "draw_guarantee"{
+		return t.draw_guarantee(stub, args)
+	} else if function == "attach_document"{
+		return t.attach_document(stub, args)
+	} else if function == "get_documents"{
+		return t.get_documents(stub, args)
+	} else if function == "get_assignment_records"{
+		return t.get_assignment_records(stub, args)
+	}  else if function == "get_invoice_details" {
+		if len(args) != 2 { return shim.Error("QUERY: Incorrect number of arguments passed") }
+		inv, err := t.retrieve_invoice(stub, args[0])
+		if err != nil { return shim.Error("QUERY: Error retrieving invoice "+err.Error()) }
+		bytes, err := t.get_invoice_details(stub, inv, args[1])
+		if err != nil { return shim.Error(err.Error()) }
+		return shim.Success(bytes)
+	}  else if function == "get_invoices" {
+		return t.get_invoices(stub, args)
+	}  else if function == "query_invoices" {
+		return t.query_invoices(stub, args)
+	}  else if function == "get_invoice_by_external_no" {
+		return t.get_invoice_by_external_no(stub, args)
+	}  else if function == "get_invoices_by_po" {
+		return t.get_invoices_by_po(stub, args)
+	}  else if function == "get_opening_trade_invoices" {
+		return t.get_opening_trade_invoices(stub, args)
+	}  else if function == "browse_market" {
+		return t.browse_market(stub, args)
+	}  else if function == "read" {
+		return t.read(stub, args)
+	}  else if function == "register_participant" {
+		return t.register_participant(stub, args)
+	}  else if function == "set_notification_preferences" {
+		return t.set_notification_preferences(stub, args)
+	}  else if function == "get_notification_preferences" {
+		return t.get_notification_preferences(stub, args)
+	}  else if function == "blacklist_participant" {
+		return t.blacklist_participant(stub, args)
+	}  else if function == "unblacklist_participant" {
+		return t.unblacklist_participant(stub, args)
+	}  else if function == "set_kyc_status" {
+		return t.set_kyc_status(stub, args)
+	}  else if function == "get_blocked_parties" {
+		return t.get_blocked_parties(stub, args)
+	}  else if function == "set_dual_control" {
+		return t.set_dual_control(stub, args)
+	}  else if function == "revoke_participant" {
+		return t.revoke_participant(stub, args)
+	}  else if function == "get_participants" {
+		return t.get_participants(stub, args)
+	}  else if function == "get_identity" {
+		identity, err := t.get_identity(stub)
+		if err != nil { return shim.Error(err.Error()) }
+		bytes, _ := json.Marshal(identity)
+		return shim.Success(bytes)
+	}  else if function == "get_username" {
+		username, err := t.get_username(stub)
+		if err != nil { return shim.Error(err.Error()) }
+		return shim.Success([]byte(username))
+	}  else if function == "get_role" {
+		role, err := t.get_role(stub)
+		if err != nil { return shim.Error(err.Error()) }
+		return shim.Success([]byte(role))
+	}
+
+    return shim.Error("Received unknown function invocation: " + function)
+}
+
+
+func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var name, jsonResp string
+	var err error
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting name of the var to query")
+	}
+
+	name = args[0]
+	valAsbytes, err := stub.GetState(name)									//get the var from chaincode state
+	if err != nil {
+		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
+		return shim.Error(jsonResp)
+	}
+
+	return shim.Success(valAsbytes)											//send it onward
+}
+
+//=================================================================================================================================
+//	 check_line_items - Each line needs a description, a positive quantity and a valid unit price and tax, and the
+//						line totals must equal the header amount exactly.
+//=================================================================================================================================
+func (t *SimpleChaincode) check_line_items(lineItems []Line_Item, amount string, currency string) error {
+
+	headerAmount, err := t.parse_amount(currency, amount)
+	if err != nil { return errors.New("Invalid invoice amount " + amount) }
+
+	var total int64
+	for i, item := range lineItems {
+		if item.Description == "" || item.Quantity <= 0 { return t.coded(ERR_VALIDATION, fmt.Sprintf("Line item %d needs a description and a positive quantity", i + 1), "field", "lineitems", "item", strconv.Itoa(i + 1), "reason", "missing description or quantity") }
+
+		unitPrice, err := t.parse_amount(currency, item.UnitPrice)
+		if err != nil || unitPrice < 0 { return t.coded(ERR_VALIDATION, fmt.Sprintf("Line item %d has an invalid unit price %s", i + 1, item.UnitPrice), "field", "unitprice", "item", strconv.Itoa(i + 1), "value", item.UnitPrice, "reason", "not a decimal amount") }
+
+		tax, err := t.parse_amount(currency, item.Tax)
+		if err != nil || tax < 0 { return t.coded(ERR_VALIDATION, fmt.Sprintf("Line item %d has an invalid tax %s", i + 1, item.Tax), "field", "tax", "item", strconv.Itoa(i + 1), "value", item.Tax, "reason", "not a decimal amount") }
+
+		total += item.Quantity * unitPrice + tax
+	}
+
+	if total != headerAmount {
+		return t.coded(ERR_VALIDATION, fmt.Sprintf("Line items total %s does not equal the invoice amount %s", t.format_amount(currency, total), t.format_amount(currency, headerAmount)), "field", "lineitems", "value", t.format_amount(currency, total), "reason", "total differs from the amount")
+	}
+	return nil
+}
+
+//=================================================================================================================================
+//	 fingerprint - Identifies the receivable behind an invoice independently of its invoice ID: the SHA-256 of its
+//				   seller, buyer, external invoice number, amount and due date. Each fingerprint can be claimed by
+//				   one live invoice only, so the same receivable cannot be financed twice.
+//=================================================================================================================================
+func (t *SimpleChaincode) fingerprint(inv Invoice) string {
+
+	amount := inv.Amount
+	if units, err := t.parse_amount(inv.Currency, inv.Amount); err == nil { amount = t.format_amount(inv.Currency, units) }
+
+	external := inv.ExternalNumber
+	if external == "" { external = inv.InvoiceId }
+
+	return t.hash([]byte(strings.Join([]string{inv.Seller, inv.Buyer, external, amount, inv.DueDate}, "\x1f")))
+}
+
+func (t *SimpleChaincode) claim_fingerprint(stub shim.ChaincodeStubInterface, inv Invoice) error {
+
+	key, err := t.check_fingerprint(stub, inv)
+	if err != nil { return err }
+
+	err = stub.PutState(key, []byte(inv.InvoiceId))
+	if err != nil { return errors.New("Error storing fingerprint") }
+
+	return nil
+}
+
+//	The fingerprint key of an invoice, failing with ERR_DUPLICATE when another invoice holds it
+func (t *SimpleChaincode) check_fingerprint(stub shim.ChaincodeStubInterface, inv Invoice) (string, error) {
+
+	key, err := stub.CreateCompositeKey(FINGERPRINT_PREFIX, []string{t.fingerprint(inv)})
+	if err != nil { return "", errors.New("Error building fingerprint key") }
+
+	existing, err := stub.GetState(key)
+	if err != nil { return "", errors.New("Error retrieving fingerprint") }
+	if existing != nil && string(existing) != inv.InvoiceId {
+		return "", t.coded(ERR_DUPLICATE, fmt.Sprintf("Invoice %s duplicates invoice %s", inv.InvoiceId, string(existing)), "invoiceid", inv.InvoiceId, "duplicateof", string(existing))
+	}
+
+	return key, nil
+}
+
+func (t *SimpleChaincode) release_fingerprint(stub shim.ChaincodeStubInterface, inv Invoice) error {
+
+	key, err := stub.CreateCompositeKey(FINGERPRINT_PREFIX, []string{t.fingerprint(inv)})
+	if err != nil { return errors.New("Error building fingerprint key") }
+
+	existing, err := stub.GetState(key)
+	if err != nil { return errors.New("Error retrieving fingerprint") }
+	if string(existing) != inv.InvoiceId { return nil }
+
+	err = stub.DelState(key)
+	if err != nil { return errors.New("Error removing fingerprint") }
+
+	return nil
+}
+
+//=================================================================================================================================
+//	 Create Function
+//=================================================================================================================================
+//	 Create Invoice - Creates the initial JSON for the invoice and then saves it to the ledger.
+//=================================================================================================================================
+func (t *SimpleChaincode) create_invoice(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0               1              2              3               4 (optional)
+	//			123443232        100.00           0.05         test_user1       2017-09-30
+	//
+	//	The discount (2) is better passed as {"discount":"0.05"} in the transient "terms" field with 2 left empty,
+	//	so that it stays out of the block.
+	//
+	//				5 (optional)                                                                          6 (optional)     7 (optional)
+	//			[{"description":"Widgets","quantity":4,"unitprice":"20.00","tax":"20.00"}]           PO-7781          INV-2017-0042
+	//
+	//	The external number (7) is the seller's own invoice number and defaults to the invoice ID.
+	//
+	//				8 (optional)
+	//				   EUR
+	//
+	//	The currency (8) must be in the currency master and defaults to DEFAULT_CURRENCY.
+	//
+	//				9 (optional)      10 (optional)
+	//			   SAP-5100734        CTR-2017-118
+	//
+	//	The ERP document ID (9) and seller reference (10) are indexed for get_invoice_by_external_no.
+
+	if len(args) < 4 || len(args) > 11 { return shim.Error("Incorrect number of arguments. Expecting 4 to 11") }
+
+	upload := Invoice_Upload{InvoiceId: args[0], Amount: args[1], Discount: args[2], Buyer: args[3]}
+	if len(args) > 4 { upload.DueDate = args[4] }
+	if len(args) > 5 && args[5] != "" {
+		if err := json.Unmarshal([]byte(args[5]), &upload.LineItems); err != nil { return shim.Error("6th argument must be a JSON array of line items") }
+	}
+	if len(args) > 6 { upload.PONumber = args[6] }
+	if len(args) > 7 { upload.ExternalNumber = args[7] }
+	if len(args) > 8 { upload.Currency = args[8] }
+	if len(args) > 9 { upload.ErpDocId = args[9] }
+	if len(args) > 10 { upload.SellerReference = args[10] }
+
+	terms, err := t.get_transient_terms(stub)
+	if err != nil { return shim.Error(err.Error()) }
+	if terms["discount"] != "" { upload.Discount = terms["discount"] }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	role, err := t.get_role(stub)
+
+	if 	role != SELLER {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. create_invoice. %v !== %v", role, SELLER), "function", "create_invoice", "actual", role, "expected", SELLER)
+	}
+
+	inv, err := t.prepare_invoice(stub, username, upload)
+	if err != nil { return shim.Error(err.Error()) }
+
+	err = t.save_terms(stub, &inv)
+	if err != nil { return shim.Error(err.Error()) }
+
+	err = t.claim_fingerprint(stub, inv)
+	if err != nil { return shim.Error(err.Error()) }
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("CREATE_INVOICE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_CREATED, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(inv)
+	return shim.Success(bytes)
+
+}
+
+//=================================================================================================================================
+//	 prepare_invoice - Validates an invoice to be created by the seller and builds it, without writing anything, so a
+//					   bulk upload can reject one record and carry on with the next.
+//=================================================================================================================================
+func (t *SimpleChaincode) prepare_invoice(stub shim.ChaincodeStubInterface, seller string, upload Invoice_Upload) (Invoice, error) {
+
+	var inv Invoice
+
+	if upload.InvoiceId == "" { return inv, errors.New("The invoice ID is missing") }
+	if upload.Buyer == "" || upload.Buyer == seller { return inv, t.coded(ERR_VALIDATION, "Invoice " + upload.InvoiceId + " needs a buyer other than the seller", "field", "buyer", "value", upload.Buyer, "reason", "missing or the seller") }
+
+	currency := DEFAULT_CURRENCY
+	if upload.Currency != "" {
+		if err := t.check_currency(stub, upload.Currency); err != nil { return inv, err }
+		currency = upload.Currency
+	}
+
+	amount, err := t.check_amount(stub, "amount", upload.Amount, currency)
+	if err != nil { return inv, err }
+
+	if upload.Discount != "" {
+		err = t.check_discount(stub, "discount", upload.Discount)
+		if err != nil { return inv, err }
+	}
+
+	dueDate := UNDEFINED
+	if upload.DueDate != "" {
+		if _, err := time.Parse(DATE_FORMAT, upload.DueDate); err != nil { return inv, errors.New("The due date of invoice " + upload.InvoiceId + " must be formatted YYYY-MM-DD") }
+		dueDate = upload.DueDate
+	}
+
+	if len(upload.LineItems) > 0 {
+		if err := t.check_line_items(upload.LineItems, upload.Amount, currency); err != nil { return inv, err }
+	}
+
+	err = t.check_parties(stub, seller, upload.Buyer)
+	if err != nil { return inv, err }
+
+	err = t.check_new_invoice_id(stub, upload.InvoiceId)
+	if err != nil { return inv, err }
+
+	issuedAt, err := t.get_timestamp(stub)
+	if err != nil { return inv, err }
+
+	inv = Invoice{InvoiceId: upload.InvoiceId, Amount: t.format_amount(currency, amount), Currency: currency, Seller: seller, Buyer: upload.Buyer, DueDate: dueDate, Status: ISSUED, Financier: UNDEFINED, Discount: upload.Discount, Outstanding: t.format_amount(currency, amount), IssuedAt: issuedAt.Format(time.RFC3339), LineItems: upload.LineItems, PONumber: upload.PONumber, ExternalNumber: upload.ExternalNumber, ErpDocId: upload.ErpDocId, SellerReference: upload.SellerReference, Payments: []Payment{}}
+	if inv.ExternalNumber == "" { inv.ExternalNumber = inv.InvoiceId }
+
+	err = t.check_credit_limit(stub, inv.Buyer, currency, amount)
+	if err != nil { return inv, err }
+
+	_, err = t.check_fingerprint(stub, inv)
+	if err != nil { return inv, err }
+
+	return inv, nil
+}
+
+//=================================================================================================================================
+//	 bulk_create_invoices - Creates the invoices of a seller's ERP export in one transaction. Each record is validated
+//							like create_invoice; duplicates are skipped and invalid records fail without stopping the
+//							others. Returns one result per record.
+//=================================================================================================================================
+func (t *SimpleChaincode) bulk_create_invoices(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			[{"invoiceid":"123443232","amount":"100.00","buyer":"test_user1","duedate":"2017-09-30"}, ...]
+	//
+	//	Records take the optional fields of create_invoice as well: lineitems, ponumber, externalnumber and currency.
+	//	Discounts are better passed by invoice ID in the transient "terms" field, {"123443232":"0.05"}, than in the
+	//	records' discount field.
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	var uploads []Invoice_Upload
+	if err := json.Unmarshal([]byte(args[0]), &uploads); err != nil { return shim.Error("1st argument must be a JSON array of invoices") }
+	if len(uploads) > BULK_LIMIT { return shim.Error(fmt.Sprintf("At most %d invoices can be uploaded at once", BULK_LIMIT)) }
+
+	terms, err := t.get_transient_terms(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	role, err := t.get_role(stub)
+	if 	role != SELLER {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. bulk_create_invoices. %v !== %v", role, SELLER), "function", "bulk_create_invoices", "actual", role, "expected", SELLER)
+	}
+
+	results := []Bulk_Result{}
+	created := []string{}
+	buyers := []string{}													// Invoices created here cannot be read back for the event
+	invoiceIds := map[string]bool{}											// Writes of this transaction are not visible to GetState,
+	fingerprints := map[string]string{}										// so duplicates within the upload are caught here
+
+	for _, upload := range uploads {
+
+		if terms[upload.InvoiceId] != "" { upload.Discount = terms[upload.InvoiceId] }
+
+		inv, err := t.prepare_invoice(stub, username, upload)
+		if err == nil && invoiceIds[inv.InvoiceId] {
+			err = t.coded(ERR_DUPLICATE, "Invoice " + inv.InvoiceId + " appears twice in the upload", "invoiceid", inv.InvoiceId)
+		} else if err == nil && fingerprints[t.fingerprint(inv)] != "" {
+			err = t.coded(ERR_DUPLICATE, fmt.Sprintf("Invoice %s duplicates invoice %s", inv.InvoiceId, fingerprints[t.fingerprint(inv)]), "invoiceid", inv.InvoiceId, "duplicateof", fingerprints[t.fingerprint(inv)])
+		}
+
+		if err != nil {
+			result := Bulk_Result{InvoiceId: upload.InvoiceId, Status: BULK_FAILED, Error: err.Error()}
+			if coded, ok := err.(*Chaincode_Error); ok {
+				result.Code, result.Error = coded.Code, coded.Message
+				if coded.Code == ERR_DUPLICATE { result.Status = BULK_SKIPPED }
+			}
+			results = append(results, result)
+			continue
+		}
+
+		err = t.save_terms(stub, &inv)
+		if err != nil { return shim.Error(err.Error()) }
+
+		err = t.claim_fingerprint(stub, inv)
+		if err != nil { return shim.Error(err.Error()) }
+
+		_, err = t.save_changes(stub, inv)
+		if err != nil { fmt.Printf("BULK_CREATE_INVOICES: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+		invoiceIds[inv.InvoiceId] = true
+		fingerprints[t.fingerprint(inv)] = inv.InvoiceId
+		created = append(created, inv.InvoiceId)
+		buyers = append(buyers, inv.Buyer)
+		results = append(results, Bulk_Result{InvoiceId: inv.InvoiceId, Status: BULK_CREATED})
+	}
+
+	if len(created) > 0 {
+		err = t.emit_event(stub, Invoice_Event{Event: EVENT_BULK_CREATED, InvoiceIds: created, Recipients: buyers})
+		if err != nil { return shim.Error(err.Error()) }
+	}
+
+	bytes, _ := json.Marshal(results)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 Reverse Factoring Functions
+//=================================================================================================================================
+//	 create_approved_payable - The buyer uploads an invoice it has already approved for payment, nominating the seller.
+//							   Once the seller confirms it, financiers finance it against the buyer's credit: the
+//							   selected offer needs no further approval from the buyer.
+//=================================================================================================================================
+func (t *SimpleChaincode) create_approved_payable(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0               1              2               3             4 (optional)     5 (optional)   6 (optional)
+	//			123443232        100.00       test_user0       2017-09-30       INV-2017-0042       PO-7781          EUR
+
+	if len(args) < 4 || len(args) > 7 { return shim.Error("Incorrect number of arguments. Expecting 4 to 7") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	role, err := t.get_role(stub)
+	if 	role != BUYER {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. create_approved_payable. %v !== %v", role, BUYER), "function", "create_approved_payable", "actual", role, "expected", BUYER)
+	}
+
+	if args[2] == "" || args[2] == username { return shim.Error("3rd argument must be the nominated seller") }
+
+	if _, err = time.Parse(DATE_FORMAT, args[3]); err != nil { return shim.Error("4th argument must be a due date formatted YYYY-MM-DD") }
+
+	currency := DEFAULT_CURRENCY
+	if len(args) > 6 && args[6] != "" {
+		err = t.check_currency(stub, args[6])
+		if err != nil { return shim.Error(err.Error()) }
+		currency = args[6]
+	}
+
+	amount, err := t.parse_amount(currency, args[1])
+	if err != nil || amount <= 0 { return shim.Error(fmt.Sprintf("2nd argument must be a positive amount with at most %d decimals", money.Decimals(currency))) }
+
+	err = t.check_parties(stub, username, args[2])
+	if err != nil { return shim.Error(err.Error()) }
+
+	err = t.check_new_invoice_id(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv := Invoice{InvoiceId: args[0], Amount: t.format_amount(currency, amount), Currency: currency, Seller: args[2], Buyer: username, DueDate: args[3], Status: PAYABLE_PENDING, Financier: UNDEFINED, Outstanding: t.format_amount(currency, amount), IssuedAt: now.Format(time.RFC3339), BuyerInitiated: true, Payments: []Payment{}}
+	inv.Delivery = &Delivery_Confirmation{ConfirmedBy: username, ConfirmedAt: now.Format(time.RFC3339)}	// Approving the payable attests delivery
+
+	inv.ExternalNumber = inv.InvoiceId
+	if len(args) > 4 && args[4] != "" { inv.ExternalNumber = args[4] }
+	if len(args) > 5 { inv.PONumber = args[5] }
+
+	err = t.check_credit_limit(stub, inv.Buyer, currency, amount)
+	if err != nil { return shim.Error(err.Error()) }
+
+	err = t.claim_fingerprint(stub, inv)
+	if err != nil { return shim.Error(err.Error()) }
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("CREATE_APPROVED_PAYABLE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_PAYABLE_CREATED, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(inv)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 confirm_payable & decline_payable - The nominated seller accepts an approved payable as its invoice, opening it to
+//										 financiers, or declines it, cancelling it.
+//=================================================================================================================================
+func (t *SimpleChaincode) confirm_payable(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.answer_payable(stub, args, "confirm_payable", ISSUED, EVENT_PAYABLE_CONFIRMED)
+}
+
+func (t *SimpleChaincode) decline_payable(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.answer_payable(stub, args, "decline_payable", CANCELLED, EVENT_PAYABLE_DECLINED)
+}
+
+func (t *SimpleChaincode) answer_payable(stub shim.ChaincodeStubInterface, args []string, function string, status string, event string) pb.Response {
+
+	//Args
+	//				0
+	//			123443232
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	role, err := t.get_role(stub)
+	if 	role != SELLER {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. %v. %v !== %v", function, role, SELLER), "function", function, "actual", role, "expected", SELLER)
+	}
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if  username != inv.Seller {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. %v. %v !== %v", function, username, inv.Seller), "function", function, "actual", username, "expected", inv.Seller)
+	}
+
+	if inv.Status != PAYABLE_PENDING { return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v is not a payable awaiting confirmation", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+
+	err = t.transition(&inv, status)
+	if err != nil { return shim.Error(err.Error()) }
+
+	if status == CANCELLED {
+		err = t.release_fingerprint(stub, inv)
+		if err != nil { return shim.Error(err.Error()) }
+	}
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("%v: Error saving changes: %s", strings.ToUpper(function), err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: event, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(t.visible_terms(inv, username, role))
+	return shim.Success(bytes)
+}
+
+
+
+func (t *SimpleChaincode) approve_trade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0                
+	//			123443232         
+	var inv Invoice
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	var invoiceId = args[0]
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err = t.retrieve_invoice(stub, invoiceId)
+	if err != nil { return shim.Error(err.Error()) }
+
+	err = t.approve_invoice(stub, &inv, username, "approve_trade")
+	if err != nil { return shim.Error(err.Error()) }
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("APPROVE_TRADE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	event := Invoice_Event{Event: EVENT_APPROVED, Invoice: &inv}
+	if inv.PendingApproval != nil { event.Event = EVENT_APPROVAL_PENDING }
+
+	err = t.emit_event(stub, event)
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(t.visible_terms(inv, username, ""))
+	return shim.Success(bytes)
+
+}
+
+func (t *SimpleChaincode) reject_trade(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0                 
+	//			123443232         
+	var inv Invoice
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	var invoiceId = args[0]
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err = t.retrieve_invoice(stub, invoiceId)
+	if err != nil { return shim.Error(err.Error()) }
+
+	err = t.reject_invoice(stub, &inv, username, "reject_trade")
+	if err != nil { return shim.Error(err.Error()) }
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("REJECT_TRADE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_REJECTED, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(t.visible_terms(inv, username, ""))
+	return shim.Success(bytes)
+
+}
+
+//	The buyer's approval of the financing of an invoice, applied to the invoice for the caller to save. Under dual
+//	control the approval is only recorded as pending, see countersign_approval.
+func (t *SimpleChaincode) approve_invoice(stub shim.ChaincodeStubInterface, inv *Invoice, username string, function string) error {
+
+	if  username != inv.Buyer {
+		return t.coded(ERR_PERMISSION, fmt.Sprintf("Permission Denied. %v. %v !== %v", function, username, inv.Buyer), "function", function, "actual", username, "expected", inv.Buyer)
+	}
+
+	dual, err := t.dual_control(stub, inv.Buyer)
+	if err != nil { return err }
+	if !dual { return t.complete_approval(stub, inv) }
+
+	if inv.PendingApproval != nil {
+		return t.coded(ERR_INVALID_STATE, fmt.Sprintf("The approval of invoice %v awaits countersignature by %v", inv.InvoiceId, inv.Buyer), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+
+	probe := *inv															// Refuse now what the countersignature could not complete
+	err = t.transition(&probe, APPROVED)
+	if err != nil { return err }
+
+	err = t.check_parties(stub, append([]string{inv.Seller, inv.Buyer}, t.financiers(*inv)...)...)
+	if err != nil { return err }
+
+	identity, err := t.get_identity(stub)
+	if err != nil { return err }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return err }
+
+	inv.PendingApproval = &Pending_Approval{Approver: username, ApproverId: identity.Id, ApproverMspId: identity.MspId, ApprovedAt: now.Format(time.RFC3339), TxId: stub.GetTxID()}
+	return nil
+}
+
+//	Moves an invoice to APPROVED and charges the financing fees
+func (t *SimpleChaincode) complete_approval(stub shim.ChaincodeStubInterface, inv *Invoice) error {
+
+	err := t.check_parties(stub, append([]string{inv.Seller, inv.Buyer}, t.financiers(*inv)...)...)
+	if err != nil { return err }
+
+	err = t.transition(inv, APPROVED)
+	if err != nil { return err }
+
+	err = t.charge_financing_fees(stub, *inv)
+	if err != nil { return err }
+
+	return t.post_intercompany(stub, inv)
+}
+
+//	The buyer's rejection of the financing of an invoice, applied to the invoice for the caller to save
+func (t *SimpleChaincode) reject_invoice(stub shim.ChaincodeStubInterface, inv *Invoice, username string, function string) error {
+
+	if  username != inv.Buyer {
+		return t.coded(ERR_PERMISSION, fmt.Sprintf("Permission Denied. %v. %v !== %v", function, username, inv.Buyer), "function", function, "actual", username, "expected", inv.Buyer)
+	}
+
+	err := t.transition(inv, REJECTED)
+	if err != nil { return err }
+
+	inv.Financier = "UNDEFINED"
+	inv.FinancedAmount = ""
+	inv.FinancedCurrency = ""
+	inv.FxRate = ""
+	inv.Tranches = nil
+
+	if inv.TermsHash == "" || inv.Discount != "" {						// Only peers that can read the terms rewrite them
+		err = t.save_terms(stub, inv)
+		if err != nil { return err }
+	}
+	return nil
+}
+
+//=================================================================================================================================
+//	 countersign_approval - A second identity of a buyer under dual control completes the approval another of its
+//							identities made with approve_trade.
+//=================================================================================================================================
+func (t *SimpleChaincode) countersign_approval(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			123443232
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if  username != inv.Buyer {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. countersign_approval. %v !== %v", username, inv.Buyer), "function", "countersign_approval", "actual", username, "expected", inv.Buyer)
+	}
+
+	if inv.PendingApproval == nil {
+		return t.fail(ERR_NOT_FOUND, fmt.Sprintf("Invoice %v has no approval awaiting countersignature", inv.InvoiceId), "invoiceid", inv.InvoiceId)
+	}
+
+	identity, err := t.get_identity(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	if identity.Id == inv.PendingApproval.ApproverId && identity.MspId == inv.PendingApproval.ApproverMspId {
+		return t.fail(ERR_PERMISSION, "Permission Denied. countersign_approval. The approval must be countersigned by a second identity", "function", "countersign_approval", "actual", identity.Id)
+	}
+
+	err = t.complete_approval(stub, &inv)
+	if err != nil { return shim.Error(err.Error()) }
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("COUNTERSIGN_APPROVAL: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_APPROVED, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(t.visible_terms(inv, username, ""))
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 approve_trades & reject_trades - The buyer approves or rejects the financing of several invoices at once. Each
+//									  invoice is checked like approve_trade and reject_trade; the valid ones are applied
+//									  and the others fail without stopping them. Returns one result per invoice, whose
+//									  status stays FINANCE_OFFERED when the approval awaits countersignature. The
+//									  intercompany chaincode reads an account as it was before the transaction, so only
+//									  the first invoice of a batch posting to an intercompany account is approved.
+//=================================================================================================================================
+func (t *SimpleChaincode) approve_trades(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0               1       ...
+	//			123443232       123443233
+
+	return t.decide_trades(stub, args, "approve_trades", EVENT_BATCH_APPROVED, t.approve_invoice)
+}
+
+func (t *SimpleChaincode) reject_trades(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0               1       ...
+	//			123443232       123443233
+
+	return t.decide_trades(stub, args, "reject_trades", EVENT_BATCH_REJECTED, t.reject_invoice)
+}
+
+func (t *SimpleChaincode) decide_trades(stub shim.ChaincodeStubInterface, args []string, function string, event string, decide func(shim.ChaincodeStubInterface, *Invoice, string, string) error) pb.Response {
+
+	if len(args) == 0 { return shim.Error("Incorrect number of arguments. Expecting at least 1") }
+	if len(args) > BULK_LIMIT { return shim.Error(fmt.Sprintf("At most %d invoices can be decided at once", BULK_LIMIT)) }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	results := []Bulk_Result{}
+	decided := []string{}
+	seen := map[string]bool{}												// Writes of this transaction are not visible to GetState
+	posted := map[string]string{}											// Invoice posted to each intercompany account, for the same reason
+
+	for _, invoiceId := range args {
+
+		result := Bulk_Result{InvoiceId: invoiceId, Status: BULK_FAILED}
+
+		inv, err := t.retrieve_invoice(stub, invoiceId)
+		if err == nil && seen[invoiceId] {
+			err = t.coded(ERR_DUPLICATE, "Invoice " + invoiceId + " appears twice in the batch", "invoiceid", invoiceId)
+		}
+
+		var route *Intercompany_Route
+		if err == nil && inv.Intercompany == nil { route, err = t.retrieve_intercompany_route(stub, inv.Seller, inv.Buyer) }
+		if err == nil && route != nil && posted[route.Chaincode + "~" + route.AccountNo] != "" {
+			err = t.coded(ERR_DUPLICATE, fmt.Sprintf("Invoice %v posts to intercompany account %v like invoice %v of the batch. Approve it in a separate transaction", invoiceId, route.AccountNo, posted[route.Chaincode + "~" + route.AccountNo]), "invoiceid", invoiceId, "accountno", route.AccountNo)
+		}
+
+		if err == nil { err = decide(stub, &inv, username, function) }
+		seen[invoiceId] = true
+
+		if err != nil {
+			result.Error = err.Error()
+			if coded, ok := err.(*Chaincode_Error); ok { result.Code, result.Error = coded.Code, coded.Message }
+			results = append(results, result)
+			continue
+		}
+
+		_, err = t.save_changes(stub, inv)
+		if err != nil { fmt.Printf("%v: Error saving changes: %s", strings.ToUpper(function), err); return shim.Error("Error saving changes") }
+
+		if route != nil && inv.Intercompany != nil { posted[route.Chaincode + "~" + route.AccountNo] = inv.InvoiceId }
+
+		result.Status = inv.Status
+		results = append(results, result)
+		decided = append(decided, inv.InvoiceId)
+	}
+
+	if len(decided) > 0 {
+		err = t.emit_event(stub, Invoice_Event{Event: event, InvoiceIds: decided})
+		if err != nil { return shim.Error(err.Error()) }
+	}
+
+	bytes, _ := json.Marshal(results)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 Auto-Approval Functions
+//=================================================================================================================================
+//	 add_auto_approval_rule - The buyer lets the financing of routine invoices through without its approval: invoices
+//							  from the listed sellers, in the rule's currency, up to a face amount and a discount
+//							  percentage. The rule ID is the transaction ID.
+//=================================================================================================================================
+func (t *SimpleChaincode) add_auto_approval_rule(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0                              1            2           3 (optional)
+	//			["test_user1","test_user4"]      5000.00       3.00           EUR
+
+	if len(args) != 3 && len(args) != 4 { return shim.Error("Incorrect number of arguments. Expecting 3 or 4") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	role, err := t.get_role(stub)
+	if 	role != BUYER {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. add_auto_approval_rule. %v !== %v", role, BUYER), "function", "add_auto_approval_rule", "actual", role, "expected", BUYER)
+	}
+
+	var sellers []string
+	err = json.Unmarshal([]byte(args[0]), &sellers)
+	if err != nil || len(sellers) == 0 { return shim.Error("1st argument must be a JSON array of sellers") }
+	for _, seller := range sellers {
+		if seller == "" { return shim.Error("Sellers must be non-empty strings") }
+	}
+
+	maxDiscount, err := t.parse_hundredths(args[2])
+	if err != nil || maxDiscount < 0 || maxDiscount > FULL_SHARE { return shim.Error("3rd argument must be a discount percentage up to 100.00") }
+
+	currency := DEFAULT_CURRENCY
+	if len(args) == 4 && args[3] != "" {
+		err = t.check_currency(stub, args[3])
+		if err != nil { return shim.Error(err.Error()) }
+		currency = args[3]
+	}
+
+	maxAmount, err := t.parse_amount(currency, args[1])
+	if err != nil || maxAmount <= 0 { return shim.Error(fmt.Sprintf("2nd argument must be a positive amount with at most %d decimals", money.Decimals(currency))) }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	rule := Auto_Approval_Rule{RuleId: stub.GetTxID(), Buyer: username, Sellers: sellers, MaxAmount: t.format_amount(currency, maxAmount), MaxDiscount: t.format_hundredths(maxDiscount), Currency: currency, CreatedAt: now.Format(time.RFC3339)}
+
+	key, err := stub.CreateCompositeKey(AUTO_APPROVAL_PREFIX, []string{username, rule.RuleId})
+	if err != nil { return shim.Error("Error building auto-approval rule key") }
+
+	bytes, _ := json.Marshal(rule)
+	err = stub.PutState(key, bytes)
+	if err != nil { return shim.Error("Error storing auto-approval rule") }
+
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 remove_auto_approval_rule - The buyer removes one of its auto-approval rules.
+//=================================================================================================================================
+func (t *SimpleChaincode) remove_auto_approval_rule(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			<ruleid>
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	key, err := stub.CreateCompositeKey(AUTO_APPROVAL_PREFIX, []string{username, args[0]})
+	if err != nil { return shim.Error("Error building auto-approval rule key") }
+
+	bytes, err := stub.GetState(key)
+	if err != nil { return shim.Error("Error retrieving auto-approval rule") }
+	if bytes == nil { return t.fail(ERR_NOT_FOUND, "Auto-approval rule " + args[0] + " not found", "ruleid", args[0]) }
+
+	err = stub.DelState(key)
+	if err != nil { return shim.Error("Error removing auto-approval rule") }
+
+	return shim.Success(nil)
+}
+
+//=================================================================================================================================
+//	 get_auto_approval_rules - The caller's auto-approval rules.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_auto_approval_rules(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	rules, err := t.retrieve_auto_approval_rules(stub, username)
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(rules)
+	return shim.Success(bytes)
+}
+
+func (t *SimpleChaincode) retrieve_auto_approval_rules(stub shim.ChaincodeStubInterface, buyer string) ([]Auto_Approval_Rule, error) {
+
+	iter, err := stub.GetStateByPartialCompositeKey(AUTO_APPROVAL_PREFIX, []string{buyer})
+	if err != nil { return nil, errors.New("Unable to query auto-approval rules") }
+	defer iter.Close()
+
+	rules := []Auto_Approval_Rule{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil { return nil, errors.New("Unable to read auto-approval rules") }
+
+		var rule Auto_Approval_Rule
+		err = json.Unmarshal(kv.Value, &rule)
+		if err != nil { return nil, errors.New("Corrupt auto-approval rule " + string(kv.Value)) }
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+//	Approves the financing of an invoice on the buyer's behalf when one of its rules matches, recording the rule
+func (t *SimpleChaincode) auto_approve(stub shim.ChaincodeStubInterface, inv *Invoice) error {
+
+	rules, err := t.retrieve_auto_approval_rules(stub, inv.Buyer)
+	if err != nil || len(rules) == 0 { return err }
+
+	faceAmount, err := t.parse_amount(inv.Currency, inv.Amount)
+	if err != nil { return errors.New("Invoice " + inv.InvoiceId + " has an invalid amount " + inv.Amount) }
+
+	discount, err := t.discount_percentage(*inv)
+	if err != nil { return err }
+
+	currency := inv.Currency
+	if currency == "" { currency = DEFAULT_CURRENCY }
+
+	for _, rule := range rules {
+		maxAmount, _ := t.parse_amount(rule.Currency, rule.MaxAmount)
+		maxDiscount, _ := t.parse_hundredths(rule.MaxDiscount)
+		if rule.Currency != currency || faceAmount > maxAmount || discount > maxDiscount { continue }
+
+		for _, seller := range rule.Sellers {
+			if seller != inv.Seller { continue }
+
+			err = t.transition(inv, APPROVED)
+			if err != nil { return err }
+
+			now, err := t.get_timestamp(stub)
+			if err != nil { return err }
+
+			inv.AutoApproval = &Auto_Approval{RuleId: rule.RuleId, ApprovedAt: now.Format(time.RFC3339)}
+			return nil
+		}
+	}
+	return nil
+}
+
+//	The discount the financiers of an invoice buy it at, as a percentage of its face amount
+func (t *SimpleChaincode) discount_percentage(inv Invoice) (int64, error) {
+
+	faceAmount, err := t.parse_amount(inv.Currency, inv.Amount)
+	if err != nil || faceAmount <= 0 { return 0, errors.New("Invoice " + inv.InvoiceId + " has an invalid amount " + inv.Amount) }
+
+	var price int64
+	if len(inv.Tranches) > 0 {
+		for _, tranche := range inv.Tranches {
+			tranchePrice, err := t.parse_amount(inv.Currency, tranche.PurchasePrice)
+			if err != nil { return 0, errors.New("Invoice " + inv.InvoiceId + " has an invalid tranche purchase price") }
+			price += tranchePrice
+		}
+	} else {
+		price, err = t.parse_amount(t.financed_currency(inv), inv.FinancedAmount)
+		if err != nil { return 0, errors.New("Invoice " + inv.InvoiceId + " has an invalid financed amount") }
+
+		if inv.FxRate != "" {
+			price, err = t.to_invoice_currency(inv, price)
+			if err != nil { return 0, err }
+		}
+	}
+
+	return (faceAmount - price) * FULL_SHARE / faceAmount, nil
+}
+
+//=================================================================================================================================
+//	 Offer Functions
+//=================================================================================================================================
+//	 submit_offer - A financier bids to finance an invoice that is open to financiers, either naming the purchase price
+//					or passing an annual rate for price_offer to price it from. Offers stay open until the seller
+//					selects one or they pass their expiry.
+//=================================================================================================================================
+func (t *SimpleChaincode) submit_offer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0                      1
+	//			123443232        2017-09-30T00:00:00Z
+	//
+	//	Transient "terms": {"discountrate":"0.05","amount":"95.00"}
+	//				   or: {"annualrate":"0.12"}
+	//
+	//	Either can add {"currency":"EUR","fxrate":"0.92"} to offer in another currency, the rate being units of that
+	//	currency per unit of the invoice currency. Rate pricing converts its price at that rate.
+
+	if len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting 2") }
+
+	terms, err := t.get_transient_terms(stub)
+	if err != nil { return shim.Error(err.Error()) }
+	if terms == nil { return shim.Error("The offer terms must be passed in the transient \"terms\" field") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	role, err := t.get_role(stub)
+	if 	role != FINANCIER {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. submit_offer. %v !== %v", role, FINANCIER), "function", "submit_offer", "actual", role, "expected", FINANCIER)
+	}
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if inv.Status != ISSUED && inv.Status != REJECTED {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v is not open to offers. Status is %v", inv.InvoiceId, inv.Status), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+	if inv.Auction != nil && inv.Auction.Status == AUCTION_OPEN {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v is being auctioned, bid with submit_bid", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+
+	err = t.check_parties(stub, inv.Seller, inv.Buyer, username)
+	if err != nil { return shim.Error(err.Error()) }
+
+	err = t.check_financeable(stub, inv)
+	if err != nil { return shim.Error(err.Error()) }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	pricing := Offer{PricingMode: PRICING_FIXED}
+	if terms["annualrate"] != "" {
+		if terms["discountrate"] != "" || terms["amount"] != "" { return shim.Error("Pass either an annualrate or a discountrate and amount") }
+
+		pricing, err = t.price_offer(inv, terms["annualrate"], now)
+		if err != nil { return shim.Error(err.Error()) }
+
+		terms["discountrate"], terms["amount"] = pricing.DiscountRate, pricing.Amount
+	}
+
+	err = t.check_discount(stub, "discountrate", terms["discountrate"])
+	if err != nil { return shim.Error(err.Error()) }
+
+	offerCurrency := inv.Currency
+	if terms["currency"] != "" && terms["annualrate"] == "" { offerCurrency = terms["currency"] }	// Rate pricing is converted below
+
+	amount, err := t.check_amount(stub, "amount", terms["amount"], offerCurrency)
+	if err != nil { return shim.Error(err.Error()) }
+
+	fxRate := big.NewRat(1, 1)
+	currency := inv.Currency
+	if terms["currency"] != "" && terms["currency"] != inv.Currency {
+		err = t.check_currency(stub, terms["currency"])
+		if err != nil { return shim.Error(err.Error()) }
+
+		fxRate, err = money.ParseDecimal(terms["fxrate"])
+		if err != nil || fxRate.Sign() <= 0 { return shim.Error("fxrate must be a positive rate from " + inv.Currency + " to " + terms["currency"]) }
+
+		currency = terms["currency"]
+		if terms["annualrate"] != "" {
+			amount, err = t.convert(amount, inv.Currency, currency, fxRate)
+			if err != nil { return shim.Error(err.Error()) }
+		}
+	}
+
+	invoiceAmount, err := t.parse_amount(inv.Currency, inv.Amount)
+	if err == nil {
+		invoiceAmount, err = t.convert(invoiceAmount, inv.Currency, currency, fxRate)
+		if err != nil { return shim.Error(err.Error()) }
+		if amount > invoiceAmount { return t.fail(ERR_LIMIT_EXCEEDED, "Offer amount exceeds the invoice amount " + inv.Amount + " " + inv.Currency, "invoiceid", inv.InvoiceId, "value", terms["amount"], "limit", inv.Amount) }
+	}
+
+	expiry, err := time.Parse(time.RFC3339, args[1])
+	if err != nil { return shim.Error("2nd argument must be an RFC 3339 expiry time") }
+	if !expiry.After(now) { return shim.Error("Offer expiry must be in the future") }
+
+	offer := Offer{OfferId: stub.GetTxID(), InvoiceId: inv.InvoiceId, Financier: username, DiscountRate: terms["discountrate"], Amount: t.format_amount(currency, amount), Expiry: expiry.UTC().Format(time.RFC3339), Status: OFFER_OPEN, SubmittedAt: now.Format(time.RFC3339)}
+	offer.PricingMode, offer.AnnualRate, offer.TenorDays, offer.Discount = pricing.PricingMode, pricing.AnnualRate, pricing.TenorDays, pricing.Discount
+	if terms["currency"] != "" && terms["currency"] != inv.Currency { offer.Currency, offer.FxRate = terms["currency"], terms["fxrate"] }
+
+	err = t.save_offer_terms(stub, &offer)
+	if err != nil { return shim.Error(err.Error()) }
+
+	err = t.save_offer(stub, offer)
+	if err != nil { return shim.Error(err.Error()) }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_OFFER_MADE, Invoice: &inv, Offer: &offer})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(offer)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 list_offers - The seller's view of every offer on an invoice. Open offers past their expiry are shown as expired.
+//=================================================================================================================================
+func (t *SimpleChaincode) list_offers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			123443232
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if  username != inv.Seller {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. list_offers. %v !== %v", username, inv.Seller), "function", "list_offers", "actual", username, "expected", inv.Seller)
+	}
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	offers, err := t.retrieve_offers(stub, inv.InvoiceId)
+	if err != nil { return shim.Error(err.Error()) }
+
+	for i := range offers {
+		if offers[i].Status == OFFER_OPEN && t.offer_expired(offers[i], now) { offers[i].Status = OFFER_EXPIRED }
+	}
+
+	bytes, _ := json.Marshal(offers)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 select_offer - The seller picks the winning offer. The invoice moves to FINANCE_OFFERED on the winner's terms,
+//					or on to APPROVED when a buyer's auto-approval rule matches, and every other open offer is marked
+//					expired.
+//=================================================================================================================================
+func (t *SimpleChaincode) select_offer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0               1
+	//			123443232        <offerid>
+
+	if len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting 2") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if  username != inv.Seller {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. select_offer. %v !== %v", username, inv.Seller), "function", "select_offer", "actual", username, "expected", inv.Seller)
+	}
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	offers, err := t.retrieve_offers(stub, inv.InvoiceId)
+	if err != nil { return shim.Error(err.Error()) }
+
+	var selected *Offer
+	for i := range offers {
+		if offers[i].OfferId == args[1] { selected = &offers[i] }
+	}
+	if selected == nil { return t.fail(ERR_NOT_FOUND, "Offer " + args[1] + " not found for invoice " + inv.InvoiceId, "invoiceid", inv.InvoiceId, "offerid", args[1]) }
+
+	if inv.Auction != nil && inv.Auction.Status == AUCTION_OPEN {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v is being auctioned, the winner is selected by close_auction", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+	if selected.Status != OFFER_OPEN || t.offer_expired(*selected, now) {
+		return t.fail(ERR_INVALID_STATE, "Offer " + selected.OfferId + " is no longer open", "invoiceid", inv.InvoiceId, "offerid", selected.OfferId, "status", selected.Status)
+	}
+
+	err = t.award_offer(stub, &inv, offers, selected)
+	if err != nil { return shim.Error(err.Error()) }
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("SELECT_OFFER: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_OFFER_SELECTED, Invoice: &inv, Offer: selected})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(inv)
+	return shim.Success(bytes)
+}
+
+//	Finances an invoice on the terms of the selected offer, one of offers, and expires the other open offers. The
+//	invoice moves to FINANCE_OFFERED, or on to APPROVED for an approved payable or by an auto-approval rule.
+func (t *SimpleChaincode) award_offer(stub shim.ChaincodeStubInterface, inv *Invoice, offers []Offer, selected *Offer) error {
+
+	err := t.check_parties(stub, inv.Seller, inv.Buyer, selected.Financier)
+	if err != nil { return err }
+
+	if len(inv.Tranches) > 0 { return t.coded(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v is being financed in tranches", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+	err = t.check_financeable(stub, *inv)
+	if err != nil { return err }
+
+	err = t.transition(inv, FINANCE_OFFERED)
+	if err != nil { return err }
+
+	outstanding, err := t.outstanding_balance(*inv)
+	if err != nil { return err }
+
+	err = t.check_credit_limit(stub, inv.Buyer, inv.Currency, outstanding)
+	if err != nil { return err }
+
+	if inv.BuyerInitiated {													// The buyer approved the payable up front
+		err = t.transition(inv, APPROVED)
+		if err != nil { return err }
+	}
+
+	inv.Financier = selected.Financier
+	if selected.DiscountRate == "" { return errors.New("The offer terms are not readable on this peer") }
+
+	inv.Discount = selected.DiscountRate
+	inv.FinancedAmount = selected.Amount
+	inv.FinancedCurrency = selected.Currency
+	inv.FxRate = selected.FxRate
+
+	err = t.save_terms(stub, inv)
+	if err != nil { return err }
+
+	err = t.record_assignment(stub, *inv, selected.Financier, FULL_SHARE, inv.Amount, selected.Amount, selected.Currency)
+	if err != nil { return err }
+
+	if inv.Status == FINANCE_OFFERED {
+		err = t.auto_approve(stub, inv)
+		if err != nil { return err }
+	}
+
+	if inv.Status == APPROVED {
+		err = t.charge_financing_fees(stub, *inv)
+		if err != nil { return err }
+
+		err = t.post_intercompany(stub, inv)
+		if err != nil { return err }
+	}
+
+	for i := range offers {
+		if offers[i].Status != OFFER_OPEN { continue }
+
+		if offers[i].OfferId == selected.OfferId {
+			offers[i].Status = OFFER_SELECTED
+		} else {
+			offers[i].Status = OFFER_EXPIRED
+		}
+
+		err = t.save_offer(stub, offers[i])
+		if err != nil { return err }
+	}
+	return nil
+}
+
+//=================================================================================================================================
+//	 accept_trade_partial - A financier takes a percentage of an invoice open to financiers, for a purchase price passed
+//							in the transient "terms" field. Once the tranches add up to 100% the invoice is fully
+//							subscribed and moves to FINANCE_OFFERED for the buyer to approve, or straight to APPROVED
+//							for an approved payable or when a buyer's auto-approval rule matches, and open offers expire.
+//=================================================================================================================================
+func (t *SimpleChaincode) accept_trade_partial(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0              1              2 (optional)
+	//			123443232        25.00      2017-09-30T00:00:00Z
+	//
+	//	Transient "terms": {"amount":"23.75"}
+
+	if len(args) != 2 && len(args) != 3 { return shim.Error("Incorrect number of arguments. Expecting 2 or 3") }
+
+	terms, err := t.get_transient_terms(stub)
+	if err != nil { return shim.Error(err.Error()) }
+	if terms == nil { return shim.Error("The purchase price must be passed in the transient \"terms\" field") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	role, err := t.get_role(stub)
+	if 	role != FINANCIER {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. accept_trade_partial. %v !== %v", role, FINANCIER), "function", "accept_trade_partial", "actual", role, "expected", FINANCIER)
+	}
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if inv.Status != ISSUED && inv.Status != REJECTED {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v is not open to financiers. Status is %v", inv.InvoiceId, inv.Status), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+
+	if inv.Auction != nil && inv.Auction.Status == AUCTION_OPEN {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v is being auctioned, bid with submit_bid", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+
+	err = t.check_parties(stub, append([]string{inv.Seller, inv.Buyer, username}, t.financiers(inv)...)...)
+	if err != nil { return shim.Error(err.Error()) }
+
+	err = t.check_financeable(stub, inv)
+	if err != nil { return shim.Error(err.Error()) }
+	if len(inv.Tranches) > 0 && inv.Tranches[0].PurchasePrice == "" { return shim.Error("The invoice terms are not readable on this peer") }
+
+	percentage, err := t.parse_hundredths(args[1])
+	if err != nil || percentage <= 0 { return shim.Error("2nd argument must be a positive percentage") }
+
+	var subscribed, allocated int64
+	for _, tranche := range inv.Tranches {
+		if tranche.Financier == username { return t.fail(ERR_DUPLICATE, fmt.Sprintf("%v already holds a tranche of invoice %v", username, inv.InvoiceId), "invoiceid", inv.InvoiceId, "financier", username) }
+
+		share, _ := t.parse_hundredths(tranche.Percentage)
+		subscribed += share
+		face, _ := t.parse_amount(inv.Currency, tranche.FaceAmount)
+		allocated += face
+	}
+	if subscribed + percentage > FULL_SHARE {
+		return t.fail(ERR_LIMIT_EXCEEDED, fmt.Sprintf("Only %v%% of invoice %v is left to finance", t.format_hundredths(FULL_SHARE - subscribed), inv.InvoiceId), "invoiceid", inv.InvoiceId, "value", t.format_hundredths(percentage), "limit", t.format_hundredths(FULL_SHARE - subscribed))
+	}
+
+	faceAmount, err := t.parse_amount(inv.Currency, inv.Amount)
+	if err != nil { return shim.Error("Invoice " + inv.InvoiceId + " has an invalid amount " + inv.Amount) }
+
+	trancheFace := faceAmount * percentage / FULL_SHARE
+	if subscribed + percentage == FULL_SHARE { trancheFace = faceAmount - allocated }		// The last tranche takes the rounding remainder
+
+	price, err := t.parse_amount(inv.Currency, terms["amount"])
+	if err != nil || price <= 0 || price > trancheFace {
+		return t.fail(ERR_LIMIT_EXCEEDED, fmt.Sprintf("The purchase price must be a positive amount up to the tranche face amount %v", t.format_amount(inv.Currency, trancheFace)), "invoiceid", inv.InvoiceId, "value", terms["amount"], "limit", t.format_amount(inv.Currency, trancheFace))
+	}
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	expiresAt := ""
+	if len(args) == 3 && args[2] != "" {
+		expiry, err := time.Parse(time.RFC3339, args[2])
+		if err != nil { return shim.Error("3rd argument must be an RFC 3339 expiry time") }
+		if !expiry.After(now) { return shim.Error("Tranche expiry must be in the future") }
+		expiresAt = expiry.UTC().Format(time.RFC3339)
+	}
+
+	inv.Tranches = append(inv.Tranches, Tranche{Financier: username, Percentage: t.format_hundredths(percentage), FaceAmount: t.format_amount(inv.Currency, trancheFace), PurchasePrice: t.format_amount(inv.Currency, price), AcceptedAt: now.Format(time.RFC3339), ExpiresAt: expiresAt, TxId: stub.GetTxID()})
+
+	err = t.record_assignment(stub, inv, username, percentage, t.format_amount(inv.Currency, trancheFace), t.format_amount(inv.Currency, price), "")
+	if err != nil { return shim.Error(err.Error()) }
+
+	if subscribed + percentage == FULL_SHARE {
+		err = t.transition(&inv, FINANCE_OFFERED)
+		if err != nil { return shim.Error(err.Error()) }
+
+		outstanding, err := t.outstanding_balance(inv)
+		if err != nil { return shim.Error(err.Error()) }
+
+		err = t.check_credit_limit(stub, inv.Buyer, inv.Currency, outstanding)
+		if err != nil { return shim.Error(err.Error()) }
+
+		if inv.BuyerInitiated {												// The buyer approved the payable up front
+			err = t.transition(&inv, APPROVED)
+			if err != nil { return shim.Error(err.Error()) }
+		}
+
+		offers, err := t.retrieve_offers(stub, inv.InvoiceId)
+		if err != nil { return shim.Error(err.Error()) }
+
+		for _, offer := range offers {
+			if offer.Status != OFFER_OPEN { continue }
+
+			offer.Status = OFFER_EXPIRED
+			err = t.save_offer(stub, offer)
+			if err != nil { return shim.Error(err.Error()) }
+		}
+
+		if inv.Status == FINANCE_OFFERED {
+			err = t.auto_approve(stub, &inv)
+			if err != nil { return shim.Error(err.Error()) }
+		}
+
+		if inv.Status == APPROVED {
+			err = t.charge_financing_fees(stub, inv)
+			if err != nil { return shim.Error(err.Error()) }
+
+			err = t.post_intercompany(stub, &inv)
+			if err != nil { return shim.Error(err.Error()) }
+		}
+	}
+
+	err = t.save_terms(stub, &inv)
+	if err != nil { return shim.Error(err.Error()) }
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("ACCEPT_TRADE_PARTIAL: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_TRANCHE, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(t.visible_terms(inv, username, role))
+	return shim.Success(bytes)
+}
+
+//	Splits an amount between the tranches by percentage. When the tranches add up to 100% the last one takes the
+//	rounding remainder, otherwise the unsubscribed rest is left over.
+func (t *SimpleChaincode) pro_rata(amount int64, tranches []Tranche) []int64 {
+
+	shares := make([]int64, len(tranches))
+	var subscribed, allocated int64
+	for i, tranche := range tranches {
+		percentage, _ := t.parse_hundredths(tranche.Percentage)
+		subscribed += percentage
+		shares[i] = amount * percentage / FULL_SHARE
+		allocated += shares[i]
+	}
+
+	if subscribed == FULL_SHARE && len(shares) > 0 { shares[len(shares) - 1] += amount - allocated }
+	return shares
+}
+
+//=================================================================================================================================
+//	 price_offer - Prices an offer from an annual discount rate: the discount is the invoice amount times the rate times
+//				   the days from the transaction date to the due date over DAY_COUNT_BASIS, rounded to the nearest minor
+//				   unit. The transaction timestamp makes the price the same on every endorsing peer.
+//=================================================================================================================================
+func (t *SimpleChaincode) price_offer(inv Invoice, annualRate string, now time.Time) (Offer, error) {
+
+	var pricing Offer
+
+	rate, err := money.ParseDecimal(annualRate)
+	if err != nil || rate.Sign() <= 0 || rate.Cmp(big.NewRat(1, 1)) >= 0 { return pricing, t.coded(ERR_VALIDATION, "annualrate must be an annual discount rate between 0 and 1", "field", "annualrate", "value", annualRate, "reason", "not between 0 and 1") }
+
+	dueDate, err := time.Parse(DATE_FORMAT, inv.DueDate)
+	if err != nil { return pricing, t.coded(ERR_INVALID_STATE, "Invoice " + inv.InvoiceId + " has no due date to price from", "invoiceid", inv.InvoiceId, "status", inv.Status) }
+
+	tenor := int(dueDate.Sub(now.Truncate(24 * time.Hour)).Hours() / 24)
+	if tenor <= 0 { return pricing, t.coded(ERR_INVALID_STATE, "Invoice " + inv.InvoiceId + " is already at maturity", "invoiceid", inv.InvoiceId, "status", inv.Status) }
+
+	faceAmount, err := t.parse_amount(inv.Currency, inv.Amount)
+	if err != nil { return pricing, errors.New("Invoice " + inv.InvoiceId + " has an invalid amount " + inv.Amount) }
+
+	discount, err := money.ScaleUnits(faceAmount, rate, big.NewRat(int64(tenor), DAY_COUNT_BASIS))
+	if err != nil { return pricing, err }
+	if discount >= faceAmount { return pricing, t.coded(ERR_LIMIT_EXCEEDED, "The discount for a tenor of " + strconv.Itoa(tenor) + " days exceeds the invoice amount", "invoiceid", inv.InvoiceId, "value", t.format_amount(inv.Currency, discount), "limit", inv.Amount) }
+
+	pricing.PricingMode = PRICING_RATE
+	pricing.AnnualRate = annualRate
+	pricing.TenorDays = tenor
+	pricing.Discount = t.format_amount(inv.Currency, discount)
+	pricing.Amount = t.format_amount(inv.Currency, faceAmount - discount)
+	pricing.DiscountRate = money.FormatDecimal(big.NewRat(discount, faceAmount), 6)
+
+	return pricing, nil
+}
+
+func (t *SimpleChaincode) offer_expired(offer Offer, now time.Time) bool {
+
+	expiry, err := time.Parse(time.RFC3339, offer.Expiry)
+	return err != nil || !expiry.After(now)
+}
+
+//=================================================================================================================================
+//	 lapse_expired_offers - Marks open offers past their expiry EXPIRED, and lapses financing the buyer did not approve in
+//							time: an invoice whose selected offer or any of whose tranches expired goes back to ISSUED
+//							without its financier, and expired tranches of invoices still being subscribed are dropped.
+//							Checks every invoice open to or awaiting financing, or only the invoices passed as
+//							arguments. Returns the IDs of the invoices whose financing lapsed.
+//=================================================================================================================================
+func (t *SimpleChaincode) lapse_expired_offers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args (optional)
+	//				0               1       ...
+	//			123443232       123443233
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	invoiceIds := args
+	if len(invoiceIds) == 0 {
+		invoiceIds, err = t.get_invoice_ids(stub, ISSUED, FINANCE_OFFERED, REJECTED)
+		if err != nil { return shim.Error(err.Error()) }
+	}
+
+	lapsed := []string{}
+	for _, invoiceId := range invoiceIds {
+
+		inv, err := t.retrieve_invoice(stub, invoiceId)
+		if err != nil { return shim.Error(err.Error()) }
+
+		if inv.Status != ISSUED && inv.Status != FINANCE_OFFERED && inv.Status != REJECTED { continue }
+
+		offers, err := t.retrieve_offers(stub, inv.InvoiceId)
+		if err != nil { return shim.Error(err.Error()) }
+
+		changed := false
+		for _, offer := range offers {
+			selected := offer.Status == OFFER_SELECTED && inv.Status == FINANCE_OFFERED && offer.Financier == inv.Financier
+			if (offer.Status != OFFER_OPEN && !selected) || !t.offer_expired(offer, now) { continue }
+
+			offer.Status = OFFER_EXPIRED
+			err = t.save_offer(stub, offer)
+			if err != nil { return shim.Error(err.Error()) }
+
+			if selected {
+				inv.Financier = UNDEFINED
+				inv.FinancedAmount = ""
+				inv.FinancedCurrency = ""
+				inv.FxRate = ""
+				changed = true
+			}
+		}
+
+		tranches := []Tranche{}
+		for _, tranche := range inv.Tranches {
+			expiry, err := time.Parse(time.RFC3339, tranche.ExpiresAt)
+			if err == nil && !expiry.After(now) { changed = true; continue }
+			tranches = append(tranches, tranche)
+		}
+
+		if !changed { continue }
+
+		if len(tranches) == 0 { tranches = nil }
+		inv.Tranches = tranches
+
+		if inv.Status == FINANCE_OFFERED {
+			err = t.transition(&inv, ISSUED)
+			if err != nil { return shim.Error(err.Error()) }
+		}
+
+		if inv.TermsHash == "" || inv.Discount != "" {						// Only peers that can read the terms rewrite them
+			err = t.save_terms(stub, &inv)
+			if err != nil { return shim.Error(err.Error()) }
+		}
+
+		_, err = t.save_changes(stub, inv)
+		if err != nil { fmt.Printf("LAPSE_EXPIRED_OFFERS: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+		lapsed = append(lapsed, inv.InvoiceId)
+	}
+
+	if len(lapsed) > 0 {
+		err = t.emit_event(stub, Invoice_Event{Event: EVENT_OFFERS_LAPSED, InvoiceIds: lapsed})
+		if err != nil { return shim.Error(err.Error()) }
+	}
+
+	bytes, _ := json.Marshal(lapsed)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 transfer_position - A financier sells its position in a financed invoice, the whole invoice or its tranche, to
+//						 another financier. The purchase price recorded for the position does not change, the sale
+//						 price is settled between the financiers off-chain.
+//=================================================================================================================================
+func (t *SimpleChaincode) transfer_position(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0               1
+	//			123443232     test_user3
+
+	if len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting 2") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	role, err := t.get_role(stub)
+	if 	role != FINANCIER {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. transfer_position. %v !== %v", role, FINANCIER), "function", "transfer_position", "actual", role, "expected", FINANCIER)
+	}
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if !t.is_financier(inv, username) {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. transfer_position. %v does not hold invoice %v", username, inv.InvoiceId), "function", "transfer_position", "actual", username, "invoiceid", inv.InvoiceId)
+	}
+
+	if inv.Status != APPROVED && inv.Status != OVERDUE {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Only financed invoices can be transferred. Invoice %v is %v", inv.InvoiceId, inv.Status), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+
+	holder := args[1]
+	if holder == "" || holder == UNDEFINED { return shim.Error("2nd argument must be the username of the receiving financier") }
+	if t.is_financier(inv, holder) { return t.fail(ERR_DUPLICATE, fmt.Sprintf("%v already holds a position in invoice %v", holder, inv.InvoiceId), "invoiceid", inv.InvoiceId, "financier", holder) }
+
+	err = t.check_parties(stub, inv.Seller, inv.Buyer, username, holder)
+	if err != nil { return shim.Error(err.Error()) }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	transfer := Position_Transfer{From: username, To: holder, Percentage: t.format_hundredths(FULL_SHARE), TransferredAt: now.Format(time.RFC3339), TxId: stub.GetTxID()}
+
+	if len(inv.Tranches) > 0 {
+		if inv.Tranches[0].PurchasePrice == "" { return shim.Error("The invoice terms are not readable on this peer") }
+
+		for i := range inv.Tranches {
+			if inv.Tranches[i].Financier != username { continue }
+
+			inv.Tranches[i].Financier = holder
+			transfer.Percentage = inv.Tranches[i].Percentage
+		}
+
+		err = t.save_terms(stub, &inv)										// Tranche prices are keyed by financier
+		if err != nil { return shim.Error(err.Error()) }
+	} else {
+		inv.Financier = holder
+	}
+
+	inv.Transfers = append(inv.Transfers, transfer)
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("TRANSFER_POSITION: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_POSITION_TRANSFERRED, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(t.without_terms(inv))							// The caller no longer holds the position
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 Auction Functions
+//=================================================================================================================================
+//	 open_auction - The seller auctions the financing of an invoice open to financiers. Until the deadline financiers
+//					submit sealed bids with submit_bid instead of offers, and the seller cannot select an offer.
+//=================================================================================================================================
+func (t *SimpleChaincode) open_auction(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0                      1
+	//			123443232        2017-09-15T12:00:00Z
+
+	if len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting 2") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if  username != inv.Seller {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. open_auction. %v !== %v", username, inv.Seller), "function", "open_auction", "actual", username, "expected", inv.Seller)
+	}
+
+	if inv.Status != ISSUED && inv.Status != REJECTED {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v is not open to financiers. Status is %v", inv.InvoiceId, inv.Status), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+	if inv.Auction != nil && inv.Auction.Status == AUCTION_OPEN {
+		return t.fail(ERR_DUPLICATE, fmt.Sprintf("Invoice %v is already being auctioned", inv.InvoiceId), "invoiceid", inv.InvoiceId)
+	}
+	if len(inv.Tranches) > 0 { return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v is being financed in tranches", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+
+	err = t.check_financeable(stub, inv)
+	if err != nil { return shim.Error(err.Error()) }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	deadline, err := time.Parse(time.RFC3339, args[1])
+	if err != nil { return shim.Error("2nd argument must be an RFC 3339 deadline") }
+	if !deadline.After(now) { return shim.Error("Auction deadline must be in the future") }
+
+	inv.Auction = &Auction{AuctionId: stub.GetTxID(), Status: AUCTION_OPEN, Deadline: deadline.UTC().Format(time.RFC3339), OpenedAt: now.Format(time.RFC3339)}
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("OPEN_AUCTION: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_AUCTION_OPENED, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(inv.Auction)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 submit_bid - A financier bids an annual discount rate, passed in the transient "terms" field, in an open auction.
+//				  The bid goes to the BIDS_COLLECTION; the ledger only records that the financier bid and the hash of
+//				  its bid. A later bid replaces the financier's earlier one.
+//=================================================================================================================================
+func (t *SimpleChaincode) submit_bid(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			123443232
+	//
+	//	Transient "terms": {"annualrate":"0.085"}
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	terms, err := t.get_transient_terms(stub)
+	if err != nil { return shim.Error(err.Error()) }
+	if terms == nil || terms["annualrate"] == "" { return shim.Error("The bid must be passed as an annualrate in the transient \"terms\" field") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	role, err := t.get_role(stub)
+	if 	role != FINANCIER {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. submit_bid. %v !== %v", role, FINANCIER), "function", "submit_bid", "actual", role, "expected", FINANCIER)
+	}
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if inv.Auction == nil || inv.Auction.Status != AUCTION_OPEN {
+		return t.fail(ERR_NOT_FOUND, fmt.Sprintf("Invoice %v has no open auction", inv.InvoiceId), "invoiceid", inv.InvoiceId)
+	}
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	deadline, _ := time.Parse(time.RFC3339, inv.Auction.Deadline)
+	if !now.Before(deadline) { return t.fail(ERR_INVALID_STATE, fmt.Sprintf("The auction of invoice %v closed at %v", inv.InvoiceId, inv.Auction.Deadline), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+
+	err = t.check_parties(stub, inv.Seller, inv.Buyer, username)
+	if err != nil { return shim.Error(err.Error()) }
+
+	_, err = t.price_offer(inv, terms["annualrate"], now)
+	if err != nil { return shim.Error(err.Error()) }
+
+	salt, err := t.get_salt(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	bid := Auction_Bid{InvoiceId: inv.InvoiceId, AuctionId: inv.Auction.AuctionId, Financier: username, AnnualRate: terms["annualrate"], SubmittedAt: now.Format(time.RFC3339), TxId: stub.GetTxID(), Salt: salt}
+
+	key, err := stub.CreateCompositeKey(AUCTION_BID_PREFIX, []string{inv.InvoiceId, bid.AuctionId, username})
+	if err != nil { return shim.Error("Error building bid key") }
+
+	bytes, _ := json.Marshal(bid)
+	err = stub.PutPrivateData(BIDS_COLLECTION, key, bytes)
+	if err != nil { return shim.Error("Error storing bid") }
+
+	sealed := Sealed_Bid{InvoiceId: bid.InvoiceId, AuctionId: bid.AuctionId, Financier: username, BidHash: t.hash(bytes), SubmittedAt: bid.SubmittedAt, TxId: bid.TxId}
+
+	bytes, _ = json.Marshal(sealed)
+	err = stub.PutState(key, bytes)
+	if err != nil { return shim.Error("Error storing sealed bid") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_BID_SUBMITTED, InvoiceIds: []string{inv.InvoiceId}})
+	if err != nil { return shim.Error(err.Error()) }
+
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 close_auction - After the deadline the seller closes the auction. The bid with the lowest annual rate wins, the
+//					 earliest on a tie, and the invoice is financed on it as if the seller had selected it as an
+//					 offer. Only the winning bid is revealed on the ledger. Needs a peer that can read the bids.
+//=================================================================================================================================
+func (t *SimpleChaincode) close_auction(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			123443232
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if  username != inv.Seller {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. close_auction. %v !== %v", username, inv.Seller), "function", "close_auction", "actual", username, "expected", inv.Seller)
+	}
+
+	if inv.Auction == nil || inv.Auction.Status != AUCTION_OPEN {
+		return t.fail(ERR_NOT_FOUND, fmt.Sprintf("Invoice %v has no open auction", inv.InvoiceId), "invoiceid", inv.InvoiceId)
+	}
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	deadline, _ := time.Parse(time.RFC3339, inv.Auction.Deadline)
+	if now.Before(deadline) { return t.fail(ERR_INVALID_STATE, fmt.Sprintf("The auction of invoice %v closes at %v", inv.InvoiceId, inv.Auction.Deadline), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+
+	bids, err := t.retrieve_bids(stub, inv.InvoiceId, inv.Auction.AuctionId)
+	if err != nil { return shim.Error(err.Error()) }
+
+	var winner *Auction_Bid
+	var best *big.Rat
+	for i := range bids {
+		if t.check_parties(stub, bids[i].Financier) != nil { continue }			// Parties blocked since they bid cannot win
+
+		rate, err := money.ParseDecimal(bids[i].AnnualRate)
+		if err != nil { continue }
+
+		if winner == nil || rate.Cmp(best) < 0 || (rate.Cmp(best) == 0 && bids[i].SubmittedAt < winner.SubmittedAt) {
+			winner, best = &bids[i], rate
+		}
+	}
+
+	inv.Auction.Status = AUCTION_CLOSED
+	inv.Auction.Bids = len(bids)
+	inv.Auction.ClosedAt = now.Format(time.RFC3339)
+
+	var selected *Offer
+	if winner != nil {
+		pricing, err := t.price_offer(inv, winner.AnnualRate, now)
+		if err != nil { return shim.Error(err.Error()) }
+
+		offers, err := t.retrieve_offers(stub, inv.InvoiceId)
+		if err != nil { return shim.Error(err.Error()) }
+
+		offer := Offer{OfferId: winner.TxId, InvoiceId: inv.InvoiceId, Financier: winner.Financier, DiscountRate: pricing.DiscountRate, Amount: pricing.Amount, PricingMode: pricing.PricingMode, AnnualRate: pricing.AnnualRate, TenorDays: pricing.TenorDays, Discount: pricing.Discount, Expiry: inv.Auction.Deadline, Status: OFFER_OPEN, SubmittedAt: winner.SubmittedAt}
+
+		err = t.save_offer_terms(stub, &offer)
+		if err != nil { return shim.Error(err.Error()) }
+
+		offers = append(offers, offer)
+		selected = &offers[len(offers) - 1]
+
+		err = t.award_offer(stub, &inv, offers, selected)
+		if err != nil { return shim.Error(err.Error()) }
+
+		inv.Auction.Winner = winner.Financier
+		inv.Auction.WinningRate = winner.AnnualRate
+		inv.Auction.WinningOfferId = offer.OfferId
+	}
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("CLOSE_AUCTION: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_AUCTION_CLOSED, Invoice: &inv, Offer: selected})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(inv)
+	return shim.Success(bytes)
+}
+
+//	The bids of an auction, each checked against the hash sealed on the ledger
+func (t *SimpleChaincode) retrieve_bids(stub shim.ChaincodeStubInterface, invoiceId string, auctionId string) ([]Auction_Bid, error) {
+
+	iter, err := stub.GetStateByPartialCompositeKey(AUCTION_BID_PREFIX, []string{invoiceId, auctionId})
+	if err != nil { return nil, errors.New("Unable to query bids for invoice " + invoiceId) }
+	defer iter.Close()
+
+	bids := []Auction_Bid{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil { return nil, errors.New("Unable to read bids for invoice " + invoiceId) }
+
+		var sealed Sealed_Bid
+		err = json.Unmarshal(kv.Value, &sealed)
+		if err != nil { return nil, errors.New("Corrupt sealed bid " + string(kv.Value)) }
+
+		private, err := stub.GetPrivateData(BIDS_COLLECTION, kv.Key)
+		if err != nil || private == nil { return nil, errors.New("The bids are not readable on this peer") }
+		if t.hash(private) != sealed.BidHash { return nil, errors.New("The bid of " + sealed.Financier + " does not match its sealed hash") }
+
+		var bid Auction_Bid
+		err = json.Unmarshal(private, &bid)
+		if err != nil { return nil, errors.New("Corrupt bid of " + sealed.Financier) }
+
+		bids = append(bids, bid)
+	}
+	return bids, nil
+}
+
+//=================================================================================================================================
+//	 Assignment Functions
+//=================================================================================================================================
+//	 record_assignment - Evidences the assignment of an invoice, or a percentage of it, by the seller to a financier
+//						 for a consideration in currency. The consideration goes to the TERMS_COLLECTION, the public
+//						 record carries its hash.
+//=================================================================================================================================
+func (t *SimpleChaincode) record_assignment(stub shim.ChaincodeStubInterface, inv Invoice, assignee string, percentage int64, faceAmount string, consideration string, currency string) error {
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return err }
+
+	if currency == "" { currency = inv.Currency }
+	if currency == "" { currency = DEFAULT_CURRENCY }
+
+	record := Assignment_Record{InvoiceId: inv.InvoiceId, InvoiceReference: inv.ExternalNumber, Assignor: inv.Seller, Assignee: assignee, Debtor: inv.Buyer, Percentage: t.format_hundredths(percentage), FaceAmount: faceAmount, Currency: currency, EffectiveAt: now.Format(time.RFC3339), TxId: stub.GetTxID()}
+
+	key, err := stub.CreateCompositeKey(ASSIGNMENT_PREFIX, []string{inv.InvoiceId, record.TxId, assignee})
+	if err != nil { return errors.New("Error building assignment key") }
+
+	salt, err := t.get_salt(stub)
+	if err != nil { return err }
+
+	bytes, _ := json.Marshal(Assignment_Terms{InvoiceId: inv.InvoiceId, TxId: record.TxId, Consideration: consideration, Salt: salt})
+	err = stub.PutPrivateData(TERMS_COLLECTION, key, bytes)
+	if err != nil { return errors.New("Error storing assignment terms") }
+
+	record.ConsiderationHash = t.hash(bytes)
+
+	bytes, _ = json.Marshal(record)
+	err = stub.PutState(key, bytes)
+	if err != nil { return errors.New("Error storing assignment record") }
+
+	return nil
+}
+
+//=================================================================================================================================
+//	 get_assignment_records - The assignments of an invoice the caller is the assignor, assignee or debtor of. The
+//							  consideration is only shown to the assignor and assignee, on peers that can read it.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_assignment_records(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			123443232
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	iter, err := stub.GetStateByPartialCompositeKey(ASSIGNMENT_PREFIX, []string{args[0]})
+	if err != nil { return shim.Error("Unable to query assignments of invoice " + args[0]) }
+	defer iter.Close()
+
+	records := []Assignment_Record{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil { return shim.Error("Unable to read assignments of invoice " + args[0]) }
+
+		var record Assignment_Record
+		err = json.Unmarshal(kv.Value, &record)
+		if err != nil { return shim.Error("Corrupt assignment record " + string(kv.Value)) }
+
+		if username != record.Assignor && username != record.Assignee && username != record.Debtor { continue }
+
+		if username != record.Debtor {
+			if private, err := stub.GetPrivateData(TERMS_COLLECTION, kv.Key); err == nil && private != nil && t.hash(private) == record.ConsiderationHash {
+				var terms Assignment_Terms
+				if json.Unmarshal(private, &terms) == nil { record.Consideration = terms.Consideration }
+			}
+		}
+		records = append(records, record)
+	}
+
+	if len(records) == 0 {
+		return t.fail(ERR_NOT_FOUND, "No assignments of invoice " + args[0] + " for " + username, "invoiceid", args[0])
+	}
+
+	bytes, _ := json.Marshal(records)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 Cancel and Amend Functions
+//=================================================================================================================================
+//	 cancel_invoice - The seller withdraws an invoice that has not been financed or paid.
+//=================================================================================================================================
+func (t *SimpleChaincode) cancel_invoice(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			123443232
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if  username != inv.Seller {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. cancel_invoice. %v !== %v", username, inv.Seller), "function", "cancel_invoice", "actual", username, "expected", inv.Seller)
+	}
+
+	if inv.Status != ISSUED {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %s can only be cancelled while %s, it is %s", inv.InvoiceId, ISSUED, inv.Status), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+	if len(inv.Tranches) > 0 { return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v cannot be cancelled once financiers have taken tranches", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+	if inv.BuyerInitiated { return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v is a payable approved by the buyer and cannot be cancelled", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+
+	err = t.transition(&inv, CANCELLED)
+	if err != nil { return shim.Error(err.Error()) }
+
+	err = t.release_fingerprint(stub, inv)									// The receivable may be invoiced again
+	if err != nil { return shim.Error(err.Error()) }
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("CANCEL_INVOICE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_CANCELLED, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(inv)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 void_invoice - Voids an invoice raised in error that has not been financed, keeping the record and its history.
+//					An admin voids it at once; otherwise the seller and buyer must both call void_invoice with the
+//					same reason code, the first call recording the request.
+//=================================================================================================================================
+func (t *SimpleChaincode) void_invoice(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0               1                        2
+	//			123443232       duplicate       Raised twice from the ERP batch of 2017-09-01
+
+	if len(args) != 3 { return shim.Error("Incorrect number of arguments. Expecting 3") }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	known := false
+	for _, reason := range VOID_REASONS {
+		if reason == args[1] { known = true }
+	}
+	if !known { return shim.Error(fmt.Sprintf("2nd argument must be one of the reason codes %v", strings.Join(VOID_REASONS, ", "))) }
+	if strings.TrimSpace(args[2]) == "" { return shim.Error("3rd argument must be a note explaining the void") }
+
+	admin := t.is_admin(stub)
+	username := ""
+	if admin {
+		identity, err := t.get_identity(stub)
+		if err != nil { return shim.Error(err.Error()) }
+		username = identity.Id
+	} else {
+		username, err = t.get_username(stub);
+		if err != nil { return shim.Error(err.Error()) }
+
+		if username != inv.Seller && username != inv.Buyer {
+			return t.fail(ERR_PERMISSION, "Permission Denied. void_invoice", "function", "void_invoice", "actual", username, "invoiceid", inv.InvoiceId)
+		}
+	}
+
+	if len(inv.Tranches) > 0 { return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v cannot be voided once financiers have taken tranches", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+
+	probe := inv
+	err = t.transition(&probe, VOID)
+	if err != nil { return shim.Error(err.Error()) }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	event := EVENT_VOIDED
+	if admin {
+		inv.Void = &Void_Record{ReasonCode: args[1], Note: args[2], RequestedBy: username, RequestedAt: now.Format(time.RFC3339)}
+	} else if inv.Void == nil || inv.Void.RequestedBy == username {
+		inv.Void = &Void_Record{ReasonCode: args[1], Note: args[2], RequestedBy: username, RequestedAt: now.Format(time.RFC3339)}
+		event = EVENT_VOID_REQUESTED
+	} else if inv.Void.ReasonCode != args[1] {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("%v requested voiding invoice %v as %v, not %v", inv.Void.RequestedBy, inv.InvoiceId, inv.Void.ReasonCode, args[1]), "invoiceid", inv.InvoiceId, "status", inv.Status, "expected", inv.Void.ReasonCode, "actual", args[1])
+	}
+
+	if event == EVENT_VOIDED {
+		err = t.transition(&inv, VOID)
+		if err != nil { return shim.Error(err.Error()) }
+
+		inv.Void.ConfirmedBy = username
+		inv.Void.VoidedAt = now.Format(time.RFC3339)
+
+		err = t.release_fingerprint(stub, inv)								// The receivable may be invoiced again
+		if err != nil { return shim.Error(err.Error()) }
+	}
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("VOID_INVOICE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: event, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(inv)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 amend_invoice - The seller corrects the amount, discount or buyer of an invoice. Empty arguments keep the current
+//					 value. The prior version is kept under the history key. Amendments stop once the invoice has
+//					 an offer, a financier or a payment.
+//=================================================================================================================================
+func (t *SimpleChaincode) amend_invoice(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0               1              2              3
+	//			123443232        120.00           0.04         test_user2
+	//
+	//	As with create_invoice, the discount (2) is better passed in the transient "terms" field.
+
+	if len(args) != 4 { return shim.Error("Incorrect number of arguments. Expecting 4") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if  username != inv.Seller {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. amend_invoice. %v !== %v", username, inv.Seller), "function", "amend_invoice", "actual", username, "expected", inv.Seller)
+	}
+
+	if inv.Status != ISSUED { return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v cannot be amended while %v", inv.InvoiceId, inv.Status), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+	if inv.BuyerInitiated { return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v is a payable approved by the buyer and cannot be amended", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+	if len(inv.Payments) > 0 { return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v cannot be amended after a payment", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+
+	offers, err := t.retrieve_offers(stub, inv.InvoiceId)
+	if err != nil { return shim.Error(err.Error()) }
+	if len(offers) > 0 || len(inv.Tranches) > 0 { return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v cannot be amended after a financier has made an offer", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+
+	err = t.save_version(stub, inv)
+	if err != nil { return shim.Error(err.Error()) }
+
+	err = t.release_fingerprint(stub, inv)
+	if err != nil { return shim.Error(err.Error()) }
+
+	if args[1] != "" && len(inv.LineItems) > 0 {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v amount is the total of its line items and cannot be amended", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+	if args[1] != "" {
+		amount, err := t.check_amount(stub, "amount", args[1], inv.Currency)
+		if err != nil { return shim.Error(err.Error()) }
+
+		inv.Amount = t.format_amount(inv.Currency, amount)
+		inv.Outstanding = inv.Amount
+	}
+	if args[3] != "" && args[3] != inv.Buyer {
+		inv.Buyer = args[3]
+		inv.Delivery = nil													// The new buyer has to confirm delivery itself
+	}
+	inv.Match = nil															// Matched again as amended
+	inv.Version++
+
+	err = t.claim_fingerprint(stub, inv)
+	if err != nil { return shim.Error(err.Error()) }
+
+	terms, err := t.get_transient_terms(stub)
+	if err != nil { return shim.Error(err.Error()) }
+	if terms["discount"] != "" { args[2] = terms["discount"] }
+
+	if args[2] != "" {
+		err = t.check_discount(stub, "discount", args[2])
+		if err != nil { return shim.Error(err.Error()) }
+
+		inv.Discount = args[2]
+		err = t.save_terms(stub, &inv)
+		if err != nil { return shim.Error(err.Error()) }
+	}
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("AMEND_INVOICE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_AMENDED, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(inv)
+	return shim.Success(bytes)
+}
+
+//	Store the invoice as it is now under its history key before it is amended
+func (t *SimpleChaincode) save_version(stub shim.ChaincodeStubInterface, inv Invoice) error {
+
+	key, err := stub.CreateCompositeKey(HISTORY_PREFIX, []string{inv.InvoiceId, fmt.Sprintf("%06d", inv.Version)})
+	if err != nil { return errors.New("Error building invoice history key") }
+
+	bytes, err := json.Marshal(t.without_terms(inv))
+	if err != nil { return errors.New("Error converting invoice record") }
+
+	err = stub.PutState(key, bytes)
+	if err != nil { return errors.New("Error storing invoice history") }
+
+	return nil
+}
+
+//=================================================================================================================================
+//	 Due Date Functions
+//=================================================================================================================================
+//	 update_due_date - The seller proposes a new due date, which takes effect once the buyer calls update_due_date
+//					   with the same date. Not available once an invoice is paid, cancelled or overdue.
+//=================================================================================================================================
+func (t *SimpleChaincode) update_due_date(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0               1
+	//			123443232       2017-10-31
+
+	if len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting 2") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if inv.Status == PAID || inv.Status == SETTLED || inv.Status == CANCELLED || inv.Status == VOID || inv.Status == OVERDUE {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v due date cannot change while %v", inv.InvoiceId, inv.Status), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+
+	if _, err = time.Parse(DATE_FORMAT, args[1]); err != nil { return shim.Error("2nd argument must be a due date formatted YYYY-MM-DD") }
+
+	if username == inv.Seller {
+		inv.PendingDueDate = args[1]
+	} else if username == inv.Buyer {
+		if inv.PendingDueDate != args[1] {
+			return t.fail(ERR_INVALID_STATE, fmt.Sprintf("The seller has not proposed the due date %v for invoice %v", args[1], inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status)
+		}
+		err = t.release_fingerprint(stub, inv)
+		if err != nil { return shim.Error(err.Error()) }
+
+		inv.DueDate = inv.PendingDueDate
+		inv.PendingDueDate = ""
+
+		err = t.claim_fingerprint(stub, inv)
+		if err != nil { return shim.Error(err.Error()) }
+	} else {
+		return t.fail(ERR_PERMISSION, "Permission Denied. update_due_date", "function", "update_due_date")
+	}
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("UPDATE_DUE_DATE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_DUE_DATE_CHANGED, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(t.visible_terms(inv, username, ""))
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 mark_overdue - Moves every unpaid invoice whose due date is before the transaction date to OVERDUE, or only the
+//					invoices passed as arguments, and marks their installments past due as overdue. Returns the IDs
+//					of the invoices it changed.
+//=================================================================================================================================
+func (t *SimpleChaincode) mark_overdue(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args (optional)
+	//				0               1       ...
+	//			123443232       123443233
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	invoiceIds := args
+	if len(invoiceIds) == 0 {
+		invoiceIds, err = t.get_invoice_ids(stub, ISSUED, FINANCE_OFFERED, APPROVED, REJECTED, OVERDUE)
+		if err != nil { return shim.Error(err.Error()) }
+	}
+
+	marked := []string{}
+	summaries := []Invoice_Summary{}
+	for _, invoiceId := range invoiceIds {
+
+		inv, err := t.retrieve_invoice(stub, invoiceId)
+		if err != nil { return shim.Error(err.Error()) }
+
+		if t.days_past_due(inv, now) <= 0 { continue }
+
+		changed := t.overdue_installments(&inv, now)
+		if inv.Status != OVERDUE && t.transition(&inv, OVERDUE) == nil { changed = true }	// Paid and cancelled invoices are never overdue
+		if !changed { continue }
+
+		_, err = t.save_changes(stub, inv)
+		if err != nil { fmt.Printf("MARK_OVERDUE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+		marked = append(marked, inv.InvoiceId)
+		summaries = append(summaries, t.summary(inv, now))
+	}
+
+	if len(marked) > 0 {
+		err = t.emit_event(stub, Invoice_Event{Event: EVENT_OVERDUE, InvoiceIds: marked, Summaries: summaries})
+		if err != nil { return shim.Error(err.Error()) }
+	}
+
+	bytes, _ := json.Marshal(marked)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 run_reminders - Emits a reminder listing every unpaid invoice due in the given number of days, one of
+//					 REMINDER_DAYS, for a scheduler to invoke daily with each. An invoice is only reminded once per
+//					 due date and reminder. Returns the IDs of the invoices reminded.
+//=================================================================================================================================
+func (t *SimpleChaincode) run_reminders(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//				7
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	days, err := strconv.Atoi(args[0])
+	event, ok := REMINDER_DAYS[days]
+	if err != nil || !ok { return shim.Error("1st argument must be the days before the due date to remind of, 7 or 1") }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	today := now.Truncate(24 * time.Hour)
+
+	invoiceIds, err := t.get_invoice_ids(stub, ISSUED, FINANCE_OFFERED, APPROVED, REJECTED)
+	if err != nil { return shim.Error(err.Error()) }
+
+	reminded := []string{}
+	summaries := []Invoice_Summary{}
+	for _, invoiceId := range invoiceIds {
+
+		inv, err := t.retrieve_invoice(stub, invoiceId)
+		if err != nil { return shim.Error(err.Error()) }
+
+		dueDate, err := time.Parse(DATE_FORMAT, t.due_date(inv))
+		if err != nil || int(dueDate.Sub(today).Hours() / 24) != days { continue }
+
+		key, err := stub.CreateCompositeKey(REMINDER_PREFIX, []string{inv.InvoiceId, t.due_date(inv), args[0]})
+		if err != nil { return shim.Error("Error building reminder key") }
+
+		sent, err := stub.GetState(key)
+		if err != nil { return shim.Error("Error retrieving reminder") }
+		if sent != nil { continue }
+
+		err = stub.PutState(key, []byte(now.Format(time.RFC3339)))
+		if err != nil { return shim.Error("Error storing reminder") }
+
+		reminded = append(reminded, inv.InvoiceId)
+		summaries = append(summaries, t.summary(inv, now))
+	}
+
+	if len(reminded) > 0 {
+		err = t.emit_event(stub, Invoice_Event{Event: event, InvoiceIds: reminded, Summaries: summaries})
+		if err != nil { return shim.Error(err.Error()) }
+	}
+
+	bytes, _ := json.Marshal(reminded)
+	return shim.Success(bytes)
+}
+
+//	The public figures of an invoice that treasury systems act on, without its terms
+func (t *SimpleChaincode) summary(inv Invoice, now time.Time) Invoice_Summary {
+
+	summary := Invoice_Summary{InvoiceId: inv.InvoiceId, ExternalNumber: inv.ExternalNumber, Seller: inv.Seller, Buyer: inv.Buyer, Financier: inv.Financier, Amount: inv.Amount, Outstanding: inv.Outstanding, Currency: inv.Currency, DueDate: t.due_date(inv), Status: inv.Status, DaysPastDue: t.days_past_due(inv, now)}
+	if outstanding, err := t.outstanding_balance(inv); err == nil { summary.Outstanding = t.format_amount(inv.Currency, outstanding) }
+	if summary.Currency == "" { summary.Currency = DEFAULT_CURRENCY }
+
+	return summary
+}
+
+//=================================================================================================================================
+//	 get_overdue_invoices - The caller's overdue invoices grouped into aging buckets by days past due, with the
+//							outstanding total of each bucket.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_overdue_invoices(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	invoices, err := t.get_owner_invoices(stub, username)
+	if err != nil { return shim.Error(err.Error()) }
+
+	buckets := make([]Aging_Bucket, len(AGING_BUCKETS))
+	totals := make([]int64, len(AGING_BUCKETS))
+	for i, bucket := range AGING_BUCKETS {
+		buckets[i] = Aging_Bucket{Bucket: bucket.Name, Invoices: []Invoice{}}
+	}
+
+	for _, inv := range invoices {
+
+		if inv.Status == PAID || inv.Status == SETTLED || inv.Status == CANCELLED || inv.Status == VOID { continue }
+
+		days := t.days_past_due(inv, now)
+		if days <= 0 { continue }
+
+		outstanding, err := t.outstanding_balance(inv)
+		if err != nil { return shim.Error(err.Error()) }
+
+		for i, bucket := range AGING_BUCKETS {
+			if bucket.MaxDays < 0 || days <= bucket.MaxDays {
+				nominal, err := t.nominal_amount(stub, inv.Currency, outstanding)
+				if err != nil { return shim.Error(err.Error()) }
+
+				buckets[i].Invoices = append(buckets[i].Invoices, t.visible_terms(inv, username, ""))
+				totals[i], err = money.AddUnits(totals[i], nominal)
+				if err != nil { return shim.Error("The outstanding total of bucket " + bucket.Name + " is too large") }
+				break
+			}
+		}
+	}
+
+	for i := range buckets {
+		buckets[i].Outstanding = t.format_amount(DEFAULT_CURRENCY, totals[i])
+	}
+
+	bytes, _ := json.Marshal(buckets)
+	return shim.Success(bytes)
+}
+
+//	Whole days between the due date and now; zero or less when the invoice is not yet due or has no due date
+func (t *SimpleChaincode) days_past_due(inv Invoice, now time.Time) int {
+
+	dueDate, err := time.Parse(DATE_FORMAT, t.due_date(inv))
+	if err != nil { return 0 }
+
+	return int(now.Sub(dueDate).Hours() / 24)
+}
+
+//	The due date of an invoice or, under an agreed repayment schedule, of its earliest unpaid installment
+func (t *SimpleChaincode) due_date(inv Invoice) string {
+
+	if inv.Schedule != nil && inv.Schedule.Status == SCHEDULE_AGREED {
+		for _, installment := range inv.Schedule.Installments {
+			if installment.Status != INSTALLMENT_PAID { return installment.DueDate }
+		}
+	}
+	return inv.DueDate
+}
+
+//=================================================================================================================================
+//	 Late Fee Functions
+//=================================================================================================================================
+//	 set_late_fee_policy - An admin sets the late fee policy, or removes it when the basis is empty.
+//=================================================================================================================================
+func (t *SimpleChaincode) set_late_fee_policy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0           1           2
+	//			  daily      0.0005         5
+
+	if len(args) != 1 && len(args) != 3 { return shim.Error("Incorrect number of arguments. Expecting 1 or 3") }
+
+	if !t.is_admin(stub) { return t.fail(ERR_PERMISSION, "Permission Denied. set_late_fee_policy. Caller is not an admin", "function", "set_late_fee_policy") }
+
+	key, err := stub.CreateCompositeKey(LATE_FEE_POLICY, []string{})
+	if err != nil { return shim.Error("Error building late fee policy key") }
+
+	if args[0] == "" {
+		err = stub.DelState(key)
+		if err != nil { return shim.Error("Error removing late fee policy") }
+		return shim.Success(nil)
+	}
+
+	if len(args) != 3 { return shim.Error("Incorrect number of arguments. Expecting a basis, a rate and grace days") }
+	if args[0] != LATE_FEE_DAILY && args[0] != LATE_FEE_MONTHLY { return shim.Error(fmt.Sprintf("1st argument must be %v or %v", LATE_FEE_DAILY, LATE_FEE_MONTHLY)) }
+
+	rate, err := money.ParseDecimal(args[1])
+	if err != nil || rate.Sign() <= 0 || rate.Cmp(big.NewRat(1, 1)) >= 0 { return shim.Error("2nd argument must be a rate between 0 and 1") }
+
+	graceDays, err := strconv.Atoi(args[2])
+	if err != nil || graceDays < 0 { return shim.Error("3rd argument must be a non-negative number of days") }
+
+	identity, err := t.get_identity(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	policy := Late_Fee_Policy{Basis: args[0], Rate: args[1], GraceDays: graceDays, UpdatedBy: identity.Id}
+
+	bytes, _ := json.Marshal(policy)
+	err = stub.PutState(key, bytes)
+	if err != nil { return shim.Error("Error storing late fee policy") }
+
+	return shim.Success(bytes)
+}
+
+func (t *SimpleChaincode) retrieve_late_fee_policy(stub shim.ChaincodeStubInterface) (*Late_Fee_Policy, error) {
+
+	key, err := stub.CreateCompositeKey(LATE_FEE_POLICY, []string{})
+	if err != nil { return nil, errors.New("Error building late fee policy key") }
+
+	bytes, err := stub.GetState(key)
+	if err != nil { return nil, errors.New("Error retrieving late fee policy") }
+	if bytes == nil { return nil, nil }
+
+	var policy Late_Fee_Policy
+	err = json.Unmarshal(bytes, &policy)
+	if err != nil { return nil, errors.New("Corrupt late fee policy") }
+
+	return &policy, nil
+}
+
+//=================================================================================================================================
+//	 accrue_late_fees - Charges every overdue invoice, or only the invoices passed as arguments, the late fees for the
+//						whole periods since its last accrual, or since its due date plus the grace days. Each accrual
+//						is added to the outstanding balance and recorded as a fee line. Returns the IDs of the
+//						invoices charged.
+//=================================================================================================================================
+func (t *SimpleChaincode) accrue_late_fees(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args (optional)
+	//				0               1       ...
+	//			123443232       123443233
+
+	policy, err := t.retrieve_late_fee_policy(stub)
+	if err != nil { return shim.Error(err.Error()) }
+	if policy == nil { return shim.Error("No late fee policy is set") }
+
+	rate, err := money.ParseDecimal(policy.Rate)
+	if err != nil { return shim.Error("Corrupt late fee policy rate " + policy.Rate) }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+	today := now.Truncate(24 * time.Hour)
+
+	invoiceIds := args
+	if len(invoiceIds) == 0 {
+		invoiceIds, err = t.get_invoice_ids(stub, OVERDUE)
+		if err != nil { return shim.Error(err.Error()) }
+	}
+
+	charged := []string{}
+	for _, invoiceId := range invoiceIds {
+
+		inv, err := t.retrieve_invoice(stub, invoiceId)
+		if err != nil { return shim.Error(err.Error()) }
+
+		if inv.Status != OVERDUE { continue }
+
+		dueDate, err := time.Parse(DATE_FORMAT, inv.DueDate)
+		if err != nil { continue }
+
+		from := dueDate.AddDate(0, 0, policy.GraceDays)
+		if len(inv.Fees) > 0 {
+			from, err = time.Parse(DATE_FORMAT, inv.Fees[len(inv.Fees) - 1].To)
+			if err != nil { return shim.Error("Invoice " + inv.InvoiceId + " has a corrupt fee line") }
+		}
+
+		periods, to := 0, from
+		if policy.Basis == LATE_FEE_DAILY {
+			periods = int(today.Sub(from).Hours() / 24)
+			to = from.AddDate(0, 0, periods)
+		} else {
+			for !from.AddDate(0, periods + 1, 0).After(today) { periods++ }
+			to = from.AddDate(0, periods, 0)
+		}
+		if periods <= 0 { continue }
+
+		outstanding, err := t.outstanding_balance(inv)
+		if err != nil { return shim.Error(err.Error()) }
+
+		fee, err := money.ScaleUnits(outstanding, rate, big.NewRat(int64(periods), 1))
+		if err != nil { return shim.Error(err.Error()) }
+		if fee <= 0 { continue }
+
+		newOutstanding, err := money.AddUnits(outstanding, fee)
+		if err != nil { return shim.Error(err.Error()) }
+
+		inv.Fees = append(inv.Fees, Late_Fee{Amount: t.format_amount(inv.Currency, fee), Basis: policy.Basis, Rate: policy.Rate, Periods: periods, From: from.Format(DATE_FORMAT), To: to.Format(DATE_FORMAT), TxId: stub.GetTxID()})
+		inv.Outstanding = t.format_amount(inv.Currency, newOutstanding)
+
+		_, err = t.save_changes(stub, inv)
+		if err != nil { fmt.Printf("ACCRUE_LATE_FEES: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+		charged = append(charged, inv.InvoiceId)
+	}
+
+	if len(charged) > 0 {
+		err = t.emit_event(stub, Invoice_Event{Event: EVENT_FEES_ACCRUED, InvoiceIds: charged})
+		if err != nil { return shim.Error(err.Error()) }
+	}
+
+	bytes, _ := json.Marshal(charged)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 Platform Fee Functions
+//=================================================================================================================================
+//	 set_fee_schedule - An admin sets the platform fee schedule, or removes it when the basis points are empty.
+//=================================================================================================================================
+func (t *SimpleChaincode) set_fee_schedule(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0          1            2
+	//			   25        10.00     platform_ops
+
+	if len(args) != 1 && len(args) != 3 { return shim.Error("Incorrect number of arguments. Expecting 1 or 3") }
+
+	if !t.is_admin(stub) { return t.fail(ERR_PERMISSION, "Permission Denied. set_fee_schedule. Caller is not an admin", "function", "set_fee_schedule") }
+
+	key, err := stub.CreateCompositeKey(FEE_SCHEDULE, []string{})
+	if err != nil { return shim.Error("Error building fee schedule key") }
+
+	if args[0] == "" {
+		err = stub.DelState(key)
+		if err != nil { return shim.Error("Error removing fee schedule") }
+		return shim.Success(nil)
+	}
+
+	if len(args) != 3 { return shim.Error("Incorrect number of arguments. Expecting basis points, a minimum fee and a fee account") }
+
+	feeBps, err := strconv.Atoi(args[0])
+	if err != nil || feeBps < 0 || feeBps > BPS_PER_UNIT { return shim.Error(fmt.Sprintf("1st argument must be basis points from 0 to %d", BPS_PER_UNIT)) }
+
+	minimumFee, err := money.ParseDecimal(args[1])
+	if err != nil || minimumFee.Sign() < 0 { return shim.Error("2nd argument must be a non-negative amount") }
+
+	if args[2] == "" { return shim.Error("3rd argument must be the fee account") }
+
+	identity, err := t.get_identity(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	schedule := Fee_Schedule{FeeBps: feeBps, MinimumFee: strings.TrimSpace(args[1]), FeeAccount: args[2], UpdatedBy: identity.Id}
+
+	bytes, _ := json.Marshal(schedule)
+	err = stub.PutState(key, bytes)
+	if err != nil { return shim.Error("Error storing fee schedule") }
+
+	return shim.Success(bytes)
+}
+
+func (t *SimpleChaincode) retrieve_fee_schedule(stub shim.ChaincodeStubInterface) (*Fee_Schedule, error) {
+
+	key, err := stub.CreateCompositeKey(FEE_SCHEDULE, []string{})
+	if err != nil { return nil, errors.New("Error building fee schedule key") }
+
+	bytes, err := stub.GetState(key)
+	if err != nil { return nil, errors.New("Error retrieving fee schedule") }
+	if bytes == nil { return nil, nil }
+
+	var schedule Fee_Schedule
+	err = json.Unmarshal(bytes, &schedule)
+	if err != nil { return nil, errors.New("Corrupt fee schedule") }
+
+	return &schedule, nil
+}
+
+//	Charges every financier of an invoice whose financing the buyer approved, on the face amount of its share
+func (t *SimpleChaincode) charge_financing_fees(stub shim.ChaincodeStubInterface, inv Invoice) error {
+
+	if len(inv.Tranches) == 0 {
+		faceAmount, err := t.parse_amount(inv.Currency, inv.Amount)
+		if err != nil { return errors.New("Invoice " + inv.InvoiceId + " has an invalid amount " + inv.Amount) }
+		return t.charge_fee(stub, inv, inv.Financier, FEE_FINANCING, faceAmount)
+	}
+
+	for _, tranche := range inv.Tranches {
+		trancheFace, err := t.parse_amount(inv.Currency, tranche.FaceAmount)
+		if err != nil { return errors.New("Invoice " + inv.InvoiceId + " has an invalid tranche face amount") }
+
+		err = t.charge_fee(stub, inv, tranche.Financier, FEE_FINANCING, trancheFace)
+		if err != nil { return err }
+	}
+	return nil
+}
+
+//	Records the platform fee on an amount under the current fee schedule, nothing when there is none
+func (t *SimpleChaincode) charge_fee(stub shim.ChaincodeStubInterface, inv Invoice, payer string, basis string, baseAmount int64) error {
+
+	schedule, err := t.retrieve_fee_schedule(stub)
+	if err != nil { return err }
+	if schedule == nil { return nil }
+
+	currency := inv.Currency
+	if currency == "" { currency = DEFAULT_CURRENCY }
+
+	minimumFee, _ := money.RoundUnits(schedule.MinimumFee, money.Decimals(currency))		// The minimum is a plain number in every currency
+	amount := baseAmount * int64(schedule.FeeBps) / BPS_PER_UNIT
+	if amount < minimumFee { amount = minimumFee }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return err }
+
+	fee := Platform_Fee{InvoiceId: inv.InvoiceId, Payer: payer, FeeAccount: schedule.FeeAccount, Basis: basis, BaseAmount: t.format_amount(currency, baseAmount), FeeBps: schedule.FeeBps, Amount: t.format_amount(currency, amount), Currency: currency, ChargedAt: now.Format(time.RFC3339), TxId: stub.GetTxID()}
+
+	key, err := stub.CreateCompositeKey(FEE_PREFIX, []string{inv.InvoiceId, fee.TxId, payer})
+	if err != nil { return errors.New("Error building platform fee key") }
+
+	bytes, _ := json.Marshal(fee)
+	err = stub.PutState(key, bytes)
+	if err != nil { return errors.New("Error storing platform fee") }
+
+	return nil
+}
+
+//=================================================================================================================================
+//	 get_platform_fees - The platform fees charged, for admins to invoice participants from. Optionally only those of
+//						 one payer, or of one invoice.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_platform_fees(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args (optional)
+	//				0               1
+	//			test_user3      123443232
+
+	if len(args) > 2 { return shim.Error("Incorrect number of arguments. Expecting at most 2") }
+
+	if !t.is_admin(stub) { return t.fail(ERR_PERMISSION, "Permission Denied. get_platform_fees. Caller is not an admin", "function", "get_platform_fees") }
+
+	payer, invoiceId := "", ""
+	if len(args) > 0 { payer = args[0] }
+	if len(args) > 1 { invoiceId = args[1] }
+
+	keys := []string{}
+	if invoiceId != "" { keys = append(keys, invoiceId) }
+
+	iter, err := stub.GetStateByPartialCompositeKey(FEE_PREFIX, keys)
+	if err != nil { return shim.Error("Unable to query platform fees") }
+	defer iter.Close()
+
+	fees := []Platform_Fee{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil { return shim.Error("Unable to read platform fees") }
+
+		var fee Platform_Fee
+		err = json.Unmarshal(kv.Value, &fee)
+		if err != nil { return shim.Error("Corrupt platform fee " + string(kv.Value)) }
+
+		if payer != "" && fee.Payer != payer { continue }
+		fees = append(fees, fee)
+	}
+
+	bytes, _ := json.Marshal(fees)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 Intercompany Functions
+//=================================================================================================================================
+//	 set_intercompany_route - An admin marks a seller and buyer as companies of the same group by naming the account
+//							  of the intercompany chaincode their invoices are posted to once approved. An empty
+//							  account removes the route.
+//=================================================================================================================================
+func (t *SimpleChaincode) set_intercompany_route(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0              1              2                 3 (optional)
+	//			test_user1     test_user2      IC-1001-2002      intercompany
+
+	if len(args) != 3 && len(args) != 4 { return shim.Error("Incorrect number of arguments. Expecting 3 or 4") }
+
+	if !t.is_admin(stub) { return t.fail(ERR_PERMISSION, "Permission Denied. set_intercompany_route. Caller is not an admin", "function", "set_intercompany_route") }
+
+	if args[0] == "" || args[1] == "" { return shim.Error("Seller and buyer must be non-empty strings") }
+	if args[0] == args[1] { return shim.Error("Seller and buyer must be different companies") }
+
+	key, err := stub.CreateCompositeKey(INTERCOMPANY_PREFIX, []string{args[0], args[1]})
+	if err != nil { return shim.Error("Error building intercompany route key") }
+
+	if args[2] == "" {
+		err = stub.DelState(key)
+		if err != nil { return shim.Error("Error removing intercompany route") }
+		return shim.Success(nil)
+	}
+
+	identity, err := t.get_identity(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	route := Intercompany_Route{Seller: args[0], Buyer: args[1], AccountNo: args[2], Chaincode: INTERCOMPANY_CHAINCODE, UpdatedBy: identity.Id}
+	if len(args) == 4 && args[3] != "" { route.Chaincode = args[3] }
+
+	bytes, _ := json.Marshal(route)
+	err = stub.PutState(key, bytes)
+	if err != nil { return shim.Error("Error storing intercompany route") }
+
+	return shim.Success(bytes)
+}
+
+func (t *SimpleChaincode) retrieve_intercompany_route(stub shim.ChaincodeStubInterface, seller string, buyer string) (*Intercompany_Route, error) {
+
+	key, err := stub.CreateCompositeKey(INTERCOMPANY_PREFIX, []string{seller, buyer})
+	if err != nil { return nil, errors.New("Error building intercompany route key") }
+
+	bytes, err := stub.GetState(key)
+	if err != nil { return nil, errors.New("Error retrieving intercompany route") }
+	if bytes == nil { return nil, nil }
+
+	var route Intercompany_Route
+	err = json.Unmarshal(bytes, &route)
+	if err != nil { return nil, errors.New("Corrupt intercompany route for " + seller + " and " + buyer) }
+
+	return &route, nil
+}
+
+//	Posts an approved intercompany invoice to the intercompany chaincode and keeps its journal reference on the
+//	invoice. Nothing is posted between companies that have no route, and a failed posting fails the approval.
+func (t *SimpleChaincode) post_intercompany(stub shim.ChaincodeStubInterface, inv *Invoice) error {
+
+	route, err := t.retrieve_intercompany_route(stub, inv.Seller, inv.Buyer)
+	if err != nil { return err }
+	if route == nil || inv.Intercompany != nil { return nil }
+
+	references := []string{inv.InvoiceId}
+	if inv.ExternalNumber != "" { references = append(references, inv.ExternalNumber) }
+	referenceBytes, _ := json.Marshal(references)
+
+	response := stub.InvokeChaincode(route.Chaincode, [][]byte{[]byte("transaction_activity"), []byte(route.AccountNo), []byte(inv.Amount), referenceBytes}, "")
+	if response.Status != shim.OK {
+		return fmt.Errorf("Posting invoice %v to intercompany account %v failed: %v", inv.InvoiceId, route.AccountNo, response.Message)
+	}
+
+	var posting struct {
+		Status           string `json:"status"`
+		Transaction      *struct{ TransactionId string `json:"transactionId"` } `json:"transaction"`
+		PendingPosting   *struct{ PostingId string `json:"postingId"` } `json:"pendingPosting"`
+		ErrorQueueEntry  *struct{ EntryId string `json:"entryId"` } `json:"errorQueueEntry"`
+	}
+	err = json.Unmarshal(response.Payload, &posting)
+	if err != nil { return errors.New("Unreadable response from the intercompany chaincode " + string(response.Payload)) }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return err }
+
+	inv.Intercompany = &Intercompany_Posting{Chaincode: route.Chaincode, AccountNo: route.AccountNo, Status: posting.Status, PostedAt: now.Format(time.RFC3339)}
+	if posting.Transaction != nil { inv.Intercompany.JournalRef = posting.Transaction.TransactionId }
+	if posting.PendingPosting != nil { inv.Intercompany.JournalRef = posting.PendingPosting.PostingId }
+	if posting.ErrorQueueEntry != nil { inv.Intercompany.JournalRef = posting.ErrorQueueEntry.EntryId }
+
+	return nil
+}
+
+//=================================================================================================================================
+//	 Delivery Functions
+//=================================================================================================================================
+//	 confirm_delivery - The buyer attests that the goods or services were received, optionally anchoring the SHA-256
+//						hash of a delivery note or receipt.
+//=================================================================================================================================
+func (t *SimpleChaincode) confirm_delivery(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0               1 (optional)
+	//			123443232        <sha256 hex>
+
+	if len(args) != 1 && len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting 1 or 2") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if  username != inv.Buyer {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. confirm_delivery. %v !== %v", username, inv.Buyer), "function", "confirm_delivery", "actual", username, "expected", inv.Buyer)
+	}
+
+	if inv.Status == CANCELLED || inv.Status == VOID || inv.Status == PAID || inv.Status == SETTLED {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v cannot be confirmed while %v", inv.InvoiceId, inv.Status), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+	if inv.Delivery != nil { return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v delivery was already confirmed", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+
+	documentHash := ""
+	if len(args) == 2 && args[1] != "" {
+		documentHash, err = t.check_document_hash(args[1])
+		if err != nil { return shim.Error("2nd argument must be a hex SHA-256 document hash") }
+	}
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv.Delivery = &Delivery_Confirmation{ConfirmedBy: username, ConfirmedAt: now.Format(time.RFC3339), DocumentHash: documentHash}
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("CONFIRM_DELIVERY: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_DELIVERY, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(t.visible_terms(inv, username, ""))
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 Three-Way Match Functions
+//=================================================================================================================================
+//	 create_purchase_order - The buyer records a purchase order placed with a seller. Unit prices are before tax.
+//=================================================================================================================================
+func (t *SimpleChaincode) create_purchase_order(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0              1                                     2                                          3 (optional)
+	//			PO-7781       test_user0       [{"description":"Widgets","quantity":4,"unitprice":"20.00"}]           EUR
+
+	if len(args) != 3 && len(args) != 4 { return shim.Error("Incorrect number of arguments. Expecting 3 or 4") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	role, err := t.get_role(stub)
+	if 	role != BUYER {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. create_purchase_order. %v !== %v", role, BUYER), "function", "create_purchase_order", "actual", role, "expected", BUYER)
+	}
+
+	if args[0] == "" || args[1] == "" { return shim.Error("PO number and seller must be non-empty strings") }
+
+	order := Purchase_Order{PONumber: args[0], Buyer: username, Seller: args[1], Currency: DEFAULT_CURRENCY, TxId: stub.GetTxID()}
+
+	err = json.Unmarshal([]byte(args[2]), &order.Lines)
+	if err != nil || len(order.Lines) == 0 { return shim.Error("3rd argument must be a non-empty JSON array of order lines") }
+
+	if len(args) == 4 && args[3] != "" {
+		err = t.check_currency(stub, args[3])
+		if err != nil { return shim.Error(err.Error()) }
+		order.Currency = args[3]
+	}
+
+	for i, line := range order.Lines {
+		if line.Description == "" || line.Quantity <= 0 { return shim.Error(fmt.Sprintf("Order line %d needs a description and a positive quantity", i + 1)) }
+
+		unitPrice, err := t.parse_amount(order.Currency, line.UnitPrice)
+		if err != nil || unitPrice < 0 { return shim.Error(fmt.Sprintf("Order line %d has an invalid unit price %s", i + 1, line.UnitPrice)) }
+		order.Lines[i].UnitPrice = t.format_amount(order.Currency, unitPrice)
+	}
+
+	existing, err := t.retrieve_purchase_order(stub, username, order.PONumber)
+	if err != nil { return shim.Error(err.Error()) }
+	if existing != nil { return t.fail(ERR_DUPLICATE, "Purchase order " + order.PONumber + " already exists", "ponumber", order.PONumber) }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+	order.CreatedAt = now.Format(time.RFC3339)
+
+	key, err := stub.CreateCompositeKey(PURCHASE_ORDER_PREFIX, []string{username, order.PONumber})
+	if err != nil { return shim.Error("Error building purchase order key") }
+
+	bytes, _ := json.Marshal(order)
+	err = stub.PutState(key, bytes)
+	if err != nil { return shim.Error("Error storing purchase order") }
+
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 create_goods_receipt - The buyer records goods received against one of its purchase orders. A purchase order can
+//							be received in several deliveries, each with its own receipt.
+//=================================================================================================================================
+func (t *SimpleChaincode) create_goods_receipt(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0              1                             2
+	//			PO-7781        GR-0001       [{"description":"Widgets","quantity":4}]
+
+	if len(args) != 3 { return shim.Error("Incorrect number of arguments. Expecting 3") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	role, err := t.get_role(stub)
+	if 	role != BUYER {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. create_goods_receipt. %v !== %v", role, BUYER), "function", "create_goods_receipt", "actual", role, "expected", BUYER)
+	}
+
+	order, err := t.retrieve_purchase_order(stub, username, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+	if order == nil { return t.fail(ERR_NOT_FOUND, "Purchase order " + args[0] + " not found", "ponumber", args[0]) }
+
+	if args[1] == "" { return shim.Error("Receipt ID must be a non-empty string") }
+
+	receipt := Goods_Receipt{ReceiptId: args[1], PONumber: order.PONumber, Buyer: username, TxId: stub.GetTxID()}
+
+	err = json.Unmarshal([]byte(args[2]), &receipt.Lines)
+	if err != nil || len(receipt.Lines) == 0 { return shim.Error("3rd argument must be a non-empty JSON array of receipt lines") }
+
+	for i, line := range receipt.Lines {
+		if line.Quantity <= 0 { return shim.Error(fmt.Sprintf("Receipt line %d needs a positive quantity", i + 1)) }
+		if t.order_line(*order, line.Description) == nil {
+			return shim.Error(fmt.Sprintf("Receipt line %d, %v, is not on purchase order %v", i + 1, line.Description, order.PONumber))
+		}
+	}
+
+	key, err := stub.CreateCompositeKey(GOODS_RECEIPT_PREFIX, []string{username, order.PONumber, receipt.ReceiptId})
+	if err != nil { return shim.Error("Error building goods receipt key") }
+
+	existing, err := stub.GetState(key)
+	if err != nil { return shim.Error("Error retrieving goods receipt") }
+	if existing != nil { return t.fail(ERR_DUPLICATE, "Goods receipt " + receipt.ReceiptId + " already exists", "ponumber", order.PONumber, "receiptid", receipt.ReceiptId) }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+	receipt.ReceivedAt = now.Format(time.RFC3339)
+
+	bytes, _ := json.Marshal(receipt)
+	err = stub.PutState(key, bytes)
+	if err != nil { return shim.Error("Error storing goods receipt") }
+
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 match_invoice - The seller or buyer matches an invoice against its purchase order and the goods received so far.
+//					 Each invoice line must be on the order at no more than the ordered unit price, and no more may be
+//					 invoiced of an item than was ordered or received. Any exceptions are recorded for the buyer to
+//					 review with accept_match; the invoice can be matched again once more goods are received.
+//=================================================================================================================================
+func (t *SimpleChaincode) match_invoice(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			123443232
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if  username != inv.Seller && username != inv.Buyer {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. match_invoice. %v is not a party to invoice %v", username, inv.InvoiceId), "function", "match_invoice", "actual", username, "invoiceid", inv.InvoiceId)
+	}
+
+	if inv.Status != ISSUED && inv.Status != REJECTED && inv.Status != PAYABLE_PENDING {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v cannot be matched while %v", inv.InvoiceId, inv.Status), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+	if inv.PONumber == "" { return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v has no purchase order to match against", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+
+	order, err := t.retrieve_purchase_order(stub, inv.Buyer, inv.PONumber)
+	if err != nil { return shim.Error(err.Error()) }
+	if order == nil { return t.fail(ERR_NOT_FOUND, "Purchase order " + inv.PONumber + " not found", "ponumber", inv.PONumber) }
+
+	receipts, err := t.retrieve_goods_receipts(stub, inv.Buyer, inv.PONumber)
+	if err != nil { return shim.Error(err.Error()) }
+
+	received := map[string]int64{}
+	for _, receipt := range receipts {
+		for _, line := range receipt.Lines { received[line.Description] += line.Quantity }
+	}
+
+	exceptions := []Match_Exception{}
+
+	if order.Seller != inv.Seller {
+		exceptions = append(exceptions, Match_Exception{Reason: fmt.Sprintf("Purchase order %v was placed with %v", order.PONumber, order.Seller)})
+	}
+
+	currency := inv.Currency
+	if currency == "" { currency = DEFAULT_CURRENCY }
+	if order.Currency != currency {
+		exceptions = append(exceptions, Match_Exception{Reason: fmt.Sprintf("Invoice is in %v, purchase order %v is in %v", currency, order.PONumber, order.Currency)})
+	}
+
+	if len(inv.LineItems) == 0 {
+		exceptions = append(exceptions, Match_Exception{Reason: "Invoice has no line items to match"})
+	}
+
+	invoiced := map[string]int64{}
+	for i, item := range inv.LineItems {
+		line := t.order_line(*order, item.Description)
+		if line == nil {
+			exceptions = append(exceptions, Match_Exception{Line: i + 1, Description: item.Description, Reason: "Not on the purchase order"})
+			continue
+		}
+
+		unitPrice, _ := t.parse_amount(currency, item.UnitPrice)
+		orderPrice, _ := t.parse_amount(order.Currency, line.UnitPrice)
+		if unitPrice > orderPrice {
+			exceptions = append(exceptions, Match_Exception{Line: i + 1, Description: item.Description, Reason: fmt.Sprintf("Unit price %v is above the ordered %v", item.UnitPrice, line.UnitPrice)})
+		}
+
+		invoiced[item.Description] += item.Quantity
+		if invoiced[item.Description] > line.Quantity {
+			exceptions = append(exceptions, Match_Exception{Line: i + 1, Description: item.Description, Reason: fmt.Sprintf("Quantity invoiced %d is above the %d ordered", invoiced[item.Description], line.Quantity)})
+		} else if invoiced[item.Description] > received[item.Description] {
+			exceptions = append(exceptions, Match_Exception{Line: i + 1, Description: item.Description, Reason: fmt.Sprintf("Quantity invoiced %d is above the %d received", invoiced[item.Description], received[item.Description])})
+		}
+	}
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv.Match = &Invoice_Match{Status: MATCH_MATCHED, MatchedBy: username, MatchedAt: now.Format(time.RFC3339), TxId: stub.GetTxID()}
+	if len(exceptions) > 0 {
+		inv.Match.Status = MATCH_EXCEPTIONS
+		inv.Match.Exceptions = exceptions
+	}
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("MATCH_INVOICE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_MATCHED, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(t.visible_terms(inv, username, ""))
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 accept_match - The buyer reviews the exceptions of a match and accepts the invoice as it is.
+//=================================================================================================================================
+func (t *SimpleChaincode) accept_match(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			123443232
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if  username != inv.Buyer {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. accept_match. %v !== %v", username, inv.Buyer), "function", "accept_match", "actual", username, "expected", inv.Buyer)
+	}
+
+	if inv.Match == nil || inv.Match.Status != MATCH_EXCEPTIONS {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v has no match exceptions to accept", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+
+	inv.Match.Status = MATCH_ACCEPTED
+	inv.Match.AcceptedBy = username
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("ACCEPT_MATCH: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_MATCHED, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(t.visible_terms(inv, username, ""))
+	return shim.Success(bytes)
+}
+
+//	A buyer's purchase order, nil when it is not on the ledger
+func (t *SimpleChaincode) retrieve_purchase_order(stub shim.ChaincodeStubInterface, buyer string, poNumber string) (*Purchase_Order, error) {
+
+	key, err := stub.CreateCompositeKey(PURCHASE_ORDER_PREFIX, []string{buyer, poNumber})
+	if err != nil { return nil, errors.New("Error building purchase order key") }
+
+	bytes, err := stub.GetState(key)
+	if err != nil { return nil, errors.New("Error retrieving purchase order " + poNumber) }
+	if bytes == nil { return nil, nil }
+
+	var order Purchase_Order
+	err = json.Unmarshal(bytes, &order)
+	if err != nil { return nil, errors.New("Corrupt purchase order record " + string(bytes)) }
+
+	return &order, nil
+}
+
+func (t *SimpleChaincode) retrieve_goods_receipts(stub shim.ChaincodeStubInterface, buyer string, poNumber string) ([]Goods_Receipt, error) {
+
+	iter, err := stub.GetStateByPartialCompositeKey(GOODS_RECEIPT_PREFIX, []string{buyer, poNumber})
+	if err != nil { return nil, errors.New("Unable to query the goods receipts of " + poNumber) }
+	defer iter.Close()
+
+	receipts := []Goods_Receipt{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil { return nil, errors.New("Unable to read the goods receipts of " + poNumber) }
+
+		var receipt Goods_Receipt
+		err = json.Unmarshal(kv.Value, &receipt)
+		if err != nil { return nil, errors.New("Corrupt goods receipt record " + string(kv.Value)) }
+
+		receipts = append(receipts, receipt)
+	}
+	return receipts, nil
+}
+
+//	The purchase order line for an item, matched on its description
+func (t *SimpleChaincode) order_line(order Purchase_Order, description string) *Order_Line {
+
+	for i := range order.Lines {
+		if order.Lines[i].Description == description { return &order.Lines[i] }
+	}
+	return nil
+}
+
+//=================================================================================================================================
+//	 check_financeable - Financiers can only finance an invoice whose delivery the buyer confirmed and which, when its
+//						 purchase order is on the ledger, passed the three-way match or had its exceptions accepted.
+//=================================================================================================================================
+func (t *SimpleChaincode) check_financeable(stub shim.ChaincodeStubInterface, inv Invoice) error {
+
+	if inv.Delivery == nil { return t.coded(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v has no delivery confirmation from the buyer", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+	if inv.PONumber == "" { return nil }
+
+	order, err := t.retrieve_purchase_order(stub, inv.Buyer, inv.PONumber)
+	if err != nil { return err }
+	if order == nil { return nil }
+
+	if inv.Match == nil || inv.Match.Status == MATCH_EXCEPTIONS {
+		return t.coded(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v has not passed the three-way match against %v", inv.InvoiceId, inv.PONumber), "invoiceid", inv.InvoiceId, "status", inv.Status, "ponumber", inv.PONumber)
+	}
+	return nil
+}
+
+//=================================================================================================================================
+//	 Guarantee Functions
+//=================================================================================================================================
+//	 attach_guarantee - A guarantor records a guarantee or credit insurance policy against an open invoice. Until it is
+//						drawn, the guarantor can replace its own guarantee, and another guarantor can once it expired.
+//=================================================================================================================================
+func (t *SimpleChaincode) attach_guarantee(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0              1             2                  3                          4 (optional)
+	//			123443232        90.00      <sha256 hex>    2017-12-31T00:00:00Z              insurance
+
+	if len(args) != 4 && len(args) != 5 { return shim.Error("Incorrect number of arguments. Expecting 4 or 5") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	role, err := t.get_role(stub)
+	if 	role != GUARANTOR {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. attach_guarantee. %v !== %v", role, GUARANTOR), "function", "attach_guarantee", "actual", role, "expected", GUARANTOR)
+	}
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if inv.Status == PAID || inv.Status == SETTLED || inv.Status == CANCELLED || inv.Status == VOID || inv.Status == PAYABLE_PENDING {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v cannot be guaranteed while %v", inv.InvoiceId, inv.Status), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+
+	coverage, err := t.parse_hundredths(args[1])
+	if err != nil || coverage <= 0 || coverage > FULL_SHARE { return shim.Error("2nd argument must be a coverage percentage up to 100.00") }
+
+	policyHash, err := t.check_document_hash(args[2])
+	if err != nil { return shim.Error("3rd argument must be a hex SHA-256 policy hash") }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	expiry, err := time.Parse(time.RFC3339, args[3])
+	if err != nil { return shim.Error("4th argument must be an RFC 3339 expiry time") }
+	if !expiry.After(now) { return shim.Error("Guarantee expiry must be in the future") }
+
+	guaranteeType := GUARANTEE_BANK
+	if len(args) == 5 && args[4] != "" { guaranteeType = args[4] }
+	if guaranteeType != GUARANTEE_BANK && guaranteeType != GUARANTEE_INSURANCE {
+		return shim.Error(fmt.Sprintf("5th argument must be %v or %v", GUARANTEE_BANK, GUARANTEE_INSURANCE))
+	}
+
+	if inv.Guarantee != nil && inv.Guarantee.DrawnAmount != "" {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("The guarantee of invoice %v has been drawn", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+	if t.guaranteed(inv, now) && inv.Guarantee.Guarantor != username {
+		return t.fail(ERR_DUPLICATE, fmt.Sprintf("Invoice %v is already guaranteed by %v", inv.InvoiceId, inv.Guarantee.Guarantor), "invoiceid", inv.InvoiceId, "guarantor", inv.Guarantee.Guarantor)
+	}
+
+	err = t.check_parties(stub, inv.Seller, inv.Buyer, username)
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv.Guarantee = &Guarantee{Type: guaranteeType, Guarantor: username, Coverage: t.format_hundredths(coverage), PolicyHash: policyHash, ExpiresAt: expiry.UTC().Format(time.RFC3339), AttachedAt: now.Format(time.RFC3339), TxId: stub.GetTxID()}
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("ATTACH_GUARANTEE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_GUARANTEE, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(inv.Guarantee)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 draw_guarantee - A financier of an overdue invoice claims from the guarantor the covered part of the outstanding
+//					  balance. Only an unexpired guarantee can be drawn, and only once.
+//=================================================================================================================================
+func (t *SimpleChaincode) draw_guarantee(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			123443232
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if !t.is_financier(inv, username) {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. draw_guarantee. %v does not hold invoice %v", username, inv.InvoiceId), "function", "draw_guarantee", "actual", username, "invoiceid", inv.InvoiceId)
+	}
+
+	if inv.Status != OVERDUE {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v is not overdue. Status is %v", inv.InvoiceId, inv.Status), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	if !t.guaranteed(inv, now) { return t.fail(ERR_NOT_FOUND, fmt.Sprintf("Invoice %v has no guarantee in force", inv.InvoiceId), "invoiceid", inv.InvoiceId) }
+	if inv.Guarantee.DrawnAmount != "" {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("The guarantee of invoice %v has been drawn", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+
+	outstanding, err := t.outstanding_balance(inv)
+	if err != nil { return shim.Error(err.Error()) }
+
+	coverage, _ := t.parse_hundredths(inv.Guarantee.Coverage)
+
+	inv.Guarantee.DrawnBy = username
+	inv.Guarantee.DrawnAmount = t.format_amount(inv.Currency, outstanding * coverage / FULL_SHARE)
+	inv.Guarantee.DrawnAt = now.Format(time.RFC3339)
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("DRAW_GUARANTEE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_GUARANTEE_DRAWN, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(inv.Guarantee)
+	return shim.Success(bytes)
+}
+
+//	Whether an invoice carries a guarantee that has not expired
+func (t *SimpleChaincode) guaranteed(inv Invoice, now time.Time) bool {
+
+	if inv.Guarantee == nil { return false }
+
+	expiry, err := time.Parse(time.RFC3339, inv.Guarantee.ExpiresAt)
+	return err == nil && now.Before(expiry)
+}
+
+//=================================================================================================================================
+//	 Document Functions
+//=================================================================================================================================
+//	 attach_document - A party to the invoice anchors the SHA-256 hash of the invoice PDF, delivery note or assignment
+//					   agreement, so every party can later check an off-chain copy against what was financed.
+//=================================================================================================================================
+func (t *SimpleChaincode) attach_document(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0              1               2
+	//			123443232       invoice       <sha256 hex>
+
+	if len(args) != 3 { return shim.Error("Incorrect number of arguments. Expecting 3") }
+
+	identity, err := t.get_identity(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if username != inv.Seller && username != inv.Buyer && !t.is_financier(inv, username) {
+		return t.fail(ERR_PERMISSION, "Permission Denied. attach_document", "function", "attach_document")
+	}
+
+	if args[1] != DOCUMENT_INVOICE && args[1] != DOCUMENT_DELIVERY && args[1] != DOCUMENT_ASSIGNMENT {
+		return shim.Error(fmt.Sprintf("2nd argument must be %v, %v or %v", DOCUMENT_INVOICE, DOCUMENT_DELIVERY, DOCUMENT_ASSIGNMENT))
+	}
+
+	documentHash, err := t.check_document_hash(args[2])
+	if err != nil { return shim.Error("3rd argument must be a hex SHA-256 document hash") }
+
+	for _, document := range inv.Documents {
+		if document.Type == args[1] && document.Hash == documentHash {
+			return t.fail(ERR_DUPLICATE, fmt.Sprintf("Invoice %v already has this %v document", inv.InvoiceId, args[1]), "invoiceid", inv.InvoiceId, "type", args[1])
+		}
+	}
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv.Documents = append(inv.Documents, Document{Type: args[1], Hash: documentHash, UploadedBy: username, UploaderMspId: identity.MspId, UploadedAt: now.Format(time.RFC3339), TxId: stub.GetTxID()})
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("ATTACH_DOCUMENT: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_DOCUMENT, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(inv.Documents)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 get_documents - The document hashes anchored on an invoice, visible to its seller, buyer and financier. An
+//					 optional document type narrows the result.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_documents(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0               1 (optional)
+	//			123443232       deliverynote
+
+	if len(args) != 1 && len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting 1 or 2") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if _, err = t.get_invoice_details(stub, inv, username); err != nil {
+		return t.fail(ERR_PERMISSION, "Permission Denied. get_documents", "function", "get_documents")
+	}
+
+	documents := []Document{}
+	for _, document := range inv.Documents {
+		if len(args) == 2 && args[1] != "" && document.Type != args[1] { continue }
+		documents = append(documents, document)
+	}
+
+	bytes, _ := json.Marshal(documents)
+	return shim.Success(bytes)
+}
+
+//	A hex SHA-256 hash in lower case
+func (t *SimpleChaincode) check_document_hash(value string) (string, error) {
+
+	decoded, err := hex.DecodeString(value)
+	if err != nil || len(decoded) != sha256.Size { return "", errors.New("Invalid document hash " + value) }
+
+	return strings.ToLower(value), nil
+}
+
+//=================================================================================================================================
+//	 Repayment Schedule Functions
+//=================================================================================================================================
+//	 propose_schedule - The buyer or a financier of an approved invoice proposes paying its outstanding balance in
+//						installments. A new proposal replaces one that has not been agreed yet.
+//=================================================================================================================================
+func (t *SimpleChaincode) propose_schedule(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0               1
+	//			123443232       [{"duedate":"2017-10-31","amount":"50.00"},{"duedate":"2017-11-30","amount":"50.00"}]
+
+	if len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting 2") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if username != inv.Buyer && !t.is_financier(inv, username) {
+		return t.fail(ERR_PERMISSION, "Permission Denied. propose_schedule", "function", "propose_schedule")
+	}
+
+	if inv.Status != APPROVED {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v is not approved. Status is %v", inv.InvoiceId, inv.Status), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+	if inv.Schedule != nil && inv.Schedule.Status == SCHEDULE_AGREED {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v already has an agreed repayment schedule", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+
+	var installments []Installment
+	err = json.Unmarshal([]byte(args[1]), &installments)
+	if err != nil || len(installments) == 0 { return shim.Error("2nd argument must be a JSON array of installments") }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	outstanding, err := t.outstanding_balance(inv)
+	if err != nil { return shim.Error(err.Error()) }
+
+	var total int64
+	previous := now.Truncate(24 * time.Hour).AddDate(0, 0, -1)
+	for i := range installments {
+		dueDate, err := time.Parse(DATE_FORMAT, installments[i].DueDate)
+		if err != nil { return shim.Error(fmt.Sprintf("Installment %d must have a due date formatted YYYY-MM-DD", i + 1)) }
+		if !dueDate.After(previous) { return shim.Error(fmt.Sprintf("Installment %d must fall due after the previous one and not in the past", i + 1)) }
+		previous = dueDate
+
+		amount, err := t.parse_amount(inv.Currency, installments[i].Amount)
+		if err != nil || amount <= 0 { return shim.Error(fmt.Sprintf("Installment %d must have a positive amount", i + 1)) }
+		total += amount
+
+		installments[i] = Installment{Number: i + 1, DueDate: installments[i].DueDate, Amount: t.format_amount(inv.Currency, amount), Paid: t.format_amount(inv.Currency, 0), Status: INSTALLMENT_DUE}
+	}
+
+	if total != outstanding {
+		return t.fail(ERR_VALIDATION, fmt.Sprintf("Installments total %v but the outstanding balance is %v", t.format_amount(inv.Currency, total), t.format_amount(inv.Currency, outstanding)), "field", "installments", "value", t.format_amount(inv.Currency, total), "reason", "total differs from the outstanding balance")
+	}
+
+	inv.Schedule = &Repayment_Schedule{Status: SCHEDULE_PROPOSED, Installments: installments, ProposedBy: username, ProposedAt: now.Format(time.RFC3339), AcceptedBy: []string{username}, TxId: stub.GetTxID()}
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("PROPOSE_SCHEDULE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_SCHEDULE_PROPOSED, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(inv.Schedule)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 accept_schedule - The buyer or a financier accepts the proposed repayment schedule. It is agreed once the buyer
+//					   and every financier have accepted it, and the due date of the invoice moves to the due date of
+//					   the last installment.
+//=================================================================================================================================
+func (t *SimpleChaincode) accept_schedule(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			123443232
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if username != inv.Buyer && !t.is_financier(inv, username) {
+		return t.fail(ERR_PERMISSION, "Permission Denied. accept_schedule", "function", "accept_schedule")
+	}
+
+	if inv.Schedule == nil || inv.Schedule.Status != SCHEDULE_PROPOSED {
+		return t.fail(ERR_NOT_FOUND, fmt.Sprintf("Invoice %v has no proposed repayment schedule", inv.InvoiceId), "invoiceid", inv.InvoiceId)
+	}
+	if inv.Status != APPROVED {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v is not approved. Status is %v", inv.InvoiceId, inv.Status), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+
+	accepted := map[string]bool{}
+	for _, party := range inv.Schedule.AcceptedBy { accepted[party] = true }
+	if accepted[username] {
+		return t.fail(ERR_DUPLICATE, fmt.Sprintf("%v has already accepted the repayment schedule of invoice %v", username, inv.InvoiceId), "invoiceid", inv.InvoiceId, "party", username)
+	}
+
+	inv.Schedule.AcceptedBy = append(inv.Schedule.AcceptedBy, username)
+	accepted[username] = true
+
+	agreed := accepted[inv.Buyer]
+	for _, financier := range t.financiers(inv) {
+		if !accepted[financier] { agreed = false }
+	}
+
+	event := EVENT_SCHEDULE_ACCEPTED
+	if agreed {
+		now, err := t.get_timestamp(stub)
+		if err != nil { return shim.Error(err.Error()) }
+
+		err = t.release_fingerprint(stub, inv)
+		if err != nil { return shim.Error(err.Error()) }
+
+		inv.Schedule.Status = SCHEDULE_AGREED
+		inv.Schedule.AgreedAt = now.Format(time.RFC3339)
+		inv.Schedule.OriginalDueDate = inv.DueDate
+		inv.DueDate = inv.Schedule.Installments[len(inv.Schedule.Installments) - 1].DueDate
+
+		err = t.claim_fingerprint(stub, inv)
+		if err != nil { return shim.Error(err.Error()) }
+
+		event = EVENT_SCHEDULE_AGREED
+	}
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("ACCEPT_SCHEDULE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: event, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(inv.Schedule)
+	return shim.Success(bytes)
+}
+
+//	Applies a payment to one installment, or to the earliest unpaid installments when number is 0
+func (t *SimpleChaincode) apply_to_installments(inv *Invoice, amount int64, number int) error {
+
+	remaining := amount
+	for i := range inv.Schedule.Installments {
+		installment := &inv.Schedule.Installments[i]
+		if number != 0 && installment.Number != number { continue }
+
+		due, _ := t.parse_amount(inv.Currency, installment.Amount)
+		paid, _ := t.parse_amount(inv.Currency, installment.Paid)
+		if due - paid <= 0 { continue }
+
+		applied := remaining
+		if applied > due - paid {
+			if number != 0 {
+				return t.coded(ERR_LIMIT_EXCEEDED, fmt.Sprintf("Payment %v exceeds the %v still due on installment %d", t.format_amount(inv.Currency, amount), t.format_amount(inv.Currency, due - paid), number), "invoiceid", inv.InvoiceId, "value", t.format_amount(inv.Currency, amount), "limit", t.format_amount(inv.Currency, due - paid))
+			}
+			applied = due - paid
+		}
+
+		installment.Paid = t.format_amount(inv.Currency, paid + applied)
+		if paid + applied == due { installment.Status = INSTALLMENT_PAID }
+		remaining -= applied
+		if remaining == 0 { return nil }
+	}
+
+	if number != 0 { return t.coded(ERR_NOT_FOUND, fmt.Sprintf("Invoice %v has no unpaid installment %d", inv.InvoiceId, number), "invoiceid", inv.InvoiceId, "installment", strconv.Itoa(number)) }
+	return nil
+}
+
+//	Marks the unpaid installments past their due date as overdue, reporting whether any changed
+func (t *SimpleChaincode) overdue_installments(inv *Invoice, now time.Time) bool {
+
+	if inv.Schedule == nil || inv.Schedule.Status != SCHEDULE_AGREED { return false }
+
+	changed := false
+	for i := range inv.Schedule.Installments {
+		installment := &inv.Schedule.Installments[i]
+		if installment.Status != INSTALLMENT_DUE { continue }
+
+		dueDate, err := time.Parse(DATE_FORMAT, installment.DueDate)
+		if err != nil || !now.After(dueDate.AddDate(0, 0, 1)) { continue }
+
+		installment.Status = INSTALLMENT_OVERDUE
+		changed = true
+	}
+	return changed
+}
+
+//=================================================================================================================================
+//	 Payment Functions
+//=================================================================================================================================
+//	 record_payment - The buyer records a payment against an invoice. The outstanding balance is reduced by the
+//					  payment and the invoice moves to PAID once nothing is outstanding. Overpayments are rejected.
+//					  Under a repayment schedule the payment goes to the installment named, or to the earliest
+//					  unpaid installments.
+//=================================================================================================================================
+func (t *SimpleChaincode) record_payment(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0               1              2              3            4 (optional)
+	//			123443232         40.00        2017-09-30      WIRE-0042           2
+
+	if len(args) != 4 && len(args) != 5 { return shim.Error("Incorrect number of arguments. Expecting 4 or 5") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if  username != inv.Buyer {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. record_payment. %v !== %v", username, inv.Buyer), "function", "record_payment", "actual", username, "expected", inv.Buyer)
+	}
+
+	if inv.Status == FINANCE_OFFERED || inv.Status == PAID || inv.Status == SETTLED || inv.Status == CANCELLED || inv.Status == VOID {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v cannot take payments while %v", inv.InvoiceId, inv.Status), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+
+	amount, err := t.parse_amount(inv.Currency, args[1])
+	if err != nil || amount <= 0 { return shim.Error("2nd argument must be a positive amount") }
+
+	if _, err = time.Parse(DATE_FORMAT, args[2]); err != nil { return shim.Error("3rd argument must be a payment date formatted YYYY-MM-DD") }
+
+	outstanding, err := t.outstanding_balance(inv)
+	if err != nil { return shim.Error(err.Error()) }
+
+	if amount > outstanding {
+		return t.fail(ERR_LIMIT_EXCEEDED, fmt.Sprintf("Payment %v exceeds the outstanding balance %v", t.format_amount(inv.Currency, amount), t.format_amount(inv.Currency, outstanding)), "invoiceid", inv.InvoiceId, "value", t.format_amount(inv.Currency, amount), "limit", t.format_amount(inv.Currency, outstanding))
+	}
+
+	if inv.Status == DISPUTED {												// Only the undisputed part can be paid until the dispute is resolved
+		disputed, _ := t.parse_amount(inv.Currency, inv.Disputes[len(inv.Disputes) - 1].Amount)
+		if amount > outstanding - disputed {
+			return t.fail(ERR_LIMIT_EXCEEDED, fmt.Sprintf("Payment %v exceeds the undisputed balance %v", t.format_amount(inv.Currency, amount), t.format_amount(inv.Currency, outstanding - disputed)), "invoiceid", inv.InvoiceId, "value", t.format_amount(inv.Currency, amount), "limit", t.format_amount(inv.Currency, outstanding - disputed))
+		}
+	}
+
+	installment := 0
+	if len(args) == 5 && args[4] != "" {
+		installment, err = strconv.Atoi(args[4])
+		if err != nil || installment <= 0 { return shim.Error("5th argument must be an installment number") }
+	}
+
+	if inv.Schedule != nil && inv.Schedule.Status == SCHEDULE_AGREED {
+		err = t.apply_to_installments(&inv, amount, installment)
+		if err != nil { return shim.Error(err.Error()) }
+	} else if installment != 0 {
+		return t.fail(ERR_NOT_FOUND, fmt.Sprintf("Invoice %v has no agreed repayment schedule", inv.InvoiceId), "invoiceid", inv.InvoiceId)
+	}
+
+	inv.Payments = append(inv.Payments, Payment{Amount: t.format_amount(inv.Currency, amount), Date: args[2], Payer: username, Reference: args[3], Installment: installment, TxId: stub.GetTxID()})
+	inv.Outstanding = t.format_amount(inv.Currency, outstanding - amount)
+
+	if outstanding == amount {
+		err = t.transition(&inv, PAID)
+		if err != nil { return shim.Error(err.Error()) }
+	}
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("RECORD_PAYMENT: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	event := Invoice_Event{Event: EVENT_PAYMENT, Invoice: &inv}
+	if inv.Status == PAID {
+		now, err := t.get_timestamp(stub)
+		if err != nil { return shim.Error(err.Error()) }
+
+		event.Event = EVENT_PAID
+		event.Summaries = []Invoice_Summary{t.summary(inv, now)}
+	}
+
+	err = t.emit_event(stub, event)
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(t.visible_terms(inv, username, ""))
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 get_payments - Payment history of an invoice, visible to its seller, buyer and financier.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_payments(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			123443232
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if _, err = t.get_invoice_details(stub, inv, username); err != nil {
+		return t.fail(ERR_PERMISSION, "Permission Denied. get_payments", "function", "get_payments")
+	}
+
+	payments := inv.Payments
+	if payments == nil { payments = []Payment{} }
+
+	bytes, _ := json.Marshal(payments)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 settle_at_maturity - On or after the due date, the buyer pays whatever is outstanding of the face amount to the
+//						  financier, pro rata to the tranche holders, or to the seller if the invoice was never
+//						  financed. Records the payment and a Settlement with the financier's earned discount, and
+//						  moves the invoice to SETTLED. Needs a peer that can read the invoice terms.
+//=================================================================================================================================
+func (t *SimpleChaincode) settle_at_maturity(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0               1
+	//			123443232       WIRE-0057
+
+	if len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting 2") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if  username != inv.Buyer {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. settle_at_maturity. %v !== %v", username, inv.Buyer), "function", "settle_at_maturity", "actual", username, "expected", inv.Buyer)
+	}
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	dueDate, err := time.Parse(DATE_FORMAT, inv.DueDate)
+	if err != nil { return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v has no due date", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+	if now.Before(dueDate) { return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v matures on %v", inv.InvoiceId, inv.DueDate), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+
+	faceAmount, err := t.parse_amount(inv.Currency, inv.Amount)
+	if err != nil { return shim.Error("Invoice " + inv.InvoiceId + " has an invalid amount " + inv.Amount) }
+
+	outstanding, err := t.outstanding_balance(inv)
+	if err != nil { return shim.Error(err.Error()) }
+
+	financed := inv.Financier != "" && inv.Financier != UNDEFINED
+	settlement := Settlement{InvoiceId: inv.InvoiceId, Credited: inv.Credited, PaidTo: inv.Seller, FaceAmount: t.format_amount(inv.Currency, faceAmount), AmountPaid: t.format_amount(inv.Currency, outstanding), PurchasePrice: t.format_amount(inv.Currency, 0), EarnedDiscount: t.format_amount(inv.Currency, 0), SettledBy: username, SettledAt: now.Format(time.RFC3339), TxId: stub.GetTxID()}
+
+	if financed {
+		if inv.FinancedAmount == "" { return shim.Error("The invoice terms are not readable on this peer") }
+
+		purchasePrice, err := t.parse_amount(t.financed_currency(inv), inv.FinancedAmount)
+		if err != nil { return shim.Error("Invoice " + inv.InvoiceId + " has an invalid financed amount") }
+
+		settlement.PaidTo = inv.Financier
+		settlement.PurchasePrice = inv.FinancedAmount
+		if inv.FxRate != "" {												// The discount is earned in the invoice currency
+			settlement.PurchaseCurrency = inv.FinancedCurrency
+			purchasePrice, err = t.to_invoice_currency(inv, purchasePrice)
+			if err != nil { return shim.Error(err.Error()) }
+		}
+		settlement.EarnedDiscount = t.format_amount(inv.Currency, faceAmount - purchasePrice)
+	}
+
+	if len(inv.Tranches) > 0 {
+		shares := t.pro_rata(outstanding, inv.Tranches)
+
+		var subscribed, paid, purchaseTotal, faceTotal int64
+		for i, tranche := range inv.Tranches {
+			if tranche.PurchasePrice == "" { return shim.Error("The invoice terms are not readable on this peer") }
+
+			purchasePrice, err := t.parse_amount(inv.Currency, tranche.PurchasePrice)
+			if err != nil { return shim.Error("Invoice " + inv.InvoiceId + " has an invalid tranche purchase price") }
+
+			trancheFace, _ := t.parse_amount(inv.Currency, tranche.FaceAmount)
+			percentage, _ := t.parse_hundredths(tranche.Percentage)
+
+			settlement.Allocations = append(settlement.Allocations, Settlement_Allocation{PaidTo: tranche.Financier, Percentage: tranche.Percentage, AmountPaid: t.format_amount(inv.Currency, shares[i]), PurchasePrice: tranche.PurchasePrice, EarnedDiscount: t.format_amount(inv.Currency, trancheFace - purchasePrice)})
+			subscribed += percentage
+			paid += shares[i]
+			purchaseTotal += purchasePrice
+			faceTotal += trancheFace
+		}
+
+		if paid < outstanding {												// The unsubscribed part of the invoice is still the seller's
+			settlement.Allocations = append(settlement.Allocations, Settlement_Allocation{PaidTo: inv.Seller, Percentage: t.format_hundredths(FULL_SHARE - subscribed), AmountPaid: t.format_amount(inv.Currency, outstanding - paid), PurchasePrice: t.format_amount(inv.Currency, 0), EarnedDiscount: t.format_amount(inv.Currency, 0)})
+		}
+
+		settlement.PaidTo = ""
+		settlement.PurchasePrice = t.format_amount(inv.Currency, purchaseTotal)
+		settlement.EarnedDiscount = t.format_amount(inv.Currency, faceTotal - purchaseTotal)
+	}
+
+	if inv.Guarantee != nil && inv.Guarantee.DrawnAmount != "" {
+		settlement.GuaranteeDrawn = true
+		settlement.GuaranteeAmount = inv.Guarantee.DrawnAmount
+	}
+
+	err = t.transition(&inv, SETTLED)
+	if err != nil { return shim.Error(err.Error()) }
+
+	if !financed && len(inv.Tranches) == 0 {
+		err = t.charge_fee(stub, inv, inv.Seller, FEE_SETTLEMENT, faceAmount)
+		if err != nil { return shim.Error(err.Error()) }
+	}
+
+	if outstanding > 0 {
+		inv.Payments = append(inv.Payments, Payment{Amount: t.format_amount(inv.Currency, outstanding), Date: now.Format(DATE_FORMAT), Payer: username, Reference: args[1], TxId: stub.GetTxID()})
+	}
+	inv.Outstanding = t.format_amount(inv.Currency, 0)
+
+	key, err := stub.CreateCompositeKey(SETTLEMENT_PREFIX, []string{inv.InvoiceId})
+	if err != nil { return shim.Error("Error building settlement key") }
+
+	settlement.Salt, err = t.get_salt(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(settlement)
+	err = stub.PutPrivateData(TERMS_COLLECTION, key, bytes)
+	if err != nil { return shim.Error("Error storing settlement") }
+
+	inv.SettlementHash = t.hash(bytes)
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("SETTLE_AT_MATURITY: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_SETTLED, Invoice: &inv, Summaries: []Invoice_Summary{t.summary(inv, now)}})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ = json.Marshal(t.visible_terms(inv, username, ""))
+	return shim.Success(bytes)
+}
+
+//	Invoices created before payments were tracked have no outstanding balance recorded
+func (t *SimpleChaincode) outstanding_balance(inv Invoice) (int64, error) {
+
+	if inv.Outstanding != "" { return t.parse_amount(inv.Currency, inv.Outstanding) }
+
+	outstanding, err := t.parse_amount(inv.Currency, inv.Amount)
+	if err != nil { return 0, errors.New("Invoice " + inv.InvoiceId + " has an invalid amount " + inv.Amount) }
+
+	for _, payment := range inv.Payments {
+		paid, err := t.parse_amount(inv.Currency, payment.Amount)
+		if err != nil { return 0, errors.New("Invoice " + inv.InvoiceId + " has an invalid payment amount " + payment.Amount) }
+		outstanding -= paid
+	}
+
+	return outstanding, nil
+}
+
+//=================================================================================================================================
+//	 Credit Note Functions
+//=================================================================================================================================
+//	 issue_credit_note - The seller credits part of an invoice. The credit only comes off the outstanding balance once
+//						 the buyer acknowledges it with acknowledge_credit_note.
+//=================================================================================================================================
+func (t *SimpleChaincode) issue_credit_note(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0              1                  2
+	//			123443232        15.00       2 widgets returned damaged
+
+	if len(args) != 3 { return shim.Error("Incorrect number of arguments. Expecting 3") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if  username != inv.Seller {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. issue_credit_note. %v !== %v", username, inv.Seller), "function", "issue_credit_note", "actual", username, "expected", inv.Seller)
+	}
+
+	if inv.Status == PAYABLE_PENDING || inv.Status == PAID || inv.Status == SETTLED || inv.Status == CANCELLED || inv.Status == VOID {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v cannot be credited while %v", inv.InvoiceId, inv.Status), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+
+	amount, err := t.parse_amount(inv.Currency, args[1])
+	if err != nil || amount <= 0 { return shim.Error("2nd argument must be a positive amount") }
+
+	outstanding, err := t.outstanding_balance(inv)
+	if err != nil { return shim.Error(err.Error()) }
+
+	if amount > outstanding {
+		return t.fail(ERR_LIMIT_EXCEEDED, fmt.Sprintf("Credit %v exceeds the outstanding balance %v", t.format_amount(inv.Currency, amount), t.format_amount(inv.Currency, outstanding)), "invoiceid", inv.InvoiceId, "value", t.format_amount(inv.Currency, amount), "limit", t.format_amount(inv.Currency, outstanding))
+	}
+
+	if strings.TrimSpace(args[2]) == "" { return shim.Error("3rd argument must be the reason for the credit") }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	note := Credit_Note{CreditNoteId: stub.GetTxID(), InvoiceId: inv.InvoiceId, Amount: t.format_amount(inv.Currency, amount), Reason: args[2], Status: CREDIT_PENDING, IssuedBy: username, IssuedAt: now.Format(time.RFC3339)}
+
+	err = t.save_credit_note(stub, note)
+	if err != nil { return shim.Error(err.Error()) }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_CREDIT_ISSUED, Invoice: &inv, CreditNote: &note})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(note)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 acknowledge_credit_note - The buyer acknowledges a credit note, taking it off the invoice's outstanding balance. An
+//							   invoice with nothing left outstanding moves to PAID.
+//=================================================================================================================================
+func (t *SimpleChaincode) acknowledge_credit_note(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0                1
+	//			123443232      <creditnoteid>
+
+	if len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting 2") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if  username != inv.Buyer {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. acknowledge_credit_note. %v !== %v", username, inv.Buyer), "function", "acknowledge_credit_note", "actual", username, "expected", inv.Buyer)
+	}
+
+	note, err := t.retrieve_credit_note(stub, inv.InvoiceId, args[1])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if note.Status != CREDIT_PENDING { return t.fail(ERR_INVALID_STATE, "Credit note " + note.CreditNoteId + " was already acknowledged", "invoiceid", note.InvoiceId, "creditnoteid", note.CreditNoteId, "status", note.Status) }
+
+	if inv.Status == PAID || inv.Status == SETTLED || inv.Status == CANCELLED || inv.Status == VOID {
+		return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v cannot be credited while %v", inv.InvoiceId, inv.Status), "invoiceid", inv.InvoiceId, "status", inv.Status)
+	}
+
+	amount, err := t.parse_amount(inv.Currency, note.Amount)
+	if err != nil { return shim.Error("Credit note " + note.CreditNoteId + " has an invalid amount") }
+
+	outstanding, err := t.outstanding_balance(inv)
+	if err != nil { return shim.Error(err.Error()) }
+
+	if amount > outstanding {
+		return t.fail(ERR_LIMIT_EXCEEDED, fmt.Sprintf("Credit %v exceeds the outstanding balance %v", t.format_amount(inv.Currency, amount), t.format_amount(inv.Currency, outstanding)), "invoiceid", inv.InvoiceId, "value", t.format_amount(inv.Currency, amount), "limit", t.format_amount(inv.Currency, outstanding))
+	}
+
+	credited, _ := t.parse_amount(inv.Currency, inv.Credited)
+	inv.Credited = t.format_amount(inv.Currency, credited + amount)
+	inv.Outstanding = t.format_amount(inv.Currency, outstanding - amount)
+
+	if outstanding == amount {
+		err = t.transition(&inv, PAID)
+		if err != nil { return shim.Error(err.Error()) }
+	}
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	note.Status = CREDIT_ACKNOWLEDGED
+	note.AcknowledgedBy = username
+	note.AcknowledgedAt = now.Format(time.RFC3339)
+
+	err = t.save_credit_note(stub, note)
+	if err != nil { return shim.Error(err.Error()) }
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("ACKNOWLEDGE_CREDIT_NOTE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_CREDIT_ACKNOWLEDGED, Invoice: &inv, CreditNote: &note})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(t.visible_terms(inv, username, ""))
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 get_credit_notes - The credit notes of an invoice, visible to its seller, buyer and financier.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_credit_notes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			123443232
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if _, err = t.get_invoice_details(stub, inv, username); err != nil {
+		return t.fail(ERR_PERMISSION, "Permission Denied. get_credit_notes", "function", "get_credit_notes")
+	}
+
+	iter, err := stub.GetStateByPartialCompositeKey(CREDIT_NOTE_PREFIX, []string{inv.InvoiceId})
+	if err != nil { return shim.Error("Unable to query credit notes for invoice " + inv.InvoiceId) }
+	defer iter.Close()
+
+	notes := []Credit_Note{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil { return shim.Error("Unable to read credit notes for invoice " + inv.InvoiceId) }
+
+		var note Credit_Note
+		err = json.Unmarshal(kv.Value, &note)
+		if err != nil { return shim.Error("Corrupt credit note record " + string(kv.Value)) }
+
+		notes = append(notes, note)
+	}
+
+	bytes, _ := json.Marshal(notes)
+	return shim.Success(bytes)
+}
+
+func (t *SimpleChaincode) retrieve_credit_note(stub shim.ChaincodeStubInterface, invoiceId string, creditNoteId string) (Credit_Note, error) {
+
+	var note Credit_Note
+
+	key, err := stub.CreateCompositeKey(CREDIT_NOTE_PREFIX, []string{invoiceId, creditNoteId})
+	if err != nil { return note, errors.New("Error building credit note key") }
+
+	bytes, err := stub.GetState(key)
+	if err != nil { return note, errors.New("Error retrieving credit note " + creditNoteId) }
+	if bytes == nil { return note, t.coded(ERR_NOT_FOUND, "Credit note " + creditNoteId + " not found for invoice " + invoiceId, "invoiceid", invoiceId, "creditnoteid", creditNoteId) }
+
+	err = json.Unmarshal(bytes, &note)
+	if err != nil { return note, errors.New("Corrupt credit note record " + string(bytes)) }
+
+	return note, nil
+}
+
+func (t *SimpleChaincode) save_credit_note(stub shim.ChaincodeStubInterface, note Credit_Note) error {
+
+	key, err := stub.CreateCompositeKey(CREDIT_NOTE_PREFIX, []string{note.InvoiceId, note.CreditNoteId})
+	if err != nil { return errors.New("Error building credit note key") }
+
+	bytes, err := json.Marshal(note)
+	if err != nil { return errors.New("Error converting credit note record") }
+
+	err = stub.PutState(key, bytes)
+	if err != nil { return errors.New("Error storing credit note record") }
+
+	return nil
+}
+
+//=================================================================================================================================
+//	 Dispute Functions
+//=================================================================================================================================
+//	 raise_dispute - The buyer disputes part or all of the outstanding balance of an invoice. The invoice moves to
+//					 DISPUTED, which blocks financing and settlement until resolve_dispute.
+//=================================================================================================================================
+func (t *SimpleChaincode) raise_dispute(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0                    1                     2
+	//			123443232        Goods damaged on arrival      40.00
+
+	if len(args) != 3 { return shim.Error("Incorrect number of arguments. Expecting 3") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if  username != inv.Buyer {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. raise_dispute. %v !== %v", username, inv.Buyer), "function", "raise_dispute", "actual", username, "expected", inv.Buyer)
+	}
+
+	if strings.TrimSpace(args[1]) == "" { return shim.Error("2nd argument must be the reason for the dispute") }
+
+	amount, err := t.parse_amount(inv.Currency, args[2])
+	if err != nil || amount <= 0 { return shim.Error("3rd argument must be a positive amount") }
+
+	outstanding, err := t.outstanding_balance(inv)
+	if err != nil { return shim.Error(err.Error()) }
+
+	if amount > outstanding {
+		return t.fail(ERR_LIMIT_EXCEEDED, fmt.Sprintf("Disputed amount %v exceeds the outstanding balance %v", t.format_amount(inv.Currency, amount), t.format_amount(inv.Currency, outstanding)), "invoiceid", inv.InvoiceId, "value", t.format_amount(inv.Currency, amount), "limit", t.format_amount(inv.Currency, outstanding))
+	}
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	dispute := Dispute{Reason: args[1], Amount: t.format_amount(inv.Currency, amount), RaisedBy: username, RaisedAt: now.Format(time.RFC3339), PriorStatus: inv.Status}
+	if inv.Status == APPROVED || inv.Status == OVERDUE { dispute.Financiers = t.financiers(inv) }
+
+	err = t.transition(&inv, DISPUTED)
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv.Disputes = append(inv.Disputes, dispute)
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("RAISE_DISPUTE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_DISPUTE_RAISED, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(t.visible_terms(inv, username, ""))
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 respond_dispute - The seller answers the open dispute of an invoice. Responding again replaces the response.
+//=================================================================================================================================
+func (t *SimpleChaincode) respond_dispute(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0                         1
+	//			123443232        Replacement shipped 2017-09-12
+
+	if len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting 2") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	if  username != inv.Seller {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. respond_dispute. %v !== %v", username, inv.Seller), "function", "respond_dispute", "actual", username, "expected", inv.Seller)
+	}
+
+	if inv.Status != DISPUTED { return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v has no open dispute", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+	if strings.TrimSpace(args[1]) == "" { return shim.Error("2nd argument must be the response to the dispute") }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	dispute := &inv.Disputes[len(inv.Disputes) - 1]
+	dispute.Response = args[1]
+	dispute.RespondedAt = now.Format(time.RFC3339)
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("RESPOND_DISPUTE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_DISPUTE_RESPONDED, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(t.visible_terms(inv, username, ""))
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 resolve_dispute - Closes the open dispute of an invoice and returns it to the status it had when the dispute was
+//					   raised. The seller can only uphold the dispute and the buyer can only dismiss it; an admin can
+//					   rule either way. Upholding writes the disputed amount off the outstanding balance, and an invoice
+//					   with nothing left outstanding moves to PAID.
+//=================================================================================================================================
+func (t *SimpleChaincode) resolve_dispute(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0              1
+	//			123443232       UPHELD
+
+	if len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting 2") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	outcome := args[1]
+	if outcome != DISPUTE_UPHELD && outcome != DISPUTE_DISMISSED {
+		return shim.Error(fmt.Sprintf("2nd argument must be %v or %v", DISPUTE_UPHELD, DISPUTE_DISMISSED))
+	}
+
+	if !t.is_admin(stub) &&
+	   !(outcome == DISPUTE_UPHELD && username == inv.Seller) &&
+	   !(outcome == DISPUTE_DISMISSED && username == inv.Buyer) {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. resolve_dispute. %v cannot resolve %v", username, outcome), "function", "resolve_dispute", "actual", username, "outcome", outcome)
+	}
+
+	if inv.Status != DISPUTED { return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v has no open dispute", inv.InvoiceId), "invoiceid", inv.InvoiceId, "status", inv.Status) }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	dispute := &inv.Disputes[len(inv.Disputes) - 1]
+	dispute.Outcome = outcome
+	dispute.ResolvedBy = username
+	dispute.ResolvedAt = now.Format(time.RFC3339)
+
+	status := dispute.PriorStatus
+
+	if outcome == DISPUTE_UPHELD {
+		outstanding, err := t.outstanding_balance(inv)
+		if err != nil { return shim.Error(err.Error()) }
+
+		disputed, err := t.parse_amount(inv.Currency, dispute.Amount)
+		if err != nil { return shim.Error("Invoice " + inv.InvoiceId + " has an invalid disputed amount") }
+
+		if disputed > outstanding { disputed = outstanding }			// Never below zero
+		inv.Outstanding = t.format_amount(inv.Currency, outstanding - disputed)
+		if outstanding == disputed { status = PAID }
+	}
+
+	err = t.transition(&inv, status)
+	if err != nil { return shim.Error(err.Error()) }
+
+	_, err  = t.save_changes(stub, inv)
+
+	if err != nil { fmt.Printf("RESOLVE_DISPUTE: Error saving changes: %s", err); return shim.Error("Error saving changes") }
+
+	err = t.emit_event(stub, Invoice_Event{Event: EVENT_DISPUTE_RESOLVED, Invoice: &inv})
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(t.visible_terms(inv, username, ""))
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 get_disputed_invoices - The calling financier's invoices that were disputed after it had financed them.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_disputed_invoices(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	role, err := t.get_role(stub)
+	if 	role != FINANCIER {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. get_disputed_invoices. %v !== %v", role, FINANCIER), "function", "get_disputed_invoices", "actual", role, "expected", FINANCIER)
+	}
+
+	invoiceIds, err := index.IDs(stub, OWNER_INDEX, username, DISPUTED)
+	if err != nil { return shim.Error(err.Error()) }
+
+	invoices := []Invoice{}
+	for _, invoiceId := range invoiceIds {
+
+		inv, err := t.retrieve_invoice(stub, invoiceId)
+		if err != nil { return shim.Error(err.Error()) }
+
+		financed := false
+		for _, financier := range inv.Disputes[len(inv.Disputes) - 1].Financiers {
+			if financier == username { financed = true }
+		}
+		if !financed { continue }
+
+		invoices = append(invoices, t.visible_terms(inv, username, role))
+	}
+
+	bytes, _ := json.Marshal(invoices)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 Report Functions
+//=================================================================================================================================
+//	 get_portfolio - Every invoice financed by the calling financier with its face value, purchase price, expected yield
+//					 and days to maturity, plus totals. Purchase prices come from the terms collection.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_portfolio(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	role, err := t.get_role(stub)
+	if 	role != FINANCIER {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. get_portfolio. %v !== %v", role, FINANCIER), "function", "get_portfolio", "actual", role, "expected", FINANCIER)
+	}
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	invoices, err := t.get_owner_invoices(stub, username)
+	if err != nil { return shim.Error(err.Error()) }
+
+	portfolio := Portfolio{Financier: username, Invoices: []Portfolio_Entry{}}
+	var faceTotal, outstandingTotal, purchaseTotal, yieldTotal int64
+	add := func(total *int64, currency string, amount int64) error {
+		nominal, err := t.nominal_amount(stub, currency, amount)
+		if err != nil { return err }
+
+		*total, err = money.AddUnits(*total, nominal)
+		if err != nil { return errors.New("The portfolio totals are too large") }
+		return nil
+	}
+
+	for _, inv := range invoices {
+		if !t.is_financier(inv, username) { continue }
+
+		faceValue, err := t.parse_amount(inv.Currency, inv.Amount)
+		if err != nil { return shim.Error("Invoice " + inv.InvoiceId + " has an invalid amount " + inv.Amount) }
+
+		outstanding, err := t.outstanding_balance(inv)
+		if err != nil { return shim.Error(err.Error()) }
+
+		price, share := inv.FinancedAmount, ""
+		for i, tranche := range inv.Tranches {						// Only the financier's own tranche of the invoice
+			if tranche.Financier != username { continue }
+
+			faceValue, _ = t.parse_amount(inv.Currency, tranche.FaceAmount)
+			outstanding = t.pro_rata(outstanding, inv.Tranches)[i]
+			price, share = tranche.PurchasePrice, tranche.Percentage
+		}
+
+		priceCurrency := inv.Currency
+		if len(inv.Tranches) == 0 { priceCurrency = t.financed_currency(inv) }
+
+		purchasePrice, err := t.parse_amount(priceCurrency, price)
+		if err != nil { return shim.Error("The terms of invoice " + inv.InvoiceId + " are not readable on this peer") }
+
+		if inv.FxRate != "" {
+			purchasePrice, err = t.to_invoice_currency(inv, purchasePrice)
+			if err != nil { return shim.Error(err.Error()) }
+		}
+
+		expectedYield := faceValue - purchasePrice
+
+		entry := Portfolio_Entry{InvoiceId: inv.InvoiceId, Status: inv.Status, Currency: inv.Currency, Seller: inv.Seller, Buyer: inv.Buyer, FaceValue: t.format_amount(inv.Currency, faceValue), Outstanding: t.format_amount(inv.Currency, outstanding), PurchasePrice: t.format_amount(inv.Currency, purchasePrice), ExpectedYield: t.format_amount(inv.Currency, expectedYield), DueDate: inv.DueDate, Share: share}
+		if purchasePrice > 0 { entry.YieldRate = t.format_hundredths(expectedYield * FULL_SHARE / purchasePrice) }
+
+		if dueDate, err := time.Parse(DATE_FORMAT, inv.DueDate); err == nil {
+			days := int(dueDate.Sub(now.Truncate(24 * time.Hour)).Hours() / 24)
+			entry.DaysToMaturity = &days
+		}
+
+		portfolio.Invoices = append(portfolio.Invoices, entry)
+		if err := add(&faceTotal, inv.Currency, faceValue); err != nil { return shim.Error(err.Error()) }
+		if err := add(&outstandingTotal, inv.Currency, outstanding); err != nil { return shim.Error(err.Error()) }
+		if err := add(&purchaseTotal, inv.Currency, purchasePrice); err != nil { return shim.Error(err.Error()) }
+		if err := add(&yieldTotal, inv.Currency, expectedYield); err != nil { return shim.Error(err.Error()) }
+	}
+
+	portfolio.Count = len(portfolio.Invoices)
+	portfolio.FaceValue = t.format_amount(DEFAULT_CURRENCY, faceTotal)
+	portfolio.Outstanding = t.format_amount(DEFAULT_CURRENCY, outstandingTotal)
+	portfolio.PurchasePrice = t.format_amount(DEFAULT_CURRENCY, purchaseTotal)
+	portfolio.ExpectedYield = t.format_amount(DEFAULT_CURRENCY, yieldTotal)
+
+	bytes, _ := json.Marshal(portfolio)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 get_concentration_report - The calling financier's open exposure, its share of the outstanding balances it
+//								financed, aggregated by buyer, by currency and by maturity bucket with each group's
+//								percentage of the total. Exposure in other currencies is converted to the reporting
+//								currency at the rates passed, in units of the reporting currency per unit.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_concentration_report(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args (optional)
+	//				0                  1
+	//			   USD          {"EUR":1.08,"GBP":1.27}
+
+	if len(args) > 2 { return shim.Error("Incorrect number of arguments. Expecting at most 2") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	role, err := t.get_role(stub)
+	if 	role != FINANCIER {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. get_concentration_report. %v !== %v", role, FINANCIER), "function", "get_concentration_report", "actual", role, "expected", FINANCIER)
+	}
+
+	reporting := DEFAULT_CURRENCY
+	if len(args) > 0 && args[0] != "" { reporting = args[0] }
+
+	rates := map[string]json.Number{}
+	if len(args) > 1 && args[1] != "" {
+		err = json.Unmarshal([]byte(args[1]), &rates)
+		if err != nil { return shim.Error("2nd argument must be a JSON object of FX rates by currency") }
+	}
+	rates[reporting] = "1"
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	invoices, err := t.get_owner_invoices(stub, username)
+	if err != nil { return shim.Error(err.Error()) }
+
+	var total int64
+	count := 0
+	byBuyer, byCurrency, byMaturity := map[string]*Concentration_Line{}, map[string]*Concentration_Line{}, map[string]*Concentration_Line{}
+	add := func(lines map[string]*Concentration_Line, key string, exposure int64) {
+		if lines[key] == nil { lines[key] = &Concentration_Line{Key: key} }
+		lines[key].units += exposure
+		lines[key].Count++
+	}
+
+	for _, inv := range invoices {
+		if !t.is_financier(inv, username) { continue }
+		if inv.Status != FINANCE_OFFERED && inv.Status != APPROVED && inv.Status != OVERDUE && inv.Status != DISPUTED { continue }
+
+		exposure, err := t.outstanding_balance(inv)
+		if err != nil { return shim.Error(err.Error()) }
+
+		for i, tranche := range inv.Tranches {						// Only the financier's own tranche of the invoice
+			if tranche.Financier == username { exposure = t.pro_rata(exposure, inv.Tranches)[i] }
+		}
+
+		currency := inv.Currency
+		if currency == "" { currency = DEFAULT_CURRENCY }
+
+		rate, err := money.ParseDecimal(string(rates[currency]))
+		if err != nil || rate.Sign() <= 0 { return t.fail(ERR_NOT_FOUND, fmt.Sprintf("No FX rate from %v to %v for invoice %v", currency, reporting, inv.InvoiceId), "invoiceid", inv.InvoiceId, "from", currency, "to", reporting) }
+
+		exposure, err = t.convert(exposure, currency, reporting, rate)
+		if err != nil { return shim.Error(err.Error()) }
+
+		bucket := MATURITY_UNDATED
+		if dueDate, err := time.Parse(DATE_FORMAT, inv.DueDate); err == nil {
+			days := int(dueDate.Sub(now.Truncate(24 * time.Hour)).Hours() / 24)
+			bucket = MATURITY_PAST_DUE
+			for _, maturity := range MATURITY_BUCKETS {
+				if days >= 0 && (maturity.MaxDays < 0 || days <= maturity.MaxDays) { bucket = maturity.Name; break }
+			}
+		}
+
+		add(byBuyer, inv.Buyer, exposure)
+		add(byCurrency, currency, exposure)
+		add(byMaturity, bucket, exposure)
+
+		total += exposure
+		count++
+	}
+
+	report := Concentration_Report{Financier: username, Currency: reporting, Exposure: t.format_amount(reporting, total), Count: count, ByBuyer: t.concentration_lines(byBuyer, total, reporting), ByCurrency: t.concentration_lines(byCurrency, total, reporting), ByMaturity: t.concentration_lines(byMaturity, total, reporting)}
+
+	bytes, _ := json.Marshal(report)
+	return shim.Success(bytes)
+}
+
+//	The lines of one grouping, largest exposure first, with their percentages of the total
+func (t *SimpleChaincode) concentration_lines(groups map[string]*Concentration_Line, total int64, currency string) []Concentration_Line {
+
+	lines := []Concentration_Line{}
+	for _, line := range groups {
+		line.Exposure = t.format_amount(currency, line.units)
+		line.Percentage = t.format_hundredths(0)
+		if total > 0 { line.Percentage = t.format_hundredths(line.units * FULL_SHARE / total) }
+		lines = append(lines, *line)
+	}
+
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].units != lines[j].units { return lines[i].units > lines[j].units }
+		return lines[i].Key < lines[j].Key
+	})
+	return lines
+}
+
+//=================================================================================================================================
+//	 get_receivables_aging - The calling seller's open invoices bucketed by days past due ("due", the default) or days
+//							 since issue ("issue"), split by financed and unfinanced. Invoices not yet due, without a
+//							 due date or issued today fall in the "current" bucket.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_receivables_aging(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args (optional)
+	//				0
+	//			  issue
+
+	basis := "due"
+	if len(args) > 0 && args[0] != "" { basis = args[0] }
+	if len(args) > 1 || (basis != "due" && basis != "issue") { return shim.Error("Expecting an optional aging basis of \"due\" or \"issue\"") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	invoices, err := t.get_owner_invoices(stub, username)
+	if err != nil { return shim.Error(err.Error()) }
+
+	names := []string{"current"}
+	for _, bucket := range AGING_BUCKETS { names = append(names, bucket.Name) }
+
+	buckets := make([]Receivables_Bucket, len(names))
+	financedTotals := make([]int64, len(names))
+	unfinancedTotals := make([]int64, len(names))
+	for i, name := range names {
+		buckets[i] = Receivables_Bucket{Bucket: name, Financed: Receivables_Split{Invoices: []string{}}, Unfinanced: Receivables_Split{Invoices: []string{}}}
+	}
+
+	for _, inv := range invoices {
+		if inv.Seller != username { continue }
+		if inv.Status == PAID || inv.Status == SETTLED || inv.Status == CANCELLED || inv.Status == VOID { continue }
+
+		outstanding, err := t.outstanding_balance(inv)
+		if err != nil { return shim.Error(err.Error()) }
+
+		days := 0
+		if basis == "due" {
+			days = t.days_past_due(inv, now)
+		} else if issuedAt, err := time.Parse(time.RFC3339, inv.IssuedAt); err == nil {
+			days = int(now.Sub(issuedAt).Hours() / 24)
+		}
+
+		i := 0
+		if days > 0 {
+			for j, bucket := range AGING_BUCKETS {
+				if bucket.MaxDays < 0 || days <= bucket.MaxDays { i = j + 1; break }
+			}
+		}
+
+		split, totals := &buckets[i].Unfinanced, unfinancedTotals
+		if len(t.financiers(inv)) > 0 { split, totals = &buckets[i].Financed, financedTotals }
+
+		nominal, err := t.nominal_amount(stub, inv.Currency, outstanding)
+		if err != nil { return shim.Error(err.Error()) }
+
+		split.Count++
+		split.Invoices = append(split.Invoices, inv.InvoiceId)
+		totals[i], err = money.AddUnits(totals[i], nominal)
+		if err != nil { return shim.Error("The outstanding total of bucket " + buckets[i].Bucket + " is too large") }
+	}
+
+	for i := range buckets {
+		buckets[i].Financed.Outstanding = t.format_amount(DEFAULT_CURRENCY, financedTotals[i])
+		buckets[i].Unfinanced.Outstanding = t.format_amount(DEFAULT_CURRENCY, unfinancedTotals[i])
+	}
+
+	bytes, _ := json.Marshal(buckets)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 get_statement_with - Every invoice between the caller and the named counterparty, whichever side of it each of them
+//						  is on, grouped by status with the outstanding totals in each currency.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_statement_with(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			test_user1
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	counterparty := args[0]
+	if counterparty == "" || counterparty == username { return shim.Error("Counterparty must be another participant") }
+
+	invoices, err := t.get_owner_invoices(stub, username)						// Ordered by status, see OWNER_INDEX
+	if err != nil { return shim.Error(err.Error()) }
+
+	statement := Statement{Party: username, Counterparty: counterparty, Outstanding: map[string]string{}, Groups: []Statement_Group{}}
+	totals := map[string]int64{}
+	groupTotals := map[string]map[string]int64{}
+
+	for _, inv := range invoices {
+		if inv.Seller != counterparty && inv.Buyer != counterparty && !t.is_financier(inv, counterparty) { continue }
+
+		outstanding, err := t.outstanding_balance(inv)
+		if err != nil { return shim.Error(err.Error()) }
+		if inv.Status == CANCELLED || inv.Status == VOID { outstanding = 0 }
+
+		currency := inv.Currency
+		if currency == "" { currency = DEFAULT_CURRENCY }
+
+		last := len(statement.Groups) - 1
+		if last < 0 || statement.Groups[last].Status != inv.Status {
+			statement.Groups = append(statement.Groups, Statement_Group{Status: inv.Status, Outstanding: map[string]string{}, Invoices: []Invoice{}})
+			groupTotals[inv.Status] = map[string]int64{}
+			last++
+		}
+
+		group := &statement.Groups[last]
+		group.Count++
+		group.Invoices = append(group.Invoices, t.visible_terms(inv, username, ""))
+		groupTotals[inv.Status][currency] += outstanding
+		totals[currency] += outstanding
+	}
+
+	for i := range statement.Groups {
+		for currency, total := range groupTotals[statement.Groups[i].Status] { statement.Groups[i].Outstanding[currency] = t.format_amount(currency, total) }
+	}
+	for currency, total := range totals { statement.Outstanding[currency] = t.format_amount(currency, total) }
+
+	bytes, _ := json.Marshal(statement)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 Currency Functions
+//=================================================================================================================================
+//	 set_currency - An admin adds a currency to the currency master or renames it. An empty name removes it. The
+//					decimal places its amounts may have default to its ISO 4217 minor unit and can only be fewer. The
+//					rate, in units of DEFAULT_CURRENCY per unit, is needed to save invoices in the currency.
+//=================================================================================================================================
+func (t *SimpleChaincode) set_currency(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0          1          2 (optional)     3 (optional)
+	//			   EUR        Euro             2              1.08
+
+	if len(args) < 2 || len(args) > 4 { return shim.Error("Incorrect number of arguments. Expecting 2 to 4") }
+
+	if !t.is_admin(stub) { return t.fail(ERR_PERMISSION, "Permission Denied. set_currency. Caller is not an admin", "function", "set_currency") }
+
+	code := args[0]
+	if len(code) != 3 || strings.ToUpper(code) != code || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return shim.Error("1st argument must be an ISO 4217 currency code such as EUR")
+	}
+
+	key, err := stub.CreateCompositeKey(CURRENCY_PREFIX, []string{code})
+	if err != nil { return shim.Error("Error building currency key") }
+
+	if args[1] == "" {
+		err = stub.DelState(key)
+		if err != nil { return shim.Error("Error removing currency") }
+		return shim.Success(nil)
+	}
+
+	currency := Currency{Code: code, Name: args[1]}
+	if len(args) == 3 && args[2] != "" {
+		decimals, err := strconv.Atoi(args[2])
+		if err != nil || decimals < 0 || decimals > money.Decimals(code) { return shim.Error(fmt.Sprintf("3rd argument must be the decimal places, from 0 to %d", money.Decimals(code))) }
+		currency.Decimals = &decimals
+	}
+	if len(args) == 4 && args[3] != "" {
+		rate, err := money.ParseDecimal(args[3])
+		if err != nil || rate.Sign() <= 0 { return shim.Error("4th argument must be a positive FX rate to " + DEFAULT_CURRENCY) }
+		currency.Rate = args[3]
+	}
+
+	identity, err := t.get_identity(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	currency.UpdatedBy = identity.Id
+
+	bytes, _ := json.Marshal(currency)
+	err = stub.PutState(key, bytes)
+	if err != nil { return shim.Error("Error storing currency") }
+
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 get_currencies - The currency master.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_currencies(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	iter, err := stub.GetStateByPartialCompositeKey(CURRENCY_PREFIX, []string{})
+	if err != nil { return shim.Error("Unable to query the currency master") }
+	defer iter.Close()
+
+	currencies := []Currency{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil { return shim.Error("Unable to read the currency master") }
+
+		var currency Currency
+		err = json.Unmarshal(kv.Value, &currency)
+		if err != nil { return shim.Error("Corrupt currency record " + string(kv.Value)) }
+
+		currencies = append(currencies, currency)
+	}
+
+	bytes, _ := json.Marshal(currencies)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 set_discount_band - An admin sets the band of discount rates invoices and offers may carry, or removes it when the
+//						 minimum is empty. Without a band any rate from 0 up to 1 is accepted.
+//=================================================================================================================================
+func (t *SimpleChaincode) set_discount_band(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0          1
+	//			  0.005      0.15
+
+	if len(args) != 1 && len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting 1 or 2") }
+
+	if !t.is_admin(stub) { return t.fail(ERR_PERMISSION, "Permission Denied. set_discount_band. Caller is not an admin", "function", "set_discount_band") }
+
+	key, err := stub.CreateCompositeKey(DISCOUNT_BAND, []string{})
+	if err != nil { return shim.Error("Error building discount band key") }
+
+	if args[0] == "" {
+		err = stub.DelState(key)
+		if err != nil { return shim.Error("Error removing discount band") }
+		return shim.Success(nil)
+	}
+
+	if len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting a minimum and a maximum rate") }
+
+	minRate, err := money.ParseDecimal(args[0])
+	if err != nil || minRate.Sign() < 0 || minRate.Cmp(big.NewRat(1, 1)) >= 0 { return shim.Error("1st argument must be a rate from 0 up to 1") }
+
+	maxRate, err := money.ParseDecimal(args[1])
+	if err != nil || maxRate.Cmp(minRate) < 0 || maxRate.Cmp(big.NewRat(1, 1)) >= 0 { return shim.Error("2nd argument must be a rate from the minimum up to 1") }
+
+	identity, err := t.get_identity(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	band := Discount_Band{MinRate: args[0], MaxRate: args[1], UpdatedBy: identity.Id}
+
+	bytes, _ := json.Marshal(band)
+	err = stub.PutState(key, bytes)
+	if err != nil { return shim.Error("Error storing discount band") }
+
+	return shim.Success(bytes)
+}
+
+func (t *SimpleChaincode) retrieve_discount_band(stub shim.ChaincodeStubInterface) (*Discount_Band, error) {
+
+	key, err := stub.CreateCompositeKey(DISCOUNT_BAND, []string{})
+	if err != nil { return nil, errors.New("Error building discount band key") }
+
+	bytes, err := stub.GetState(key)
+	if err != nil { return nil, errors.New("Error retrieving discount band") }
+	if bytes == nil { return nil, nil }
+
+	var band Discount_Band
+	err = json.Unmarshal(bytes, &band)
+	if err != nil { return nil, errors.New("Corrupt discount band") }
+
+	return &band, nil
+}
+
+//	The decimal places amounts in a currency may have, its ISO 4217 minor unit unless the currency master says fewer
+func (t *SimpleChaincode) currency_decimals(stub shim.ChaincodeStubInterface, code string) (int, error) {
+
+	if code == "" || code == DEFAULT_CURRENCY { return money.Decimals(DEFAULT_CURRENCY), nil }
+
+	key, err := stub.CreateCompositeKey(CURRENCY_PREFIX, []string{code})
+	if err != nil { return 0, errors.New("Error building currency key") }
+
+	bytes, err := stub.GetState(key)
+	if err != nil { return 0, errors.New("Error retrieving currency " + code) }
+	if bytes == nil { return 0, errors.New("Currency " + code + " is not in the currency master") }
+
+	var currency Currency
+	err = json.Unmarshal(bytes, &currency)
+	if err != nil { return 0, errors.New("Corrupt currency record " + string(bytes)) }
+
+	if currency.Decimals == nil { return money.Decimals(code), nil }
+	return *currency.Decimals, nil
+}
+
+//	The minor units of the amount in the field. Fails with ERR_VALIDATION unless it is positive with no more decimals
+//	than its currency allows, e.g. "1.234" is BHD 1.234 but too many decimals for EUR.
+func (t *SimpleChaincode) check_amount(stub shim.ChaincodeStubInterface, field string, value string, currency string) (int64, error) {
+
+	decimals, err := t.currency_decimals(stub, currency)
+	if err != nil { return 0, err }
+
+	if _, err := money.ParseDecimal(value); err == nil {
+		if _, err := money.ParseUnits(value, decimals); err != nil {
+			return 0, t.coded(ERR_VALIDATION, fmt.Sprintf("%v %v has more than %d decimals for %v", field, value, decimals, currency), "field", field, "value", value, "reason", "too many decimals", "decimals", strconv.Itoa(decimals))
+		}
+	}
+
+	amount, err := t.parse_amount(currency, value)
+	if err != nil || amount <= 0 {
+		return 0, t.coded(ERR_VALIDATION, fmt.Sprintf("%v must be a positive decimal amount", field), "field", field, "value", value, "reason", "not a positive decimal")
+	}
+	return amount, nil
+}
+
+//	Fails with ERR_VALIDATION unless the field holds a discount rate from 0 up to 1 within the discount band, if any
+func (t *SimpleChaincode) check_discount(stub shim.ChaincodeStubInterface, field string, value string) error {
+
+	rate, err := money.ParseDecimal(value)
+	if err != nil || rate.Sign() < 0 || rate.Cmp(big.NewRat(1, 1)) >= 0 {
+		return t.coded(ERR_VALIDATION, fmt.Sprintf("%v must be a discount rate from 0 up to 1", field), "field", field, "value", value, "reason", "not a rate")
+	}
+
+	band, err := t.retrieve_discount_band(stub)
+	if err != nil { return err }
+	if band == nil { return nil }
+
+	minRate, err := money.ParseDecimal(band.MinRate)
+	if err != nil { return errors.New("Corrupt discount band") }
+	maxRate, err := money.ParseDecimal(band.MaxRate)
+	if err != nil { return errors.New("Corrupt discount band") }
+	if rate.Cmp(minRate) < 0 || rate.Cmp(maxRate) > 0 {
+		return t.coded(ERR_VALIDATION, fmt.Sprintf("%v %v is outside the discount band %v to %v", field, value, band.MinRate, band.MaxRate), "field", field, "value", value, "reason", "outside discount band", "min", band.MinRate, "max", band.MaxRate)
+	}
+	return nil
+}
+
+//	Fails unless the currency is DEFAULT_CURRENCY or in the currency master
+func (t *SimpleChaincode) check_currency(stub shim.ChaincodeStubInterface, code string) error {
+
+	if code == DEFAULT_CURRENCY { return nil }
+
+	key, err := stub.CreateCompositeKey(CURRENCY_PREFIX, []string{code})
+	if err != nil { return errors.New("Error building currency key") }
+
+	bytes, err := stub.GetState(key)
+	if err != nil { return errors.New("Error retrieving currency " + code) }
+	if bytes == nil { return errors.New("Currency " + code + " is not in the currency master") }
+
+	return nil
+}
+
+//	Converts an amount from one currency to another at a rate per unit, rounding to the nearest minor unit
+func (t *SimpleChaincode) convert(amount int64, from string, to string, rate *big.Rat) (int64, error) {
+
+	if from == "" { from = DEFAULT_CURRENCY }
+	if to == "" { to = DEFAULT_CURRENCY }
+	converted, err := money.New(from, amount).Convert(to, rate)
+	return converted.Units, err
+}
+
+//	Converts an amount in the financed currency of an invoice back to its own currency
+func (t *SimpleChaincode) to_invoice_currency(inv Invoice, amount int64) (int64, error) {
+
+	rate, err := money.ParseDecimal(inv.FxRate)
+	if err != nil || rate.Sign() <= 0 { return 0, errors.New("Invoice " + inv.InvoiceId + " has an invalid FX rate " + inv.FxRate) }
+
+	return t.convert(amount, inv.FinancedCurrency, inv.Currency, new(big.Rat).Inv(rate))
+}
+
+//=================================================================================================================================
+//	 Credit Limit Functions
+//=================================================================================================================================
+//	 set_credit_limit - An admin or financier sets a buyer's credit limit. An empty limit removes it.
+//=================================================================================================================================
+func (t *SimpleChaincode) set_credit_limit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0               1            2 (optional)
+	//			test_user1      50000.00         BBB
+
+	if len(args) < 2 || len(args) > 3 || args[0] == "" { return shim.Error("Incorrect number of arguments. Expecting a buyer, a limit and an optional rating") }
+
+	role, _ := t.get_role(stub)
+	if !t.is_admin(stub) && role != FINANCIER { return t.fail(ERR_PERMISSION, "Permission Denied. set_credit_limit. Caller is not an admin or financier", "function", "set_credit_limit") }
+
+	key, err := stub.CreateCompositeKey(CREDIT_PREFIX, []string{args[0]})
+	if err != nil { return shim.Error("Error building credit profile key") }
+
+	if args[1] == "" {
+		err = stub.DelState(key)
+		if err != nil { return shim.Error("Error removing credit profile") }
+		return shim.Success(nil)
+	}
+
+	limit, err := t.parse_amount(DEFAULT_CURRENCY, args[1])
+	if err != nil || limit < 0 { return shim.Error("2nd argument must be a non-negative amount") }
+
+	updatedBy, err := t.get_username(stub)
+	if err != nil {
+		identity, err := t.get_identity(stub)
+		if err != nil { return shim.Error(err.Error()) }
+		updatedBy = identity.Id
+	}
+
+	profile := Credit_Profile{Buyer: args[0], Limit: t.format_amount(DEFAULT_CURRENCY, limit), UpdatedBy: updatedBy}
+	if existing, err := t.retrieve_credit_profile(stub, args[0]); err == nil && existing != nil { profile.Rating = existing.Rating }
+	if len(args) == 3 && args[2] != "" {
+		if t.rating_rank(args[2]) < 0 { return shim.Error(fmt.Sprintf("3rd argument must be one of %v", strings.Join(BUYER_RATINGS, ", "))) }
+		profile.Rating = args[2]
+	}
+
+	bytes, _ := json.Marshal(profile)
+	err = stub.PutState(key, bytes)
+	if err != nil { return shim.Error("Error storing credit profile") }
+
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 get_buyer_exposure - A buyer's limit, exposure and utilization, for admins, financiers and the buyer itself.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_buyer_exposure(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			test_user1
+
+	if len(args) != 1 || args[0] == "" { return shim.Error("Incorrect number of arguments. Expecting a buyer") }
+
+	username, _ := t.get_username(stub)
+	role, _ := t.get_role(stub)
+	if !t.is_admin(stub) && role != FINANCIER && username != args[0] { return t.fail(ERR_PERMISSION, "Permission Denied. get_buyer_exposure", "function", "get_buyer_exposure") }
+
+	profile, err := t.retrieve_credit_profile(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	exposure, invoiceIds, err := t.buyer_exposure(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	report := Buyer_Exposure{Buyer: args[0], Exposure: t.format_amount(DEFAULT_CURRENCY, exposure), Invoices: invoiceIds}
+	if profile != nil {
+		limit, err := t.parse_amount(DEFAULT_CURRENCY, profile.Limit)
+		if err != nil { return shim.Error("Corrupt credit profile for " + args[0]) }
+
+		available, err := money.SubUnits(limit, exposure)
+		if err != nil { return shim.Error(err.Error()) }
+
+		report.Limit = profile.Limit
+		report.Available = t.format_amount(DEFAULT_CURRENCY, available)
+		if limit > 0 {
+			utilization, err := money.ScaleUnits(exposure, big.NewRat(FULL_SHARE, limit))
+			if err != nil { return shim.Error(err.Error()) }
+			report.Utilization = t.format_hundredths(utilization)
+		}
+	}
+
+	bytes, _ := json.Marshal(report)
+	return shim.Success(bytes)
+}
+
+//	Fails when adding the amount to the buyer's exposure would take it over its credit limit. The limit and the exposure
+//	are in DEFAULT_CURRENCY, amounts in other currencies are converted, see nominal_amount.
+func (t *SimpleChaincode) check_credit_limit(stub shim.ChaincodeStubInterface, buyer string, currency string, amount int64) error {
+
+	profile, err := t.retrieve_credit_profile(stub, buyer)
+	if err != nil || profile == nil { return err }
+
+	amount, err = t.nominal_amount(stub, currency, amount)
+	if err != nil { return err }
+
+	limit, err := t.parse_amount(DEFAULT_CURRENCY, profile.Limit)
+	if err != nil { return errors.New("Corrupt credit profile for " + buyer) }
+
+	exposure, _, err := t.buyer_exposure(stub, buyer)
+	if err != nil { return err }
+
+	total, err := money.AddUnits(exposure, amount)
+	if err != nil {
+		return t.coded(ERR_LIMIT_EXCEEDED, fmt.Sprintf("Credit limit exceeded for buyer %s: exposure %s plus %s is out of range", buyer, t.format_amount(DEFAULT_CURRENCY, exposure), t.format_amount(DEFAULT_CURRENCY, amount)), "party", buyer, "limit", profile.Limit)
+	}
+	if total > limit {
+		return t.coded(ERR_LIMIT_EXCEEDED, fmt.Sprintf("Credit limit exceeded for buyer %s: exposure %s plus %s is over the limit %s", buyer, t.format_amount(DEFAULT_CURRENCY, exposure), t.format_amount(DEFAULT_CURRENCY, amount), profile.Limit), "party", buyer, "value", t.format_amount(DEFAULT_CURRENCY, total), "limit", profile.Limit)
+	}
+	return nil
+}
+
+//	The outstanding balance of the buyer's financed invoices that are not yet paid or settled
+func (t *SimpleChaincode) buyer_exposure(stub shim.ChaincodeStubInterface, buyer string) (int64, []string, error) {
+
+	invoices, err := t.get_owner_invoices(stub, buyer)
+	if err != nil { return 0, nil, err }
+
+	var exposure int64
+	invoiceIds := []string{}
+	for _, inv := range invoices {
+		if inv.Buyer != buyer { continue }
+		if inv.Status != FINANCE_OFFERED && inv.Status != APPROVED && inv.Status != OVERDUE && inv.Status != DISPUTED { continue }
+		if len(t.financiers(inv)) == 0 { continue }
+
+		outstanding, err := t.outstanding_balance(inv)
+		if err != nil { return 0, nil, err }
+
+		nominal, err := t.nominal_amount(stub, inv.Currency, outstanding)
+		if err != nil { return 0, nil, err }
+
+		exposure, err = money.AddUnits(exposure, nominal)
+		if err != nil { return 0, nil, errors.New("The exposure of buyer " + buyer + " is too large") }
+		invoiceIds = append(invoiceIds, inv.InvoiceId)
+	}
+	return exposure, invoiceIds, nil
+}
+
+func (t *SimpleChaincode) retrieve_credit_profile(stub shim.ChaincodeStubInterface, buyer string) (*Credit_Profile, error) {
+
+	key, err := stub.CreateCompositeKey(CREDIT_PREFIX, []string{buyer})
+	if err != nil { return nil, errors.New("Error building credit profile key") }
+
+	bytes, err := stub.GetState(key)
+	if err != nil { return nil, errors.New("Error retrieving credit profile for " + buyer) }
+	if bytes == nil { return nil, nil }
+
+	var profile Credit_Profile
+	err = json.Unmarshal(bytes, &profile)
+	if err != nil { return nil, errors.New("Corrupt credit profile for " + buyer) }
+
+	return &profile, nil
+}
+
+//=================================================================================================================================
+//	 Compliance Functions
+//=================================================================================================================================
+//	 blacklist_participant & unblacklist_participant - Compliance blocks a party, giving the reason, or lifts the block.
+//=================================================================================================================================
+func (t *SimpleChaincode) blacklist_participant(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0                    1
+	//			test_user1       Sanctions list match
+
+	if len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting 2") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	role, err := t.get_role(stub)
+	if 	role != COMPLIANCE {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. blacklist_participant. %v !== %v", role, COMPLIANCE), "function", "blacklist_participant", "actual", role, "expected", COMPLIANCE)
+	}
+
+	if args[0] == "" || strings.TrimSpace(args[1]) == "" { return shim.Error("Username and reason must be non-empty strings") }
+
+	key, err := stub.CreateCompositeKey(BLACKLIST_PREFIX, []string{args[0]})
+	if err != nil { return shim.Error("Error building blacklist key") }
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	entry := Blacklist_Entry{Username: args[0], Reason: args[1], BlockedBy: username, BlockedAt: now.Format(time.RFC3339)}
+
+	bytes, _ := json.Marshal(entry)
+	err = stub.PutState(key, bytes)
+	if err != nil { return shim.Error("Error storing blacklist entry") }
+
+	return shim.Success(bytes)
+}
+
+func (t *SimpleChaincode) unblacklist_participant(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			test_user1
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	role, err := t.get_role(stub)
+	if 	role != COMPLIANCE {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. unblacklist_participant. %v !== %v", role, COMPLIANCE), "function", "unblacklist_participant", "actual", role, "expected", COMPLIANCE)
+	}
+
+	key, err := stub.CreateCompositeKey(BLACKLIST_PREFIX, []string{args[0]})
+	if err != nil { return shim.Error("Error building blacklist key") }
+
+	bytes, err := stub.GetState(key)
+	if err != nil { return shim.Error("Error retrieving blacklist entry") }
+	if bytes == nil { return shim.Error(args[0] + " is not blacklisted") }
+
+	err = stub.DelState(key)
+	if err != nil { return shim.Error("Error removing blacklist entry") }
+
+	return shim.Success(nil)
+}
+
+//=================================================================================================================================
+//	 get_blocked_parties - Every blocked party with the reason, for compliance and admins.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_blocked_parties(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	role, _ := t.get_role(stub)
+	if role != COMPLIANCE && !t.is_admin(stub) { return t.fail(ERR_PERMISSION, "Permission Denied. get_blocked_parties. Caller is not compliance or an admin", "function", "get_blocked_parties") }
+
+	iter, err := stub.GetStateByPartialCompositeKey(BLACKLIST_PREFIX, []string{})
+	if err != nil { return shim.Error("Unable to query the blacklist") }
+	defer iter.Close()
+
+	entries := []Blacklist_Entry{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil { return shim.Error("Unable to read the blacklist") }
+
+		var entry Blacklist_Entry
+		err = json.Unmarshal(kv.Value, &entry)
+		if err != nil { return shim.Error("Corrupt blacklist entry " + string(kv.Value)) }
+
+		entries = append(entries, entry)
+	}
+
+	bytes, _ := json.Marshal(entries)
+	return shim.Success(bytes)
+}
+
+//	Fails with ERR_PARTY_BLOCKED when any of the parties is blacklisted, and with ERR_KYC_REQUIRED when any has no
+//	current KYC approval
+func (t *SimpleChaincode) check_parties(stub shim.ChaincodeStubInterface, parties ...string) error {
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return err }
+
+	for _, party := range parties {
+		if party == "" || party == UNDEFINED { continue }
+
+		key, err := stub.CreateCompositeKey(BLACKLIST_PREFIX, []string{party})
+		if err != nil { return errors.New("Error building blacklist key") }
+
+		bytes, err := stub.GetState(key)
+		if err != nil { return errors.New("Error retrieving blacklist entry") }
+		if bytes != nil {
+			var entry Blacklist_Entry
+			json.Unmarshal(bytes, &entry)
+			return t.coded(ERR_PARTY_BLOCKED, fmt.Sprintf("%s is blocked: %s", party, entry.Reason), "party", party, "reason", entry.Reason)
+		}
+
+		status, err := t.kyc_status(stub, party, now)
+		if err != nil { return err }
+		if status != KYC_APPROVED {
+			return t.coded(ERR_KYC_REQUIRED, fmt.Sprintf("%s has no current KYC approval. KYC status is %s", party, status), "party", party, "kycstatus", status)
+		}
+	}
+	return nil
+}
+
+//	The KYC status of a party: approved while any of its active identities has an approval that has not expired
+func (t *SimpleChaincode) kyc_status(stub shim.ChaincodeStubInterface, party string, now time.Time) (string, error) {
+
+	participants, err := t.retrieve_participants(stub, party)
+	if err != nil { return "", err }
+
+	status := KYC_PENDING
+	for _, participant := range participants {
+		if !participant.Active { continue }
+
+		if participant.KycStatus == KYC_APPROVED {
+			expiresOn, err := time.Parse(DATE_FORMAT, participant.KycExpiry)
+			if err == nil && now.Before(expiresOn.AddDate(0, 0, 1)) { return KYC_APPROVED, nil }
+			status = KYC_EXPIRED
+		} else if participant.KycStatus == KYC_EXPIRED {
+			status = KYC_EXPIRED
+		}
+	}
+	return status, nil
+}
+
+//=================================================================================================================================
+//	 set_kyc_status - Compliance records the KYC status of a party on every identity registered under its username.
+//					  An approval needs the date it expires on.
+//=================================================================================================================================
+func (t *SimpleChaincode) set_kyc_status(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0               1              2 (approved only)
+	//			test_user1       approved        2018-09-30
+
+	if len(args) != 2 && len(args) != 3 { return shim.Error("Incorrect number of arguments. Expecting 2 or 3") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	role, err := t.get_role(stub)
+	if 	role != COMPLIANCE {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. set_kyc_status. %v !== %v", role, COMPLIANCE), "function", "set_kyc_status", "actual", role, "expected", COMPLIANCE)
+	}
+
+	status := args[1]
+	if status != KYC_PENDING && status != KYC_APPROVED && status != KYC_EXPIRED {
+		return shim.Error(fmt.Sprintf("2nd argument must be %v, %v or %v", KYC_PENDING, KYC_APPROVED, KYC_EXPIRED))
+	}
+
+	expiry := ""
+	if status == KYC_APPROVED {
+		if len(args) != 3 { return shim.Error("Incorrect number of arguments. An approval needs an expiry date") }
+
+		expiresOn, err := time.Parse(DATE_FORMAT, args[2])
+		if err != nil { return shim.Error("3rd argument must be an expiry date formatted YYYY-MM-DD") }
+
+		now, err := t.get_timestamp(stub)
+		if err != nil { return shim.Error(err.Error()) }
+		if !now.Before(expiresOn.AddDate(0, 0, 1)) { return shim.Error("KYC expiry date must not be in the past") }
+
+		expiry = args[2]
+	}
+
+	participants, err := t.retrieve_participants(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+	if len(participants) == 0 { return t.fail(ERR_NOT_FOUND, "Participant " + args[0] + " is not registered", "username", args[0]) }
+
+	for i := range participants {
+		participants[i].KycStatus = status
+		participants[i].KycExpiry = expiry
+		participants[i].KycUpdatedBy = username
+
+		err = t.save_participant(stub, participants[i])
+		if err != nil { return shim.Error(err.Error()) }
+	}
+
+	bytes, _ := json.Marshal(participants)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 Notification Functions
+//=================================================================================================================================
+//	 set_notification_preferences - The caller names the events it wants to be told about. An empty list silences
+//									every event; participants that never set preferences are told about all of them.
+//=================================================================================================================================
+func (t *SimpleChaincode) set_notification_preferences(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			["invoice_approved","invoice_settled"]
+
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	preference := Notification_Preference{Username: username, Events: []string{}}
+	err = json.Unmarshal([]byte(args[0]), &preference.Events)
+	if err != nil { return shim.Error("1st argument must be a JSON array of event names") }
+
+	for _, event := range preference.Events {
+		if event == "" { return shim.Error("Event names must be non-empty strings") }
+	}
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+	preference.UpdatedAt = now.Format(time.RFC3339)
+
+	key, err := stub.CreateCompositeKey(NOTIFY_PREFIX, []string{username})
+	if err != nil { return shim.Error("Error building notification preference key") }
+
+	bytes, _ := json.Marshal(preference)
+	err = stub.PutState(key, bytes)
+	if err != nil { return shim.Error("Error storing notification preferences") }
+
+	return shim.Success(bytes)
+}
+
+func (t *SimpleChaincode) get_notification_preferences(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	preference, err := t.retrieve_notification_preference(stub, username)
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(preference)
+	return shim.Success(bytes)
+}
+
+//	A participant's notification preferences, nil when it never set any
+func (t *SimpleChaincode) retrieve_notification_preference(stub shim.ChaincodeStubInterface, username string) (*Notification_Preference, error) {
+
+	key, err := stub.CreateCompositeKey(NOTIFY_PREFIX, []string{username})
+	if err != nil { return nil, errors.New("Error building notification preference key") }
+
+	bytes, err := stub.GetState(key)
+	if err != nil { return nil, errors.New("Error retrieving notification preferences for " + username) }
+	if bytes == nil { return nil, nil }
+
+	var preference Notification_Preference
+	err = json.Unmarshal(bytes, &preference)
+	if err != nil { return nil, errors.New("Corrupt notification preferences for " + username) }
+
+	return &preference, nil
+}
+
+//	The parties of an invoice: its seller, buyer, financiers and guarantor
+func (t *SimpleChaincode) parties(inv Invoice) []string {
+
+	parties := append([]string{inv.Seller, inv.Buyer}, t.financiers(inv)...)
+	if inv.Guarantee != nil { parties = append(parties, inv.Guarantee.Guarantor) }
+	return parties
+}
+
+//	The parties that want to be told about an event, each once, in the order given
+func (t *SimpleChaincode) recipients(stub shim.ChaincodeStubInterface, event string, parties []string) ([]string, error) {
+
+	recipients := []string{}
+	seen := map[string]bool{}
+	for _, party := range parties {
+		if party == "" || party == UNDEFINED || seen[party] { continue }
+		seen[party] = true
+
+		preference, err := t.retrieve_notification_preference(stub, party)
+		if err != nil { return nil, err }
+
+		wanted := preference == nil
+		if preference != nil {
+			for _, name := range preference.Events {
+				if name == event { wanted = true }
+			}
+		}
+		if wanted { recipients = append(recipients, party) }
+	}
+	return recipients, nil
+}
+
+//=================================================================================================================================
+//	 Participant Registry Functions
+//=================================================================================================================================
+//	 register_participant - Admin only. Maps an identity to a username and role, replacing any previous entry.
+//=================================================================================================================================
+func (t *SimpleChaincode) register_participant(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0                   1              2              3
+	//			x509::CN=user1...     Org1MSP       test_user1       seller
+
+	if len(args) != 4 { return shim.Error("Incorrect number of arguments. Expecting 4") }
+
+	if !t.is_admin(stub) { return t.fail(ERR_PERMISSION, "Permission Denied. register_participant. Caller is not an admin", "function", "register_participant") }
+
+	role := args[3]
+	if role != SELLER && role != BUYER && role != FINANCIER && role != COMPLIANCE && role != GUARANTOR {
+		return shim.Error(fmt.Sprintf("Invalid role %v. Expecting %v, %v, %v, %v or %v", role, SELLER, BUYER, FINANCIER, COMPLIANCE, GUARANTOR))
+	}
+	if args[0] == "" || args[1] == "" || args[2] == "" { return shim.Error("Identity, MSP ID and username must be non-empty strings") }
+
+	caller, err := t.get_identity(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	participant := Participant{Id: args[0], MspId: args[1], Username: args[2], Role: role, Active: true, RegisteredBy: caller.Id}
+
+	if existing, err := t.retrieve_participant(stub, args[1], args[0]); err == nil && existing.Username == participant.Username {
+		participant.DualControl = existing.DualControl && role == BUYER
+		participant.KycStatus, participant.KycExpiry, participant.KycUpdatedBy = existing.KycStatus, existing.KycExpiry, existing.KycUpdatedBy
+	}
+
+	err = t.save_participant(stub, participant)
+	if err != nil { return shim.Error(err.Error()) }
+
+	bytes, _ := json.Marshal(participant)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 set_dual_control - Admin only. Turns dual control of a buyer's approvals on or off for every identity registered
+//						under its username. Under dual control a second identity must countersign each approval.
+//=================================================================================================================================
+func (t *SimpleChaincode) set_dual_control(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0              1
+	//			test_user2       true
+
+	if len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting 2") }
+
+	if !t.is_admin(stub) { return t.fail(ERR_PERMISSION, "Permission Denied. set_dual_control. Caller is not an admin", "function", "set_dual_control") }
+
+	enabled, err := strconv.ParseBool(args[1])
+	if err != nil { return shim.Error("2nd argument must be true or false") }
+
+	participants, err := t.retrieve_participants(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+	if len(participants) == 0 { return t.fail(ERR_NOT_FOUND, "Participant " + args[0] + " is not registered", "username", args[0]) }
+
+	for i := range participants {
+		if participants[i].Role != BUYER { return shim.Error("Dual control only applies to buyers. " + args[0] + " is a " + participants[i].Role) }
+		participants[i].DualControl = enabled
+
+		err = t.save_participant(stub, participants[i])
+		if err != nil { return shim.Error(err.Error()) }
+	}
+
+	bytes, _ := json.Marshal(participants)
+	return shim.Success(bytes)
+}
+
+//	Every registry entry of a username, including revoked ones
+func (t *SimpleChaincode) retrieve_participants(stub shim.ChaincodeStubInterface, username string) ([]Participant, error) {
+
+	iter, err := stub.GetStateByPartialCompositeKey(PARTICIPANT_PREFIX, []string{})
+	if err != nil { return nil, errors.New("Unable to query the participant registry") }
+	defer iter.Close()
+
+	participants := []Participant{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil { return nil, errors.New("Unable to read the participant registry") }
 
-func (t *SimpleChaincode) get_username(stub shim.ChaincodeStubInterface) (string, error) {
+		var participant Participant
+		err = json.Unmarshal(kv.Value, &participant)
+		if err != nil { return nil, errors.New("Corrupt participant record " + string(kv.Value)) }
 
-	role, err := stub.ReadCertAttribute("username");
-	if err != nil { return "", errors.New("Couldn't retrieve username for caller.") }
-	return string(role), nil
+		if participant.Username == username { participants = append(participants, participant) }
+	}
+	return participants, nil
 }
 
-func (t *SimpleChaincode) get_role(stub shim.ChaincodeStubInterface) (string, error) {
+//	Whether any active identity of a buyer is under dual control
+func (t *SimpleChaincode) dual_control(stub shim.ChaincodeStubInterface, buyer string) (bool, error) {
 
-	role, err := stub.ReadCertAttribute("role");
-	if err != nil { return "", errors.New("Couldn't retrieve role for caller.") }
-	return string(role), nil
-}
+	participants, err := t.retrieve_participants(stub, buyer)
+	if err != nil { return false, err }
 
+	for _, participant := range participants {
+		if participant.Active && participant.DualControl { return true, nil }
+	}
+	return false, nil
+}
 
-//==============================================================================================================================
-//	 retrieve_invoice
-//==============================================================================================================================
-func (t *SimpleChaincode) retrieve_invoice(stub shim.ChaincodeStubInterface, invoiceId string) (Invoice, error) {
+//=================================================================================================================================
+//	 revoke_participant - Admin only. Deactivates an identity's registry entry; the record is kept for audit.
+//=================================================================================================================================
+func (t *SimpleChaincode) revoke_participant(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	var inv Invoice
+	//Args
+	//				0                   1
+	//			x509::CN=user1...     Org1MSP
 
-	bytes, err := stub.GetState(invoiceId);
+	if len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting 2") }
 
-	if err != nil { return inv, errors.New("RETRIEVE_INVOICE: Error retrieving invoice with invoice Id = " + invoiceId) }
+	if !t.is_admin(stub) { return t.fail(ERR_PERMISSION, "Permission Denied. revoke_participant. Caller is not an admin", "function", "revoke_participant") }
 
-	err = json.Unmarshal(bytes, &inv);
+	participant, err := t.retrieve_participant(stub, args[1], args[0])
+	if err != nil { return t.fail(ERR_NOT_FOUND, "Participant not found", "id", args[0], "mspid", args[1]) }
 
-    if err != nil { return inv, errors.New("RETRIEVE_INVOICE: Corrupt invoice record " + string(bytes))	}
+	if !participant.Active { return t.fail(ERR_INVALID_STATE, "Participant " + participant.Username + " has already been revoked", "username", participant.Username) }
 
-	return inv, nil
-}
+	caller, err := t.get_identity(stub)
+	if err != nil { return shim.Error(err.Error()) }
 
-//==============================================================================================================================
-// save_changes - Writes to the ledger the Vehicle struct passed in a JSON format. Uses the shim file's
-//				  method 'PutState'.
-//==============================================================================================================================
-func (t *SimpleChaincode) save_changes(stub shim.ChaincodeStubInterface, inv Invoice) (bool, error) {
+	participant.Active = false
+	participant.RevokedBy = caller.Id
 
-	bytes, err := json.Marshal(inv)
+	err = t.save_participant(stub, participant)
+	if err != nil { return shim.Error(err.Error()) }
 
-	if err != nil { return false, errors.New("Error converting invoice record") }
+	bytes, _ := json.Marshal(participant)
+	return shim.Success(bytes)
+}
 
-	err = stub.PutState(inv.InvoiceId, bytes)
+//=================================================================================================================================
+//	 get_participants - Admin only. Lists every registry entry, including revoked ones.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_participants(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	if err != nil { return false, errors.New("Error storing invoice record") }
+	if !t.is_admin(stub) { return t.fail(ERR_PERMISSION, "Permission Denied. get_participants. Caller is not an admin", "function", "get_participants") }
 
-	return true, nil
-}
+	iter, err := stub.GetStateByPartialCompositeKey(PARTICIPANT_PREFIX, []string{})
+	if err != nil { return shim.Error("Unable to query the participant registry") }
+	defer iter.Close()
 
-//==============================================================================================================================
-//	 Router Functions
-//==============================================================================================================================
-//	Invoke - Called on chaincode invoke. Takes a function name passed and calls that function. Converts some
-//		  initial arguments passed to other things for use in the called function.
-//==============================================================================================================================
-func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	participants := []Participant{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil { return shim.Error("Unable to read the participant registry") }
 
+		var participant Participant
+		err = json.Unmarshal(kv.Value, &participant)
+		if err != nil { return shim.Error("Corrupt participant record " + string(kv.Value)) }
 
-	if function == "create_invoice" {
-        return t.create_invoice(stub, args)
-	} else if function == "approve_trade"{
-		return t.approve_trade(stub, args)
-	} else if function == "reject_trade"{
-		return t.reject_trade(stub, args)
-	} else if function == "accept_trade"{
-		return t.accept_trade(stub, args)
+		participants = append(participants, participant)
 	}
 
-    return nil, errors.New("Received unknown function invocation: " + function)
+	bytes, _ := json.Marshal(participants)
+	return shim.Success(bytes)
 }
+
 //=================================================================================================================================
-//	Query - Called on chaincode query. Takes a function name passed and calls that function. Passes the
-//  		initial arguments passed are passed on to the called function.
+//	 get_invoice_audit - Every change to an invoice, oldest first, from the history of its key: who made it, in which
+//						 role and through which function, and how it moved the status. Visible to the invoice's
+//						 parties and to admins. Versions written before changes were stamped have no actor.
 //=================================================================================================================================
-func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (t *SimpleChaincode) get_invoice_audit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	if function == "get_invoice_details" {
-		if len(args) != 2 { return nil, errors.New("QUERY: Incorrect number of arguments passed") }
-		inv, err := t.retrieve_invoice(stub, args[0])
-		if err != nil { return nil, errors.New("QUERY: Error retrieving invoice "+err.Error()) }
-		return t.get_invoice_details(stub, inv, args[1])
-	}  else if function == "get_invoices" {
-		return t.get_invoices(stub, args)
-	}  else if function == "get_opening_trade_invoices" {
-		return t.get_opening_trade_invoices(stub, args)
-	}  else if function == "read" {											
-		return t.read(stub, args)
-	}  else if function == "get_username" {			
-		return stub.ReadCertAttribute("username");
-	}  else if function == "get_role" {
-        return stub.ReadCertAttribute("role");
-    }  
+	//Args
+	//				0
+	//			123443232
 
-	return nil, errors.New("Received unknown function query " + function)
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
 
-}
+	inv, err := t.retrieve_invoice(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
 
+	username, _ := t.get_username(stub)
+	if _, err = t.get_invoice_details(stub, inv, username); err != nil && !t.is_admin(stub) {
+		return t.fail(ERR_PERMISSION, "Permission Denied. get_invoice_audit", "function", "get_invoice_audit")
+	}
 
-func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var name, jsonResp string
-	var err error
+	iter, err := stub.GetHistoryForKey(inv.InvoiceId)
+	if err != nil { return shim.Error("Unable to read the history of invoice " + inv.InvoiceId) }
+	defer iter.Close()
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the var to query")
-	}
+	entries := []Audit_Entry{}
+	status := ""
+	for iter.HasNext() {
+		modification, err := iter.Next()
+		if err != nil { return shim.Error("Unable to read the history of invoice " + inv.InvoiceId) }
 
-	name = args[0]
-	valAsbytes, err := stub.GetState(name)									//get the var from chaincode state
-	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
-		return nil, errors.New(jsonResp)
+		entry := Audit_Entry{TxId: modification.TxId, StatusBefore: status, Deleted: modification.IsDelete}
+		if modification.Timestamp != nil {
+			entry.Timestamp = time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos)).UTC().Format(time.RFC3339)
+		}
+
+		if !modification.IsDelete {
+			var version Invoice
+			err = json.Unmarshal(modification.Value, &version)
+			if err != nil { return shim.Error("Corrupt version of invoice " + inv.InvoiceId + " in transaction " + modification.TxId) }
+
+			if legacy, ok := LEGACY_STATUSES[version.Status]; ok { version.Status = legacy }
+			status = version.Status
+
+			if version.LastChange != nil {
+				entry.Function = version.LastChange.Function
+				entry.Actor = version.LastChange.Actor
+				entry.ActorId = version.LastChange.ActorId
+				entry.ActorMspId = version.LastChange.ActorMspId
+				entry.Role = version.LastChange.Role
+			}
+		}
+		entry.StatusAfter = status
+
+		entries = append(entries, entry)
 	}
 
-	return valAsbytes, nil													//send it onward
+	bytes, _ := json.Marshal(entries)
+	return shim.Success(bytes)
 }
 
 //=================================================================================================================================
-//	 Create Function
-//=================================================================================================================================
-//	 Create Invoice - Creates the initial JSON for the invoice and then saves it to the ledger.
+//	 get_seller_score - Scores a seller for financiers pricing its invoices, see Seller_Score. Open to financiers, admins
+//						and the seller itself. Buyer approved payables are left out of the days to approval.
 //=================================================================================================================================
-func (t *SimpleChaincode) create_invoice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+func (t *SimpleChaincode) get_seller_score(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	//Args
-	//				0               1              2              3            
-	//			123443232        100.00           0.05         test_user1
-
-	var inv Invoice
+	//				0
+	//			test_user0
 
-	var invoiceId = args[0]
+	if len(args) != 1 { return shim.Error("Incorrect number of arguments. Expecting 1") }
 
 	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
 
-	invoice_json := `{ "invoiceid": "` + invoiceId + `", "amount": "` + args[1] + `", "currency": "USD", "seller": "` + username + `", "buyer": "` + args[3] + `", "duedate": "UNDEFINED", "status": "0", "financier":"UNDEFINED", "discount":"` + args[2] + `"}`
-
-	err = json.Unmarshal([]byte(invoice_json), &inv)							// Convert the JSON defined above into a vehicle object for go
+	role, _ := t.get_role(stub)
+	if role != FINANCIER && username != args[0] && !t.is_admin(stub) {
+		return t.fail(ERR_PERMISSION, fmt.Sprintf("Permission Denied. get_seller_score. %v !== %v", role, FINANCIER), "function", "get_seller_score", "actual", role, "expected", FINANCIER)
+	}
 
-	if err != nil { return nil, errors.New("Invalid JSON object") }
+	invoices, err := t.get_owner_invoices(stub, args[0])
+	if err != nil { return shim.Error(err.Error()) }
 
-	record, err := stub.GetState(inv.InvoiceId) 								// If not an error then a record exists so cant create a new car with this V5cID as it must be unique
+	score := Seller_Score{Seller: args[0]}
+	var approvalSeconds int64
 
-	if record != nil { return nil, errors.New("Invoice already exists") }
+	for _, inv := range invoices {
+		if inv.Seller != args[0] || inv.Status == PAYABLE_PENDING { continue }
 
-	role, err := t.get_role(stub)
+		score.InvoicesIssued++
+		if len(inv.Disputes) > 0 { score.Disputed++ }
+		if len(t.financiers(inv)) == 0 { continue }
 
-	if 	role != SELLER {
-		return nil, errors.New(fmt.Sprintf("Permission Denied. create_invoice. %v !== %v", role, SELLER))
-	}
+		reached, err := t.first_reached(stub, inv.InvoiceId)
+		if err != nil { return shim.Error(err.Error()) }
 
-	_, err  = t.save_changes(stub, inv)
+		approvedAt, approved := reached[APPROVED]
+		if !approved { continue }
 
-	if err != nil { fmt.Printf("CREATE_INVOICE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+		score.Financed++
+		if _, overdue := reached[OVERDUE]; overdue { score.Defaulted++ }
 
-	bytes, err := stub.GetState("invoiceIDs")
+		issuedAt, issued := reached[ISSUED]
+		if inv.BuyerInitiated || !issued { continue }
 
-	if err != nil { return nil, errors.New("Unable to get invoiceIDs") }
+		score.Approved++
+		approvalSeconds += int64(approvedAt.Sub(issuedAt).Seconds())
+	}
 
-	var invoiceIDs Invoice_Holder
+	var disputeRate, defaultRate, avgDays int64								// In hundredths
+	if score.InvoicesIssued > 0 { disputeRate = int64(score.Disputed) * FULL_SHARE / int64(score.InvoicesIssued) }
+	if score.Financed > 0 { defaultRate = int64(score.Defaulted) * FULL_SHARE / int64(score.Financed) }
+	if score.Approved > 0 { avgDays = approvalSeconds * HUNDREDTHS / (24 * 60 * 60) / int64(score.Approved) }
 
-	err = json.Unmarshal(bytes, &invoiceIDs)
+	approvalPenalty := avgDays / 3
+	if approvalPenalty > 20 * HUNDREDTHS { approvalPenalty = 20 * HUNDREDTHS }
 
-	if err != nil {	return nil, errors.New("Corrupt Invoice_Holder record") }
+	points := FULL_SHARE - disputeRate * 3 / 10 - defaultRate / 2 - approvalPenalty
+	if points < 0 { points = 0 }
 
-	invoiceIDs.Invoices = append(invoiceIDs.Invoices, invoiceId)
+	score.DisputeRate = t.format_hundredths(disputeRate)
+	score.DefaultRate = t.format_hundredths(defaultRate)
+	score.AvgDaysToApproval = t.format_hundredths(avgDays)
+	score.Score = t.format_hundredths(points)
 
-	bytes, err = json.Marshal(invoiceIDs)
+	bytes, _ := json.Marshal(score)
+	return shim.Success(bytes)
+}
 
-	if err != nil { fmt.Print("Error creating Invoice_Holder record") }
+//	When an invoice first reached each of the statuses it has been in, from the history of its key
+func (t *SimpleChaincode) first_reached(stub shim.ChaincodeStubInterface, invoiceId string) (map[string]time.Time, error) {
 
-	err = stub.PutState("invoiceIDs", bytes)
+	iter, err := stub.GetHistoryForKey(invoiceId)
+	if err != nil { return nil, errors.New("Unable to read the history of invoice " + invoiceId) }
+	defer iter.Close()
 
-	if err != nil { return nil, errors.New("Unable to put the state") }
+	reached := map[string]time.Time{}
+	for iter.HasNext() {
+		modification, err := iter.Next()
+		if err != nil { return nil, errors.New("Unable to read the history of invoice " + invoiceId) }
+		if modification.IsDelete || modification.Timestamp == nil { continue }
 
-	return nil, nil
+		var version Invoice
+		if json.Unmarshal(modification.Value, &version) != nil { continue }
+		if legacy, ok := LEGACY_STATUSES[version.Status]; ok { version.Status = legacy }
 
+		if _, ok := reached[version.Status]; !ok {
+			reached[version.Status] = time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos)).UTC()
+		}
+	}
+	return reached, nil
 }
 
+//=================================================================================================================================
+//	 Archive Functions
+//=================================================================================================================================
+//	 archive_invoice - An admin moves settled, paid, cancelled and void invoices closed for longer than
+//					   ARCHIVE_AFTER_DAYS out of the world state and its indexes into the archive, or only the invoices
+//					   passed as arguments. Their key history stays as it was. Returns the IDs of the invoices archived.
+//=================================================================================================================================
+func (t *SimpleChaincode) archive_invoice(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
+	//Args (optional)
+	//				0               1       ...
+	//			123443232       123443233
 
-func (t *SimpleChaincode) accept_trade(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if !t.is_admin(stub) { return t.fail(ERR_PERMISSION, "Permission Denied. archive_invoice. Caller is not an admin", "function", "archive_invoice") }
 
-	//Args
-	//				0           
-	//			123443232        
-	var inv Invoice
-	username, err := t.get_username(stub);
-	role, err := t.get_role(stub)
-	var invoiceId = args[0]
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
 
+	invoiceIds := args
+	if len(invoiceIds) == 0 {
+		invoiceIds, err = t.get_invoice_ids(stub, SETTLED, PAID, CANCELLED, VOID)
+		if err != nil { return shim.Error(err.Error()) }
+	}
 
-	inv, err = t.retrieve_invoice(stub, invoiceId)
+	archived := []string{}
+	for _, invoiceId := range invoiceIds {
 
-	if 	role != FINANCIER {						
-		return nil, errors.New(fmt.Sprintf("Permission Denied. accept_trade. %v !== %v", role, FINANCIER))
-	}
+		inv, err := t.retrieve_invoice(stub, invoiceId)
+		if err != nil { return shim.Error(err.Error()) }
 
-	inv.Financier = username
-	inv.Status = "1"
+		if inv.Status != SETTLED && inv.Status != PAID && inv.Status != CANCELLED && inv.Status != VOID {
+			if len(args) == 0 { continue }
+			return t.fail(ERR_INVALID_STATE, fmt.Sprintf("Invoice %v cannot be archived while %v", inv.InvoiceId, inv.Status), "invoiceid", inv.InvoiceId, "status", inv.Status)
+		}
 
-	_, err  = t.save_changes(stub, inv)
+		closedAt, err := time.Parse(time.RFC3339, inv.IssuedAt)
+		if len(inv.Transitions) > 0 { closedAt, err = time.Parse(time.RFC3339, inv.Transitions[len(inv.Transitions) - 1].Timestamp) }
+		if err != nil || now.Sub(closedAt).Hours() < ARCHIVE_AFTER_DAYS * 24 { continue }
 
-	if err != nil { fmt.Printf("OFFER_TRADE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+		err = t.archive(stub, inv, now)
+		if err != nil { return shim.Error(err.Error()) }
 
-	return nil, nil
+		archived = append(archived, inv.InvoiceId)
+	}
 
+	bytes, _ := json.Marshal(archived)
+	return shim.Success(bytes)
 }
 
-func (t *SimpleChaincode) approve_trade(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+//	Fails if an invoice ID is taken by a live or an archived invoice, so archiving never frees an ID for reuse
+func (t *SimpleChaincode) check_new_invoice_id(stub shim.ChaincodeStubInterface, invoiceId string) error {
 
-	//Args
-	//				0                
-	//			123443232         
-	var inv Invoice
-	var invoiceId = args[0]
+	record, err := stub.GetState(invoiceId)
+	if err != nil { return errors.New("Error retrieving invoice record") }
+	if record != nil { return t.coded(ERR_DUPLICATE, "Invoice " + invoiceId + " already exists", "invoiceid", invoiceId) }
 
-	username, err := t.get_username(stub);
+	key, err := stub.CreateCompositeKey(ARCHIVE_PREFIX, []string{invoiceId})
+	if err != nil { return errors.New("Error building archive key") }
 
-	inv, err = t.retrieve_invoice(stub, invoiceId)
+	record, err = stub.GetState(key)
+	if err != nil { return errors.New("Error retrieving archived invoice " + invoiceId) }
+	if record != nil { return t.coded(ERR_DUPLICATE, "Invoice " + invoiceId + " already exists in the archive", "invoiceid", invoiceId) }
 
-	if  username != inv.Buyer {
-		return nil, errors.New(fmt.Sprintf("Permission Denied. approve_trade. %v !== %v", username, inv.Buyer))
+	return nil
+}
+
+//	Writes an invoice, without its private terms, to the archive and removes it and its index keys from the world state
+func (t *SimpleChaincode) archive(stub shim.ChaincodeStubInterface, inv Invoice, now time.Time) error {
+
+	keys, err := t.index_keys(stub, inv)
+	if err != nil { return err }
+
+	for key := range keys {
+		err = stub.DelState(key)
+		if err != nil { return errors.New("Error removing invoice index") }
 	}
 
-	inv.Status = "2"
+	err = stub.DelState(inv.InvoiceId)
+	if err != nil { return errors.New("Error removing invoice record") }
 
-	_, err  = t.save_changes(stub, inv)
+	inv = t.without_terms(inv)
+	inv.ArchivedAt = now.Format(time.RFC3339)
 
-	if err != nil { fmt.Printf("APPROVE_TRADE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	key, err := stub.CreateCompositeKey(ARCHIVE_PREFIX, []string{inv.InvoiceId})
+	if err != nil { return errors.New("Error building archive key") }
 
-	return nil, nil
+	bytes, _ := json.Marshal(inv)
+	err = stub.PutState(key, bytes)
+	if err != nil { return errors.New("Error storing archived invoice") }
 
+	for _, owner := range append([]string{inv.Seller, inv.Buyer}, t.financiers(inv)...) {
+		if owner == "" || owner == UNDEFINED { continue }
+
+		err = index.CreateIndex(stub, ARCHIVE_INDEX, []string{owner, inv.InvoiceId})
+		if err != nil { return err }
+	}
+	return nil
 }
 
-func (t *SimpleChaincode) reject_trade(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+//=================================================================================================================================
+//	 get_archived_invoices - The caller's archived invoices, or one archived invoice by ID for its parties and admins.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_archived_invoices(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	//Args
-	//				0                 
-	//			123443232         
-	var inv Invoice
-	var invoiceId = args[0]
+	//Args (optional)
+	//				0
+	//			123443232
 
-	username, err := t.get_username(stub);
+	if len(args) > 1 { return shim.Error("Incorrect number of arguments. Expecting at most 1") }
 
-	inv, err = t.retrieve_invoice(stub, invoiceId)
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
 
-	if  username != inv.Buyer {
-		return nil, errors.New(fmt.Sprintf("Permission Denied. reject_trade. %v !== %v", username, inv.Buyer))
+	invoiceIds := args
+	if len(invoiceIds) == 0 {
+		invoiceIds, err = index.IDs(stub, ARCHIVE_INDEX, username)
+		if err != nil { return shim.Error(err.Error()) }
 	}
 
-	if inv.Status == "0" {
-		return nil, errors.New(fmt.Sprintf("Permission Denied. reject_trade. This invoice hasn't been bought by a third party financier"))
-	}
-	if inv.Status == "2" {
-		return nil, errors.New(fmt.Sprintf("Permission Denied. reject_trade. This invoice has already been approved."))
-	}
+	invoices := []Invoice{}
+	for _, invoiceId := range invoiceIds {
 
-	inv.Status = "0"
-	inv.Financier = "UNDEFINED"
+		key, err := stub.CreateCompositeKey(ARCHIVE_PREFIX, []string{invoiceId})
+		if err != nil { return shim.Error("Error building archive key") }
 
-	_, err  = t.save_changes(stub, inv)
+		bytes, err := stub.GetState(key)
+		if err != nil { return shim.Error("Error retrieving archived invoice " + invoiceId) }
+		if bytes == nil { return t.fail(ERR_NOT_FOUND, "Archived invoice " + invoiceId + " not found", "invoiceid", invoiceId) }
+
+		var inv Invoice
+		err = json.Unmarshal(bytes, &inv)
+		if err != nil { return shim.Error("Corrupt archived invoice " + string(bytes)) }
 
-	if err != nil { fmt.Printf("REJECT_TRADE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+		if _, err = t.get_invoice_details(stub, inv, username); err != nil && !t.is_admin(stub) {
+			return t.fail(ERR_PERMISSION, "Permission Denied. get_archived_invoices", "function", "get_archived_invoices", "actual", username, "invoiceid", invoiceId)
+		}
 
-	return nil, nil
+		invoices = append(invoices, inv)
+	}
 
+	bytes, _ := json.Marshal(invoices)
+	return shim.Success(bytes)
 }
 
 //=================================================================================================================================
@@ -349,16 +7762,16 @@ func (t *SimpleChaincode) reject_trade(stub shim.ChaincodeStubInterface, args []
 //=================================================================================================================================
 func (t *SimpleChaincode) get_invoice_details(stub shim.ChaincodeStubInterface, inv Invoice, caller string) ([]byte, error) {
 
-	bytes, err := json.Marshal(inv)
+	bytes, err := json.Marshal(t.visible_terms(inv, caller, ""))
 
 	if err != nil { return nil, errors.New("GET_INVOICE_DETAILS: Invalid invoice object") }
 
 	if 		inv.Seller  == caller		||
 			inv.Buyer	== caller	||
-			inv.Financier == caller	 {
+			t.is_financier(inv, caller)	 {
 				return bytes, nil
 	} else {
-			return nil, errors.New("Permission Denied. get_invoice_details")
+			return nil, t.coded(ERR_PERMISSION, "Permission Denied. get_invoice_details", "function", "get_invoice_details", "actual", caller, "invoiceid", inv.InvoiceId)
 	}
 
 }
@@ -367,29 +7780,19 @@ func (t *SimpleChaincode) get_invoice_details(stub shim.ChaincodeStubInterface,
 //	 get_invoices
 //=================================================================================================================================
 
-func (t *SimpleChaincode) get_invoices(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+func (t *SimpleChaincode) get_invoices(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	
-	bytes, err := stub.GetState("invoiceIDs")
-	if err != nil { return nil, errors.New("Unable to get invoiceIDs") }
-
 	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
 
-	var invoiceIDs Invoice_Holder
-
-	err = json.Unmarshal(bytes, &invoiceIDs)
-
-	if err != nil {	return nil, errors.New("Corrupt Invoice_Holder") }
+	invoices, err := t.get_owner_invoices(stub, username)
+	if err != nil { return shim.Error(err.Error()) }
 
 	result := "["
 
 	var temp []byte
-	var inv Invoice
-
-	for _, invoiceId := range invoiceIDs.Invoices {
-
-		inv, err = t.retrieve_invoice(stub, invoiceId)
 
-		if err != nil {return nil, errors.New("Failed to retrieve Invoice")}
+	for _, inv := range invoices {
 
 		temp, err = t.get_invoice_details(stub, inv, username)
 
@@ -404,34 +7807,41 @@ func (t *SimpleChaincode) get_invoices(stub shim.ChaincodeStubInterface, args []
 		result = result[:len(result)-1] + "]"
 	}
 
-	return []byte(result), nil
+	return shim.Success([]byte(result))
 }
 
-func (t *SimpleChaincode) get_opening_trade_invoices(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	bytes, err := stub.GetState("invoiceIDs")
+func (t *SimpleChaincode) get_opening_trade_invoices(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	if err != nil { return nil, errors.New("Unable to get invoiceIDs") }
+	//Args (optional)
+	//				0
+	//			guaranteed
 
-	var invoiceIDs Invoice_Holder
+	guaranteedOnly := len(args) > 0 && args[0] == "guaranteed"
 
-	err = json.Unmarshal(bytes, &invoiceIDs)
+	username, _ := t.get_username(stub)
+	role, _ := t.get_role(stub)
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
 
-	if err != nil {	return nil, errors.New("Corrupt Invoice_Holder") }
+	invoiceIds, err := t.get_invoice_ids(stub, ISSUED, REJECTED)
+
+	if err != nil { return shim.Error(err.Error()) }
 
 	result := "["
 
 	var inv Invoice
 
-	for _, invoiceId := range invoiceIDs.Invoices {
+	for _, invoiceId := range invoiceIds {
 
 		inv, err = t.retrieve_invoice(stub, invoiceId)
-		if err != nil {return nil, errors.New("Failed to retrieve Invoice")}
+		if err != nil {return shim.Error("Failed to retrieve Invoice")}
 
-		if inv.Status == "0" {
-			bytes, err := json.Marshal(inv)
-			if err != nil { return nil, errors.New("GET_INVOICE_DETAILS: Invalid invoice object") }
-			result += string(bytes) + ","
-		}
+		if guaranteedOnly && !t.guaranteed(inv, now) { continue }
+
+		bytes, err := json.Marshal(t.visible_terms(inv, username, role))
+		if err != nil { return shim.Error("GET_INVOICE_DETAILS: Invalid invoice object") }
+		result += string(bytes) + ","
 	}
 
 	if len(result) == 1 {
@@ -440,7 +7850,335 @@ func (t *SimpleChaincode) get_opening_trade_invoices(stub shim.ChaincodeStubInte
 		result = result[:len(result)-1] + "]"
 	}
 
-	return []byte(result), nil
+	return shim.Success([]byte(result))
+}
+
+//=================================================================================================================================
+//	 browse_market - The invoices open to financiers that match a financier's mandate, see Market_Filter, sorted by
+//					 amount, due date or issue date. Uses a CouchDB selector and falls back to scanning the status index
+//					 on LevelDB; either way the filter is checked again in chaincode.
+//=================================================================================================================================
+func (t *SimpleChaincode) browse_market(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args (optional)
+	//				0
+	//			{"currency":"EUR","maxdaystomaturity":90,"minbuyerrating":"A","guaranteed":true,"sort":"-amount"}
+
+	if len(args) > 1 { return shim.Error("Incorrect number of arguments. Expecting at most 1") }
+
+	var filter Market_Filter
+	if len(args) == 1 && args[0] != "" {
+		if err := json.Unmarshal([]byte(args[0]), &filter); err != nil { return shim.Error("1st argument must be a JSON market filter") }
+	}
+
+	sortField := strings.TrimPrefix(filter.Sort, "-")
+	if sortField != "" && sortField != "amount" && sortField != "duedate" && sortField != "issuedat" {
+		return shim.Error("Sort must be amount, duedate or issuedat, with a leading - for descending")
+	}
+	if filter.MinBuyerRating != "" && t.rating_rank(filter.MinBuyerRating) < 0 {
+		return shim.Error(fmt.Sprintf("Invalid buyer rating %v. Expecting one of %v", filter.MinBuyerRating, strings.Join(BUYER_RATINGS, ", ")))
+	}
+
+	username, _ := t.get_username(stub)
+	role, _ := t.get_role(stub)
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	selector := map[string]interface{}{"status": map[string][]string{"$in": {ISSUED, REJECTED}}}
+	if filter.Currency != "" { selector["currency"] = filter.Currency }
+	amountRange := map[string]int64{}
+	if filter.MinAmount != "" {
+		minAmount, err := t.parse_amount(DEFAULT_CURRENCY, filter.MinAmount)
+		if err != nil { return shim.Error("Invalid minamount " + filter.MinAmount) }
+		amountRange["$gte"] = minAmount
+	}
+	if filter.MaxAmount != "" {
+		maxAmount, err := t.parse_amount(DEFAULT_CURRENCY, filter.MaxAmount)
+		if err != nil { return shim.Error("Invalid maxamount " + filter.MaxAmount) }
+		amountRange["$lte"] = maxAmount
+	}
+	if len(amountRange) > 0 { selector["amountunits"] = amountRange }
+	if filter.MaxDaysToMaturity > 0 {
+		selector["duedate"] = map[string]string{"$lte": now.AddDate(0, 0, filter.MaxDaysToMaturity).Format(DATE_FORMAT)}
+	}
+	if filter.Guaranteed { selector["guarantee"] = map[string]bool{"$exists": true} }
+
+	queryAsBytes, _ := json.Marshal(map[string]interface{}{"selector": selector})
+
+	candidates := []Invoice{}
+	iter, err := stub.GetQueryResult(string(queryAsBytes))
+	if err == nil {
+		defer iter.Close()
+		for iter.HasNext() {
+			kv, err := iter.Next()
+			if err != nil { return shim.Error("Unable to read invoices") }
+			if strings.HasPrefix(kv.Key, "\x00") { continue }				// Offers, archives and history versions are composite keys
+
+			inv, err := t.retrieve_invoice(stub, kv.Key)
+			if err != nil { continue }
+			candidates = append(candidates, inv)
+		}
+	} else {
+		invoiceIds, err := t.get_invoice_ids(stub, ISSUED, REJECTED)
+		if err != nil { return shim.Error(err.Error()) }
+
+		for _, invoiceId := range invoiceIds {
+			inv, err := t.retrieve_invoice(stub, invoiceId)
+			if err != nil { return shim.Error("Failed to retrieve Invoice " + invoiceId) }
+			candidates = append(candidates, inv)
+		}
+	}
+
+	ratings := map[string]string{}
+	amounts := map[string]int64{}									// Nominal amounts to sort by
+	invoices := []Invoice{}
+	for _, inv := range candidates {
+		if inv.Status != ISSUED && inv.Status != REJECTED { continue }
+		matches, err := t.matches_filter(stub, inv, Invoice_Filter{Currency: filter.Currency, MinAmount: filter.MinAmount, MaxAmount: filter.MaxAmount})
+		if err != nil { return shim.Error(err.Error()) }
+		if !matches { continue }
+		if filter.Guaranteed && !t.guaranteed(inv, now) { continue }
+
+		if filter.MaxDaysToMaturity > 0 {
+			dueDate, err := time.Parse(DATE_FORMAT, inv.DueDate)
+			if err != nil || dueDate.Sub(now).Hours() > float64(filter.MaxDaysToMaturity * 24) { continue }
+		}
+
+		if filter.MinBuyerRating != "" {
+			rating, ok := ratings[inv.Buyer]
+			if !ok {
+				profile, err := t.retrieve_credit_profile(stub, inv.Buyer)
+				if err != nil { return shim.Error(err.Error()) }
+				if profile != nil { rating = profile.Rating }
+				ratings[inv.Buyer] = rating
+			}
+
+			rank := t.rating_rank(rating)
+			if rank < 0 || rank > t.rating_rank(filter.MinBuyerRating) { continue }		// Unrated buyers never qualify
+		}
+
+		if sortField == "amount" {
+			amount, _ := t.parse_amount(inv.Currency, inv.Amount)
+			amounts[inv.InvoiceId], err = t.nominal_amount(stub, inv.Currency, amount)
+			if err != nil { return shim.Error(err.Error()) }
+		}
+
+		invoices = append(invoices, t.visible_terms(inv, username, role))
+	}
+
+	if sortField != "" {
+		descending := strings.HasPrefix(filter.Sort, "-")
+		sort.SliceStable(invoices, func(i, j int) bool {
+			a, b := invoices[i], invoices[j]
+			if descending { a, b = b, a }
+
+			switch sortField {
+			case "amount":
+				return amounts[a.InvoiceId] < amounts[b.InvoiceId]
+			case "duedate":
+				return a.DueDate < b.DueDate
+			}
+			return a.IssuedAt < b.IssuedAt
+		})
+	}
+
+	bytes, _ := json.Marshal(invoices)
+	return shim.Success(bytes)
+}
+
+//	Position of a rating in BUYER_RATINGS, best first, or -1 when it is not a rating
+func (t *SimpleChaincode) rating_rank(rating string) int {
+
+	for i, known := range BUYER_RATINGS {
+		if known == rating { return i }
+	}
+	return -1
+}
+
+//=================================================================================================================================
+//	 query_invoices - One page of the invoices matching a filter that the caller may see: its own invoices, plus
+//					  invoices open to financiers when the caller is a financier. Uses a CouchDB selector and falls
+//					  back to scanning the status index on LevelDB, where pages may hold fewer matches than requested.
+//=================================================================================================================================
+func (t *SimpleChaincode) query_invoices(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0                                                       1              2 (optional)
+	//			{"status":"ISSUED","minamount":"100.00"}                  20             <bookmark>
+
+	if len(args) < 2 || len(args) > 3 { return shim.Error("Incorrect number of arguments. Expecting 2 or 3") }
+
+	var filter Invoice_Filter
+	if err := json.Unmarshal([]byte(args[0]), &filter); err != nil { return shim.Error("1st argument must be a JSON invoice filter") }
+
+	pageSize, err := strconv.ParseInt(args[1], 10, 32)
+	if err != nil || pageSize <= 0 { return shim.Error("2nd argument must be a positive integer") }
+
+	bookmark := ""
+	if len(args) == 3 { bookmark = args[2] }
+
+	selector := map[string]interface{}{"invoiceid": map[string]bool{"$exists": true}}
+	for field, value := range map[string]string{"status": filter.Status, "buyer": filter.Buyer, "seller": filter.Seller, "currency": filter.Currency} {
+		if value != "" { selector[field] = value }
+	}
+	amountRange := map[string]int64{}
+	if filter.MinAmount != "" {
+		minAmount, err := t.parse_amount(DEFAULT_CURRENCY, filter.MinAmount)
+		if err != nil { return shim.Error("Invalid minamount " + filter.MinAmount) }
+		amountRange["$gte"] = minAmount
+	}
+	if filter.MaxAmount != "" {
+		maxAmount, err := t.parse_amount(DEFAULT_CURRENCY, filter.MaxAmount)
+		if err != nil { return shim.Error("Invalid maxamount " + filter.MaxAmount) }
+		amountRange["$lte"] = maxAmount
+	}
+	if len(amountRange) > 0 { selector["amountunits"] = amountRange }
+	if filter.Guaranteed { selector["guarantee"] = map[string]bool{"$exists": true} }
+
+	queryAsBytes, _ := json.Marshal(map[string]interface{}{"selector": selector})
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+	role, _ := t.get_role(stub)
+
+	now, err := t.get_timestamp(stub)
+	if err != nil { return shim.Error(err.Error()) }
+
+	fromIndex := false
+	iter, metadata, err := stub.GetQueryResultWithPagination(string(queryAsBytes), int32(pageSize), bookmark)
+	if err != nil {
+		statuses := []string{}
+		if filter.Status != "" { statuses = append(statuses, filter.Status) }
+
+		iter, metadata, err = stub.GetStateByPartialCompositeKeyWithPagination(STATUS_INDEX, statuses, int32(pageSize), bookmark)
+		if err != nil { return shim.Error("Unable to query invoices") }
+		fromIndex = true
+	}
+	defer iter.Close()
+
+	page := Invoice_Page{Records: []Invoice{}}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil { return shim.Error("Unable to read invoices") }
+
+		var inv Invoice
+		if fromIndex {
+			_, keys, err := stub.SplitCompositeKey(kv.Key)
+			if err != nil || len(keys) != 2 { continue }
+
+			inv, err = t.retrieve_invoice(stub, keys[1])
+			if err != nil { continue }
+		} else {
+			if strings.HasPrefix(kv.Key, "\x00") { continue }				// Offers and history versions are composite keys
+			if json.Unmarshal(kv.Value, &inv) != nil { continue }
+		}
+
+		matches, err := t.matches_filter(stub, inv, filter)
+		if err != nil { return shim.Error(err.Error()) }
+		if !matches { continue }
+		if filter.Guaranteed && !t.guaranteed(inv, now) { continue }
+
+		_, err = t.get_invoice_details(stub, inv, username)
+		if err != nil && !(role == FINANCIER && (inv.Status == ISSUED || inv.Status == REJECTED)) { continue }
+
+		page.Records = append(page.Records, t.visible_terms(inv, username, role))
+	}
+
+	page.FetchedRecordsCount = int32(len(page.Records))
+	if metadata != nil { page.Bookmark = metadata.Bookmark }
+
+	bytes, _ := json.Marshal(page)
+	return shim.Success(bytes)
+}
+
+//	Re-checks a filter in chaincode, for results of the status index scan and invoices saved before amountunits existed
+//	or at an earlier FX rate
+func (t *SimpleChaincode) matches_filter(stub shim.ChaincodeStubInterface, inv Invoice, filter Invoice_Filter) (bool, error) {
+
+	if (filter.Status != "" && inv.Status != filter.Status) ||
+		(filter.Buyer != "" && inv.Buyer != filter.Buyer) ||
+		(filter.Seller != "" && inv.Seller != filter.Seller) ||
+		(filter.Currency != "" && inv.Currency != filter.Currency) {
+		return false, nil
+	}
+	if filter.MinAmount == "" && filter.MaxAmount == "" { return true, nil }
+
+	amount, err := t.parse_amount(inv.Currency, inv.Amount)
+	if err != nil { return false, nil }
+
+	amount, err = t.nominal_amount(stub, inv.Currency, amount)
+	if err != nil { return false, err }
+
+	if minAmount, err := t.parse_amount(DEFAULT_CURRENCY, filter.MinAmount); err == nil && amount < minAmount { return false, nil }
+	if maxAmount, err := t.parse_amount(DEFAULT_CURRENCY, filter.MaxAmount); err == nil && amount > maxAmount { return false, nil }
+
+	return true, nil
+}
+
+//=================================================================================================================================
+//	 get_invoice_by_external_no - The caller's invoices carrying a number the ERP already knows: the seller's invoice
+//								  number by default, or the ERP document ID or seller reference. Invoices written before
+//								  these were indexed are found once they next change.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_invoice_by_external_no(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0                  1 (optional)
+	//			INV-2017-0042       externalnumber | erpdocid | sellerreference
+
+	if len(args) != 1 && len(args) != 2 { return shim.Error("Incorrect number of arguments. Expecting 1 or 2") }
+	if args[0] == "" { return shim.Error("1st argument must be a non-empty string") }
+
+	kind := REFERENCE_EXTERNAL
+	if len(args) == 2 && args[1] != "" { kind = args[1] }
+	if kind != REFERENCE_EXTERNAL && kind != REFERENCE_ERP && kind != REFERENCE_SELLER {
+		return shim.Error(fmt.Sprintf("2nd argument must be %v, %v or %v", REFERENCE_EXTERNAL, REFERENCE_ERP, REFERENCE_SELLER))
+	}
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	invoiceIds, err := index.IDs(stub, REFERENCE_INDEX, kind, args[0])
+	if err != nil { return shim.Error(err.Error()) }
+
+	invoices := []Invoice{}
+	for _, invoiceId := range invoiceIds {
+		inv, err := t.retrieve_invoice(stub, invoiceId)
+		if err != nil { return shim.Error(err.Error()) }
+
+		if _, err = t.get_invoice_details(stub, inv, username); err != nil { continue }		// Other companies may use the same numbers
+		invoices = append(invoices, t.visible_terms(inv, username, ""))
+	}
+
+	bytes, _ := json.Marshal(invoices)
+	return shim.Success(bytes)
+}
+
+//=================================================================================================================================
+//	 get_invoices_by_po - The caller's invoices raised against a purchase order number.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_invoices_by_po(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//Args
+	//				0
+	//			PO-7781
+
+	if len(args) != 1 || args[0] == "" { return shim.Error("Incorrect number of arguments. Expecting a purchase order number") }
+
+	username, err := t.get_username(stub);
+	if err != nil { return shim.Error(err.Error()) }
+
+	owned, err := t.get_owner_invoices(stub, username)
+	if err != nil { return shim.Error(err.Error()) }
+
+	invoices := []Invoice{}
+	for _, inv := range owned {
+		if inv.PONumber == args[0] { invoices = append(invoices, t.visible_terms(inv, username, "")) }
+	}
+
+	bytes, _ := json.Marshal(invoices)
+	return shim.Success(bytes)
 }
 
 //=================================================================================================================================
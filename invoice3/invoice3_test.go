@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/common/attrmgr"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// testStub invokes the chaincode as a given identity with the given transient data. MockStub has neither and keeps the
+// arguments of MockInvoke to itself, so they are set here and the chaincode is called with the testStub directly.
+type testStub struct {
+	*shim.MockStub
+	creator   []byte
+	args      [][]byte
+	transient map[string][]byte
+	txs       int
+}
+
+func (stub *testStub) GetCreator() ([]byte, error)              { return stub.creator, nil }
+func (stub *testStub) GetTransient() (map[string][]byte, error) { return stub.transient, nil }
+func (stub *testStub) GetArgs() [][]byte                        { return stub.args }
+
+func (stub *testStub) GetStringArgs() []string {
+	args := []string{}
+	for _, arg := range stub.args {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func (stub *testStub) GetFunctionAndParameters() (string, []string) {
+	args := stub.GetStringArgs()
+	return args[0], args[1:]
+}
+
+func newTestStub() *testStub {
+	return &testStub{MockStub: shim.NewMockStub("invoice3", new(SimpleChaincode))}
+}
+
+// invoke calls function as caller, passing terms, if any, in the transient "terms" field along with a fresh salt
+func (stub *testStub) invoke(caller []byte, terms map[string]string, function string, args ...string) pb.Response {
+	stub.txs++
+	txID := fmt.Sprintf("tx%d", stub.txs)
+	stub.creator = caller
+	stub.args = [][]byte{[]byte(function)}
+	for _, arg := range args {
+		stub.args = append(stub.args, []byte(arg))
+	}
+	stub.transient = map[string][]byte{SALT_TRANSIENT: []byte(fmt.Sprintf("salt of %-16s", txID))}
+	if terms != nil {
+		stub.transient[TERMS_TRANSIENT], _ = json.Marshal(terms)
+	}
+
+	stub.MockTransactionStart(txID)
+	defer stub.MockTransactionEnd(txID)
+	return new(SimpleChaincode).Invoke(stub)
+}
+
+// identity is the serialized identity of a caller with a certificate for name carrying attrs, the way cid reads them
+func identity(t *testing.T, name string, attrs map[string]string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: name}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	err = attrmgr.New().AddAttributesToCert(&attrmgr.Attributes{Attrs: attrs}, template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.ExtraExtensions = template.Extensions	// x509 only writes the extensions of a template from ExtraExtensions
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: "Org1MSP", IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creator
+}
+
+// register adds a participant with the role under its name and approves its KYC, returning the caller identity
+func register(t *testing.T, stub *testStub, admin []byte, compliance []byte, name string, role string) []byte {
+	t.Helper()
+	caller := identity(t, name, nil)
+
+	var id Identity
+	if err := json.Unmarshal(succeed(t, stub.invoke(caller, nil, "get_identity"), "get_identity of "+name), &id); err != nil {
+		t.Fatal(err)
+	}
+	succeed(t, stub.invoke(admin, nil, "register_participant", id.Id, id.MspId, name, role), "register_participant "+name)
+	if compliance != nil {
+		succeed(t, stub.invoke(compliance, nil, "set_kyc_status", name, KYC_APPROVED, "2099-12-31"), "set_kyc_status "+name)
+	}
+	return caller
+}
+
+// parties registers an admin, a compliance officer, a seller, a buyer and a financier, all with KYC approved
+func parties(t *testing.T, stub *testStub) (admin, seller, buyer, financier []byte) {
+	admin = identity(t, "admin", map[string]string{ADMIN_ATTRIBUTE: "true"})
+	compliance := register(t, stub, admin, nil, "compliance", COMPLIANCE)
+	succeed(t, stub.invoke(compliance, nil, "set_kyc_status", "compliance", KYC_APPROVED, "2099-12-31"), "set_kyc_status compliance")
+
+	seller = register(t, stub, admin, compliance, "seller", SELLER)
+	buyer = register(t, stub, admin, compliance, "buyer", BUYER)
+	financier = register(t, stub, admin, compliance, "financier", FINANCIER)
+	return admin, seller, buyer, financier
+}
+
+// finance takes an invoice the buyer has confirmed delivery of to FINANCE_OFFERED on the financier's offer of amount
+func finance(t *testing.T, stub *testStub, seller, buyer, financier []byte, invoiceId string, amount string) {
+	t.Helper()
+	succeed(t, stub.invoke(buyer, nil, "confirm_delivery", invoiceId), "confirm_delivery of "+invoiceId)
+
+	var offer Offer
+	payload := succeed(t, stub.invoke(financier, map[string]string{"discountrate": "0.05", "amount": amount}, "submit_offer", invoiceId, "2099-12-31T00:00:00Z"), "submit_offer on "+invoiceId)
+	if err := json.Unmarshal(payload, &offer); err != nil {
+		t.Fatal(err)
+	}
+	succeed(t, stub.invoke(seller, nil, "select_offer", invoiceId, offer.OfferId), "select_offer on "+invoiceId)
+}
+
+func succeed(t *testing.T, res pb.Response, what string) []byte {
+	t.Helper()
+	if res.Status != shim.OK {
+		t.Fatalf("%s: %s", what, res.Message)
+	}
+	return res.Payload
+}
+
+func fail(t *testing.T, res pb.Response, what string, message string) {
+	t.Helper()
+	if res.Status == shim.OK {
+		t.Fatalf("%s succeeded, want an error containing %q", what, message)
+	}
+	if !strings.Contains(res.Message, message) {
+		t.Fatalf("%s: %q, want an error containing %q", what, res.Message, message)
+	}
+}
+
+func TestCreditLimit(t *testing.T) {
+	stub := newTestStub()
+	admin, seller, buyer, financier := parties(t, stub)
+
+	fail(t, stub.invoke(seller, nil, "set_credit_limit", "buyer", "1000.00"), "set_credit_limit by a seller", ERR_PERMISSION)
+	succeed(t, stub.invoke(admin, nil, "set_credit_limit", "buyer", "1000.00"), "set_credit_limit")
+
+	fail(t, stub.invoke(seller, nil, "create_invoice", "INV-1", "1200.00", "", "buyer", "2017-09-30"), "create_invoice over the limit", ERR_LIMIT_EXCEEDED)
+
+	// Amounts in other currencies count at the rate of the currency master, not at face value
+	succeed(t, stub.invoke(admin, nil, "set_currency", "EUR", "Euro"), "set_currency without a rate")
+	fail(t, stub.invoke(seller, nil, "create_invoice", "INV-2", "900.00", "", "buyer", "2017-09-30", "", "", "", "EUR"), "create_invoice in a currency without a rate", "No FX rate from EUR to USD")
+	fail(t, stub.invoke(admin, nil, "set_currency", "EUR", "Euro", "", "-1.10"), "set_currency with a negative rate", "positive FX rate")
+	succeed(t, stub.invoke(admin, nil, "set_currency", "EUR", "Euro", "", "1.10"), "set_currency")
+	fail(t, stub.invoke(seller, nil, "create_invoice", "INV-2", "950.00", "", "buyer", "2017-09-30", "", "", "", "EUR"), "create_invoice of EUR 950.00", ERR_LIMIT_EXCEEDED)
+	succeed(t, stub.invoke(seller, nil, "create_invoice", "INV-2", "900.00", "", "buyer", "2017-09-30", "", "", "", "EUR"), "create_invoice of EUR 900.00")
+
+	// Only financed invoices are exposure, at USD 990.00 for EUR 900.00
+	var exposure Buyer_Exposure
+	if err := json.Unmarshal(succeed(t, stub.invoke(buyer, nil, "get_buyer_exposure", "buyer"), "get_buyer_exposure"), &exposure); err != nil {
+		t.Fatal(err)
+	}
+	if exposure.Exposure != "0.00" || exposure.Available != "1000.00" {
+		t.Fatalf("Exposure before financing = %+v; want 0.00 of 1000.00", exposure)
+	}
+
+	finance(t, stub, seller, buyer, financier, "INV-2", "855.00")
+	if err := json.Unmarshal(succeed(t, stub.invoke(financier, nil, "get_buyer_exposure", "buyer"), "get_buyer_exposure"), &exposure); err != nil {
+		t.Fatal(err)
+	}
+	if exposure.Exposure != "990.00" || exposure.Available != "10.00" || exposure.Utilization != "99.00" || len(exposure.Invoices) != 1 {
+		t.Fatalf("Exposure after financing = %+v; want 990.00, 10.00 available, 99.00%% utilized", exposure)
+	}
+
+	fail(t, stub.invoke(seller, nil, "create_invoice", "INV-3", "20.00", "", "buyer", "2017-09-30"), "create_invoice over the remaining limit", ERR_LIMIT_EXCEEDED)
+	succeed(t, stub.invoke(seller, nil, "create_invoice", "INV-3", "10.00", "", "buyer", "2017-09-30"), "create_invoice within the remaining limit")
+
+	// A limit too large for the exposure to be added to fails rather than wrapping around
+	succeed(t, stub.invoke(admin, nil, "set_credit_limit", "buyer", "92233720368547758.07"), "set_credit_limit to the largest amount")
+	fail(t, stub.invoke(seller, nil, "create_invoice", "INV-4", "92233720368547758.07", "", "buyer", "2017-09-30"), "create_invoice overflowing the exposure", "out of range")
+}
+
+func TestSettleAtMaturity(t *testing.T) {
+	stub := newTestStub()
+	_, seller, buyer, financier := parties(t, stub)
+
+	succeed(t, stub.invoke(seller, nil, "create_invoice", "INV-1", "1000.00", "", "buyer", "2017-09-30"), "create_invoice INV-1")
+	succeed(t, stub.invoke(seller, nil, "create_invoice", "INV-2", "500.00", "", "buyer", "2017-09-30"), "create_invoice INV-2")
+	succeed(t, stub.invoke(seller, nil, "create_invoice", "INV-3", "200.00", "", "buyer", "2099-12-31"), "create_invoice INV-3")
+	finance(t, stub, seller, buyer, financier, "INV-1", "950.00")
+	succeed(t, stub.invoke(buyer, nil, "approve_trade", "INV-1"), "approve_trade")
+
+	fail(t, stub.invoke(seller, nil, "settle_at_maturity", "INV-1", "WIRE-1"), "settle_at_maturity by the seller", ERR_PERMISSION)
+	fail(t, stub.invoke(buyer, nil, "settle_at_maturity", "INV-3", "WIRE-3"), "settle_at_maturity before the due date", "matures on 2099-12-31")
+
+	settlement := func(invoiceId string) Settlement {
+		t.Helper()
+		key, _ := stub.CreateCompositeKey(SETTLEMENT_PREFIX, []string{invoiceId})
+		var settlement Settlement
+		if err := json.Unmarshal(stub.PvtState[TERMS_COLLECTION][key], &settlement); err != nil {
+			t.Fatalf("Settlement of %s: %v", invoiceId, err)
+		}
+		return settlement
+	}
+
+	// A financed invoice pays the financier, who earns the face amount over the purchase price
+	succeed(t, stub.invoke(buyer, nil, "settle_at_maturity", "INV-1", "WIRE-1"), "settle_at_maturity of INV-1")
+	inv, err := new(SimpleChaincode).retrieve_invoice(stub, "INV-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.Status != SETTLED || inv.Outstanding != "0.00" || len(inv.Payments) != 1 || inv.Payments[0].Amount != "1000.00" || inv.Payments[0].Reference != "WIRE-1" {
+		t.Fatalf("INV-1 after settlement = %s, outstanding %s, payments %+v; want SETTLED, 0.00, one payment of 1000.00", inv.Status, inv.Outstanding, inv.Payments)
+	}
+	if s := settlement("INV-1"); s.PaidTo != "financier" || s.AmountPaid != "1000.00" || s.PurchasePrice != "950.00" || s.EarnedDiscount != "50.00" {
+		t.Fatalf("Settlement of INV-1 = %+v; want 1000.00 paid to the financier, 50.00 earned on 950.00", s)
+	}
+	fail(t, stub.invoke(buyer, nil, "settle_at_maturity", "INV-1", "WIRE-1"), "settling twice", ERR_INVALID_TRANSITION)
+
+	// An unfinanced one pays the seller and nobody earns a discount
+	succeed(t, stub.invoke(buyer, nil, "settle_at_maturity", "INV-2", "WIRE-2"), "settle_at_maturity of INV-2")
+	if s := settlement("INV-2"); s.PaidTo != "seller" || s.AmountPaid != "500.00" || s.PurchasePrice != "0.00" || s.EarnedDiscount != "0.00" {
+		t.Fatalf("Settlement of INV-2 = %+v; want 500.00 paid to the seller, nothing earned", s)
+	}
+}
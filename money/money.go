@@ -0,0 +1,232 @@
+package money
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+//==============================================================================================================================
+//	Money - An amount in the minor units of its currency, e.g. {EUR 4500000} is EUR 45000.00. Amounts are added and
+//			multiplied as integers and exact fractions so that no float64 rounding creeps into a balance; a
+//			multiplication is rounded to the minor unit once, half away from zero.
+//==============================================================================================================================
+type Money struct{
+	Currency string `json:"currency"`
+	Units int64 `json:"units"`
+}
+
+const DefaultDecimals = 2				// Decimal places of the currencies not in currencyDecimals
+
+var currencyDecimals = map[string]int{	// ISO 4217 currencies whose minor unit is not a hundredth
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0, "PYG": 0, "RWF": 0, "UGX": 0,
+	"VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+var decimalPattern = regexp.MustCompile(`^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)$`)	// Decimals without exponent
+
+// ============================================================================================================================
+// Decimals - The decimal places of the minor unit of a currency
+// ============================================================================================================================
+func Decimals(currency string) int {
+	if decimals, ok := currencyDecimals[strings.ToUpper(currency)]; ok {
+		return decimals
+	}
+	return DefaultDecimals
+}
+
+// ============================================================================================================================
+// New - An amount of minor units of a currency
+// ============================================================================================================================
+func New(currency string, units int64) Money {
+	return Money{Currency: currency, Units: units}
+}
+
+// ============================================================================================================================
+// Parse - Read a decimal string ("45000.00", "-25.5") as an amount of a currency. More decimals than the currency has
+//		   are an error rather than being rounded away, unless they are zeros ("1000.00" yen).
+// ============================================================================================================================
+func Parse(currency string, value string) (Money, error) {
+	units, err := ParseUnits(value, Decimals(currency))
+	if err != nil {
+		return Money{}, err
+	}
+	return New(currency, units), nil
+}
+
+// ============================================================================================================================
+// String - The amount as a decimal string with the decimals of its currency, e.g. "45000.00"
+// ============================================================================================================================
+func (m Money) String() string {
+	return FormatUnits(m.Units, Decimals(m.Currency))
+}
+
+// ============================================================================================================================
+// Add, Sub - The sum and the difference of two amounts of the same currency
+// ============================================================================================================================
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, fmt.Errorf("Cannot add %s to %s", other.Currency, m.Currency)
+	}
+	units, err := AddUnits(m.Units, other.Units)
+	if err != nil {
+		return Money{}, err
+	}
+	return New(m.Currency, units), nil
+}
+
+func (m Money) Sub(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, fmt.Errorf("Cannot subtract %s from %s", other.Currency, m.Currency)
+	}
+	units, err := SubUnits(m.Units, other.Units)
+	if err != nil {
+		return Money{}, err
+	}
+	return New(m.Currency, units), nil
+}
+
+// ============================================================================================================================
+// Mul - The amount multiplied by rates, fractions or quantities, rounded to the minor unit
+// ============================================================================================================================
+func (m Money) Mul(factors ...*big.Rat) (Money, error) {
+	units, err := ScaleUnits(m.Units, factors...)
+	if err != nil {
+		return Money{}, err
+	}
+	return New(m.Currency, units), nil
+}
+
+// ============================================================================================================================
+// Convert - The amount in another currency at a rate quoted per major unit (EUR 1 = USD 1.0850), rounded to the minor
+//			 unit of that currency
+// ============================================================================================================================
+func (m Money) Convert(currency string, rate *big.Rat) (Money, error) {
+	units, err := ScaleUnits(m.Units, rate, new(big.Rat).SetFrac(pow10(Decimals(currency)), pow10(Decimals(m.Currency))))
+	if err != nil {
+		return Money{}, err
+	}
+	return New(currency, units), nil
+}
+
+// ============================================================================================================================
+// Parse Units - Convert a decimal string with at most the given decimals into integer minor units. Zeros after them
+//				 are accepted, so an amount written with more places than its currency has is read exactly.
+// ============================================================================================================================
+func ParseUnits(value string, decimals int) (int64, error) {
+	value = strings.TrimSpace(value)
+	if !decimalPattern.MatchString(value) {
+		return 0, fmt.Errorf("Invalid amount %s", value)
+	}
+
+	if i := strings.Index(value, "."); i >= 0 && len(strings.TrimRight(value[i+1:], "0")) > decimals {
+		return 0, fmt.Errorf("Amount %s has more than %d decimals", value, decimals)
+	}
+
+	amount, _ := new(big.Rat).SetString(value)
+	return to_units(amount, decimals, value)
+}
+
+// ============================================================================================================================
+// Round Units - Convert a decimal string of any precision, or in the scientific notation ("4.5E+04"), into integer minor
+//				 units, rounding half away from zero
+// ============================================================================================================================
+func RoundUnits(value string, decimals int) (int64, error) {
+	value = strings.TrimSpace(value)
+	amount, ok := new(big.Rat).SetString(value)
+	if !ok || strings.Contains(value, "/") {
+		return 0, fmt.Errorf("Invalid amount %s", value)
+	}
+	return to_units(amount, decimals, value)
+}
+
+// ============================================================================================================================
+// Format Units - Convert integer minor units into a decimal string with the given decimals, e.g. 4500000 -> "45000.00"
+// ============================================================================================================================
+func FormatUnits(units int64, decimals int) string {
+	sign := ""
+	magnitude := new(big.Int).SetInt64(units)
+	if units < 0 {
+		sign = "-"
+		magnitude.Neg(magnitude)
+	}
+
+	digits := magnitude.String()
+	if decimals <= 0 {
+		return sign + digits
+	}
+	for len(digits) <= decimals {
+		digits = "0" + digits
+	}
+	return sign + digits[:len(digits) - decimals] + "." + digits[len(digits) - decimals:]
+}
+
+// ============================================================================================================================
+// Add Units, Sub Units - The sum and the difference of minor units, an error rather than an overflow
+// ============================================================================================================================
+func AddUnits(a int64, b int64) (int64, error) {
+	if (b > 0 && a > math.MaxInt64 - b) || (b < 0 && a < math.MinInt64 - b) {
+		return 0, fmt.Errorf("Amount out of range adding %d and %d minor units", a, b)
+	}
+	return a + b, nil
+}
+
+func SubUnits(a int64, b int64) (int64, error) {
+	if (b < 0 && a > math.MaxInt64 + b) || (b > 0 && a < math.MinInt64 + b) {
+		return 0, fmt.Errorf("Amount out of range subtracting %d from %d minor units", b, a)
+	}
+	return a - b, nil
+}
+
+// ============================================================================================================================
+// Scale Units - Minor units multiplied exactly by every factor, then rounded half away from zero
+// ============================================================================================================================
+func ScaleUnits(units int64, factors ...*big.Rat) (int64, error) {
+	product := new(big.Rat).SetInt64(units)
+	for _, factor := range factors {
+		product.Mul(product, factor)
+	}
+	return to_units(product, 0, product.FloatString(2))
+}
+
+// ============================================================================================================================
+// Parse Decimal - Read a rate, a share or a quantity written as a decimal string ("1.0850", "0.05") exactly
+// ============================================================================================================================
+func ParseDecimal(value string) (*big.Rat, error) {
+	value = strings.TrimSpace(value)
+	if !decimalPattern.MatchString(value) {
+		return nil, fmt.Errorf("Invalid decimal %s", value)
+	}
+	decimal, _ := new(big.Rat).SetString(value)
+	return decimal, nil
+}
+
+// ============================================================================================================================
+// Format Decimal - A rate, share or quantity as a decimal string with the given places, rounded half away from zero
+// ============================================================================================================================
+func FormatDecimal(value *big.Rat, places int) string {
+	return value.FloatString(places)
+}
+
+// Rounds an exact amount to the nearest minor unit, half away from zero, within the range of int64
+func to_units(amount *big.Rat, decimals int, value string) (int64, error) {
+	scaled := new(big.Rat).Mul(amount, new(big.Rat).SetInt(pow10(decimals)))
+
+	quotient, remainder := new(big.Int).QuoRem(scaled.Num(), scaled.Denom(), new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2)).Cmp(scaled.Denom()) >= 0 {
+		quotient.Add(quotient, big.NewInt(int64(scaled.Num().Sign())))
+	}
+
+	if !quotient.IsInt64() {
+		return 0, fmt.Errorf("Amount %s is out of range", value)
+	}
+	return quotient.Int64(), nil
+}
+
+// 10 to the power of the given decimals
+func pow10(decimals int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+}
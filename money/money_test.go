@@ -0,0 +1,213 @@
+package money
+
+import (
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestParseUnits(t *testing.T) {
+	tests := []struct {
+		value    string
+		decimals int
+		units    int64
+		ok       bool
+	}{
+		{"45000.00", 2, 4500000, true},
+		{"-25.5", 2, -2550, true},
+		{"+1", 2, 100, true},
+		{".5", 2, 50, true},
+		{" 7.10 ", 2, 710, true},
+		{"1.234", 3, 1234, true},
+		{"1000.00", 0, 1000, true},
+		{"1.230", 2, 123, true},
+		{"1.234", 2, 0, false},
+		{"1.5", 0, 0, false},
+		{"4.5E+04", 2, 0, false},
+		{"1/3", 2, 0, false},
+		{"", 2, 0, false},
+		{"abc", 2, 0, false},
+		{"92233720368547758.07", 2, math.MaxInt64, true},
+		{"92233720368547758.08", 2, 0, false},
+		{"-92233720368547758.08", 2, math.MinInt64, true},
+	}
+
+	for _, test := range tests {
+		units, err := ParseUnits(test.value, test.decimals)
+		if test.ok && (err != nil || units != test.units) {
+			t.Errorf("ParseUnits(%q, %d) = %d, %v, want %d", test.value, test.decimals, units, err, test.units)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("ParseUnits(%q, %d) = %d, want an error", test.value, test.decimals, units)
+		}
+	}
+}
+
+func TestRoundUnits(t *testing.T) {
+	tests := []struct {
+		value    string
+		decimals int
+		units    int64
+		ok       bool
+	}{
+		{"4.5E+04", 2, 4500000, true},
+		{"1E+01", 0, 10, true},
+		{"1.005", 2, 101, true},
+		{"-1.005", 2, -101, true},
+		{"1.0049", 2, 100, true},
+		{"-1.0049", 2, -100, true},
+		{"2.5", 0, 3, true},
+		{"-2.5", 0, -3, true},
+		{"0.0001", 2, 0, true},
+		{"1/3", 2, 0, false},
+		{"abc", 2, 0, false},
+		{"1E+30", 2, 0, false},
+	}
+
+	for _, test := range tests {
+		units, err := RoundUnits(test.value, test.decimals)
+		if test.ok && (err != nil || units != test.units) {
+			t.Errorf("RoundUnits(%q, %d) = %d, %v, want %d", test.value, test.decimals, units, err, test.units)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("RoundUnits(%q, %d) = %d, want an error", test.value, test.decimals, units)
+		}
+	}
+}
+
+func TestFormatUnits(t *testing.T) {
+	tests := []struct {
+		units    int64
+		decimals int
+		value    string
+	}{
+		{4500000, 2, "45000.00"},
+		{0, 2, "0.00"},
+		{5, 2, "0.05"},
+		{-5, 2, "-0.05"},
+		{-250, 2, "-2.50"},
+		{1234, 3, "1.234"},
+		{1000, 0, "1000"},
+		{-1000, 0, "-1000"},
+		{math.MaxInt64, 2, "92233720368547758.07"},
+		{math.MinInt64, 2, "-92233720368547758.08"},
+	}
+
+	for _, test := range tests {
+		if value := FormatUnits(test.units, test.decimals); value != test.value {
+			t.Errorf("FormatUnits(%d, %d) = %q, want %q", test.units, test.decimals, value, test.value)
+		}
+	}
+}
+
+func TestScaleUnits(t *testing.T) {
+	tests := []struct {
+		units   int64
+		factors []*big.Rat
+		scaled  int64
+		ok      bool
+	}{
+		{1000, []*big.Rat{big.NewRat(1, 3)}, 333, true},
+		{1000, []*big.Rat{big.NewRat(2, 3)}, 667, true},
+		{-1000, []*big.Rat{big.NewRat(2, 3)}, -667, true},
+		{5, []*big.Rat{big.NewRat(1, 2)}, 3, true},
+		{-5, []*big.Rat{big.NewRat(1, 2)}, -3, true},
+		{10000, []*big.Rat{big.NewRat(108, 100), big.NewRat(1, 2)}, 5400, true},
+		{10000, nil, 10000, true},
+		{math.MaxInt64, []*big.Rat{big.NewRat(2, 1), big.NewRat(1, 2)}, math.MaxInt64, true},
+		{math.MaxInt64, []*big.Rat{big.NewRat(2, 1)}, 0, false},
+		{math.MinInt64, []*big.Rat{big.NewRat(-1, 1)}, 0, false},
+	}
+
+	for _, test := range tests {
+		scaled, err := ScaleUnits(test.units, test.factors...)
+		if test.ok && (err != nil || scaled != test.scaled) {
+			t.Errorf("ScaleUnits(%d, %v) = %d, %v, want %d", test.units, test.factors, scaled, err, test.scaled)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("ScaleUnits(%d, %v) = %d, want an error", test.units, test.factors, scaled)
+		}
+	}
+}
+
+func TestAddSubUnits(t *testing.T) {
+	if sum, err := AddUnits(150, -200); err != nil || sum != -50 {
+		t.Errorf("AddUnits(150, -200) = %d, %v, want -50", sum, err)
+	}
+	if _, err := AddUnits(math.MaxInt64, 1); err == nil {
+		t.Errorf("AddUnits(MaxInt64, 1) did not overflow")
+	}
+	if _, err := AddUnits(math.MinInt64, -1); err == nil {
+		t.Errorf("AddUnits(MinInt64, -1) did not overflow")
+	}
+	if difference, err := SubUnits(150, 200); err != nil || difference != -50 {
+		t.Errorf("SubUnits(150, 200) = %d, %v, want -50", difference, err)
+	}
+	if _, err := SubUnits(math.MinInt64, 1); err == nil {
+		t.Errorf("SubUnits(MinInt64, 1) did not overflow")
+	}
+	if _, err := SubUnits(0, math.MinInt64); err == nil {
+		t.Errorf("SubUnits(0, MinInt64) did not overflow")
+	}
+}
+
+func TestMoney(t *testing.T) {
+	tests := []struct {
+		currency string
+		value    string
+		units    int64
+		text     string
+	}{
+		{"EUR", "45000.5", 4500050, "45000.50"},
+		{"JPY", "1000", 1000, "1000"},
+		{"jpy", "1000.00", 1000, "1000"},
+		{"BHD", "1.234", 1234, "1.234"},
+		{"", "12", 1200, "12.00"},
+	}
+
+	for _, test := range tests {
+		m, err := Parse(test.currency, test.value)
+		if err != nil || m.Units != test.units || m.String() != test.text {
+			t.Errorf("Parse(%q, %q) = %v, %v, want %d units shown as %q", test.currency, test.value, m, err, test.units, test.text)
+		}
+	}
+
+	if _, err := Parse("JPY", "1.5"); err == nil {
+		t.Errorf("Parse(JPY, 1.5) accepted a fraction of a yen")
+	}
+	if _, err := New("EUR", 100).Add(New("USD", 100)); err == nil {
+		t.Errorf("Adding USD to EUR did not fail")
+	}
+
+	charge, err := New("EUR", 1999).Mul(big.NewRat(3, 1), big.NewRat(1, 12))
+	if err != nil || charge.String() != "5.00" {
+		t.Errorf("EUR 19.99 * 3 / 12 = %v, %v, want 5.00", charge, err)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		from     Money
+		currency string
+		rate     *big.Rat
+		text     string
+	}{
+		{New("EUR", 10000), "USD", big.NewRat(10850, 10000), "108.50"},
+		{New("EUR", 10000), "JPY", big.NewRat(16234, 100), "16234"},
+		{New("JPY", 16234), "EUR", big.NewRat(1, 16234), "1.00"},
+		{New("USD", 100), "BHD", big.NewRat(376, 1000), "0.376"},
+		{New("BHD", 1), "USD", big.NewRat(2659, 1000), "0.00"},
+		{New("BHD", 2), "USD", big.NewRat(2659, 1000), "0.01"},
+	}
+
+	for _, test := range tests {
+		converted, err := test.from.Convert(test.currency, test.rate)
+		if err != nil || converted.Currency != test.currency || converted.String() != test.text {
+			t.Errorf("%v.Convert(%s, %v) = %v, %v, want %s", test.from, test.currency, test.rate, converted, err, test.text)
+		}
+	}
+
+	if _, err := New("JPY", math.MaxInt64).Convert("BHD", big.NewRat(1, 1)); err == nil {
+		t.Errorf("Converting MaxInt64 yen into BHD did not overflow")
+	}
+}